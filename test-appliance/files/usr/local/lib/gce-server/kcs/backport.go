@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"thunk.org/gce-server/util/check"
+	"thunk.org/gce-server/util/email"
+	"thunk.org/gce-server/util/gcp"
+	"thunk.org/gce-server/util/logging"
+	"thunk.org/gce-server/util/server"
+
+	"github.com/sirupsen/logrus"
+)
+
+// backportFailure records an upstream commit that could not be backported.
+type backportFailure struct {
+	commit string
+	reason string
+}
+
+/*
+StartBackportTest validates a stable backport queue.
+
+The upstream commits in BackportCommits are cherry-picked in order on top
+of CommitID, which is usually a stable branch. A commit that is unknown or
+does not apply is skipped and the remaining commits are still picked, so
+that one conflict does not hide the state of the rest of the queue. The
+result is built and tested like a patch series, with the applied and
+skipped commits attached to the test report.
+
+If none of the commits apply, the reasons are sent to the user and nothing
+is built.
+*/
+func StartBackportTest(c server.TaskRequest, testID string, serverLog *logrus.Entry) {
+	log := serverLog.WithField("testID", testID)
+	log.Info("Start testing backport queue")
+
+	buildLog := logging.KCSLogDir + testID + ".build"
+	subject := "xfstests KCS backport test failure " + testID
+	defer email.ReportFailure(log, buildLog, c.Options.ReportFailEmail, subject)
+	defer reportBuildFailure(c, log)
+
+	gsBucket, err := gcp.GceConfig.Get("GS_BUCKET")
+	check.Panic(err, log, "Failed to get gs bucket config")
+
+	repo := getRepo(c.Options.GitRepo, log)
+	defer putRepo(repo)
+	cmdLog := log.WithField("repoId", repo.ID())
+	w := cmdLog.WithField("cmd", "cherryPick").Writer()
+	defer w.Close()
+
+	err = repo.Checkout(c.Options.CommitID, w)
+	check.Panic(err, cmdLog, "Failed to checkout to base commit")
+	base, err := repo.GetCommit(w)
+	check.Panic(err, cmdLog, "Failed to get base commit")
+
+	applied := 0
+	failures := []backportFailure{}
+	for _, commit := range strings.Split(c.Options.BackportCommits, "|") {
+		commit = strings.TrimSpace(commit)
+		if commit == "" {
+			continue
+		}
+		commitLog := cmdLog.WithField("commit", commit)
+
+		if valid, _ := repo.Valid(commit, w); !valid {
+			commitLog.Warn("Backport commit not found")
+			failures = append(failures, backportFailure{commit, "commit not found"})
+			continue
+		}
+		output, err := repo.CherryPick(commit, w)
+		if err != nil {
+			commitLog.WithError(err).Warn("Backport commit does not apply")
+			failures = append(failures, backportFailure{commit, cherryPickReason(output)})
+			continue
+		}
+		applied++
+	}
+
+	if applied == 0 {
+		cmdLog.Warn("No backport commit applies")
+		reportBackportFailure(c, testID, base, failures, log)
+		notifyBuildFailure(c, log)
+		return
+	}
+
+	picked, err := repo.Log(base+"..HEAD", w)
+	check.Panic(err, cmdLog, "Failed to get applied commits")
+	series := backportSeries(base, picked, failures)
+	cmdLog.WithField("series", series).Info("Backport queue applied")
+
+	buildSeries(c, repo, gsBucket, testID, buildLog, series, log)
+}
+
+// cherryPickReason extracts the conflict and error lines from the output
+// of a failed git cherry-pick.
+func cherryPickReason(output string) string {
+	reasons := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "CONFLICT") || strings.HasPrefix(line, "error:") ||
+			strings.HasPrefix(line, "fatal:") || strings.Contains(line, "is now empty") {
+			reasons = append(reasons, line)
+		}
+	}
+	if len(reasons) == 0 {
+		return "does not apply"
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// backportSeries formats the applied and skipped commits for the report.
+func backportSeries(base string, picked string, failures []backportFailure) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "BASE COMMIT:\t%s\n", base)
+	if picked == "" {
+		b.WriteString("APPLIED:\tnone\n")
+	} else {
+		fmt.Fprintf(&b, "APPLIED:\n%s\n", strings.TrimSuffix(picked, "\n"))
+	}
+	fmt.Fprintf(&b, "NOT APPLIED (%d):\n", len(failures))
+	for _, f := range failures {
+		fmt.Fprintf(&b, "%s\t%s\n", f.commit, f.reason)
+	}
+	return b.String()
+}
+
+// reportBackportFailure tells the user why none of the backport commits
+// apply on the base commit.
+func reportBackportFailure(c server.TaskRequest, testID string, base string, failures []backportFailure, log *logrus.Entry) {
+	receiver := c.Options.ReportFailEmail
+	if receiver == "" {
+		log.Info("No email receiver provided")
+		return
+	}
+
+	subject := "xfstests backport queue does not apply " + testID
+	content := fmt.Sprintf("None of the backport commits apply on top of %s (%s).\n\n%s",
+		c.Options.CommitID, base, backportSeries(base, "", failures))
+
+	err := email.Send(subject, content, receiver)
+	check.NoError(err, log, "Failed to send the email")
+}
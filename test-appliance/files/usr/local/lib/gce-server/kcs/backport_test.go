@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+)
+
+var cherryPickConflict = `Auto-merging fs/ext4/inode.c
+CONFLICT (content): Merge conflict in fs/ext4/inode.c
+error: could not apply 1234567... ext4: fix a use-after-free
+hint: After resolving the conflicts, mark them with
+hint: "git add/rm <pathspec>", then run
+hint: "git cherry-pick --continue".
+`
+
+func TestCherryPickReason(t *testing.T) {
+	reason := cherryPickReason(cherryPickConflict)
+	expected := "CONFLICT (content): Merge conflict in fs/ext4/inode.c; error: could not apply 1234567... ext4: fix a use-after-free"
+	if reason != expected {
+		t.Errorf("get wrong reason %q", reason)
+	}
+
+	reason = cherryPickReason("")
+	if reason != "does not apply" {
+		t.Errorf("get wrong reason %q", reason)
+	}
+}
+
+func TestBackportSeries(t *testing.T) {
+	failures := []backportFailure{{"abcdef0", "commit not found"}}
+	series := backportSeries("base", "1111111 ext4: first\n2222222 ext4: second\n", failures)
+	expected := "BASE COMMIT:\tbase\nAPPLIED:\n1111111 ext4: first\n2222222 ext4: second\nNOT APPLIED (1):\nabcdef0\tcommit not found\n"
+	if series != expected {
+		t.Errorf("get wrong series %q", series)
+	}
+
+	series = backportSeries("base", "", failures)
+	expected = "BASE COMMIT:\tbase\nAPPLIED:\tnone\nNOT APPLIED (1):\nabcdef0\tcommit not found\n"
+	if series != expected {
+		t.Errorf("get wrong series %q", series)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"thunk.org/gce-server/util/email"
 	"thunk.org/gce-server/util/gcp"
 	"thunk.org/gce-server/util/git"
+	"thunk.org/gce-server/util/junit"
 	"thunk.org/gce-server/util/logging"
 	"thunk.org/gce-server/util/parser"
 	"thunk.org/gce-server/util/server"
@@ -25,22 +26,39 @@ import (
 // GitBisector performs a git bisect operation on a repo branch.
 // Each bisector keeps a unique repository to save the states for bisect
 // progress.
+// In build mode, the verdict for each commit comes from the kernel build
+// itself, and the bisect runs entirely in KCS.
+// A fix bisector looks for the first commit that passes again instead of
+// the first commit that fails.
+// If verify is set, the commit found is reverted on top of the commit where
+// the bisect started, and the tests that failed during the bisect run again
+// to confirm the result.
 type GitBisector struct {
 	testID  string
 	origCmd string
+	user    string
+	mode    string
+	target  string
+	terms   git.BisectTerms
 
 	gsBucket       string
 	bucketSubdir   string
 	reportReceiver string
 	testRequest    server.TaskRequest
 	testHistory    []string
-
-	repo        *git.Repository
-	finished    bool
-	badCommit   string
-	goodCommits []string
-	lastActive  time.Time
-	done        chan bool
+	failedSteps    []string
+	buildResults   map[string]server.ResultType
+
+	repo         *git.Repository
+	finished     bool
+	verify       bool
+	verifying    bool
+	verifyTestID string
+	verification string
+	badCommit    string
+	goodCommits  []string
+	lastActive   time.Time
+	done         chan bool
 
 	logDir     string
 	resultsDir string
@@ -51,6 +69,16 @@ const (
 	// bisectorTimeout defines the max idle time before a bisector get cleaned.
 	bisectorTimeout = 4 * time.Hour
 	checkInterval   = 5 * time.Minute
+
+	// testMode bisects on test results from LTM.
+	testMode = "test"
+	// buildMode bisects on whether the kernel builds.
+	buildMode = "build"
+
+	// regressionTarget looks for the commit that introduced a failure.
+	regressionTarget = "regression"
+	// fixTarget looks for the commit that fixed a failure.
+	fixTarget = "fix"
 )
 
 // bisectorMap indexes bisectors by testID which are guaranteed to be unique.
@@ -71,7 +99,7 @@ func NewGitBisector(c server.TaskRequest, testID string) *GitBisector {
 
 	logFile := logDir + "run.log"
 	log := logging.InitLogger(logFile)
-	log.Info("Initiating git bisector")
+	log.WithField("user", c.User).Info("Initiating git bisector")
 
 	resultsDir := logDir + "results/"
 	err = check.CreateDir(resultsDir)
@@ -97,21 +125,42 @@ func NewGitBisector(c server.TaskRequest, testID string) *GitBisector {
 	repo, err := git.NewRepository(testID, c.Options.GitRepo, w)
 	check.Panic(err, log, "Failed to clone repo")
 
+	mode := testMode
+	if c.Options.BisectBuild {
+		mode = buildMode
+	}
+
+	target := regressionTarget
+	terms := git.RegressionTerms
+	if c.Options.BisectFix {
+		target = fixTarget
+		terms = git.FixTerms
+	}
+
 	badCommit := c.Options.BadCommit
 	goodCommits := strings.Split(c.Options.GoodCommit, "|")
+	if target == fixTarget && len(goodCommits) != 1 {
+		log.Panic("Fix bisect takes exactly one fixed commit")
+	}
 
 	bisector := GitBisector{
 		testID:  testID,
 		origCmd: origCmd,
+		user:    c.User,
+		mode:    mode,
+		target:  target,
+		terms:   terms,
 
 		gsBucket:       gsBucket,
 		bucketSubdir:   bucketSubdir,
 		reportReceiver: c.Options.ReportEmail,
 		testRequest:    c,
 		testHistory:    []string{},
+		buildResults:   make(map[string]server.ResultType),
 
 		repo:        repo,
 		finished:    false,
+		verify:      c.Options.BisectVerify,
 		badCommit:   badCommit,
 		goodCommits: goodCommits,
 		lastActive:  time.Now(),
@@ -164,7 +213,13 @@ func (bisector *GitBisector) Start() {
 		check.Panic(err, bisector.log, "Failed to validate goodCommit")
 	}
 
-	finished, err := bisector.repo.BisectStart(bisector.badCommit, bisector.goodCommits, w)
+	// the failing commit is the new state for a regression and the old
+	// state for a fix
+	newCommit, oldCommits := bisector.badCommit, bisector.goodCommits
+	if bisector.target == fixTarget {
+		newCommit, oldCommits = bisector.goodCommits[0], []string{bisector.badCommit}
+	}
+	finished, err := bisector.repo.BisectStart(newCommit, oldCommits, bisector.terms, w)
 	check.Panic(err, bisector.log, "Failed to start bisect")
 
 	bisector.finished = finished
@@ -175,23 +230,37 @@ func (bisector *GitBisector) Step(testResult server.ResultType) {
 	bisector.lastActive = time.Now()
 	bisector.log.WithField("testResult", testResult).Debug("Git bisect step")
 
+	if bisector.verifying {
+		bisector.verifyStep(testResult)
+		return
+	}
+
 	if !bisector.finished {
 		w := bisector.log.WithField("cmd", "bisectStep").Writer()
 		defer w.Close()
 
-		finished, err := bisector.repo.BisectStep(testResult, w)
+		finished, err := bisector.repo.BisectStep(testResult, bisector.terms, w)
 		check.Panic(err, bisector.log, "Failed to perform a bisect step")
 
+		if bisector.mode == testMode && testResult == server.Fail && len(bisector.testHistory) > 0 {
+			bisector.failedSteps = append(bisector.failedSteps, bisector.testHistory[len(bisector.testHistory)-1])
+		}
+
 		bisector.finished = finished
 	}
 }
 
 // Finish checks whether bisect finishes and perform result aggregation if true.
 // It fetches and aggregates test results and send bisect log as email.
+// If the result needs to be verified, it returns false until verification
+// finishes.
 func (bisector *GitBisector) Finish() bool {
 	if !bisector.finished {
 		return false
 	}
+	if bisector.verify && bisector.verification == "" && bisector.startVerify() {
+		return false
+	}
 
 	bisector.log.Info("Git bisect finished")
 	defer bisector.Clean()
@@ -209,6 +278,158 @@ func (bisector *GitBisector) Finish() bool {
 	return true
 }
 
+/*
+startVerify prepares the verification of the bisect result.
+
+It checks out the commit the bisect started from (the bad commit, or the fixed
+commit for a fix bisect) and reverts the commit found on top of it. The next
+Build and Step then run on the revert. In test mode, only the tests that
+failed in the bisect steps run again. It returns false if there is nothing
+to verify, in which case the verification result is already set.
+*/
+func (bisector *GitBisector) startVerify() bool {
+	bisector.log.Info("Verifying bisect result")
+	w := bisector.log.WithField("cmd", "bisectVerify").Writer()
+	defer w.Close()
+
+	bisectLog, err := bisector.repo.BisectLog(w)
+	check.Panic(err, bisector.log, "Failed to get bisect log")
+	culprit := firstCommitHash(bisector.terms.FirstCommit(bisectLog))
+	if culprit == "" {
+		bisector.verification = "inconclusive: no commit to verify"
+		return false
+	}
+
+	startCommit := bisector.badCommit
+	if bisector.target == fixTarget {
+		startCommit = bisector.goodCommits[0]
+	}
+	err = bisector.repo.Checkout(startCommit, w)
+	check.Panic(err, bisector.log, "Failed to checkout to verify bisect result")
+
+	err = bisector.repo.Revert(culprit, w)
+	if err != nil {
+		bisector.log.WithError(err).Warn("Failed to revert bisect result")
+		bisector.verification = fmt.Sprintf("inconclusive: %s does not revert cleanly on top of %s", culprit, startCommit)
+		return false
+	}
+
+	if bisector.mode == testMode {
+		bisector.restrictTests()
+	}
+
+	bisector.verifying = true
+	bisector.verification = fmt.Sprintf("running: %s reverted on top of %s", culprit, startCommit)
+	return true
+}
+
+// restrictTests changes the test request to run only the tests that failed
+// in the bisect steps. The whole test request runs again if the failed
+// tests are not known.
+func (bisector *GitBisector) restrictTests() {
+	gce, err := gcp.NewService(bisector.gsBucket)
+	if !check.NoError(err, bisector.log, "Failed to connect to GCE service, verifying with all tests") {
+		return
+	}
+	defer gce.Close()
+
+	failed := []string{}
+	for _, testID := range bisector.failedSteps {
+		if _, err := bisector.getResults(testID, gce); err != nil {
+			continue
+		}
+		resultsFile := bisector.resultsDir + testID + "/results.xml"
+		suites, err := junit.Parse(resultsFile)
+		if !check.NoError(err, bisector.log, "Failed to parse test results") {
+			continue
+		}
+		for key, outcome := range suites.Outcomes() {
+			if outcome.Failed() {
+				failed = append(failed, key)
+			}
+		}
+	}
+	if len(failed) == 0 {
+		bisector.log.Warn("No failed tests found, verifying with all tests")
+		return
+	}
+
+	cmdLine, err := verifyCmd(bisector.origCmd, failed)
+	if !check.NoError(err, bisector.log, "Failed to restrict tests, verifying with all tests") {
+		return
+	}
+	bisector.log.WithField("cmdLine", cmdLine).Info("Verifying with failed tests")
+	bisector.testRequest.CmdLine = parser.EncodeCmd(cmdLine)
+}
+
+// verifyCmd returns a command line that runs the failed tests, given as
+// "<config>:<test>", in the configs they failed in. The other options of
+// origCmd are kept.
+func verifyCmd(origCmd string, failed []string) (string, error) {
+	req, err := parser.Parse(origCmd)
+	if err != nil {
+		return "", err
+	}
+	configs := parser.NewSet([]string{})
+	tests := parser.NewSet([]string{})
+	for _, key := range failed {
+		i := strings.LastIndex(key, ":")
+		if i <= 0 {
+			return "", fmt.Errorf("invalid test %s", key)
+		}
+		configs.Add(key[:i])
+		tests.Add(key[i+1:])
+	}
+
+	testList, configList := tests.ToSlice(), configs.ToSlice()
+	sort.Strings(testList)
+	sort.Strings(configList)
+
+	req = req.WithTests(testList)
+	options := []parser.Arg{}
+	for _, arg := range req.Options {
+		if arg.Name != "-c" {
+			options = append(options, arg)
+		}
+	}
+	req.Options = append(options, parser.Arg{Name: "-c", Value: strings.Join(configList, ",")})
+	return strings.Join(req.Render(), " "), nil
+}
+
+// verifyStep records the result of testing the reverted commit.
+// The revert confirms the result if it brings back the old bisect state,
+// i.e. the tests pass again for a regression, or fail again for a fix.
+func (bisector *GitBisector) verifyStep(testResult server.ResultType) {
+	bisector.verifying = false
+	verdict := "inconclusive"
+	state, err := bisector.terms.Step(testResult)
+	if err == nil && state == bisector.terms.Old {
+		verdict = "confirmed culprit"
+		if bisector.target == fixTarget {
+			verdict = "confirmed fix"
+		}
+	}
+	what := "tests"
+	if bisector.mode == buildMode {
+		what = "build"
+	}
+	detail := strings.TrimPrefix(bisector.verification, "running: ")
+	bisector.verification = fmt.Sprintf("%s: %s %s with %s (%s)", verdict, what, testResult, detail, bisector.verifyTestID)
+	bisector.log.WithField("verification", bisector.verification).Info("Bisect result verified")
+}
+
+// firstCommitHash returns the hash from a "[<hash>] <subject>" line.
+func firstCommitHash(line string) string {
+	if !strings.HasPrefix(line, "[") {
+		return ""
+	}
+	end := strings.Index(line, "]")
+	if end < 0 {
+		return ""
+	}
+	return line[1:end]
+}
+
 func (bisector *GitBisector) aggResults(gce *gcp.Service) {
 	bisector.log.Info("Fetching test results")
 	file, err := os.Create(bisector.resultsDir + "report")
@@ -220,6 +441,11 @@ func (bisector *GitBisector) aggResults(gce *gcp.Service) {
 	fmt.Fprint(file, bisector.Info().String())
 
 	for _, testID := range bisector.testHistory {
+		if bisector.mode == buildMode {
+			fmt.Fprintf(file, "\n============BUILD %s============\n", testID)
+			bisector.buildReport(file, testID)
+			continue
+		}
 		fmt.Fprintf(file, "\n============TEST %s============\n", testID)
 		reportFile, err := bisector.getResults(testID, gce)
 		if err == nil {
@@ -237,6 +463,28 @@ func (bisector *GitBisector) aggResults(gce *gcp.Service) {
 	}
 }
 
+// buildReport writes the build result of a bisect step, and keeps the build
+// log with the packed results.
+func (bisector *GitBisector) buildReport(w io.Writer, testID string) {
+	result := bisector.buildResults[testID]
+	fmt.Fprintf(w, "BUILD RESULT:\t%s\n", result)
+
+	buildLog := bisector.logDir + testID + ".build"
+	content, err := ioutil.ReadFile(buildLog)
+	if !check.NoError(err, bisector.log, "Failed to read build log") {
+		fmt.Fprintf(w, "No build log available\n")
+		return
+	}
+	summary := SummarizeBuildLog(string(content), result != server.Pass)
+	fmt.Fprintf(w, "WARNINGS:\t%d\nERRORS:\t%d\n", summary.Warnings, summary.Errors)
+	if result != server.Pass && len(summary.Excerpt) > 0 {
+		fmt.Fprintf(w, "BUILD LOG EXCERPT:\n%s\n", strings.Join(summary.Excerpt, "\n"))
+	}
+
+	err = check.CopyFile(bisector.resultsDir+testID+".build", buildLog)
+	check.NoError(err, bisector.log, "Failed to copy build log")
+}
+
 func (bisector *GitBisector) getResults(testID string, gce *gcp.Service) (string, error) {
 	prefix := fmt.Sprintf("%s/results.%s-%s.", bisector.bucketSubdir, server.LTMUserName, testID)
 	resultFiles, err := gce.GetFileNames(prefix)
@@ -343,21 +591,23 @@ func (bisector *GitBisector) GetCommit() string {
 
 // Build builds the current commit for the bisector
 // It returns a resultType other than DefaultResult to skip
-// running tests and perform next bisect step immediately
+// running tests and perform next bisect step immediately.
+// In build mode, it always returns the verdict from the build.
 func (bisector *GitBisector) Build() server.ResultType {
 	bisector.lastActive = time.Now()
 	commit := bisector.GetCommit()
 	bisector.log.WithField("commit", commit).Debug("Git bisect build")
 	newTestID := bisector.testID + "-" + commit[:8]
 
-	gsPath := fmt.Sprintf("gs://%s/kernels/bzImage-%s-onerun.deb", bisector.gsBucket, newTestID)
-
-	bisector.testRequest.Options.GsKernel = gsPath
 	bisector.testRequest.Options.CommitID = commit
 	bisector.testRequest.ExtraOptions.TestID = newTestID
 	bisector.testRequest.ExtraOptions.Requester = server.KCSBisectStep
+	bisector.testRequest.ExtraOptions.Priority = server.BisectPriority
 
 	bisector.testHistory = append(bisector.testHistory, newTestID)
+	if bisector.verifying {
+		bisector.verifyTestID = newTestID
+	}
 
 	buildLog := bisector.logDir + newTestID + ".build"
 	gsConfig := bisector.testRequest.Options.KConfig
@@ -366,15 +616,41 @@ func (bisector *GitBisector) Build() server.ResultType {
 	arch := bisector.testRequest.Options.Arch
 
 	if logging.MOCK {
-		return MockRunBuild(bisector.repo, bisector.gsBucket, gsPath, gsConfig, kConfigOpts, kbuildOpts, arch, newTestID, buildLog, bisector.log)
+		gsPath := fmt.Sprintf("gs://%s/kernels/bzImage-%s-onerun.deb", bisector.gsBucket, newTestID)
+		bisector.testRequest.Options.GsKernel = gsPath
+		result := MockRunBuild(bisector.repo, bisector.gsBucket, gsPath, gsConfig, kConfigOpts, kbuildOpts, arch, newTestID, buildLog, bisector.log)
+		bisector.buildResults[newTestID] = result
+		return result
+	}
+	gsPath, err := BuildCached(bisector.repo, bisector.gsBucket, gsConfig, kConfigOpts, kbuildOpts, arch, newTestID, buildLog, server.BisectPriority, bisector.log)
+	if bisector.mode == buildMode {
+		result := bisector.buildVerdict(err, buildLog)
+		bisector.buildResults[newTestID] = result
+		return result
 	}
-	err := RunBuild(bisector.repo, bisector.gsBucket, gsPath, gsConfig, kConfigOpts, kbuildOpts, arch, newTestID, buildLog)
 	if !check.NoError(err, bisector.log, "Failed to build and upload kernel, skip commit") {
 		return server.Error
 	}
+	bisector.testRequest.Options.GsKernel = gsPath
 	return server.DefaultResult
 }
 
+// buildVerdict decides a bisect step from the kernel build alone.
+// A build that fails with compiler or linker errors is bad, while a build
+// that fails for other reasons (e.g. an upload error) skips the commit.
+func (bisector *GitBisector) buildVerdict(err error, buildLog string) server.ResultType {
+	if err == nil {
+		return server.Pass
+	}
+	content, _ := ioutil.ReadFile(buildLog)
+	if SummarizeBuildLog(string(content), true).Errors > 0 {
+		bisector.log.WithError(err).Info("Kernel does not build, marking commit as bad")
+		return server.Fail
+	}
+	check.NoError(err, bisector.log, "Failed to build and upload kernel, skip commit")
+	return server.Error
+}
+
 // StartTest sends a test request to LTM
 func (bisector *GitBisector) StartTest() {
 	server.SendInternalRequest(bisector.testRequest, bisector.log, false)
@@ -416,13 +692,18 @@ func (bisector *GitBisector) Info() server.BisectorInfo {
 	}
 	resultLines := strings.Split(result, "\n")
 	return server.BisectorInfo{
-		ID:          bisector.testID,
-		Command:     bisector.origCmd,
-		Repo:        bisector.testRequest.Options.GitRepo,
-		BadCommit:   bisector.badCommit,
-		GoodCommits: bisector.goodCommits,
-		LastActive:  time.Since(bisector.lastActive).Round(time.Second).String(),
-		Log:         resultLines,
+		ID:           bisector.testID,
+		User:         bisector.user,
+		Command:      bisector.origCmd,
+		Mode:         bisector.mode,
+		Target:       bisector.target,
+		Result:       bisector.terms.FirstCommit(result),
+		Verification: bisector.verification,
+		Repo:         bisector.testRequest.Options.GitRepo,
+		BadCommit:    bisector.badCommit,
+		GoodCommits:  bisector.goodCommits,
+		LastActive:   time.Since(bisector.lastActive).Round(time.Second).String(),
+		Log:          resultLines,
 	}
 }
 
@@ -444,6 +725,8 @@ on an existing task using the test result. If the task finishes, it sends
 a report to the user and cleans up related resources.
 If the current HEAD in the request differs from the bisector, it does nothing.
 If the build fails, it bisect skip the current commit.
+In build mode, every step is decided by Build, so the bisect runs to the end
+without sending any test requests to LTM.
 */
 func RunBisect(c server.TaskRequest, testID string, serverLog *logrus.Entry) {
 	log := serverLog.WithField("testID", testID)
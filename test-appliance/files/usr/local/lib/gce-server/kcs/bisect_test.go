@@ -4,7 +4,10 @@ import (
 	"os"
 	"testing"
 
+	"thunk.org/gce-server/util/git"
 	"thunk.org/gce-server/util/server"
+
+	"github.com/sirupsen/logrus"
 )
 
 func TestBisect(t *testing.T) {
@@ -41,3 +44,91 @@ func TestBisect(t *testing.T) {
 
 	bisector.Clean()
 }
+
+func TestFirstCommitHash(t *testing.T) {
+	tests := []struct {
+		line string
+		hash string
+	}{
+		{"[c870e04e71136d57817526add31b6abe2b451c63] ext4: fix race", "c870e04e71136d57817526add31b6abe2b451c63"},
+		{"", ""},
+		{"c870e04e ext4: fix race", ""},
+	}
+	for _, e := range tests {
+		if hash := firstCommitHash(e.line); hash != e.hash {
+			t.Errorf("get wrong hash %s instead of %s", hash, e.hash)
+		}
+	}
+}
+
+func TestVerifyCmd(t *testing.T) {
+	tests := []struct {
+		origCmd string
+		failed  []string
+		cmd     string
+	}{
+		{
+			"ltm -c ext4/4k,xfs/4k -g auto --bisect-bad v6.1 --bisect-good v6.0 --bisect-verify",
+			[]string{"ext4/4k:generic/002", "ext4/4k:generic/001"},
+			"--bisect-bad v6.1 --bisect-good v6.0 --bisect-verify -c ext4/4k generic/001 generic/002",
+		},
+		{
+			"ltm smoke --bisect-bad v6.1 --bisect-good v6.0",
+			[]string{"ext4/4k:generic/001", "ext4:overlay/small:overlay/001", "ext4/4k:generic/001"},
+			"--bisect-bad v6.1 --bisect-good v6.0 -c ext4/4k,ext4:overlay/small generic/001 overlay/001",
+		},
+	}
+	for _, e := range tests {
+		cmd, err := verifyCmd(e.origCmd, e.failed)
+		if err != nil {
+			t.Errorf("verifyCmd(%q) failed: %v", e.origCmd, err)
+		} else if cmd != e.cmd {
+			t.Errorf("verifyCmd(%q) = %q, want %q", e.origCmd, cmd, e.cmd)
+		}
+	}
+
+	if _, err := verifyCmd("ltm -c 4k generic/001", []string{"generic/001"}); err == nil {
+		t.Error("verifyCmd accepts a test without config")
+	}
+	if _, err := verifyCmd("ltm --no-such-option", []string{"4k:generic/001"}); err == nil {
+		t.Error("verifyCmd accepts an invalid command line")
+	}
+}
+
+func TestVerifyStep(t *testing.T) {
+	tests := []struct {
+		target     string
+		mode       string
+		testResult server.ResultType
+		verdict    string
+	}{
+		{regressionTarget, testMode, server.Pass, "confirmed culprit: tests pass"},
+		{regressionTarget, testMode, server.Fail, "inconclusive: tests fail"},
+		{regressionTarget, testMode, server.Error, "inconclusive: tests error"},
+		{regressionTarget, buildMode, server.Pass, "confirmed culprit: build pass"},
+		{regressionTarget, buildMode, server.Fail, "inconclusive: build fail"},
+		{fixTarget, testMode, server.Fail, "confirmed fix: tests fail"},
+		{fixTarget, testMode, server.Pass, "inconclusive: tests pass"},
+		{fixTarget, testMode, server.Error, "inconclusive: tests error"},
+	}
+	for _, e := range tests {
+		terms := git.RegressionTerms
+		if e.target == fixTarget {
+			terms = git.FixTerms
+		}
+		bisector := &GitBisector{
+			mode:         e.mode,
+			target:       e.target,
+			terms:        terms,
+			verifying:    true,
+			verifyTestID: "test-abcdef12",
+			verification: "running: abcdef12 reverted on top of v6.1",
+			log:          logrus.NewEntry(logrus.New()),
+		}
+		bisector.verifyStep(e.testResult)
+		expected := e.verdict + " with abcdef12 reverted on top of v6.1 (test-abcdef12)"
+		if bisector.verifying || bisector.verification != expected {
+			t.Errorf("%s %s %s: get verification %q, want %q", e.target, e.mode, e.testResult, bisector.verification, expected)
+		}
+	}
+}
@@ -14,10 +14,22 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-// repoMap indexes repos by repo url.
-// repoLock protects map access and ensures one build at a time
+// repoPool holds the working trees of a repo. The first tree is the cached
+// clone and the others are git worktrees of it, added when all trees are in
+// use so that different commits of the same repo can be built at once.
+// lock is held while the repo is cloned or a worktree is added, so that
+// other repos can be used meanwhile.
+type repoPool struct {
+	lock  sync.Mutex
+	trees []*git.Repository
+	busy  map[*git.Repository]bool
+}
+
+// repoMap indexes repo pools by repo id.
+// repoLock protects map access and the trees of the pools. Trees are only
+// added with the pool lock held as well.
 var (
-	repoMap  = make(map[string]*git.Repository)
+	repoMap  = make(map[string]*repoPool)
 	repoLock sync.Mutex
 )
 
@@ -29,7 +41,8 @@ func init() {
 }
 
 // StartBuild starts a kernel build task.
-// The kernel image is uploaded to gs bucket at path /kernels/bzImage-<testID>.
+// The kernel image is taken from the kernel cache, or built and uploaded to
+// the cache directory in gs bucket if the commit was not built before.
 // If ExtraOptions is not nil, it rewrites gsKernel in original request and
 // send it back to LTM to init a test.
 func StartBuild(c server.TaskRequest, testID string, serverLog *logrus.Entry) {
@@ -39,29 +52,17 @@ func StartBuild(c server.TaskRequest, testID string, serverLog *logrus.Entry) {
 	buildLog := logging.KCSLogDir + testID + ".build"
 	subject := "xfstests KCS build failure " + testID
 	defer email.ReportFailure(log, buildLog, c.Options.ReportFailEmail, subject)
+	defer reportBuildFailure(c, log)
 
 	gsBucket, err := gcp.GceConfig.Get("GS_BUCKET")
 	check.Panic(err, log, "Failed to get gs bucket config")
 	gsPath := fmt.Sprintf("gs://%s/kernels/bzImage-%s-onerun.deb", gsBucket, testID)
 
-	id, err := git.ParseURL(c.Options.GitRepo)
-	check.Panic(err, log, "Failed to parse repo url")
-
-	repoLock.Lock()
-	defer repoLock.Unlock()
-	cmdLog := log.WithField("repoId", id)
-	w := cmdLog.WithField("cmd", "newRepo").Writer()
-
-	repo, ok := repoMap[id]
-	if !ok {
-		cmdLog.Debug("Cloning repo")
-		repo, err = git.NewRepository(id, c.Options.GitRepo, w)
-		check.Panic(err, cmdLog, "Failed to clone repo")
-
-		repoMap[id] = repo
-	} else {
-		cmdLog.Debug("Existing repo found")
-	}
+	repo := getRepo(c.Options.GitRepo, log)
+	defer putRepo(repo)
+	cmdLog := log.WithField("repoId", repo.ID())
+	w := cmdLog.WithField("cmd", "checkout").Writer()
+	defer w.Close()
 
 	err = repo.Checkout(c.Options.CommitID, w)
 	check.Panic(err, cmdLog, "Failed to checkout to commit")
@@ -79,9 +80,9 @@ func StartBuild(c server.TaskRequest, testID string, serverLog *logrus.Entry) {
 		server.SendInternalRequest(c, log, false)
 		return
 	}
-	cmdLog.WithField("commit", c.Options.CommitID).Info("Building kernel")
+	cmdLog.WithField("commit", c.Options.CommitID).Info("Getting kernel")
 
-	err = RunBuild(repo, gsBucket, gsPath, gsConfig, kConfigOpts, kbuildOpts, arch, testID, buildLog)
+	gsPath, err = BuildCached(repo, gsBucket, gsConfig, kConfigOpts, kbuildOpts, arch, testID, buildLog, priority(c), log)
 	check.Panic(err, log, "Failed to build and upload kernel")
 	log.WithField("gsPath", gsPath).Info("Kernel build and upload finished")
 
@@ -91,3 +92,120 @@ func StartBuild(c server.TaskRequest, testID string, serverLog *logrus.Entry) {
 		server.SendInternalRequest(c, log, false)
 	}
 }
+
+// reportBuildFailure tells LTM if building the kernel of a request from LTM
+// panics, so that a test run waiting for the kernel does not wait until it
+// times out. It panics again so that the failure is still sent by email.
+func reportBuildFailure(c server.TaskRequest, log *logrus.Entry) {
+	if r := recover(); r != nil {
+		notifyBuildFailure(c, log)
+		panic(r)
+	}
+}
+
+// notifyBuildFailure sends a build failure of a request from LTM back to LTM.
+func notifyBuildFailure(c server.TaskRequest, log *logrus.Entry) {
+	if c.ExtraOptions == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithField("panic", r).Error("Failed to report build failure to LTM")
+		}
+	}()
+	failure := c
+	failure.ExtraOptions = &server.InternalOptions{
+		TestID:    c.ExtraOptions.TestID,
+		Requester: server.KCSBuildFailure,
+	}
+	server.SendInternalRequest(failure, log, false)
+}
+
+// getRepo returns a free working tree for repoURL, cloning the repo on first
+// use. The tree must be returned with putRepo after use.
+func getRepo(repoURL string, log *logrus.Entry) *git.Repository {
+	id, err := git.ParseURL(repoURL)
+	check.Panic(err, log, "Failed to parse repo url")
+	cmdLog := log.WithField("repoId", id)
+
+	repoLock.Lock()
+	pool, ok := repoMap[id]
+	if !ok {
+		pool = &repoPool{busy: make(map[*git.Repository]bool)}
+		repoMap[id] = pool
+	}
+	repoLock.Unlock()
+
+	if tree := pool.take(); tree != nil {
+		cmdLog.WithField("tree", tree.ID()).Debug("Existing repo found")
+		return tree
+	}
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if len(pool.trees) == 0 {
+		cmdLog.Debug("Cloning repo")
+		w := cmdLog.WithField("cmd", "newRepo").Writer()
+		defer w.Close()
+		repo, err := git.NewRepository(id, repoURL, w)
+		check.Panic(err, cmdLog, "Failed to clone repo")
+		pool.add(repo)
+		return repo
+	}
+	// a tree may be returned while waiting for the lock
+	if tree := pool.take(); tree != nil {
+		cmdLog.WithField("tree", tree.ID()).Debug("Existing repo found")
+		return tree
+	}
+
+	name := fmt.Sprintf("worktree%d", len(pool.trees))
+	cmdLog.WithField("tree", name).Debug("All trees in use, adding worktree")
+	w := cmdLog.WithField("cmd", "addWorktree").Writer()
+	defer w.Close()
+	tree, err := pool.trees[0].AddWorktree(name, w)
+	check.Panic(err, cmdLog, "Failed to add worktree")
+	pool.add(tree)
+	return tree
+}
+
+// take marks a free tree of the pool as busy and returns it, or returns nil
+// if all trees are in use.
+func (pool *repoPool) take() *git.Repository {
+	repoLock.Lock()
+	defer repoLock.Unlock()
+	for _, tree := range pool.trees {
+		if !pool.busy[tree] {
+			pool.busy[tree] = true
+			return tree
+		}
+	}
+	return nil
+}
+
+// add adds a busy tree to the pool. The caller must hold the pool lock.
+func (pool *repoPool) add(tree *git.Repository) {
+	repoLock.Lock()
+	defer repoLock.Unlock()
+	pool.trees = append(pool.trees, tree)
+	pool.busy[tree] = true
+}
+
+// putRepo returns a working tree to its pool.
+func putRepo(tree *git.Repository) {
+	repoLock.Lock()
+	defer repoLock.Unlock()
+	for _, pool := range repoMap {
+		if _, ok := pool.busy[tree]; ok {
+			pool.busy[tree] = false
+			return
+		}
+	}
+}
+
+// priority returns the build priority of a request.
+// User requests to KCS are ad-hoc builds.
+func priority(c server.TaskRequest) server.Priority {
+	if c.ExtraOptions == nil {
+		return server.AdHocPriority
+	}
+	return c.ExtraOptions.Priority
+}
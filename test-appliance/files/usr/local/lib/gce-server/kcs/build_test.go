@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"thunk.org/gce-server/util/git"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestGetRepo(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	repoURL := "https://github.com/tytso/xfstests-bld.git"
+	id, err := git.ParseURL(repoURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clone := &git.Repository{}
+	worktree := &git.Repository{}
+	pool := &repoPool{busy: make(map[*git.Repository]bool)}
+	pool.add(clone)
+	pool.add(worktree)
+	repoLock.Lock()
+	repoMap[id] = pool
+	repoLock.Unlock()
+	t.Cleanup(func() {
+		repoLock.Lock()
+		delete(repoMap, id)
+		repoLock.Unlock()
+	})
+
+	putRepo(worktree)
+	// a worktree is being added for another build
+	pool.lock.Lock()
+	got := make(chan *git.Repository)
+	go func() {
+		got <- getRepo(repoURL, log)
+	}()
+	select {
+	case tree := <-got:
+		if tree != worktree {
+			t.Errorf("get a busy tree instead of the free worktree")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("getRepo waits for a worktree to be added while a tree is free")
+	}
+	pool.lock.Unlock()
+
+	if pool.take() != nil {
+		t.Errorf("take a tree while all trees are in use")
+	}
+	putRepo(clone)
+	if tree := pool.take(); tree != clone {
+		t.Errorf("take %p, want the returned clone %p", tree, clone)
+	}
+}
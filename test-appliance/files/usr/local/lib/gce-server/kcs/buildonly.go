@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"thunk.org/gce-server/util/check"
+	"thunk.org/gce-server/util/email"
+	"thunk.org/gce-server/util/gcp"
+	"thunk.org/gce-server/util/logging"
+	"thunk.org/gce-server/util/server"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxExcerptLines limits the build log lines quoted in a build report.
+	maxExcerptLines = 40
+	// gsBrowserURL is the prefix for downloading GS objects from a browser.
+	gsBrowserURL = "https://storage.cloud.google.com/"
+)
+
+var (
+	warningRegex = regexp.MustCompile(`: warning: `)
+	errorRegex   = regexp.MustCompile(`: (fatal )?error: |^ERROR: |undefined reference to |\*\*\* \[.*\] Error `)
+)
+
+// BuildSummary contains the compiler diagnostics found in a build log.
+type BuildSummary struct {
+	Warnings int
+	Errors   int
+	Excerpt  []string
+}
+
+/*
+StartBuildOnly builds a kernel without running any tests.
+
+The kernel is always built, even if a kernel for the same commit is cached,
+so that the build log is complete. The kernel image is copied out of the
+kernel cache next to the build log, so that it is not evicted before the
+user downloads it. The report sent to the user contains the
+number of compiler warnings and errors, an excerpt of the build log and
+download links to the kernel image and full build log. A build that does not
+compile is reported as a build result rather than a KCS failure.
+*/
+func StartBuildOnly(c server.TaskRequest, testID string, serverLog *logrus.Entry) {
+	log := serverLog.WithField("testID", testID)
+	log.Info("Start build-only task")
+
+	buildLog := logging.KCSLogDir + testID + ".build"
+	subject := "xfstests KCS build failure " + testID
+	defer email.ReportFailure(log, buildLog, c.Options.ReportFailEmail, subject)
+
+	gsBucket, err := gcp.GceConfig.Get("GS_BUCKET")
+	check.Panic(err, log, "Failed to get gs bucket config")
+
+	repo := getRepo(c.Options.GitRepo, log)
+	defer putRepo(repo)
+	cmdLog := log.WithField("repoId", repo.ID())
+	w := cmdLog.WithField("cmd", "checkout").Writer()
+	defer w.Close()
+
+	err = repo.Checkout(c.Options.CommitID, w)
+	check.Panic(err, cmdLog, "Failed to checkout to commit")
+	commit, err := repo.GetCommit(w)
+	check.Panic(err, cmdLog, "Failed to get commit")
+
+	gsConfig := c.Options.KConfig
+	kConfigOpts := c.Options.KConfigOpts
+	kbuildOpts := c.Options.KbuildOpts
+	arch := c.Options.Arch
+
+	var gsPath string
+	var buildErr error
+	if logging.MOCK {
+		gsPath = fmt.Sprintf("gs://%s/kernels/bzImage-%s-onerun.deb", gsBucket, testID)
+		result := MockRunBuild(repo, gsBucket, gsPath, gsConfig, kConfigOpts, kbuildOpts, arch, testID, buildLog, log)
+		if result == server.Error {
+			buildErr = fmt.Errorf("mock build failed")
+		}
+	} else {
+		gsPath, buildErr = RebuildCached(repo, gsBucket, gsConfig, kConfigOpts, kbuildOpts, arch, testID, buildLog, priority(c), log)
+		if buildErr == nil {
+			gsPath = keepKernel(c, gsBucket, testID, gsPath, log)
+		}
+	}
+	if buildErr != nil {
+		log.WithError(buildErr).Warn("Kernel build failed")
+	} else {
+		log.WithField("gsPath", gsPath).Info("Kernel build and upload finished")
+	}
+
+	content, err := ioutil.ReadFile(buildLog)
+	check.NoError(err, log, "Failed to read build log")
+	summary := SummarizeBuildLog(string(content), buildErr != nil)
+	log.WithFields(logrus.Fields{
+		"warnings": summary.Warnings,
+		"errors":   summary.Errors,
+	}).Info("Build log summarized")
+
+	logPath := ""
+	if len(content) > 0 {
+		logPath = uploadBuildLog(c, gsBucket, testID, buildLog, log)
+	}
+	reportBuild(c, testID, commit, gsBucket, gsPath, logPath, summary, buildErr, log)
+}
+
+/*
+SummarizeBuildLog counts compiler warnings and errors in a build log.
+
+The excerpt holds the diagnostic lines. If the build failed without any
+recognizable error message, it holds the last lines of the log instead.
+*/
+func SummarizeBuildLog(content string, failed bool) BuildSummary {
+	summary := BuildSummary{Excerpt: []string{}}
+	tail := []string{}
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		diagnostic := false
+		if errorRegex.MatchString(line) {
+			summary.Errors++
+			diagnostic = true
+		} else if warningRegex.MatchString(line) {
+			summary.Warnings++
+			diagnostic = true
+		}
+		if diagnostic && len(summary.Excerpt) < maxExcerptLines {
+			summary.Excerpt = append(summary.Excerpt, line)
+		}
+
+		tail = append(tail, line)
+		if len(tail) > maxExcerptLines {
+			tail = tail[1:]
+		}
+	}
+
+	if failed && summary.Errors == 0 {
+		summary.Excerpt = tail
+	}
+	return summary
+}
+
+// resultsDir returns the GS directory of the test results of a request.
+func resultsDir(c server.TaskRequest) string {
+	bucketSubdir, _ := gcp.GceConfig.Get("BUCKET_SUBDIR")
+	if c.Options.BucketSubdir != "" {
+		bucketSubdir = c.Options.BucketSubdir
+	}
+	if bucketSubdir == "" {
+		bucketSubdir = "results"
+	}
+	return bucketSubdir
+}
+
+// keepKernel copies a kernel image from the kernel cache next to the test
+// results, and returns the GS path of the copy. The cached path is returned
+// if the copy fails.
+func keepKernel(c server.TaskRequest, gsBucket string, testID string, gsPath string, log *logrus.Entry) string {
+	kernelPath := fmt.Sprintf("%s/bzImage.%s-%s.deb", resultsDir(c), server.LTMUserName, testID)
+
+	gce, err := gcp.NewService(gsBucket)
+	if !check.NoError(err, log, "Failed to connect to GCE service") {
+		return gsPath
+	}
+	defer gce.Close()
+	err = gce.CopyFile(objectName(gsPath), kernelPath)
+	if !check.NoError(err, log, "Failed to copy kernel out of the kernel cache") {
+		return gsPath
+	}
+	return fmt.Sprintf("gs://%s/%s", gsBucket, kernelPath)
+}
+
+// uploadBuildLog uploads the full build log next to the test results,
+// and returns its GS object name or an empty string on failure.
+func uploadBuildLog(c server.TaskRequest, gsBucket string, testID string, buildLog string, log *logrus.Entry) string {
+	logPath := fmt.Sprintf("%s/build.%s-%s.log", resultsDir(c), server.LTMUserName, testID)
+
+	gce, err := gcp.NewService(gsBucket)
+	if !check.NoError(err, log, "Failed to connect to GCE service") {
+		return ""
+	}
+	defer gce.Close()
+	err = gce.UploadFile(buildLog, logPath)
+	if !check.NoError(err, log, "Failed to upload build log") {
+		return ""
+	}
+	return logPath
+}
+
+// reportBuild sends the build-only report to the user.
+func reportBuild(c server.TaskRequest, testID string, commit string, gsBucket string, gsPath string, logPath string, summary BuildSummary, buildErr error, log *logrus.Entry) {
+	receiver := c.Options.ReportEmail
+	result := "success"
+	if buildErr != nil {
+		receiver = c.Options.ReportFailEmail
+		result = "failure"
+	}
+	if receiver == "" {
+		log.Info("No email receiver provided")
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "============BUILD %s============\n", testID)
+	fmt.Fprintf(&b, "REPO:\t%s\nCOMMIT:\t%s\nKCONFIG:\t%s\nKCONFIG OPTS:\t%s\nARCH:\t%s\n",
+		c.Options.GitRepo, commit, c.Options.KConfig, c.Options.KConfigOpts, c.Options.Arch)
+	fmt.Fprintf(&b, "BUILD RESULT:\t%s\nWARNINGS:\t%d\nERRORS:\t%d\n", result, summary.Warnings, summary.Errors)
+	if buildErr == nil {
+		fmt.Fprintf(&b, "KERNEL:\t%s\n\t%s%s\n", gsPath, gsBrowserURL, strings.TrimPrefix(gsPath, "gs://"))
+	}
+	if logPath != "" {
+		fmt.Fprintf(&b, "BUILD LOG:\tgs://%s/%s\n\t%s%s/%s\n", gsBucket, logPath, gsBrowserURL, gsBucket, logPath)
+	}
+	if len(summary.Excerpt) > 0 {
+		fmt.Fprintf(&b, "\nBUILD LOG EXCERPT:\n%s\n", strings.Join(summary.Excerpt, "\n"))
+	}
+
+	subject := fmt.Sprintf("xfstests KCS build %s %s", result, testID)
+	err := email.Send(subject, b.String(), receiver)
+	check.NoError(err, log, "Failed to send the email")
+}
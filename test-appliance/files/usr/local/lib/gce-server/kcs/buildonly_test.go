@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+var buildLogWarnings = `  CC      fs/ext4/super.o
+fs/ext4/super.c:123:7: warning: unused variable 'x' [-Wunused-variable]
+  CC      fs/ext4/inode.o
+fs/ext4/inode.c:456:2: warning: 'y' may be used uninitialized [-Wmaybe-uninitialized]
+  LD      vmlinux
+`
+
+var buildLogErrors = `  CC      fs/ext4/super.o
+fs/ext4/super.c:123:7: warning: unused variable 'x' [-Wunused-variable]
+fs/ext4/super.c:200:1: error: expected ';' before '}' token
+make[3]: *** [scripts/Makefile.build:243: fs/ext4/super.o] Error 1
+`
+
+func TestSummarizeBuildLog(t *testing.T) {
+	summary := SummarizeBuildLog(buildLogWarnings, false)
+	expected := BuildSummary{
+		Warnings: 2,
+		Errors:   0,
+		Excerpt: []string{
+			"fs/ext4/super.c:123:7: warning: unused variable 'x' [-Wunused-variable]",
+			"fs/ext4/inode.c:456:2: warning: 'y' may be used uninitialized [-Wmaybe-uninitialized]",
+		},
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("get wrong summary %+v", summary)
+	}
+
+	summary = SummarizeBuildLog(buildLogErrors, true)
+	expected = BuildSummary{
+		Warnings: 1,
+		Errors:   2,
+		Excerpt: []string{
+			"fs/ext4/super.c:123:7: warning: unused variable 'x' [-Wunused-variable]",
+			"fs/ext4/super.c:200:1: error: expected ';' before '}' token",
+			"make[3]: *** [scripts/Makefile.build:243: fs/ext4/super.o] Error 1",
+		},
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("get wrong summary %+v", summary)
+	}
+}
+
+func TestSummarizeBuildLogTail(t *testing.T) {
+	summary := SummarizeBuildLog("  CC      fs/ext4/super.o\nKilled\n", true)
+	expected := []string{"  CC      fs/ext4/super.o", "Killed"}
+	if summary.Errors != 0 || !reflect.DeepEqual(summary.Excerpt, expected) {
+		t.Errorf("get wrong summary %+v", summary)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"thunk.org/gce-server/util/check"
+	"thunk.org/gce-server/util/gcp"
+	"thunk.org/gce-server/util/git"
+	"thunk.org/gce-server/util/server"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// kernelCacheDir is the GS directory for cached kernel images.
+	kernelCacheDir = "kernels/cache/"
+	// defaultCacheSize is the total size of cached kernels in GB.
+	defaultCacheSize = 50
+	// cacheGracePeriod is how long a kernel is kept after it was last
+	// built or reused, whatever the cache size, so that the kernels of
+	// queued and running tests are not evicted.
+	cacheGracePeriod = 24 * time.Hour
+)
+
+// kernelCacheIndex lives on the cache pd so that it survives KCS restarts.
+var kernelCacheIndex = "/cache/kernel-cache.json"
+
+// BuildSpec identifies a kernel build. Kernels built from the same spec
+// are interchangeable. The generation of the kconfig on GS changes when the
+// kconfig is replaced in place, so that kernels built from the old kconfig
+// are not reused.
+type BuildSpec struct {
+	Commit            string `json:"commit"`
+	KConfig           string `json:"kconfig"`
+	KConfigGeneration int64  `json:"kconfig_generation,omitempty"`
+	KConfigOpts       string `json:"kconfig_opts"`
+	KbuildOpts        string `json:"kbuild_opts"`
+	Arch              string `json:"arch"`
+}
+
+// Key returns a hash of the build spec.
+func (spec BuildSpec) Key() string {
+	fields := []string{spec.Commit, spec.KConfig, strconv.FormatInt(spec.KConfigGeneration, 10),
+		spec.KConfigOpts, spec.KbuildOpts, spec.Arch}
+	hash := sha256.Sum256([]byte(strings.Join(fields, "\x00")))
+	return hex.EncodeToString(hash[:])
+}
+
+// cacheEntry records a cached kernel image on GS.
+type cacheEntry struct {
+	Spec     BuildSpec `json:"spec"`
+	GsPath   string    `json:"gs_path"`
+	Size     int64     `json:"size"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+// kernelCache indexes kernel images by build spec key.
+// cacheLock protects the index and the index file.
+var (
+	kernelCache = make(map[string]*cacheEntry)
+	cacheLock   sync.Mutex
+)
+
+// cacheStore is the part of the GS service used by the kernel cache.
+type cacheStore interface {
+	GetFileSize(name string) (int64, error)
+	DeleteFile(name string) error
+}
+
+// loadCache reads the cache index at KCS startup. An index that cannot be
+// read is logged and the cache starts over empty, rather than refusing to
+// build.
+func loadCache(log *logrus.Entry) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	kernelCache = make(map[string]*cacheEntry)
+	if !check.FileExists(kernelCacheIndex) {
+		return
+	}
+	content, err := ioutil.ReadFile(kernelCacheIndex)
+	if !check.NoError(err, log, "Failed to read kernel cache index, starting with an empty cache") {
+		return
+	}
+	err = json.Unmarshal(content, &kernelCache)
+	if !check.NoError(err, log, "Failed to parse kernel cache index, starting with an empty cache") {
+		kernelCache = make(map[string]*cacheEntry)
+	}
+}
+
+/*
+BuildCached returns the GS path of a kernel image for the current repo HEAD.
+
+If a kernel was built before from the same commit and build options, and the
+image still exists on GS, it is reused without building. Otherwise the kernel
+is built and uploaded to the cache directory on GS, and the cache is garbage
+collected to stay within GCE_KCS_CACHE_SIZE. The build waits in the build
+queue with the given priority.
+*/
+func BuildCached(repo *git.Repository, gsBucket string, gsConfig string, kConfigOpts string, kbuildOpts string, arch string, testID string, buildLog string, priority server.Priority, log *logrus.Entry) (string, error) {
+	return buildCached(repo, gsBucket, gsConfig, kConfigOpts, kbuildOpts, arch, testID, buildLog, priority, true, log)
+}
+
+// RebuildCached always builds the kernel for the current repo HEAD, so that
+// the build log is available, and replaces any cached kernel built from the
+// same commit and build options.
+func RebuildCached(repo *git.Repository, gsBucket string, gsConfig string, kConfigOpts string, kbuildOpts string, arch string, testID string, buildLog string, priority server.Priority, log *logrus.Entry) (string, error) {
+	return buildCached(repo, gsBucket, gsConfig, kConfigOpts, kbuildOpts, arch, testID, buildLog, priority, false, log)
+}
+
+func buildCached(repo *git.Repository, gsBucket string, gsConfig string, kConfigOpts string, kbuildOpts string, arch string, testID string, buildLog string, priority server.Priority, reuse bool, log *logrus.Entry) (string, error) {
+	commit, err := repo.GetCommit(ioutil.Discard)
+	if err != nil {
+		return "", err
+	}
+	gce, err := gcp.NewService(gsBucket)
+	if err != nil {
+		return "", err
+	}
+	defer gce.Close()
+
+	generation, err := kconfigGeneration(gsConfig, gsBucket, gce)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up kconfig %s: %v", gsConfig, err)
+	}
+	spec := BuildSpec{
+		Commit:            commit,
+		KConfig:           gsConfig,
+		KConfigGeneration: generation,
+		KConfigOpts:       kConfigOpts,
+		KbuildOpts:        kbuildOpts,
+		Arch:              arch,
+	}
+	key := spec.Key()
+	log = log.WithFields(logrus.Fields{
+		"commit":   commit,
+		"cacheKey": key[:16],
+	})
+
+	if reuse {
+		if gsPath := lookupCache(key, gce, log); gsPath != "" {
+			log.WithField("gsPath", gsPath).Info("Reusing cached kernel")
+			msg := fmt.Sprintf("Reusing cached kernel %s for commit %s\n", gsPath, commit)
+			ioutil.WriteFile(buildLog, []byte(msg), 0644)
+			return gsPath, nil
+		}
+	}
+
+	name := fmt.Sprintf("%sbzImage-%s.deb", kernelCacheDir, key[:16])
+	gsPath := fmt.Sprintf("gs://%s/%s", gsBucket, name)
+	log.WithField("gsPath", gsPath).Info("Building kernel")
+
+	err = RunBuild(repo, gsBucket, gsPath, gsConfig, kConfigOpts, kbuildOpts, arch, testID, buildLog, priority)
+	if err != nil {
+		return "", err
+	}
+
+	size, err := gce.GetFileSize(name)
+	check.NoError(err, log, "Failed to get kernel image size")
+
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	now := time.Now()
+	kernelCache[key] = &cacheEntry{
+		Spec:     spec,
+		GsPath:   gsPath,
+		Size:     size,
+		Created:  now,
+		LastUsed: now,
+	}
+	gcCache(gce, gsBucket, cacheSizeLimit(), log)
+	saveCache(log)
+
+	return gsPath, nil
+}
+
+// kconfigGeneration returns the GS generation of a kconfig, or 0 if the
+// kernel is built without a kconfig on GS.
+func kconfigGeneration(gsConfig string, gsBucket string, gce *gcp.Service) (int64, error) {
+	if !strings.HasPrefix(gsConfig, "gs://") {
+		return 0, nil
+	}
+	bucket, name, _ := strings.Cut(strings.TrimPrefix(gsConfig, "gs://"), "/")
+	if bucket == gsBucket {
+		return gce.GetFileGeneration(name)
+	}
+	other, err := gcp.NewService(bucket)
+	if err != nil {
+		return 0, err
+	}
+	defer other.Close()
+	return other.GetFileGeneration(name)
+}
+
+// lookupCache returns the GS path for a cached kernel and marks it as used.
+// Entries whose image no longer exists are dropped.
+func lookupCache(key string, gce cacheStore, log *logrus.Entry) string {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	entry, ok := kernelCache[key]
+	if !ok {
+		return ""
+	}
+	_, err := gce.GetFileSize(objectName(entry.GsPath))
+	if err != nil {
+		if gcp.NotFound(err) {
+			log.WithField("gsPath", entry.GsPath).Warn("Cached kernel is gone, dropping cache entry")
+			delete(kernelCache, key)
+			saveCache(log)
+		} else {
+			check.NoError(err, log, "Failed to check cached kernel")
+		}
+		return ""
+	}
+
+	entry.LastUsed = time.Now()
+	saveCache(log)
+	return entry.GsPath
+}
+
+// gcCache removes the least recently used kernels until the total size of
+// cached kernels is no more than limit bytes. Kernels used within
+// cacheGracePeriod are kept even if the cache stays over the limit.
+// The caller must hold cacheLock.
+func gcCache(gce cacheStore, gsBucket string, limit int64, log *logrus.Entry) {
+	for _, key := range evictKeys(kernelCache, limit, time.Now()) {
+		entry := kernelCache[key]
+		log.WithFields(logrus.Fields{
+			"gsPath":   entry.GsPath,
+			"lastUsed": entry.LastUsed.Format(time.Stamp),
+		}).Info("Evicting cached kernel")
+
+		if !strings.HasPrefix(entry.GsPath, "gs://"+gsBucket+"/") {
+			log.WithField("gsPath", entry.GsPath).Warn("Cached kernel is in another bucket, dropping entry only")
+		} else {
+			err := gce.DeleteFile(objectName(entry.GsPath))
+			if err != nil && !gcp.NotFound(err) {
+				check.NoError(err, log, "Failed to delete cached kernel")
+				continue
+			}
+		}
+		delete(kernelCache, key)
+	}
+}
+
+// evictKeys returns the keys to evict, least recently used first, so that
+// the remaining entries fit in limit bytes. Entries used within
+// cacheGracePeriod before now are never evicted.
+func evictKeys(cache map[string]*cacheEntry, limit int64, now time.Time) []string {
+	keys := []string{}
+	var total int64
+	for key, entry := range cache {
+		keys = append(keys, key)
+		total += entry.Size
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return cache[keys[i]].LastUsed.Before(cache[keys[j]].LastUsed)
+	})
+
+	evict := []string{}
+	for _, key := range keys {
+		if total <= limit || now.Sub(cache[key].LastUsed) < cacheGracePeriod {
+			break
+		}
+		evict = append(evict, key)
+		total -= cache[key].Size
+	}
+	return evict
+}
+
+// saveCache writes the cache index to disk. The caller must hold cacheLock.
+func saveCache(log *logrus.Entry) {
+	js, err := json.MarshalIndent(kernelCache, "", "\t")
+	if !check.NoError(err, log, "Failed to encode kernel cache index") {
+		return
+	}
+	tmpFile := kernelCacheIndex + ".tmp"
+	err = ioutil.WriteFile(tmpFile, js, 0644)
+	if !check.NoError(err, log, "Failed to write kernel cache index") {
+		return
+	}
+	err = os.Rename(tmpFile, kernelCacheIndex)
+	check.NoError(err, log, "Failed to replace kernel cache index")
+}
+
+// cacheSizeLimit returns the max total size of cached kernels in bytes.
+func cacheSizeLimit() int64 {
+	size := defaultCacheSize
+	if val, err := gcp.GceConfig.Get("GCE_KCS_CACHE_SIZE"); err == nil {
+		if n, err := strconv.Atoi(val); err == nil && n >= 0 {
+			size = n
+		}
+	}
+	return int64(size) << 30
+}
+
+// objectName strips the gs://<bucket>/ prefix from a GS path.
+func objectName(gsPath string) string {
+	path := strings.TrimPrefix(gsPath, "gs://")
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[i+1:]
+	}
+	return path
+}
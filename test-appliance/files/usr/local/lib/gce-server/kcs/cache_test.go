@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+// fakeStore holds the sizes of GS objects by name.
+type fakeStore struct {
+	files   map[string]int64
+	deleted []string
+}
+
+func (s *fakeStore) GetFileSize(name string) (int64, error) {
+	size, ok := s.files[name]
+	if !ok {
+		return 0, &googleapi.Error{Code: http.StatusNotFound}
+	}
+	return size, nil
+}
+
+func (s *fakeStore) DeleteFile(name string) error {
+	s.deleted = append(s.deleted, name)
+	delete(s.files, name)
+	return nil
+}
+
+// useTestCache points the cache index to a temp dir and restores the
+// cache when the test ends.
+func useTestCache(t *testing.T, cache map[string]*cacheEntry) {
+	index := kernelCacheIndex
+	saved := kernelCache
+	kernelCacheIndex = filepath.Join(t.TempDir(), "kernel-cache.json")
+	kernelCache = cache
+	t.Cleanup(func() {
+		kernelCacheIndex = index
+		kernelCache = saved
+	})
+}
+
+func testCache(now time.Time) map[string]*cacheEntry {
+	return map[string]*cacheEntry{
+		"new": {GsPath: "gs://bucket/kernels/cache/new", Size: 30, LastUsed: now},
+		"old": {GsPath: "gs://bucket/kernels/cache/old", Size: 20, LastUsed: now.Add(-3 * cacheGracePeriod)},
+		"mid": {GsPath: "gs://bucket/kernels/cache/mid", Size: 10, LastUsed: now.Add(-2 * cacheGracePeriod)},
+	}
+}
+
+func TestLookupCache(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	start := time.Now().Add(-time.Hour)
+	useTestCache(t, map[string]*cacheEntry{
+		"hit":  {GsPath: "gs://bucket/kernels/cache/hit", LastUsed: start},
+		"gone": {GsPath: "gs://bucket/kernels/cache/gone", LastUsed: start},
+	})
+	store := &fakeStore{files: map[string]int64{"kernels/cache/hit": 1}}
+
+	if path := lookupCache("hit", store, log); path != "gs://bucket/kernels/cache/hit" {
+		t.Errorf("get %q for cached kernel", path)
+	}
+	if !kernelCache["hit"].LastUsed.After(start) {
+		t.Error("lookup did not update the last used time")
+	}
+	if path := lookupCache("gone", store, log); path != "" {
+		t.Errorf("get %q for a deleted kernel", path)
+	}
+	if _, ok := kernelCache["gone"]; ok {
+		t.Error("entry of a deleted kernel is not dropped")
+	}
+	if path := lookupCache("missing", store, log); path != "" {
+		t.Errorf("get %q for an unknown key", path)
+	}
+
+	loadCache(log)
+	if len(kernelCache) != 1 || kernelCache["hit"] == nil {
+		t.Errorf("get %v after reloading the index, want only the hit entry", kernelCache)
+	}
+}
+
+func TestEvictKeys(t *testing.T) {
+	now := time.Now()
+	cache := testCache(now)
+	tests := []struct {
+		limit int64
+		now   time.Time
+		want  []string
+	}{
+		{60, now, []string{}},
+		{50, now, []string{"old"}},
+		{40, now, []string{"old"}},
+		{35, now, []string{"old", "mid"}},
+		// the kernel just built is kept even if it does not fit
+		{20, now, []string{"old", "mid"}},
+		{0, now, []string{"old", "mid"}},
+		{0, now.Add(-2 * cacheGracePeriod), []string{"old"}},
+		{0, now.Add(cacheGracePeriod), []string{"old", "mid", "new"}},
+	}
+	for _, test := range tests {
+		if keys := evictKeys(cache, test.limit, test.now); !reflect.DeepEqual(keys, test.want) {
+			t.Errorf("evictKeys(%d, %s) = %v, want %v", test.limit, test.now.Format(time.Stamp), keys, test.want)
+		}
+	}
+}
+
+func TestGcCache(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	cache := testCache(time.Now())
+	cache["other"] = &cacheEntry{GsPath: "gs://other/kernels/cache/other", Size: 5, LastUsed: time.Time{}}
+	useTestCache(t, cache)
+	store := &fakeStore{files: map[string]int64{
+		"kernels/cache/new": 30,
+		"kernels/cache/old": 20,
+		"kernels/cache/mid": 10,
+	}}
+
+	gcCache(store, "bucket", 40, log)
+	if !reflect.DeepEqual(store.deleted, []string{"kernels/cache/old"}) {
+		t.Errorf("deleted %v, want only the least recently used kernel", store.deleted)
+	}
+	if len(kernelCache) != 2 || kernelCache["new"] == nil || kernelCache["mid"] == nil {
+		t.Errorf("get cache %v after gc", kernelCache)
+	}
+
+	gcCache(store, "bucket", 0, log)
+	if len(kernelCache) != 1 || kernelCache["new"] == nil {
+		t.Errorf("get cache %v after gc with no room, want only the kernel in use", kernelCache)
+	}
+}
+
+func TestLoadCache(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	useTestCache(t, testCache(time.Now()))
+
+	loadCache(log)
+	if len(kernelCache) != 0 {
+		t.Errorf("get %d entries without an index file", len(kernelCache))
+	}
+	err := os.WriteFile(kernelCacheIndex, []byte("{not json"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadCache(log)
+	if len(kernelCache) != 0 {
+		t.Errorf("get %d entries from a corrupt index file", len(kernelCache))
+	}
+}
+
+func TestBuildSpecKey(t *testing.T) {
+	spec := BuildSpec{Commit: "abc", KConfig: "gs://bucket/build_config", KConfigGeneration: 1}
+	key := spec.Key()
+	spec.KConfigGeneration = 2
+	if spec.Key() == key {
+		t.Error("key does not change with the kconfig generation")
+	}
+}
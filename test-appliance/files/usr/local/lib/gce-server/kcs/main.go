@@ -7,12 +7,19 @@ The endpoints are:
 
 	/login - authenticates a user session, implemented in server.go
 
+	/tokens, /reload, /audit - admin endpoints, implemented in server.go
+
+	All requests are recorded in the audit log, see audit.go in package server.
+
 	/gce-xfstests - takes in a json POST in the form of LTMRequest, and runs the
-	tests.
+	tests. Requires the submitter role.
 
 	/internal - handles internal requests from LTM server.
 
 	/internal-status - handles queries for running status from LTM server.
+
+	Both internal endpoints only accept requests authenticated by the
+	internal certificate of LTM.
 */
 package main
 
@@ -53,8 +60,19 @@ func runCompile(w http.ResponseWriter, r *http.Request, serverLog *logrus.Entry)
 	if c.ExtraOptions == nil {
 		log.WithField("testID", testID).Info("User request, generating testID")
 
-		go StartBuild(c, testID, serverLog)
-		response.Msg = "Building kernel for user"
+		if c.Options.BuildOnly {
+			go StartBuildOnly(c, testID, serverLog)
+			response.Msg = "Building kernel without tests for user"
+		} else if c.Options.BackportCommits != "" {
+			go StartBackportTest(c, testID, serverLog)
+			response.Msg = "Building backport queue for user"
+		} else if c.Options.PatchMbox != "" || c.Options.MessageID != "" {
+			go StartPatchTest(c, testID, serverLog)
+			response.Msg = "Building patch series for user"
+		} else {
+			go StartBuild(c, testID, serverLog)
+			response.Msg = "Building kernel for user"
+		}
 
 	} else {
 		switch c.ExtraOptions.Requester {
@@ -66,6 +84,30 @@ func runCompile(w http.ResponseWriter, r *http.Request, serverLog *logrus.Entry)
 			response.TestID = testID
 			response.Msg = "Building kernel for LTM"
 
+		case server.LTMPatchTest:
+			testID = c.ExtraOptions.TestID
+			log.WithField("testID", testID).Info("LTM patch test request, use existing testID")
+
+			go StartPatchTest(c, testID, serverLog)
+			response.TestID = testID
+			response.Msg = "Applying and building patch series for LTM"
+
+		case server.LTMBackportTest:
+			testID = c.ExtraOptions.TestID
+			log.WithField("testID", testID).Info("LTM backport test request, use existing testID")
+
+			go StartBackportTest(c, testID, serverLog)
+			response.TestID = testID
+			response.Msg = "Cherry-picking and building backport queue for LTM"
+
+		case server.LTMBuildOnly:
+			testID = c.ExtraOptions.TestID
+			log.WithField("testID", testID).Info("LTM build-only request, use existing testID")
+
+			go StartBuildOnly(c, testID, serverLog)
+			response.TestID = testID
+			response.Msg = "Building kernel without tests for LTM"
+
 		case server.LTMBisectStart:
 			fallthrough
 		case server.LTMBisectStep:
@@ -94,6 +136,7 @@ func status(w http.ResponseWriter, r *http.Request, serverLog *logrus.Entry) {
 
 	response := server.StatusResponse{
 		Bisectors: BisectorStatus(),
+		Builds:    BuildStatus(),
 	}
 	log.WithField("response", response).Info("Sending response")
 
@@ -107,18 +150,20 @@ func main() {
 		panic(err)
 	}
 
-	s.Handler().Handle("/gce-xfstests", s.LoginHandler(s.FailureHandler(
-		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	s.Handler().Handle("/gce-xfstests", s.AuditHandler(s.LoginHandler(s.RoleHandler(server.SubmitterRole,
+		s.FailureHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			runCompile(w, r, s.Log())
-		})))).Methods("POST")
-	s.Handler().Handle("/internal", s.FailureHandler(
+		})))))).Methods("POST")
+	s.Handler().Handle("/internal", s.AuditHandler(s.InternalHandler(server.LTMServer, s.FailureHandler(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			runCompile(w, r, s.Log())
-		}))).Methods("POST")
-	s.Handler().Handle("/internal-status", s.FailureHandler(
+		}))))).Methods("POST")
+	s.Handler().Handle("/internal-status", s.AuditHandler(s.InternalHandler(server.LTMServer, s.FailureHandler(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			status(w, r, s.Log())
-		}))).Methods("POST")
+		}))))).Methods("POST")
+
+	loadCache(s.Log())
 
 	finished := make(chan bool)
 	go StartTracker(s, finished)
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"thunk.org/gce-server/util/check"
+	"thunk.org/gce-server/util/email"
+	"thunk.org/gce-server/util/gcp"
+	"thunk.org/gce-server/util/git"
+	"thunk.org/gce-server/util/logging"
+	"thunk.org/gce-server/util/server"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+StartPatchTest tests a patch series on top of a base commit.
+
+The series is either uploaded in the request as a base64 encoded mbox, or
+fetched by message-id from the lore mirror configured by GCE_LORE_MIRROR.
+It is applied with git am on top of CommitID, and the result is built and
+uploaded like a regular build. If the request comes from LTM, the applied
+series is attached to the test request so that the test report includes it.
+
+A series that does not apply is not treated as a KCS failure: the git am
+output is sent to the user and nothing is built.
+*/
+func StartPatchTest(c server.TaskRequest, testID string, serverLog *logrus.Entry) {
+	log := serverLog.WithField("testID", testID)
+	log.Info("Start testing patch series")
+
+	patchDir := logging.KCSLogDir + testID + ".patch/"
+	buildLog := logging.KCSLogDir + testID + ".build"
+	subject := "xfstests KCS patch test failure " + testID
+	defer email.ReportFailure(log, buildLog, c.Options.ReportFailEmail, subject)
+	defer reportBuildFailure(c, log)
+
+	err := check.CreateDir(patchDir)
+	check.Panic(err, log, "Failed to create dir")
+	defer os.RemoveAll(patchDir)
+
+	mboxPath := getMbox(c, patchDir, log)
+
+	gsBucket, err := gcp.GceConfig.Get("GS_BUCKET")
+	check.Panic(err, log, "Failed to get gs bucket config")
+
+	repo := getRepo(c.Options.GitRepo, log)
+	defer putRepo(repo)
+	cmdLog := log.WithField("repoId", repo.ID())
+	w := cmdLog.WithField("cmd", "applySeries").Writer()
+	defer w.Close()
+
+	err = repo.Checkout(c.Options.CommitID, w)
+	check.Panic(err, cmdLog, "Failed to checkout to base commit")
+	base, err := repo.GetCommit(w)
+	check.Panic(err, cmdLog, "Failed to get base commit")
+
+	output, err := repo.ApplyMbox(mboxPath, w)
+	if err != nil {
+		cmdLog.WithError(err).Warn("Patch series does not apply")
+		reportApplyFailure(c, testID, base, output, log)
+		notifyBuildFailure(c, log)
+		return
+	}
+
+	series, err := repo.Log(base+"..HEAD", w)
+	check.Panic(err, cmdLog, "Failed to get applied patches")
+	series = fmt.Sprintf("BASE COMMIT:\t%s\nPATCHES:\n%s", base, series)
+	cmdLog.WithField("series", series).Info("Patch series applied")
+
+	buildSeries(c, repo, gsBucket, testID, buildLog, series, log)
+}
+
+// buildSeries builds the current HEAD of repo with a patch series applied.
+// If the request comes from LTM, the kernel is sent to LTM for testing with
+// the series attached.
+func buildSeries(c server.TaskRequest, repo *git.Repository, gsBucket string, testID string, buildLog string, series string, log *logrus.Entry) {
+	gsConfig := c.Options.KConfig
+	kConfigOpts := c.Options.KConfigOpts
+	kbuildOpts := c.Options.KbuildOpts
+	arch := c.Options.Arch
+
+	if logging.MOCK {
+		gsPath := fmt.Sprintf("gs://%s/kernels/bzImage-%s-onerun.deb", gsBucket, testID)
+		result := MockRunBuild(repo, gsBucket, gsPath, gsConfig, kConfigOpts, kbuildOpts, arch, testID, buildLog, log)
+		if c.ExtraOptions != nil {
+			c.Options.GsKernel = gsPath
+			c.ExtraOptions.Requester = server.KCSTest
+			c.ExtraOptions.TestResult = result
+			c.ExtraOptions.Series = series
+			server.SendInternalRequest(c, log, false)
+		}
+		return
+	}
+
+	gsPath, err := BuildCached(repo, gsBucket, gsConfig, kConfigOpts, kbuildOpts, arch, testID, buildLog, priority(c), log)
+	check.Panic(err, log, "Failed to build and upload kernel")
+	log.WithField("gsPath", gsPath).Info("Kernel build and upload finished")
+
+	if c.ExtraOptions != nil {
+		c.Options.GsKernel = gsPath
+		c.ExtraOptions.Requester = server.KCSTest
+		c.ExtraOptions.Series = series
+		server.SendInternalRequest(c, log, false)
+	}
+}
+
+// getMbox writes the mbox for the patch series into dir and returns its path.
+func getMbox(c server.TaskRequest, dir string, log *logrus.Entry) string {
+	if c.Options.PatchMbox != "" {
+		data, err := base64.StdEncoding.DecodeString(c.Options.PatchMbox)
+		check.Panic(err, log, "Failed to decode mbox")
+
+		mboxPath := dir + "series.mbx"
+		err = os.WriteFile(mboxPath, data, 0644)
+		check.Panic(err, log, "Failed to write mbox")
+		return mboxPath
+	}
+
+	mirror, err := gcp.GceConfig.Get("GCE_LORE_MIRROR")
+	check.Panic(err, log, "Failed to get lore mirror config")
+
+	cmdLog := log.WithField("messageID", c.Options.MessageID)
+	w := cmdLog.WithField("cmd", "fetchMbox").Writer()
+	defer w.Close()
+	mboxPath, err := git.FetchLoreMbox(c.Options.MessageID, mirror, dir, w)
+	check.Panic(err, cmdLog, "Failed to fetch patch series")
+	return mboxPath
+}
+
+// reportApplyFailure sends the git am output to the user when a series
+// does not apply on the base commit.
+func reportApplyFailure(c server.TaskRequest, testID string, base string, output string, log *logrus.Entry) {
+	receiver := c.Options.ReportFailEmail
+	if receiver == "" {
+		log.Info("No email receiver provided")
+		return
+	}
+
+	source := "uploaded mbox"
+	if c.Options.MessageID != "" {
+		source = "message-id " + c.Options.MessageID
+	}
+	subject := "xfstests patch series does not apply " + testID
+	content := fmt.Sprintf("The patch series from %s does not apply on top of %s (%s).\n\n%s",
+		source, c.Options.CommitID, base, strings.TrimSpace(output))
+
+	err := email.Send(subject, content, receiver)
+	check.NoError(err, log, "Failed to send the email")
+}
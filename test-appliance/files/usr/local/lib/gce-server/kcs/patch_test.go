@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"testing"
+
+	"thunk.org/gce-server/util/server"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestGetMbox(t *testing.T) {
+	mbox := "From 1111111 Mon Sep 17 00:00:00 2001\nSubject: [PATCH] ext4: fix\n\n---\n"
+	c := server.TaskRequest{
+		Options: &server.UserOptions{PatchMbox: base64.StdEncoding.EncodeToString([]byte(mbox))},
+	}
+	dir := t.TempDir() + "/"
+	mboxPath := getMbox(c, dir, logrus.NewEntry(logrus.New()))
+	if mboxPath != dir+"series.mbx" {
+		t.Errorf("get mbox path %s", mboxPath)
+	}
+	data, err := os.ReadFile(mboxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != mbox {
+		t.Errorf("get mbox %q, want %q", data, mbox)
+	}
+
+	c.Options.PatchMbox = "not base64!"
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for an invalid mbox encoding")
+		}
+	}()
+	getMbox(c, dir, logrus.NewEntry(logrus.New()))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"thunk.org/gce-server/util/gcp"
+	"thunk.org/gce-server/util/server"
+)
+
+const (
+	// cpusPerBuild is the number of vCPUs assumed per build slot
+	// when GCE_KCS_BUILD_SLOTS is not set.
+	cpusPerBuild = 4
+)
+
+// buildJob is a kernel build waiting for or holding a build slot.
+type buildJob struct {
+	testID   string
+	repo     string
+	commit   string
+	priority server.Priority
+	queued   time.Time
+	started  time.Time
+	ready    chan bool
+}
+
+// BuildQueue limits the number of concurrent kernel builds.
+// Waiting builds are served by priority, then in arrival order.
+type BuildQueue struct {
+	slots   int
+	running []*buildJob
+	waiting []*buildJob
+	lock    sync.Mutex
+}
+
+var buildQueue = NewBuildQueue(buildSlots())
+
+// NewBuildQueue constructs a build queue with a number of build slots.
+func NewBuildQueue(slots int) *BuildQueue {
+	if slots < 1 {
+		slots = 1
+	}
+	return &BuildQueue{
+		slots:   slots,
+		running: []*buildJob{},
+		waiting: []*buildJob{},
+	}
+}
+
+// Acquire blocks until a build slot is available for the job.
+// It returns a function that releases the slot.
+func (q *BuildQueue) Acquire(testID string, repo string, commit string, priority server.Priority) func() {
+	job := &buildJob{
+		testID:   testID,
+		repo:     repo,
+		commit:   commit,
+		priority: priority,
+		queued:   time.Now(),
+		ready:    make(chan bool),
+	}
+
+	q.lock.Lock()
+	q.waiting = append(q.waiting, job)
+	sort.SliceStable(q.waiting, func(i, j int) bool {
+		return q.waiting[i].priority > q.waiting[j].priority
+	})
+	q.schedule()
+	q.lock.Unlock()
+
+	<-job.ready
+	return func() { q.release(job) }
+}
+
+// Len returns the number of running and waiting builds.
+func (q *BuildQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.running) + len(q.waiting)
+}
+
+// Info returns the running builds followed by waiting builds in queue order.
+func (q *BuildQueue) Info() []server.BuildInfo {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	infoList := []server.BuildInfo{}
+	for _, job := range q.running {
+		infoList = append(infoList, job.info("building", 0, job.started))
+	}
+	for i, job := range q.waiting {
+		infoList = append(infoList, job.info("queued", i+1, job.queued))
+	}
+	return infoList
+}
+
+func (q *BuildQueue) release(job *buildJob) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i, j := range q.running {
+		if j == job {
+			q.running = append(q.running[:i], q.running[i+1:]...)
+			break
+		}
+	}
+	q.schedule()
+}
+
+// schedule moves waiting jobs into free slots.
+// The caller must hold the queue lock.
+func (q *BuildQueue) schedule() {
+	for len(q.running) < q.slots && len(q.waiting) > 0 {
+		job := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		job.started = time.Now()
+		q.running = append(q.running, job)
+		close(job.ready)
+	}
+}
+
+func (job *buildJob) info(status string, position int, since time.Time) server.BuildInfo {
+	return server.BuildInfo{
+		ID:       job.testID,
+		Repo:     job.repo,
+		Commit:   job.commit,
+		Priority: job.priority.String(),
+		Status:   status,
+		Position: position,
+		Time:     time.Since(since).Round(time.Second).String(),
+	}
+}
+
+// buildSlots returns the number of concurrent builds from GCE_KCS_BUILD_SLOTS,
+// or derives it from the number of CPUs on the KCS server.
+func buildSlots() int {
+	if val, err := gcp.GceConfig.Get("GCE_KCS_BUILD_SLOTS"); err == nil {
+		if n, err := strconv.Atoi(val); err == nil && n > 0 {
+			return n
+		}
+	}
+	return runtime.NumCPU() / cpusPerBuild
+}
+
+// BuildStatus returns the info for running and queued builds.
+func BuildStatus() []server.BuildInfo {
+	return buildQueue.Info()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"thunk.org/gce-server/util/server"
+)
+
+// waitQueue waits until n builds are running or waiting in the queue.
+func waitQueue(t *testing.T, q *BuildQueue, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue has %d builds, want %d", q.Len(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBuildQueueOrder(t *testing.T) {
+	q := NewBuildQueue(1)
+	release := q.Acquire("running", "repo", "abc", server.AdHocPriority)
+
+	started := make(chan string, 3)
+	var wg sync.WaitGroup
+	for i, job := range []struct {
+		testID   string
+		priority server.Priority
+	}{
+		{"adhoc", server.AdHocPriority},
+		{"bisect", server.BisectPriority},
+		{"adhoc2", server.AdHocPriority},
+	} {
+		wg.Add(1)
+		go func(testID string, priority server.Priority) {
+			defer wg.Done()
+			done := q.Acquire(testID, "repo", "abc", priority)
+			started <- testID
+			done()
+		}(job.testID, job.priority)
+		waitQueue(t, q, i+2)
+	}
+
+	info := q.Info()
+	expected := []string{"running", "bisect", "adhoc", "adhoc2"}
+	for i, testID := range expected {
+		if info[i].ID != testID || info[i].Position != i {
+			t.Errorf("get build %s at position %d, want %s at %d", info[i].ID, info[i].Position, testID, i)
+		}
+	}
+
+	release()
+	wg.Wait()
+	close(started)
+	order := []string{}
+	for testID := range started {
+		order = append(order, testID)
+	}
+	for i, testID := range expected[1:] {
+		if order[i] != testID {
+			t.Fatalf("builds started in order %v, want %v", order, expected[1:])
+		}
+	}
+	if q.Len() != 0 {
+		t.Errorf("get %d builds after all are released", q.Len())
+	}
+}
+
+func TestBuildQueueSlots(t *testing.T) {
+	const slots = 3
+	q := NewBuildQueue(slots)
+
+	releases := []func(){}
+	for i := 0; i < slots; i++ {
+		releases = append(releases, q.Acquire("build", "repo", "abc", server.AdHocPriority))
+	}
+	started := make(chan bool)
+	go func() {
+		release := q.Acquire("extra", "repo", "abc", server.AdHocPriority)
+		close(started)
+		release()
+	}()
+	waitQueue(t, q, slots+1)
+	select {
+	case <-started:
+		t.Fatal("build started without a free slot")
+	case <-time.After(10 * time.Millisecond):
+	}
+	releases[0]()
+	<-started
+	for _, release := range releases[1:] {
+		release()
+	}
+	waitQueue(t, q, 0)
+
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 4*slots; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release := q.Acquire("build", "repo", "abc", server.AdHocPriority)
+			lock.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			lock.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			lock.Lock()
+			running--
+			lock.Unlock()
+			release()
+		}()
+	}
+	wg.Wait()
+
+	if maxRunning > slots {
+		t.Errorf("get %d concurrent builds, want at most %d", maxRunning, slots)
+	}
+	if q.Len() != 0 {
+		t.Errorf("get %d builds after all are released", q.Len())
+	}
+	if NewBuildQueue(0).slots != 1 {
+		t.Error("build queue without slots")
+	}
+}
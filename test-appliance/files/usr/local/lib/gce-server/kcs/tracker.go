@@ -1,9 +1,9 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
 	"os/exec"
-	"sync"
 	"time"
 
 	"thunk.org/gce-server/util/check"
@@ -21,16 +21,13 @@ const (
 	buildTimeout = 1 * time.Hour
 )
 
-var (
-	newBuild  chan bool
-	buildLock sync.Mutex
-)
+var newBuild chan bool
 
 /*
 StartTracker initiates a tracker for KCS server.
 
-If no build task received within buildTimeout and no active bisector,
-tracker shuts down the server and delete the VM.
+If no build task received within buildTimeout, no queued build and no active
+bisector, tracker shuts down the server and delete the VM.
 It appends a metadata to VM so that LTM would attempt to launch a new
 KCS server only after the shutdown finishes.
 */
@@ -47,8 +44,10 @@ func StartTracker(instance *server.Instance, finished chan bool) {
 			log.Warnf("KCS server has been idle for %s", buildTimeout.Round(time.Minute))
 			bisectors := BisectorStatus()
 			log.Infof("There are %d active bisectors", len(bisectors))
-			if len(bisectors) > 0 {
-				log.Infof("%+v", bisectors)
+			builds := BuildStatus()
+			log.Infof("There are %d running or queued builds", len(builds))
+			if len(bisectors) > 0 || len(builds) > 0 {
+				log.Infof("%+v %+v", bisectors, builds)
 				timer.Stop()
 			} else {
 				if !logging.DEBUG {
@@ -62,10 +61,15 @@ func StartTracker(instance *server.Instance, finished chan bool) {
 }
 
 // RunBuild builds the kernel and upload the kernel image.
-// It signals the server tracker to reset the timeout timer.
-func RunBuild(repo *git.Repository, gsBucket string, gsPath string, gsConfig string, kConfigOpts string, kbuildOpts string, arch string, testID string, buildLog string) error {
-	buildLock.Lock()
-	defer buildLock.Unlock()
+// It waits for a slot in the build queue, and signals the server tracker
+// to reset the timeout timer when the build starts.
+func RunBuild(repo *git.Repository, gsBucket string, gsPath string, gsConfig string, kConfigOpts string, kbuildOpts string, arch string, testID string, buildLog string, priority server.Priority) error {
+	commit, err := repo.GetCommit(ioutil.Discard)
+	if err != nil {
+		return err
+	}
+	release := buildQueue.Acquire(testID, repo.ID(), commit, priority)
+	defer release()
 	newBuild <- true
 
 	file, err := os.Create(buildLog)
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"thunk.org/gce-server/util/email"
+	"thunk.org/gce-server/util/junit"
+	"thunk.org/gce-server/util/server"
+)
+
+const (
+	baseVariant  = "base"
+	patchVariant = "patched"
+)
+
+// ABRun tests a base commit and the same commit with a patch series or
+// backport queue applied, and reports the failures introduced or fixed by it.
+// Both variants run with identical configs and shard layouts.
+type ABRun struct {
+	*siblingBase
+}
+
+// ABReport is the machine readable report of an A/B run.
+type ABReport struct {
+	TestID   string                    `json:"test_id"`
+	Command  string                    `json:"command"`
+	Repo     string                    `json:"repo"`
+	Commit   string                    `json:"commit"`
+	Series   string                    `json:"series"`
+	Variants map[string]*siblingResult `json:"variants"`
+	Failures junit.Comparison          `json:"failures"`
+}
+
+// NewABRun constructs a new A/B run from a patch series or backport test request.
+func NewABRun(c server.TaskRequest, testID string) *ABRun {
+	ab := &ABRun{newSiblingBase(c, testID, "A/B run", 2)}
+	ab.register(ab)
+	return ab
+}
+
+// Run asks KCS to build both variants and waits for both test runs to
+// finish before sending the combined report.
+func (ab *ABRun) Run() {
+	defer ab.clean()
+
+	subject := "xfstests LTM A/B run failure " + ab.testID
+	defer email.ReportFailure(ab.log, ab.logFile, ab.reportFailReceiver, subject)
+
+	base := ab.testRequest
+	baseOptions := *ab.testRequest.Options
+	baseOptions.PatchMbox = ""
+	baseOptions.MessageID = ""
+	baseOptions.BackportCommits = ""
+	base.Options = &baseOptions
+	base.ExtraOptions = &server.InternalOptions{
+		TestID:    ab.testID + "-" + baseVariant,
+		Requester: server.LTMBuild,
+	}
+	go ForwardKCS(base, base.ExtraOptions.TestID)
+
+	patched := ab.testRequest
+	patched.ExtraOptions = &server.InternalOptions{
+		TestID:    ab.testID + "-" + patchVariant,
+		Requester: server.LTMPatchTest,
+	}
+	if patched.Options.BackportCommits != "" {
+		patched.ExtraOptions.Requester = server.LTMBackportTest
+	}
+	go ForwardKCS(patched, patched.ExtraOptions.TestID)
+
+	ab.wait(2)
+	ab.report()
+}
+
+// Variants returns the variants of an A/B run.
+func (ab *ABRun) Variants() []string {
+	return []string{baseVariant, patchVariant}
+}
+
+// report compares both variants and sends the combined email and json report.
+func (ab *ABRun) report() {
+	ab.lock.Lock()
+	defer ab.lock.Unlock()
+	ab.log.Info("Generating A/B report")
+
+	r := ABReport{
+		TestID:   ab.testID,
+		Command:  ab.origCmd,
+		Repo:     ab.testRequest.Options.GitRepo,
+		Commit:   ab.testRequest.Options.CommitID,
+		Series:   ab.testRequest.Options.MessageID,
+		Variants: ab.results,
+	}
+	if ab.testRequest.Options.BackportCommits != "" {
+		r.Series = "backport " + strings.ReplaceAll(ab.testRequest.Options.BackportCommits, "|", " ")
+	} else if r.Series == "" {
+		r.Series = "uploaded mbox"
+	}
+
+	base, baseOK := ab.outcomes(baseVariant)
+	patched, patchedOK := ab.outcomes(patchVariant)
+	complete := baseOK && patchedOK
+	if complete {
+		r.Failures = junit.Compare(base, patched)
+	}
+	gsPath := ab.uploadReport(r, "ab")
+
+	content := ab.summary(r, complete)
+	content += fmt.Sprintf("\nJSON report: %s\n", gsPath)
+	subject := fmt.Sprintf("xfstests A/B results %s-%s", server.LTMUserName, ab.testID)
+	ab.sendReport(subject, content, !complete || len(r.Failures.New) > 0)
+}
+
+// summary formats the human readable part of the report.
+func (ab *ABRun) summary(r ABReport, complete bool) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "============A/B RUN %s============\n", r.TestID)
+	fmt.Fprintf(&b, "CMDLINE:\t%s\nREPO:\t%s\nBASE COMMIT:\t%s\nSERIES:\t%s\n\n", r.Command, r.Repo, r.Commit, r.Series)
+
+	for _, variant := range []string{baseVariant, patchVariant} {
+		if v, ok := r.Variants[variant]; ok {
+			fmt.Fprintf(&b, "%s:\t%s\t%s\t%s\n", strings.ToUpper(variant), v.TestID, v.KernelVersion, v.Result)
+		} else {
+			fmt.Fprintf(&b, "%s:\tno results, check prior emails or log for errors\n", strings.ToUpper(variant))
+		}
+	}
+
+	if !complete {
+		fmt.Fprint(&b, "\nResults are incomplete, failures cannot be compared\n")
+		return b.String()
+	}
+	sections := []struct {
+		title string
+		tests []string
+	}{
+		{"NEW FAILURES", r.Failures.New},
+		{"FIXED", r.Failures.Fixed},
+		{"UNCHANGED FAILURES", r.Failures.Unchanged},
+	}
+	for _, s := range sections {
+		fmt.Fprintf(&b, "\n%s (%d):\n", s.title, len(s.tests))
+		for _, test := range s.tests {
+			fmt.Fprintf(&b, "\t%s\n", test)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestFindABRun(t *testing.T) {
+	ab := &ABRun{&siblingBase{
+		testID:   "nightly-ext4",
+		results:  make(map[string]*siblingResult),
+		finished: make(chan string, 2),
+		log:      logrus.NewEntry(logrus.New()),
+	}}
+	siblingRunMap[ab.testID] = ab
+	defer delete(siblingRunMap, ab.testID)
+
+	for _, test := range []struct {
+		testID  string
+		variant string
+	}{
+		{"nightly-ext4-base", baseVariant},
+		{"nightly-ext4-patched", patchVariant},
+		{"nightly-ext4-k1", ""},
+		{"nightly-base", ""},
+		{"nightly", ""},
+	} {
+		found, variant := findSiblingRun(test.testID)
+		if variant != test.variant || (found != nil) != (test.variant != "") {
+			t.Errorf("get A/B run %v and variant %q for %s, want %q", found, variant, test.testID, test.variant)
+		}
+	}
+
+	ab.Fail(baseVariant)
+	ab.Fail(baseVariant)
+	if len(ab.finished) != 1 || ab.results[baseVariant].Result != "error" {
+		t.Errorf("get %d finished variants and %+v after a build failure", len(ab.finished), ab.results[baseVariant])
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"thunk.org/gce-server/util/gcp"
+	"thunk.org/gce-server/util/server"
+)
+
+// shardOverhead is the time a test VM spends besides running the tests, to
+// boot, set up the file systems and upload the results.
+const shardOverhead = 5 * time.Minute
+
+// machinePrices is the on-demand price of machine types in millidollars per
+// hour in us-central1, as in get_machtype_stats of gce-xfstests.
+var machinePrices = map[string]int{
+	"f1-micro":        8,
+	"e2-micro":        8,
+	"e2-small":        17,
+	"g1-micro":        26,
+	"e2-medium":       34,
+	"n1-standard-1":   47,
+	"e2-highcpu-2":    49,
+	"e2-standard-2":   67,
+	"e2-highmem-2":    90,
+	"n1-standard-2":   95,
+	"e2-highcpu-4":    99,
+	"n1-highcpu-2":    71,
+	"n1-highmem-2":    118,
+	"e2-standard-4":   134,
+	"n1-highcpu-4":    142,
+	"e2-highmem-4":    181,
+	"n1-standard-4":   190,
+	"e2-highcpu-8":    198,
+	"n1-highmem-4":    237,
+	"e2-standard-8":   268,
+	"n1-highcpu-8":    284,
+	"e2-highmem-8":    362,
+	"n1-standard-8":   380,
+	"e2-highcpu-16":   396,
+	"n1-highmem-8":    473,
+	"e2-standard-16":  536,
+	"n1-highcpu-16":   567,
+	"n1-standard-16":  760,
+	"e2-highmem-16":   723,
+	"e2-highcpu-32":   791,
+	"n1-highmem-16":   946,
+	"e2-standard-32":  1072,
+	"n1-highcpu-32":   1134,
+	"n1-standard-32":  1520,
+	"n1-highmem-32":   1893,
+	"n1-highcpu-64":   2267,
+	"n1-standard-64":  3040,
+	"n1-highcpu-96":   3401,
+	"n1-highmem-64":   3789,
+	"n1-standard-96":  4560,
+	"n1-highmem-96":   5679,
+	"t2a-standard-1":  39,
+	"t2a-standard-2":  77,
+	"t2a-standard-4":  154,
+	"t2a-standard-8":  308,
+	"t2a-standard-16": 616,
+	"t2a-standard-32": 1232,
+	"t2a-standard-48": 1848,
+}
+
+// machineType returns the machine type of the test VMs of the sharder.
+// Without --machtype or GCE_MACHTYPE, gce-xfstests picks the cheapest
+// machine type with the default 2 CPUs and 7.5GB of memory.
+func (sharder *ShardScheduler) machineType() string {
+	if machtype, ok := sharder.request.Get("--machtype"); ok {
+		return machtype
+	}
+	if machtype, err := gcp.GceConfig.Get("GCE_MACHTYPE"); err == nil && machtype != "" {
+		return machtype
+	}
+	if sharder.arch == "arm64" || sharder.kernelArch == "arm64" {
+		return "t2a-standard-2"
+	}
+	if sharder.request.Has("--local-ssd") || sharder.request.Has("--local-ssd-nvme") {
+		// e2 machine types have no local SSD
+		return "n1-standard-2"
+	}
+	return "e2-standard-2"
+}
+
+// shardDuration estimates the run time of a shard from the run times of its
+// tests in a prior run. It returns false if a config of the shard has no
+// run times.
+func (sharder *ShardScheduler) shardDuration(shard *ShardWorker) (time.Duration, bool) {
+	seconds := 0.0
+	for _, config := range strings.Split(shard.config, ",") {
+		times := sharder.testTimes[config]
+		if len(times) == 0 {
+			return 0, false
+		}
+		if shard.tests == nil {
+			for _, t := range times {
+				seconds += t
+			}
+			continue
+		}
+		for _, test := range shard.tests {
+			seconds += times[test]
+		}
+	}
+	return shardOverhead + time.Duration(seconds*float64(time.Second)).Round(time.Second), true
+}
+
+/*
+estimatePlan fills in the estimated run time and cost of a plan, if the run
+times of the tests of every shard are known from a prior run.
+
+The run time of the test run is the run time of its longest shard. The cost
+adds up the VM time of the shards for each of the kernels, at the price of
+the machine type. It is left out for machine types without a known price.
+*/
+func (sharder *ShardScheduler) estimatePlan(plan *server.ShardPlan, shards []*ShardWorker, kernels int) {
+	plan.MachineType = sharder.machineType()
+	durations := []time.Duration{}
+	for _, shard := range shards {
+		d, ok := sharder.shardDuration(shard)
+		if !ok {
+			return
+		}
+		durations = append(durations, d)
+	}
+
+	longest, vmTime := time.Duration(0), time.Duration(0)
+	for i, d := range durations {
+		plan.Shards[i].EstimatedTime = d.String()
+		vmTime += d
+		if d > longest {
+			longest = d
+		}
+	}
+	plan.EstimatedTime = longest.String()
+	if price, ok := machinePrices[plan.MachineType]; ok {
+		cost := vmTime.Hours() * float64(price*kernels) / 1000
+		plan.EstimatedCost = fmt.Sprintf("$%.2f", cost)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+
+	"thunk.org/gce-server/util/gcp"
+)
+
+/*
+quotaLedger tracks the GCE resources reserved for shards that are planned,
+but whose VMs GCE does not count yet.
+
+Quotas queried from GCE are reduced by the reservations in their region,
+so that test runs planned one after another do not count on the same free
+quota. A reservation is released once the VM of the shard is created, or
+when the shard exits without launching a VM.
+*/
+type quotaLedger struct {
+	reservations map[string]reservation
+	lock         sync.Mutex
+}
+
+// reservation holds the resources reserved for a shard in a zone.
+type reservation struct {
+	zone      string
+	resources gcp.Resources
+}
+
+var ledger = quotaLedger{reservations: make(map[string]reservation)}
+
+// regionOf returns the region of a zone, assuming a zone looks like
+// us-central1-f and a region looks like us-central1.
+func regionOf(zone string) string {
+	return zone[:len(zone)-2]
+}
+
+// reserve reserves resources in a zone for the shard with a VM name.
+func (l *quotaLedger) reserve(name string, zone string, resources gcp.Resources) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.reservations[name] = reservation{zone, resources}
+}
+
+// release releases the reservation of a shard. It does nothing if the
+// shard has no reservation.
+func (l *quotaLedger) release(name string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.reservations, name)
+}
+
+// reserved returns the resources reserved in a region.
+func (l *quotaLedger) reserved(region string) gcp.Resources {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	total := gcp.Resources{}
+	for _, r := range l.reservations {
+		if regionOf(r.zone) == region {
+			total = total.Add(r.resources)
+		}
+	}
+	return total
+}
+
+// apply takes the resources reserved in the region of a quota from it.
+func (l *quotaLedger) apply(quota *gcp.Quota) {
+	quota.Available = quota.Available.Sub(l.reserved(regionOf(quota.Zone)))
+}
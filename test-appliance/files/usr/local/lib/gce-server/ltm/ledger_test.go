@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"thunk.org/gce-server/util/gcp"
+)
+
+func TestQuotaLedger(t *testing.T) {
+	l := quotaLedger{reservations: make(map[string]reservation)}
+	shard := gcp.Resources{CPUs: 2, IPs: 1, SSD: 50}
+	l.reserve("xfstests-ltm-1-aa", "us-central1-a", shard)
+	l.reserve("xfstests-ltm-1-ab", "us-central1-b", shard)
+	l.reserve("xfstests-ltm-1-ac", "europe-west1-b", shard)
+
+	quota := &gcp.Quota{
+		Zone:      "us-central1-f",
+		Available: gcp.Resources{CPUs: 8, IPs: 8, SSD: 1000},
+		Shard:     shard,
+	}
+	l.apply(quota)
+	if maxShard, err := quota.GetMaxShard(); err != nil || maxShard != 2 {
+		t.Errorf("get %d shards after reservations, want 2", maxShard)
+	}
+
+	l.release("xfstests-ltm-1-aa")
+	l.release("xfstests-ltm-1-aa")
+	if reserved := l.reserved("us-central1"); reserved != shard {
+		t.Errorf("get %+v reserved after release, want %+v", reserved, shard)
+	}
+
+	quota.Available = gcp.Resources{CPUs: 2, IPs: 0, SSD: 1000}
+	l.apply(quota)
+	if maxShard, err := quota.GetMaxShard(); err != nil || maxShard != 0 {
+		t.Errorf("get %d shards from exhausted quota, want 0", maxShard)
+	}
+}
@@ -6,17 +6,33 @@ The endpoints are:
 
 	/login - authenticates a user session, implemented in server.go
 
+	/tokens, /reload, /audit - admin endpoints, implemented in server.go
+
+	All requests are recorded in the audit log, see audit.go in package server.
+
 	/gce-xfstests - takes in a json POST in the form of LTMRequest, and runs the
-	tests.
+	tests. Requires the submitter role.
+
+	/internal - handles internal requests from KCS server, authenticated by
+	the internal certificate of KCS.
+
+	/plan - takes in the same request as /gce-xfstests, and returns the
+	shards it would run without creating any VMs. Requires the submitter role.
 
-	/internal - handles internal requests from KCS server.
+	/schedules - creates, updates, deletes or lists the schedules of
+	recurring test runs, implemented in schedule.go. Requires the submitter
+	role.
 
-	/status - handles queries for running status from user.
+	/status - handles queries for running status from user. Requires the
+	viewer role.
 */
 package main
 
 import (
+	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
 
 	"thunk.org/gce-server/util/check"
 	"thunk.org/gce-server/util/logging"
@@ -29,7 +45,8 @@ import (
 /*
 runTests is the endpoint for a gce-xfstests test request from user.
 
-orig_cmdline is a base64 encoding of the command line arguments.
+orig_cmdline is a base64 encoding of the command line arguments, or plan
+is a test plan that is converted into the command line and options.
 A ShardScheduler is constructed to arrange the tests in multiple
 ShardWorkers, and then starts these shards in separate go routines.
 Returns the info generated by the sharder
@@ -63,19 +80,51 @@ func runTests(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
 		log.WithField("testID", testID).Info("KCS request, use existing testID")
 	}
 
+	admin := server.UserRole(r).Allows(server.AdminRole)
+	response := launchTest(c, testID, admin, log)
+
+	log.WithField("response", response).Info("Sending response")
+	err = server.SendResponse(w, r, response)
+	check.Panic(err, log, "Failed to send the response")
+}
+
+/*
+launchTest starts a test request with a given testID, and returns the
+response to send back. Requests from user are validated first, and admin
+tells whether the user may cancel or unwatch the tasks of other users.
+It is shared by runTests and the scheduled test runs.
+*/
+func launchTest(c server.TaskRequest, testID string, admin bool, log *logrus.Entry) server.SimpleResponse {
 	response := server.SimpleResponse{
 		Status: true,
 		TestID: testID,
 	}
 
-	if c.ExtraOptions == nil {
+	if c.ExtraOptions == nil && len(c.Plan) > 0 {
+		rejectRequest(&response, applyTestPlan(&c))
+	}
+
+	if response.Status && c.ExtraOptions == nil && c.Options.UnWatch == "" && c.Options.Cancel == "" && !logging.MOCK {
+		rejectRequest(&response, validateRequest(c))
+	}
+
+	if !response.Status {
+		log.WithField("errors", response.Errors).Info("Rejecting invalid test request")
+	} else if c.ExtraOptions == nil {
 		if c.Options.UnWatch != "" {
 			log.Info("User requests a git unwatch, terminating git repo monitor")
-			StopWatcher(c)
+			StopWatcher(c, admin)
 
 			response.Msg = "Git repo monitor terminated"
 			response.TestID = ""
 
+		} else if c.Options.Cancel != "" {
+			log.WithField("cancel", c.Options.Cancel).Info("User requests to cancel a test run")
+			CancelSharder(c, admin)
+
+			response.Msg = "Cancelling test run " + c.Options.Cancel
+			response.TestID = c.Options.Cancel
+
 		} else if c.Options.BranchName != "" {
 			log.Info("User requests a git watch, launching git repo monitor")
 			watcher := NewGitWatcher(c, testID)
@@ -92,6 +141,71 @@ func runTests(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
 			go ForwardKCS(c, testID)
 
 			response.Msg = "Calling KCS to initiate git bisect"
+			if c.Options.BisectBuild {
+				response.Msg = "Calling KCS to initiate git bisect on kernel builds"
+			}
+			if c.Options.BisectFix {
+				response.Msg += " for the fixing commit"
+			}
+
+		} else if c.Options.BuildOnly {
+			log.Info("User requests a build without tests, forwarding to KCS")
+			c.ExtraOptions = &server.InternalOptions{
+				TestID:    testID,
+				Requester: server.LTMBuildOnly,
+			}
+			go ForwardKCS(c, testID)
+
+			response.Msg = "Calling KCS to build kernel without tests"
+
+		} else if c.Options.BackportCommits != "" {
+			log.Info("User requests a stable backport test, forwarding to KCS")
+			if c.Options.ABCompare {
+				log.Info("Comparing against the stable baseline, launching A/B run")
+				ab := NewABRun(c, testID)
+				go ab.Run()
+
+				response.Msg = "Calling KCS to build stable baseline and backport queue"
+			} else {
+				c.ExtraOptions = &server.InternalOptions{
+					TestID:    testID,
+					Requester: server.LTMBackportTest,
+				}
+				go ForwardKCS(c, testID)
+
+				response.Msg = "Calling KCS to cherry-pick and build backport queue"
+			}
+
+		} else if c.Options.PatchMbox != "" || c.Options.MessageID != "" {
+			log.Info("User requests a patch series test, forwarding to KCS")
+			if c.Options.ABCompare {
+				log.Info("Comparing against the base commit, launching A/B run")
+				ab := NewABRun(c, testID)
+				go ab.Run()
+
+				response.Msg = "Calling KCS to build base commit and patch series"
+			} else {
+				c.ExtraOptions = &server.InternalOptions{
+					TestID:    testID,
+					Requester: server.LTMPatchTest,
+				}
+				go ForwardKCS(c, testID)
+
+				response.Msg = "Calling KCS to apply and build patch series"
+			}
+
+		} else if len(c.Options.KernelMatrix) > 0 {
+			log.Info("User requests a kernel matrix run, launching a test run for each kernel")
+			matrix := NewMatrixRun(c, testID)
+			rejectRequest(&response, matrix.prepare())
+			if response.Status {
+				go matrix.Run()
+
+				response.Msg = fmt.Sprintf("Launching kernel matrix run of %d kernels", len(c.Options.KernelMatrix))
+			} else {
+				log.WithField("errors", response.Errors).Info("Rejecting kernel matrix run with invalid kernels")
+				matrix.clean()
+			}
 
 		} else if c.Options.CommitID != "" {
 			log.Info("User requests a kernel build, forwarding to KCS")
@@ -103,6 +217,13 @@ func runTests(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
 
 			response.Msg = "Calling KCS to build kernel"
 		}
+
+	} else if c.ExtraOptions.Requester == server.KCSBuildFailure {
+		log.Info("KCS failed to build the kernel")
+		if siblings, variant := findSiblingRun(testID); siblings != nil {
+			siblings.Fail(variant)
+		}
+		response.Msg = "Build failure recorded"
 	}
 
 	if response.Msg == "" {
@@ -118,10 +239,49 @@ func runTests(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
 		} else {
 			sharder = NewShardScheduler(c, testID)
 			log.Info("Test sharder created")
-			go sharder.Run()
+			if c.ExtraOptions == nil {
+				rejectRequest(&response, sharder.validateKernel())
+			}
+			if response.Status {
+				sharder.register()
+				go sharder.Run()
+			} else {
+				log.WithField("errors", response.Errors).Info("Rejecting test request with invalid kernel")
+				sharder.discard()
+			}
 		}
 
-		response.Msg = "Launching tests"
+		if response.Status {
+			response.Msg = "Launching tests"
+		}
+	}
+	return response
+}
+
+/*
+plan is the endpoint for a dry run of a gce-xfstests test request.
+
+It returns the configs, the quota and the gce-xfstests arguments of each
+shard the request would run now. The kernel is only looked up if it is in
+GS, since a kernel built from a commit does not exist yet.
+*/
+func plan(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
+	log = log.WithField("endpoint", "/plan")
+
+	c, err := server.ParseTaskRequest(w, r)
+	check.Panic(err, log, "Failed to parse request")
+	log.WithFields(logrus.Fields{
+		"cmdLine": c.CmdLine,
+		"options": c.Options,
+	}).Info("Received dry run request")
+
+	// the log dir of a dry run is unique even for dry runs in the same second
+	logDir, err := os.MkdirTemp(logging.LTMLogDir, "dryrun-"+mymath.GetTimeStamp()+"-")
+	check.Panic(err, log, "Failed to create log dir")
+	defer os.RemoveAll(logDir)
+	response := PlanShards(c, filepath.Base(logDir))
+	if c.Options.CommitID != "" || c.Options.BranchName != "" {
+		response.Msg += "; the kernel would be built by KCS first"
 	}
 
 	log.WithField("response", response).Info("Sending response")
@@ -129,6 +289,18 @@ func runTests(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
 	check.Panic(err, log, "Failed to send the response")
 }
 
+// rejectRequest fails the response of a test request if there are
+// validation errors.
+func rejectRequest(response *server.SimpleResponse, errs []string) {
+	if len(errs) == 0 {
+		return
+	}
+	response.Status = false
+	response.TestID = ""
+	response.Msg = "Invalid test request"
+	response.Errors = errs
+}
+
 // status is the endpoint for querying running status.
 // It calls KCS to collect building and bisector status.
 func status(w http.ResponseWriter, r *http.Request, serverLog *logrus.Entry) {
@@ -141,6 +313,8 @@ func status(w http.ResponseWriter, r *http.Request, serverLog *logrus.Entry) {
 		Sharders:  SharderStatus(),
 		Watchers:  WatcherStatus(),
 		Bisectors: KCSStatus.Bisectors,
+		Builds:    KCSStatus.Builds,
+		Schedules: scheduleStore.List(),
 	}
 	log.WithField("response", response).Info("Sending response")
 
@@ -154,18 +328,31 @@ func main() {
 		panic(err)
 	}
 
-	s.Handler().Handle("/gce-xfstests", s.LoginHandler(s.FailureHandler(
-		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	s.Handler().Handle("/gce-xfstests", s.AuditHandler(s.LoginHandler(s.RoleHandler(server.SubmitterRole,
+		s.FailureHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			runTests(w, r, s.Log())
-		})))).Methods("POST")
-	s.Handler().Handle("/internal", s.FailureHandler(
+		})))))).Methods("POST")
+	s.Handler().Handle("/internal", s.AuditHandler(s.InternalHandler(server.KCSServer, s.FailureHandler(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			runTests(w, r, s.Log())
-		}))).Methods("POST")
-	s.Handler().Handle("/status", s.LoginHandler(s.FailureHandler(
-		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		}))))).Methods("POST")
+	s.Handler().Handle("/plan", s.AuditHandler(s.LoginHandler(s.RoleHandler(server.SubmitterRole,
+		s.FailureHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			plan(w, r, s.Log())
+		})))))).Methods("POST")
+	s.Handler().Handle("/schedules", s.AuditHandler(s.LoginHandler(s.RoleHandler(server.SubmitterRole,
+		s.FailureHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			schedules(w, r, s.Log())
+		})))))).Methods("POST")
+	s.Handler().Handle("/status", s.AuditHandler(s.LoginHandler(s.RoleHandler(server.ViewerRole,
+		s.FailureHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			status(w, r, s.Log())
-		})))).Methods("POST")
+		})))))).Methods("POST")
+
+	scheduleStore, err = NewScheduleStore(schedulesPath)
+	check.Panic(err, s.Log(), "Failed to load schedules")
 
+	go RunQueue()
+	go scheduleStore.Run(s.Log(), s.LookupRole)
 	s.Start()
 }
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"thunk.org/gce-server/util/email"
+	"thunk.org/gce-server/util/junit"
+	"thunk.org/gce-server/util/server"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MatrixRun tests several kernels with the same command line, and reports
+// the outcome of each test on each kernel. The kernel with index i is tested
+// by a sibling sharder with variant "k<i+1>". Kernels in GS are tested right
+// away, commits are built by KCS first.
+type MatrixRun struct {
+	*siblingBase
+	kernels  []server.MatrixKernel
+	sharders map[string]*ShardScheduler
+}
+
+// matrixResult holds the outcome of one kernel of a matrix run.
+type matrixResult struct {
+	Kernel string `json:"kernel"`
+	siblingResult
+}
+
+// MatrixReport is the machine readable report of a kernel matrix run.
+// Tests maps each test to its outcome on each kernel, in the order of
+// Kernels. The outcome is empty if the test did not run on a kernel.
+type MatrixReport struct {
+	TestID  string              `json:"test_id"`
+	Command string              `json:"command"`
+	Kernels []*matrixResult     `json:"kernels"`
+	Tests   map[string][]string `json:"tests"`
+}
+
+// NewMatrixRun constructs a new kernel matrix run from a test request.
+func NewMatrixRun(c server.TaskRequest, testID string) *MatrixRun {
+	m := &MatrixRun{
+		siblingBase: newSiblingBase(c, testID, "kernel matrix run", len(c.Options.KernelMatrix)),
+		kernels:     c.Options.KernelMatrix,
+		sharders:    make(map[string]*ShardScheduler),
+	}
+	m.register(m)
+	return m
+}
+
+// matrixVariant returns the variant of the kernel with index i.
+func matrixVariant(i int) string {
+	return fmt.Sprintf("k%d", i+1)
+}
+
+// matrixKernelRequest returns the test request of the kernel with index i
+// of a kernel matrix run.
+func matrixKernelRequest(c server.TaskRequest, i int) server.TaskRequest {
+	k := c.Options.KernelMatrix[i]
+	options := *c.Options
+	options.KernelMatrix = nil
+	options.GsKernel = k.GsKernel
+	options.CommitID = k.CommitID
+	if k.GitRepo != "" {
+		options.GitRepo = k.GitRepo
+	}
+	c.Options = &options
+	return c
+}
+
+// kernelRequest returns the test request of the kernel with index i, to be
+// built by KCS and tested on behalf of LTM.
+func (m *MatrixRun) kernelRequest(i int) server.TaskRequest {
+	c := matrixKernelRequest(m.testRequest, i)
+	c.ExtraOptions = &server.InternalOptions{
+		TestID:    m.testID + "-" + matrixVariant(i),
+		Requester: server.LTMBuild,
+	}
+	return c
+}
+
+// matrixSharders creates the sharders of the kernels in GS of a kernel
+// matrix run with newSharder, and checks that their kernels exist. The
+// sharders are indexed by variant. They are discarded if any kernel is
+// invalid, and the errors are returned instead.
+func matrixSharders(kernels []server.MatrixKernel, newSharder func(i int) *ShardScheduler) (map[string]*ShardScheduler, []string) {
+	sharders := make(map[string]*ShardScheduler)
+	errs := []string{}
+	for i, k := range kernels {
+		if k.GsKernel == "" {
+			continue
+		}
+		sharder := newSharder(i)
+		for _, err := range sharder.validateKernel() {
+			errs = append(errs, fmt.Sprintf("%s: %s", matrixVariant(i), err))
+		}
+		sharders[matrixVariant(i)] = sharder
+	}
+	if len(errs) > 0 {
+		for _, sharder := range sharders {
+			sharder.discard()
+		}
+		return make(map[string]*ShardScheduler), errs
+	}
+	return sharders, errs
+}
+
+// prepare creates the sharders of the kernels in GS, and checks that their
+// kernels exist. No sharder is kept if any kernel is invalid.
+func (m *MatrixRun) prepare() []string {
+	var errs []string
+	m.sharders, errs = matrixSharders(m.kernels, func(i int) *ShardScheduler {
+		return NewShardScheduler(matrixKernelRequest(m.testRequest, i), m.testID+"-"+matrixVariant(i))
+	})
+	return errs
+}
+
+// Run launches the sharders of the kernels in GS, asks KCS to build the
+// other kernels, and waits for all of them to finish before sending the
+// combined report.
+func (m *MatrixRun) Run() {
+	defer m.clean()
+
+	subject := "xfstests LTM kernel matrix run failure " + m.testID
+	defer email.ReportFailure(m.log, m.logFile, m.reportFailReceiver, subject)
+
+	for i, k := range m.kernels {
+		log := m.log.WithFields(logrus.Fields{
+			"variant": matrixVariant(i),
+			"kernel":  k.String(),
+		})
+		if sharder, ok := m.sharders[matrixVariant(i)]; ok {
+			log.Info("Launching test run")
+			sharder.register()
+			go sharder.Run()
+		} else {
+			log.Info("Forwarding kernel build to KCS")
+			c := m.kernelRequest(i)
+			go ForwardKCS(c, c.ExtraOptions.TestID)
+		}
+	}
+
+	m.wait(len(m.kernels))
+	m.report()
+}
+
+// Variants returns the variants of the kernels of a matrix run.
+func (m *MatrixRun) Variants() []string {
+	variants := make([]string, len(m.kernels))
+	for i := range m.kernels {
+		variants[i] = matrixVariant(i)
+	}
+	return variants
+}
+
+// report builds the outcome table of all kernels and sends the combined
+// email and json report.
+func (m *MatrixRun) report() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.log.Info("Generating kernel matrix report")
+
+	r := MatrixReport{
+		TestID:  m.testID,
+		Command: m.origCmd,
+	}
+	complete := true
+	outcomes := make([]map[string]junit.Outcome, len(m.kernels))
+	for i, k := range m.kernels {
+		result := &matrixResult{Kernel: k.String()}
+		if sibling, ok := m.results[matrixVariant(i)]; ok {
+			result.siblingResult = *sibling
+		}
+		r.Kernels = append(r.Kernels, result)
+
+		var ok bool
+		outcomes[i], ok = m.outcomes(matrixVariant(i))
+		complete = complete && ok
+	}
+	r.Tests = matrixTests(outcomes)
+	gsPath := m.uploadReport(r, "matrix")
+
+	content, failed := matrixSummary(r)
+	if !complete {
+		content += "\nResults are incomplete, check prior emails or log for errors\n"
+	}
+	content += fmt.Sprintf("\nJSON report: %s\n", gsPath)
+	subject := fmt.Sprintf("xfstests kernel matrix results %s-%s", server.LTMUserName, m.testID)
+	m.sendReport(subject, content, !complete || failed)
+}
+
+// matrixTests returns the outcome of each test on each kernel, given the
+// outcomes of each kernel. A kernel without results has nil outcomes.
+func matrixTests(outcomes []map[string]junit.Outcome) map[string][]string {
+	tests := make(map[string][]string)
+	for i, kernelOutcomes := range outcomes {
+		for test, outcome := range kernelOutcomes {
+			if _, ok := tests[test]; !ok {
+				tests[test] = make([]string, len(outcomes))
+			}
+			tests[test][i] = outcome.String()
+		}
+	}
+	return tests
+}
+
+/*
+matrixSummary formats the human readable part of the report. It lists the
+tests whose outcome differs between kernels, and the tests that failed on
+all kernels. Kernels without results are not compared. It also returns
+whether any test failed.
+*/
+func matrixSummary(r MatrixReport) (string, bool) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "============KERNEL MATRIX RUN %s============\n", r.TestID)
+	fmt.Fprintf(&b, "CMDLINE:\t%s\n\n", r.Command)
+
+	header := make([]string, len(r.Kernels))
+	for i, k := range r.Kernels {
+		header[i] = strings.ToUpper(matrixVariant(i))
+		if k.TestID != "" {
+			fmt.Fprintf(&b, "%s:\t%s\t%s\t%s\t%s\n", header[i], k.Kernel, k.TestID, k.KernelVersion, k.Result)
+		} else {
+			fmt.Fprintf(&b, "%s:\t%s\tno results, check prior emails or log for errors\n", header[i], k.Kernel)
+		}
+	}
+
+	// kernels without any results are left out of the comparison
+	hasResults := make([]bool, len(r.Kernels))
+	for _, row := range r.Tests {
+		for i, outcome := range row {
+			hasResults[i] = hasResults[i] || outcome != ""
+		}
+	}
+
+	var differ, failed []string
+	anyFailed := false
+	for test, row := range r.Tests {
+		same, fail := true, false
+		first := -1
+		for i, outcome := range row {
+			if !hasResults[i] {
+				continue
+			}
+			if first < 0 {
+				first = i
+			} else if outcome != row[first] {
+				same = false
+			}
+			if outcome == junit.Fail.String() || outcome == junit.Error.String() {
+				fail = true
+			}
+		}
+		anyFailed = anyFailed || fail
+		if !same {
+			differ = append(differ, test)
+		} else if fail {
+			failed = append(failed, test)
+		}
+	}
+	sort.Strings(differ)
+	sort.Strings(failed)
+
+	sections := []struct {
+		title string
+		tests []string
+	}{
+		{"DIFFERENT OUTCOMES", differ},
+		{"FAILED ON ALL KERNELS", failed},
+	}
+	for _, s := range sections {
+		fmt.Fprintf(&b, "\n%s (%d):\n", s.title, len(s.tests))
+		if len(s.tests) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\t%s\n", strings.Join(header, "\t"))
+		for _, test := range s.tests {
+			row := make([]string, len(r.Tests[test]))
+			for i, outcome := range r.Tests[test] {
+				row[i] = outcome
+				if outcome == "" {
+					row[i] = "-"
+				}
+			}
+			fmt.Fprintf(&b, "%s\t%s\n", test, strings.Join(row, "\t"))
+		}
+	}
+	return b.String(), anyFailed
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"thunk.org/gce-server/util/junit"
+	"thunk.org/gce-server/util/server"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestMatrixReport(t *testing.T) {
+	outcomes := []map[string]junit.Outcome{
+		{"ext4/4k:generic/001": junit.Pass, "ext4/4k:generic/002": junit.Fail, "ext4/4k:generic/003": junit.Fail},
+		{"ext4/4k:generic/001": junit.Fail, "ext4/4k:generic/002": junit.Fail},
+		nil,
+	}
+	expected := map[string][]string{
+		"ext4/4k:generic/001": {"pass", "fail", ""},
+		"ext4/4k:generic/002": {"fail", "fail", ""},
+		"ext4/4k:generic/003": {"fail", "", ""},
+	}
+	tests := matrixTests(outcomes)
+	if !reflect.DeepEqual(tests, expected) {
+		t.Fatalf("get tests %v, want %v", tests, expected)
+	}
+
+	r := MatrixReport{
+		TestID: "20260101000000",
+		Kernels: []*matrixResult{
+			{Kernel: "gs://bucket/bzImage-6.1", siblingResult: siblingResult{TestID: "20260101000000-k1"}},
+			{Kernel: "v6.6", siblingResult: siblingResult{TestID: "20260101000000-k2"}},
+			{Kernel: "v6.12"},
+		},
+		Tests: expected,
+	}
+	summary, failed := matrixSummary(r)
+	if !failed {
+		t.Errorf("expected failures in summary:\n%s", summary)
+	}
+	for _, s := range []string{
+		"K3:\tv6.12\tno results",
+		"DIFFERENT OUTCOMES (2):\n\tK1\tK2\tK3\n",
+		"ext4/4k:generic/001\tpass\tfail\t-\n",
+		"ext4/4k:generic/003\tfail\t-\t-\n",
+		"FAILED ON ALL KERNELS (1):\n\tK1\tK2\tK3\next4/4k:generic/002\tfail\tfail\t-\n",
+	} {
+		if !strings.Contains(summary, s) {
+			t.Errorf("summary does not contain %q:\n%s", s, summary)
+		}
+	}
+}
+
+func TestFindMatrixRun(t *testing.T) {
+	m := &MatrixRun{
+		siblingBase: &siblingBase{
+			testID:   "nightly-ext4",
+			results:  make(map[string]*siblingResult),
+			finished: make(chan string, 2),
+			log:      logrus.NewEntry(logrus.New()),
+		},
+		kernels: make([]server.MatrixKernel, 2),
+	}
+	siblingRunMap[m.testID] = m
+	defer delete(siblingRunMap, m.testID)
+
+	for _, test := range []struct {
+		testID  string
+		variant string
+	}{
+		{"nightly-ext4-k1", "k1"},
+		{"nightly-ext4-k2", "k2"},
+		{"nightly-ext4-k3", ""},
+		{"nightly-ext4-k0", ""},
+		{"nightly-ext4-k01", ""},
+		{"nightly-ext4-base", ""},
+		{"nightly-k1", ""},
+		{"nightly", ""},
+	} {
+		found, variant := findSiblingRun(test.testID)
+		if variant != test.variant || (found != nil) != (test.variant != "") {
+			t.Errorf("get matrix run %v and variant %q for %s, want %q", found, variant, test.testID, test.variant)
+		}
+		if found != nil && found != m {
+			t.Errorf("get sibling run %v for %s, want the matrix run", found, test.testID)
+		}
+	}
+
+	m.Fail("k2")
+	m.Fail("k2")
+	if len(m.finished) != 1 || m.results["k2"].Result != "error" || m.results["k2"].TestID != "nightly-ext4-k2" {
+		t.Errorf("get %d finished kernels and %+v after a build failure", len(m.finished), m.results["k2"])
+	}
+}
+
+func TestMatrixShardersInvalid(t *testing.T) {
+	kernels := []server.MatrixKernel{
+		{GsKernel: "/tmp/bzImage"},
+		{CommitID: "v6.6"},
+		{GsKernel: "gs://bucket"},
+	}
+	created := []*ShardScheduler{}
+	newSharder := func(i int) *ShardScheduler {
+		if kernels[i].GsKernel == "" {
+			t.Errorf("sharder created for kernel %d built from a commit", i)
+		}
+		sharder := newTestSharder(t, "matrix-"+matrixVariant(i), nil)
+		sharder.gsKernel = kernels[i].GsKernel
+		created = append(created, sharder)
+		return sharder
+	}
+
+	sharders, errs := matrixSharders(kernels, newSharder)
+	expected := []string{
+		"k1: failed to look up kernel /tmp/bzImage: not a gs:// path",
+		"k3: failed to look up kernel gs://bucket: no object name in path",
+	}
+	if len(sharders) != 0 || !slices.Equal(errs, expected) {
+		t.Errorf("get sharders %v and errors %q, want %q", sharders, errs, expected)
+	}
+	for _, sharder := range created {
+		if _, err := os.Stat(sharder.logDir); !os.IsNotExist(err) {
+			t.Errorf("log dir of discarded sharder %s not removed: %v", sharder.testID, err)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	"thunk.org/gce-server/util/gcp"
 	"thunk.org/gce-server/util/logging"
+	"thunk.org/gce-server/util/parser"
 	"thunk.org/gce-server/util/server"
 )
 
@@ -34,9 +35,9 @@ type JsonSharder struct {
 	AggDir  string
 	AggFile string
 
-	ValidArgs []string
-	Configs   []string
-	Shards    []JsonShard
+	Request *parser.Request
+	Configs []string
+	Shards  []JsonShard
 }
 
 type JsonShard struct {
@@ -44,6 +45,7 @@ type JsonShard struct {
 	Name               string
 	Zone               string
 	Config             string
+	Slice              string
 	Args               []string
 	LogPath            string
 	CmdLogPath         string
@@ -75,8 +77,8 @@ func (sharder *ShardScheduler) Dump(filename string) {
 		AggDir:  sharder.aggDir,
 		AggFile: sharder.aggFile,
 
-		ValidArgs: sharder.validArgs,
-		Configs:   sharder.configs,
+		Request: sharder.request,
+		Configs: sharder.configs,
 	}
 	for _, shard := range sharder.shards {
 		mock.Shards = append(mock.Shards, shard.Dump())
@@ -92,6 +94,7 @@ func (shard *ShardWorker) Dump() JsonShard {
 		Name:               shard.name,
 		Zone:               shard.zone,
 		Config:             shard.config,
+		Slice:              shard.slice,
 		Args:               shard.args,
 		LogPath:            shard.logPath,
 		CmdLogPath:         shard.cmdLogPath,
@@ -109,6 +112,7 @@ func (mock JsonShard) Read(sharder *ShardScheduler) *ShardWorker {
 		name:               mock.Name,
 		zone:               mock.Zone,
 		config:             mock.Config,
+		slice:              mock.Slice,
 		args:               mock.Args,
 		logPath:            mock.LogPath,
 		cmdLogPath:         mock.CmdLogPath,
@@ -146,8 +150,8 @@ func ReadSharder(filename string) *ShardScheduler {
 		aggDir:  mock.AggDir,
 		aggFile: mock.AggFile,
 
-		validArgs: mock.ValidArgs,
-		configs:   mock.Configs,
+		request: mock.Request,
+		configs: mock.Configs,
 	}
 
 	sharder.gce, _ = gcp.NewService(sharder.gsBucket)
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"thunk.org/gce-server/util/check"
+	"thunk.org/gce-server/util/logging"
+	"thunk.org/gce-server/util/mymath"
+	"thunk.org/gce-server/util/server"
+)
+
+/*
+PlanShards is a dry run of a test request.
+
+It validates the request, parses the command line into configs, looks up the GCE quota with the
+sharding strategy of the request, and splits the configs among the shards
+that would be launched now, without creating any VMs. The fair share of the
+user is not applied, since it depends on the other runs at launch time.
+The run time and cost are estimated with the test run times of the prior
+run given with --split-results.
+*/
+func PlanShards(c server.TaskRequest, testID string) server.ShardPlan {
+	plan := server.ShardPlan{Status: false}
+	if len(c.Plan) > 0 {
+		plan.Errors = applyTestPlan(&c)
+	}
+	if len(plan.Errors) == 0 {
+		plan.Errors = validateRequest(c)
+	}
+	if len(plan.Errors) > 0 {
+		plan.Msg = "Invalid test request"
+		return plan
+	}
+
+	matrix := c.Options.KernelMatrix
+	if len(matrix) > 0 {
+		plan.Errors = planMatrixKernels(c, testID)
+		if len(plan.Errors) > 0 {
+			plan.Msg = "Invalid test request"
+			return plan
+		}
+		// all the kernels run the same shards, which are planned with the first
+		c = matrixKernelRequest(c, 0)
+	}
+
+	sharder := NewShardScheduler(c, testID)
+	defer sharder.discard()
+	if c.Options.CommitID == "" && c.Options.BranchName == "" {
+		plan.Errors = sharder.validateKernel()
+		if len(plan.Errors) > 0 {
+			plan.Msg = "Invalid test request"
+			return plan
+		}
+	}
+
+	zones, err := sharder.quotaZones(newQuotaCache())
+	check.Panic(err, sharder.log, "Failed to get quota")
+
+	plan = sharder.shardPlan(zones, mymath.MaxInt(1, len(matrix)))
+	sharder.log.WithField("plan", plan).Info("Planned shards")
+	return plan
+}
+
+// shardPlan returns the shards the sharder would launch in zones, for each
+// of the kernels of the test run.
+func (sharder *ShardScheduler) shardPlan(zones []string, kernels int) server.ShardPlan {
+	plan := server.ShardPlan{
+		Status:        true,
+		Command:       sharder.origCmd,
+		KernelVersion: sharder.kernelVersion,
+		KernelArch:    sharder.kernelArch,
+		RegionShard:   sharder.regionShard,
+		Configs:       sharder.configs,
+		Available:     len(zones),
+		Ideal:         sharder.idealShards(),
+		Shards:        []server.PlannedShard{},
+	}
+	if len(zones) == 0 {
+		plan.Msg = "GCE project is out of quota, the test run would be queued"
+		return plan
+	}
+
+	shards := sharder.planShards(zones)
+	for _, shard := range shards {
+		plan.Shards = append(plan.Shards, server.PlannedShard{
+			ID:     shard.shardID,
+			Config: shard.config,
+			Slice:  shard.slice,
+			Zone:   shard.zone,
+			Args:   shard.args,
+		})
+	}
+	plan.Msg = fmt.Sprintf("Would launch %d shards", len(plan.Shards))
+	if len(plan.Shards) < plan.Ideal {
+		plan.Msg += fmt.Sprintf(", fewer than the %d shards to run each config separately", plan.Ideal)
+	}
+	if kernels > 1 {
+		plan.Msg += fmt.Sprintf(", for each of the %d kernels of the matrix", kernels)
+	}
+	sharder.estimatePlan(&plan, shards, kernels)
+	if plan.EstimatedTime == "" {
+		plan.Msg += "; give a prior run with --split-tests and --split-results to estimate the run time"
+	}
+	return plan
+}
+
+// planMatrixKernels checks that the kernels in GS of a kernel matrix run
+// exist. Kernels built from commits are not checked.
+func planMatrixKernels(c server.TaskRequest, testID string) []string {
+	sharders, errs := matrixSharders(c.Options.KernelMatrix, func(i int) *ShardScheduler {
+		return NewShardScheduler(matrixKernelRequest(c, i), testID+"-"+matrixVariant(i))
+	})
+	for _, sharder := range sharders {
+		sharder.discard()
+	}
+	return errs
+}
+
+// discard removes the local files of a sharder that is never run.
+func (sharder *ShardScheduler) discard() {
+	if sharder.gce != nil {
+		sharder.gce.Close()
+	}
+	logging.CloseLog(sharder.log)
+	os.RemoveAll(sharder.logDir)
+}
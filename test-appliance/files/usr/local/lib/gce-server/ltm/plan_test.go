@@ -0,0 +1,95 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"thunk.org/gce-server/util/parser"
+	"thunk.org/gce-server/util/server"
+)
+
+func TestPlanShardsInvalid(t *testing.T) {
+	c := server.TaskRequest{
+		CmdLine: parser.EncodeCmd("ltm -c ext4/4k generic/001"),
+		Options: &server.UserOptions{BuildOnly: true},
+	}
+	plan := PlanShards(c, "dryrun-invalid")
+	if plan.Status || plan.Msg != "Invalid test request" ||
+		!slices.Contains(plan.Errors, "--build-only requires --commit") {
+		t.Errorf("get plan %+v for an invalid request", plan)
+	}
+}
+
+func TestShardPlan(t *testing.T) {
+	configs := []string{"ext4/4k", "xfs/4k"}
+	sharder := newTestSharder(t, "dryrun-plan", configs)
+	req, err := parser.Parse("ltm -c ext4/4k,xfs/4k --machtype n1-standard-2 generic/001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharder.request = req
+
+	plan := sharder.shardPlan([]string{}, 1)
+	if !plan.Status || len(plan.Shards) != 0 || !strings.Contains(plan.Msg, "out of quota") {
+		t.Errorf("get plan %+v without quota", plan)
+	}
+
+	plan = sharder.shardPlan([]string{"us-central1-a", "us-central1-b"}, 1)
+	if len(plan.Shards) != 2 || plan.Available != 2 || plan.Ideal != 2 {
+		t.Fatalf("get plan %+v with enough quota", plan)
+	}
+	for i, zone := range []string{"us-central1-a", "us-central1-b"} {
+		shard := plan.Shards[i]
+		if shard.Config != configs[i] || shard.Zone != zone {
+			t.Errorf("shard %s runs %s in %s, want %s in %s", shard.ID, shard.Config, shard.Zone, configs[i], zone)
+		}
+	}
+
+	plan = sharder.shardPlan([]string{"us-central1-a"}, 1)
+	if len(plan.Shards) != 1 || plan.Shards[0].Config != "ext4/4k,xfs/4k" ||
+		!strings.Contains(plan.Msg, "fewer than the 2 shards") {
+		t.Errorf("get plan %+v with quota for a single shard", plan)
+	}
+
+	plan = sharder.shardPlan([]string{"us-central1-a", "us-central1-b"}, 3)
+	if len(plan.Shards) != 2 || !strings.Contains(plan.Msg, "for each of the 3 kernels") {
+		t.Errorf("get plan %+v for a kernel matrix run", plan)
+	}
+
+	plan = sharder.shardPlan([]string{"us-central1-a", "us-central1-a"}, 1)
+	if len(plan.Shards) != 2 || plan.Ideal != 2 || plan.EstimatedTime != "" || plan.EstimatedCost != "" {
+		t.Errorf("get plan %+v without test run times", plan)
+	}
+	if !strings.Contains(plan.Msg, "--split-results") {
+		t.Errorf("get message %q without test run times", plan.Msg)
+	}
+
+	sharder.testTimes = map[string]map[string]float64{
+		"ext4/4k": {"generic/001": 600, "generic/002": 600},
+		"xfs/4k":  {"generic/001": 1200},
+	}
+	tests := []struct {
+		zones   []string
+		kernels int
+		shards  []string
+		time    string
+		cost    string
+	}{
+		{[]string{"us-central1-a", "us-central1-b"}, 1, []string{"25m0s", "25m0s"}, "25m0s", "$0.08"},
+		{[]string{"us-central1-a"}, 1, []string{"45m0s"}, "45m0s", "$0.07"},
+		{[]string{"us-central1-a", "us-central1-b"}, 3, []string{"25m0s", "25m0s"}, "25m0s", "$0.24"},
+	}
+	for i, test := range tests {
+		plan := sharder.shardPlan(test.zones, test.kernels)
+		times := []string{}
+		for _, shard := range plan.Shards {
+			times = append(times, shard.EstimatedTime)
+		}
+		if !slices.Equal(times, test.shards) || plan.EstimatedTime != test.time ||
+			plan.EstimatedCost != test.cost || plan.MachineType != "n1-standard-2" {
+			t.Errorf("case %d: get shards %v, time %s and cost %s on %s, want %v, %s and %s on n1-standard-2",
+				i, times, plan.EstimatedTime, plan.EstimatedCost, plan.MachineType, test.shards, test.time, test.cost)
+		}
+	}
+}
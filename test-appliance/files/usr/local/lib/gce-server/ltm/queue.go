@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"thunk.org/gce-server/util/check"
+	"thunk.org/gce-server/util/gcp"
+	"thunk.org/gce-server/util/logging"
+	"thunk.org/gce-server/util/mymath"
+	"thunk.org/gce-server/util/server"
+
+	"github.com/sirupsen/logrus"
+)
+
+// queueCheckInterval is how often the queue rechecks GCE quota.
+const queueCheckInterval = 1 * time.Minute
+
+// sharderQueue holds the sharders waiting for GCE quota, ordered by
+// priority and then by submission time.
+var (
+	sharderQueue []*ShardScheduler
+	queueLock    sync.Mutex
+	queueNotify  = make(chan bool, 1)
+)
+
+// queueWait returns how long a queued test run waits for enough quota to
+// run every config in a separate shard before it starts with fewer shards.
+// It is read from GCE_LTM_QUEUE_WAIT, and defaults to not waiting.
+func queueWait(log *logrus.Entry) time.Duration {
+	wait, err := gcp.GceConfig.Get("GCE_LTM_QUEUE_WAIT")
+	if err != nil || wait == "" {
+		return 0
+	}
+	duration, err := time.ParseDuration(wait)
+	if !check.NoError(err, log, "Failed to parse GCE_LTM_QUEUE_WAIT") {
+		return 0
+	}
+	return duration
+}
+
+// shardBudget returns the number of shards LTM runs at the same time, which
+// is shared fairly among users. It is read from GCE_LTM_SHARD_BUDGET, and
+// is 0 if the budget is only limited by GCE quota.
+func shardBudget() int {
+	if val, err := gcp.GceConfig.Get("GCE_LTM_SHARD_BUDGET"); err == nil {
+		if n, err := strconv.Atoi(val); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+// fairShare returns how many more shards a user may start, given the shard
+// budget, the number of active users and the shards the user already runs.
+// Every user gets at least one shard.
+func fairShare(budget int, users int, running int) int {
+	share := mymath.MaxInt(1, budget/mymath.MaxInt(1, users))
+	return share - running
+}
+
+// sharderPriority returns the scheduling priority of a test request.
+// Test requests from users are ad-hoc runs.
+func sharderPriority(c server.TaskRequest) server.Priority {
+	if c.ExtraOptions == nil {
+		return server.AdHocPriority
+	}
+	return c.ExtraOptions.Priority
+}
+
+// admit queues the sharder until the queue scheduler creates its shards.
+// Returns false if the test run is cancelled while it is queued. The quota
+// reserved for a test run cancelled while it is admitted is released, since
+// its shards never run.
+func (sharder *ShardScheduler) admit() bool {
+	sharder.enqueue()
+	notifyQueue()
+
+	for {
+		select {
+		case <-sharder.admitted:
+			if sharder.cancelled() != "" {
+				sharder.log.Info("Test run cancelled while admitted")
+				sharder.releaseShards()
+				return false
+			}
+			return true
+		case <-time.After(queueCheckInterval):
+			if sharder.cancelled() != "" && sharder.dequeue() {
+				sharder.log.Info("Test run cancelled while queued")
+				return false
+			}
+		}
+	}
+}
+
+// enqueue adds the sharder to the queue after the sharders with the same
+// or a higher priority.
+func (sharder *ShardScheduler) enqueue() {
+	sharder.queued = time.Now()
+	sharder.admitted = make(chan bool)
+
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	sharderQueue = append(sharderQueue, sharder)
+	sort.SliceStable(sharderQueue, func(i, j int) bool {
+		return sharderQueue[i].priority > sharderQueue[j].priority
+	})
+}
+
+// dequeue removes the sharder from the queue, and returns whether it
+// was queued.
+func (sharder *ShardScheduler) dequeue() bool {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	for i, queued := range sharderQueue {
+		if queued == sharder {
+			sharderQueue = append(sharderQueue[:i], sharderQueue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// QueuePosition returns the position of the sharder in the queue starting
+// from 1, or 0 if it is not queued.
+func (sharder *ShardScheduler) QueuePosition() int {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	for i, queued := range sharderQueue {
+		if queued == sharder {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// notifyQueue wakes up the queue scheduler, e.g. when a sharder is queued
+// or its shards finish.
+func notifyQueue() {
+	select {
+	case queueNotify <- true:
+	default:
+	}
+}
+
+// RunQueue runs the queue scheduler, which admits queued sharders when
+// they are notified or every queueCheckInterval.
+func RunQueue() {
+	log := logging.InitLogger(logging.ServerLogPath).WithField("module", "queue")
+	ticker := time.NewTicker(queueCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-queueNotify:
+		case <-ticker.C:
+		}
+		scheduleQueue(log)
+	}
+}
+
+/*
+quotaCache holds the GCE quotas queried in one pass of the queue scheduler,
+so that all the queued sharders share one query of each quota. The quotas
+are kept as GCE returns them, and the reservations in the ledger are taken
+from a copy each time, since admitting a sharder reserves more quota.
+*/
+type quotaCache struct {
+	regions map[string]gcp.Quota
+	all     []gcp.Quota
+}
+
+func newQuotaCache() *quotaCache {
+	return &quotaCache{regions: make(map[string]gcp.Quota)}
+}
+
+// regionQuota returns the quota of a region less the reserved resources.
+func (cache *quotaCache) regionQuota(gce *gcp.Service, projID string, region string) (*gcp.Quota, error) {
+	quota, ok := cache.regions[region]
+	if !ok {
+		fetched, err := gce.GetRegionQuota(projID, region)
+		if err != nil {
+			return nil, err
+		}
+		quota = *fetched
+		cache.regions[region] = quota
+	}
+	ledger.apply(&quota)
+	return &quota, nil
+}
+
+// allQuotas returns the quotas of all regions less the reserved resources.
+func (cache *quotaCache) allQuotas(gce *gcp.Service, projID string) ([]*gcp.Quota, error) {
+	if cache.all == nil {
+		fetched, err := gce.GetAllRegionsQuota(projID)
+		if err != nil {
+			return nil, err
+		}
+		cache.all = []gcp.Quota{}
+		for _, quota := range fetched {
+			cache.all = append(cache.all, *quota)
+		}
+	}
+	quotas := []*gcp.Quota{}
+	for _, quota := range cache.all {
+		ledger.apply(&quota)
+		quotas = append(quotas, &quota)
+	}
+	return quotas, nil
+}
+
+/*
+scheduleQueue admits queued sharders in queue order.
+
+A sharder is admitted as soon as every config can run in a separate shard,
+or with as many shards as the quota allows once it has waited for
+GCE_LTM_QUEUE_WAIT. Besides quota, the shards of a user are limited to a fair
+share of the shard budget among the users with running or queued test runs.
+A sharder whose user has used up the fair share is skipped, so it does not
+block other users. Bisect steps are not limited by the fair share, since they
+are small and block the next step. The scheduler stops at the first sharder
+that waits for quota, so later sharders never overtake it.
+
+GCE quotas are queried once per pass. A panic in a pass is logged and does
+not stop the scheduler; a sharder that was being admitted is cancelled.
+*/
+func scheduleQueue(log *logrus.Entry) {
+	queueLock.Lock()
+	queue := append([]*ShardScheduler{}, sharderQueue...)
+	queueLock.Unlock()
+	if len(queue) == 0 {
+		return
+	}
+
+	var admitting *ShardScheduler
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithField("error", fmt.Sprint(r)).Error("Queue scheduler pass failed, get stack trace")
+			log.Error(string(debug.Stack()))
+			if admitting != nil {
+				admitting.Cancel("queue scheduler")
+				close(admitting.admitted)
+			}
+		}
+	}()
+
+	resources, err := gcp.ShardResources()
+	if !check.NoError(err, log, "Failed to get shard resources") {
+		return
+	}
+	running, users := runningShards(queue)
+	budget := shardBudget()
+	cache := newQuotaCache()
+	for _, sharder := range queue {
+		if sharder.cancelled() != "" {
+			continue
+		}
+		sharder.siblingLayout()
+		zones, err := sharder.quotaZones(cache)
+		if !check.NoError(err, log, "Failed to get quota") {
+			return
+		}
+
+		total := 0
+		for _, n := range running {
+			total += n
+		}
+		b := budget
+		if b == 0 {
+			b = total + len(zones)
+		}
+		limit, target := len(zones), sharder.idealShards()
+		if sharder.priority != server.BisectPriority {
+			share := fairShare(b, len(users), running[sharder.user])
+			if share <= 0 {
+				log.WithFields(logrus.Fields{
+					"testID": sharder.testID,
+					"user":   sharder.user,
+				}).Info("User has used up the fair share, skipping")
+				continue
+			}
+			limit = mymath.MinInt(limit, share)
+			target = mymath.MinInt(target, share)
+		}
+
+		sharderLog := log.WithFields(logrus.Fields{
+			"testID":    sharder.testID,
+			"available": len(zones),
+			"limit":     limit,
+			"ideal":     sharder.idealShards(),
+			"queued":    time.Since(sharder.queued).Round(time.Second),
+		})
+		numShards := sharder.admitShards(limit, target, queueWait(log))
+		if numShards == 0 {
+			sharderLog.Info("Waiting for GCE quota")
+			return
+		}
+		if numShards < target {
+			sharderLog.Info("Admitting test run with fewer shards than ideal")
+		} else {
+			sharderLog.Info("Admitting test run")
+		}
+		admitting = sharder
+		sharder.dequeue()
+		sharder.initShards(zones[:numShards], resources)
+		running[sharder.user] += len(sharder.shards)
+		close(sharder.admitted)
+		admitting = nil
+	}
+}
+
+/*
+admitShards returns the number of shards a queued sharder starts with, given
+the number of shards it may start now and its ideal number of shards, or 0 if
+it keeps waiting. A sharder with the fixed layout of a sibling run waits until
+all of its shards fit, since the layout cannot be shrunk.
+*/
+func (sharder *ShardScheduler) admitShards(limit int, target int, wait time.Duration) int {
+	if limit <= 0 {
+		return 0
+	}
+	if sharder.layout != nil {
+		if limit < len(sharder.layout) {
+			return 0
+		}
+		return len(sharder.layout)
+	}
+	if limit < target && time.Since(sharder.queued) < wait {
+		return 0
+	}
+	return limit
+}
+
+// runningShards returns the number of shards run by each user, and the
+// users with running or queued test runs.
+func runningShards(queue []*ShardScheduler) (map[string]int, map[string]bool) {
+	running := make(map[string]int)
+	users := make(map[string]bool)
+	for _, sharder := range queue {
+		users[sharder.user] = true
+	}
+	sharderLock.Lock()
+	defer sharderLock.Unlock()
+	for _, sharder := range sharderMap {
+		if len(sharder.shards) > 0 {
+			running[sharder.user] += len(sharder.shards)
+			users[sharder.user] = true
+		}
+	}
+	return running, users
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"thunk.org/gce-server/util/gcp"
+	"thunk.org/gce-server/util/server"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestQueueOrder(t *testing.T) {
+	adhoc := &ShardScheduler{testID: "adhoc", priority: server.AdHocPriority}
+	watcher := &ShardScheduler{testID: "watcher", priority: server.WatcherPriority}
+	bisect := &ShardScheduler{testID: "bisect", priority: server.BisectPriority}
+	adhoc2 := &ShardScheduler{testID: "adhoc2", priority: server.AdHocPriority}
+	for _, sharder := range []*ShardScheduler{adhoc, watcher, bisect, adhoc2} {
+		sharder.enqueue()
+	}
+	for i, sharder := range []*ShardScheduler{bisect, watcher, adhoc, adhoc2} {
+		if pos := sharder.QueuePosition(); pos != i+1 {
+			t.Errorf("sharder %s at position %d, want %d", sharder.testID, pos, i+1)
+		}
+	}
+
+	if !watcher.dequeue() || watcher.dequeue() {
+		t.Error("failed to dequeue sharder once")
+	}
+	if watcher.QueuePosition() != 0 || adhoc.QueuePosition() != 2 {
+		t.Errorf("get positions %d %d after dequeue, want 0 2", watcher.QueuePosition(), adhoc.QueuePosition())
+	}
+	for _, sharder := range []*ShardScheduler{adhoc, bisect, adhoc2} {
+		sharder.dequeue()
+	}
+	if len(sharderQueue) != 0 {
+		t.Errorf("queue not empty: %v", sharderQueue)
+	}
+}
+
+func TestFairShare(t *testing.T) {
+	tests := []struct {
+		budget, users, running, want int
+	}{
+		{80, 1, 0, 80},
+		{80, 2, 70, -30},
+		{80, 4, 10, 10},
+		{3, 4, 0, 1},
+		{3, 4, 1, 0},
+		{10, 0, 0, 10},
+	}
+	for _, test := range tests {
+		if got := fairShare(test.budget, test.users, test.running); got != test.want {
+			t.Errorf("fairShare(%d, %d, %d) = %d, want %d", test.budget, test.users, test.running, got, test.want)
+		}
+	}
+}
+
+func TestIdealShards(t *testing.T) {
+	sharder := &ShardScheduler{configs: []string{"ext4/4k", "ext4/1k", "xfs/4k"}}
+	if n := sharder.idealShards(); n != 3 {
+		t.Errorf("get %d ideal shards, want 3", n)
+	}
+	sharder.layout = []testSlice{{config: "ext4/4k,ext4/1k"}, {config: "xfs/4k"}}
+	if n := sharder.idealShards(); n != 2 {
+		t.Errorf("get %d ideal shards with layout, want 2", n)
+	}
+	sharder = &ShardScheduler{}
+	if n := sharder.idealShards(); n != 1 {
+		t.Errorf("get %d ideal shards without configs, want 1", n)
+	}
+}
+
+func TestAdmitShards(t *testing.T) {
+	queued := &ShardScheduler{queued: time.Now()}
+	waited := &ShardScheduler{queued: time.Now().Add(-time.Hour)}
+	sibling := &ShardScheduler{queued: time.Now().Add(-time.Hour), layout: make([]testSlice, 3)}
+	tests := []struct {
+		sharder       *ShardScheduler
+		limit, target int
+		want          int
+	}{
+		{queued, 0, 3, 0},
+		{queued, 4, 3, 4},
+		{queued, 2, 3, 0},
+		{waited, 2, 3, 2},
+		{sibling, 2, 3, 0},
+		{sibling, 3, 3, 3},
+		{sibling, 5, 3, 3},
+	}
+	for i, test := range tests {
+		if n := test.sharder.admitShards(test.limit, test.target, time.Minute); n != test.want {
+			t.Errorf("case %d: admitShards(%d, %d) = %d, want %d", i, test.limit, test.target, n, test.want)
+		}
+	}
+}
+
+func TestAdmitCancelled(t *testing.T) {
+	sharder := newTestSharder(t, "admit-cancel", []string{"ext4/4k", "xfs/4k"})
+	admitted := make(chan bool)
+	go func() {
+		admitted <- sharder.admit()
+	}()
+	for sharder.QueuePosition() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// cancel between the reservation and the start of the shards
+	sharder.dequeue()
+	shard := gcp.Resources{CPUs: 2, IPs: 1, SSD: 50}
+	sharder.initShards([]string{"us-west9-a", "us-west9-a"}, shard)
+	if reserved := ledger.reserved("us-west9"); reserved.CPUs != 4 {
+		t.Fatalf("get %+v reserved for admitted shards", reserved)
+	}
+	sharder.Cancel("admin")
+	close(sharder.admitted)
+
+	if <-admitted {
+		t.Error("cancelled test run admitted")
+	}
+	if reserved := ledger.reserved("us-west9"); reserved != (gcp.Resources{}) {
+		t.Errorf("get %+v reserved after cancel, want none", reserved)
+	}
+}
+
+func TestQuotaCache(t *testing.T) {
+	shard := gcp.Resources{CPUs: 2, IPs: 1, SSD: 50}
+	cache := newQuotaCache()
+	cache.regions["us-west8"] = gcp.Quota{
+		Zone:      "us-west8-a",
+		Available: gcp.Resources{CPUs: 8, IPs: 8, SSD: 1000},
+		Shard:     shard,
+	}
+	cache.all = []gcp.Quota{cache.regions["us-west8"]}
+	sharder := &ShardScheduler{
+		region: "us-west8",
+		zone:   "us-west8-a",
+		log:    logrus.NewEntry(logrus.New()),
+	}
+
+	for _, want := range []int{4, 3, 2} {
+		zones, err := sharder.quotaZones(cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(zones) != want {
+			t.Errorf("get %d zones from cached quota, want %d", len(zones), want)
+		}
+		// the next sharder in the pass sees the reservation
+		name := fmt.Sprintf("xfstests-ltm-cache-%d", want)
+		ledger.reserve(name, "us-west8-a", shard)
+		t.Cleanup(func() { ledger.release(name) })
+	}
+
+	sharder.regionShard = true
+	zones, err := sharder.quotaZones(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zones) != 1 || cache.all[0].Available.CPUs != 8 {
+		t.Errorf("get %d zones for region sharding and %d CPUs cached, want 1 and 8",
+			len(zones), cache.all[0].Available.CPUs)
+	}
+}
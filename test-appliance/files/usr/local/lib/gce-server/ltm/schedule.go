@@ -0,0 +1,502 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"thunk.org/gce-server/util/check"
+	"thunk.org/gce-server/util/cron"
+	"thunk.org/gce-server/util/email"
+	"thunk.org/gce-server/util/logging"
+	"thunk.org/gce-server/util/mymath"
+	"thunk.org/gce-server/util/parser"
+	"thunk.org/gce-server/util/server"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// schedulesPath stores the schedules, so that they are kept when LTM
+	// is relaunched.
+	schedulesPath = "/usr/local/lib/gce-server/.ltm_schedules.json"
+	// scheduleInterval defines the interval to check for due schedules.
+	scheduleInterval = 1 * time.Minute
+	// scheduleIDPrefix keeps the IDs and log dirs of schedules apart from
+	// the testIDs of test runs.
+	scheduleIDPrefix = "sched-"
+)
+
+/*
+Schedule submits a stored test request each time its cron expression
+matches, as if it was sent again by the user who created the schedule.
+Cron expressions are in UTC.
+
+A run is skipped if the previous run of the schedule is still running, or
+if that cannot be checked. A run is rejected if the user who created the
+schedule can no longer submit test runs. Runs missed while LTM is down are
+not made up.
+*/
+type Schedule struct {
+	ID         string             `json:"id"`
+	User       string             `json:"user"`
+	Cron       string             `json:"cron"`
+	Request    server.TaskRequest `json:"request"`
+	Created    time.Time          `json:"created"`
+	LastRun    time.Time          `json:"last_run"`
+	LastTestID string             `json:"last_test_id"`
+	LastStatus string             `json:"last_status"`
+
+	cron *cron.Schedule
+	next time.Time
+}
+
+// ScheduleStore keeps the schedules on disk.
+type ScheduleStore struct {
+	path      string
+	schedules map[string]*Schedule
+	lock      sync.Mutex
+}
+
+// scheduleStore holds the schedules of LTM, loaded by main.
+var scheduleStore *ScheduleStore
+
+// roleLookup returns the current role of a user, or false if the token of
+// the user was revoked, see server.Instance.LookupRole.
+type roleLookup func(user string) (server.Role, bool)
+
+// NewScheduleStore loads the schedules saved in path, if any.
+func NewScheduleStore(path string) (*ScheduleStore, error) {
+	store := &ScheduleStore{
+		path:      path,
+		schedules: make(map[string]*Schedule),
+	}
+	if !check.FileExists(path) {
+		return store, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(content, &store.schedules)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	for id, s := range store.schedules {
+		s.cron, err = cron.Parse(s.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %s: %v", id, err)
+		}
+		s.next = s.cron.Next(now)
+	}
+	return store, nil
+}
+
+/*
+checkSchedule validates the cron expression and the test request of a
+schedule, and returns an error message for each problem found. The request
+is checked as a request sent to /gce-xfstests, except for the kernel, which
+may change between the runs.
+*/
+func checkSchedule(expr string, c server.TaskRequest) (*cron.Schedule, []string) {
+	errs := []string{}
+	sched, err := cron.Parse(expr)
+	if err != nil {
+		errs = append(errs, err.Error())
+	} else if sched.Next(time.Now().UTC()).IsZero() {
+		errs = append(errs, fmt.Sprintf("cron expression %q never matches", expr))
+	}
+
+	o := c.Options
+	if o.UnWatch != "" || o.Cancel != "" {
+		errs = append(errs, "--unwatch and --cancel cannot be scheduled")
+	}
+	if o.BranchName != "" {
+		errs = append(errs, "--watch cannot be scheduled, a git watcher tests new commits already")
+	}
+	if o.BadCommit != "" || o.GoodCommit != "" {
+		errs = append(errs, "git bisect cannot be scheduled")
+	}
+	if strings.Contains(o.GsKernel, "-onerun") {
+		errs = append(errs, "a kernel uploaded for a single run cannot be scheduled, use a kernel in GS or --commit")
+	}
+
+	// the plan is applied again for each run, so apply it to a copy
+	options := *o
+	c.Options = &options
+	if len(c.Plan) > 0 {
+		if planErrs := applyTestPlan(&c); len(planErrs) > 0 {
+			return sched, append(errs, planErrs...)
+		}
+	}
+	return sched, append(errs, validateRequest(c)...)
+}
+
+// Create adds a schedule for user, and returns its ID.
+func (store *ScheduleStore) Create(user string, expr string, sched *cron.Schedule, c server.TaskRequest) (string, error) {
+	s := &Schedule{
+		ID:      scheduleIDPrefix + mymath.GetTimeStamp(),
+		User:    user,
+		Cron:    expr,
+		Request: c,
+		Created: time.Now(),
+		cron:    sched,
+		next:    sched.Next(time.Now().UTC()),
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if _, ok := store.schedules[s.ID]; ok {
+		return "", fmt.Errorf("schedule %s already exists", s.ID)
+	}
+	store.schedules[s.ID] = s
+	err := store.save()
+	if err != nil {
+		delete(store.schedules, s.ID)
+		return "", err
+	}
+	return s.ID, nil
+}
+
+// Update replaces the cron expression and the test request of a schedule.
+// Only admins can update schedules created by other users. The user who
+// updates a schedule owns it afterwards, since runs are launched with the
+// request given by that user.
+func (store *ScheduleStore) Update(id string, user string, admin bool, expr string, sched *cron.Schedule, c server.TaskRequest) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	s, ok := store.schedules[id]
+	if !ok {
+		return fmt.Errorf("no schedule with ID %s", id)
+	}
+	if s.User != user && !admin {
+		return fmt.Errorf("only admins can update schedules created by other users")
+	}
+
+	old := *s
+	s.User = user
+	s.Cron = expr
+	s.Request = c
+	s.cron = sched
+	s.next = sched.Next(time.Now().UTC())
+	err := store.save()
+	if err != nil {
+		*s = old
+		return err
+	}
+	return nil
+}
+
+// Delete removes a schedule. Only admins can delete schedules created by
+// other users. A run launched by the schedule is not cancelled.
+func (store *ScheduleStore) Delete(id string, user string, admin bool) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	s, ok := store.schedules[id]
+	if !ok {
+		return fmt.Errorf("no schedule with ID %s", id)
+	}
+	if s.User != user && !admin {
+		return fmt.Errorf("only admins can delete schedules created by other users")
+	}
+	delete(store.schedules, id)
+	err := store.save()
+	if err != nil {
+		store.schedules[id] = s
+		return err
+	}
+	return nil
+}
+
+// List returns the info of the schedules sorted by ID.
+func (store *ScheduleStore) List() []server.ScheduleInfo {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	infoList := []server.ScheduleInfo{}
+	for _, s := range store.schedules {
+		infoList = append(infoList, s.Info())
+	}
+	sort.Slice(infoList, func(i, j int) bool {
+		return infoList[i].ID < infoList[j].ID
+	})
+	return infoList
+}
+
+// Run checks for due schedules every scheduleInterval, and launches their
+// test runs. The roles of the users are looked up with roles.
+func (store *ScheduleStore) Run(log *logrus.Entry, roles roleLookup) {
+	log = log.WithField("component", "scheduler")
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		store.runDue(now.UTC(), log, roles)
+	}
+}
+
+// runDue launches the runs of the schedules due at now, one by one. The
+// store is not locked while a run is launched.
+func (store *ScheduleStore) runDue(now time.Time, log *logrus.Entry, roles roleLookup) {
+	store.lock.Lock()
+	due := []Schedule{}
+	for _, s := range store.schedules {
+		if !s.next.IsZero() && !s.next.After(now) {
+			s.next = s.cron.Next(now)
+			due = append(due, *s)
+		}
+	}
+	store.lock.Unlock()
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].ID < due[j].ID
+	})
+
+	for _, s := range due {
+		log.WithField("scheduleID", s.ID).Info("Schedule is due")
+		testID, status := s.launch(roles)
+
+		store.lock.Lock()
+		if current, ok := store.schedules[s.ID]; ok {
+			current.LastRun = now
+			current.LastStatus = status
+			if testID != "" {
+				current.LastTestID = testID
+			}
+			err := store.save()
+			check.NoError(err, log, "Failed to save schedules")
+		}
+		store.lock.Unlock()
+	}
+}
+
+/*
+launch submits the test request of a schedule, unless the previous run is
+still running. It returns the testID of the new run, or an empty string if
+nothing was launched, and the status shown by ltm-info.
+
+The log of the schedule is kept in its own log dir. Failures are reported
+to the report receivers of the request.
+*/
+func (s Schedule) launch(roles roleLookup) (testID string, status string) {
+	logDir := logging.LTMLogDir + s.ID + "/"
+	err := check.CreateDir(logDir)
+	if err != nil {
+		return "", "failed to create log dir: " + err.Error()
+	}
+	logFile := logDir + "run.log"
+	log := logging.InitLogger(logFile)
+	defer logging.CloseLog(log)
+
+	status = "failed to launch, see " + logFile
+	subject := "xfstests LTM schedule failure " + s.ID
+	defer email.ReportFailure(log, logFile, s.Request.Options.ReportFailEmail, subject)
+
+	if err := checkCreator(s.User, roles); err != nil {
+		status = "rejected: " + err.Error()
+		log.WithError(err).Panic("Schedule creator cannot submit test runs")
+	}
+
+	if s.LastTestID != "" {
+		active, err := testActive(s.LastTestID, func() ([]string, error) {
+			return kcsBuilds(log)
+		})
+		if err != nil {
+			log.WithError(err).Warn("Failed to check the previous run, skipping")
+			return "", "skipped, failed to check if " + s.LastTestID + " is still running"
+		}
+		if active {
+			log.WithField("lastTestID", s.LastTestID).Info("Previous run is still running, skipping")
+			return "", "skipped, " + s.LastTestID + " is still running"
+		}
+	}
+
+	// copy the options since launchTest may change them
+	c := s.Request
+	options := *c.Options
+	c.Options = &options
+
+	runID := mymath.GetTimeStamp()
+	log.WithField("testID", runID).Info("Launching scheduled test run")
+	response := launchTest(c, runID, false, log)
+	if !response.Status {
+		status = "rejected: " + strings.Join(response.Errors, "; ")
+		log.WithField("errors", response.Errors).Panic("Scheduled test run rejected")
+	}
+	return response.TestID, response.Msg
+}
+
+// checkCreator returns an error if the user who created a schedule can no
+// longer submit test runs, because the token of the user was revoked or
+// the role of the user was lowered.
+func checkCreator(user string, roles roleLookup) error {
+	role, ok := roles(user)
+	if !ok {
+		return fmt.Errorf("the token of %s was revoked", user)
+	}
+	if !role.Allows(server.SubmitterRole) {
+		return fmt.Errorf("%s is a %s, not a submitter", user, role)
+	}
+	return nil
+}
+
+// kcsBuilds returns the IDs of the builds in KCS. InternalQuery panics if
+// KCS does not respond, which is returned as an error.
+func kcsBuilds(log *logrus.Entry) (ids []string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if entry, ok := r.(*logrus.Entry); ok {
+				r = entry.Message
+			}
+			err = fmt.Errorf("failed to query KCS: %v", r)
+		}
+	}()
+	for _, build := range server.InternalQuery(log).Builds {
+		ids = append(ids, build.ID)
+	}
+	return ids, nil
+}
+
+// testActive returns whether a test run, or a part of it such as a variant
+// of an A/B or kernel matrix run, is still running in LTM or building in KCS.
+// The builds in KCS are queried with builds.
+func testActive(testID string, builds func() ([]string, error)) (bool, error) {
+	match := func(id string) bool {
+		return id == testID || strings.HasPrefix(id, testID+"-")
+	}
+
+	sharderLock.Lock()
+	for id := range sharderMap {
+		if match(id) {
+			sharderLock.Unlock()
+			return true, nil
+		}
+	}
+	sharderLock.Unlock()
+
+	siblingRunLock.Lock()
+	for id := range siblingRunMap {
+		if match(id) {
+			siblingRunLock.Unlock()
+			return true, nil
+		}
+	}
+	siblingRunLock.Unlock()
+
+	ids, err := builds()
+	if err != nil {
+		return false, err
+	}
+	return slices.ContainsFunc(ids, match), nil
+}
+
+// Info returns structured schedule information.
+func (s *Schedule) Info() server.ScheduleInfo {
+	command, _ := parser.DecodeCmd(s.Request.CmdLine)
+	info := server.ScheduleInfo{
+		ID:         s.ID,
+		User:       s.User,
+		Cron:       s.Cron,
+		Command:    command,
+		LastTestID: s.LastTestID,
+		LastStatus: s.LastStatus,
+	}
+	if !s.next.IsZero() {
+		info.NextRun = s.next.Format(time.RFC3339)
+	}
+	if !s.LastRun.IsZero() {
+		info.LastRun = s.LastRun.Format(time.RFC3339)
+	}
+	return info
+}
+
+// save writes the schedules to disk. The caller must hold the store lock.
+func (store *ScheduleStore) save() error {
+	js, err := json.MarshalIndent(store.schedules, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmpFile := store.path + ".tmp"
+	err = os.WriteFile(tmpFile, js, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, store.path)
+}
+
+/*
+schedules is the endpoint to create, update, delete or list the schedules
+of recurring test runs. The request of a schedule is validated like a
+request sent to /gce-xfstests. Only admins can update or delete schedules
+created by other users.
+*/
+func schedules(w http.ResponseWriter, r *http.Request, log *logrus.Entry) {
+	log = log.WithField("endpoint", "/schedules")
+
+	var c server.ScheduleRequest
+	err := json.NewDecoder(r.Body).Decode(&c)
+	check.Panic(err, log, "Failed to parse json request")
+	log = log.WithFields(logrus.Fields{
+		"action": c.Action,
+		"id":     c.ID,
+		"cron":   c.Cron,
+	})
+	log.Info("Received schedule request")
+
+	user := server.User(r)
+	admin := server.UserRole(r).Allows(server.AdminRole)
+	response := server.ScheduleResponse{Status: true}
+
+	switch c.Action {
+	case "create", "update":
+		if c.Request.ExtraOptions != nil {
+			log.Panic("Internal options cannot be scheduled")
+		}
+		c.Request.User = user
+		if c.Request.Options == nil {
+			c.Request.Options = &server.UserOptions{}
+		}
+		// each run gets a new testID
+		c.Request.Options.TestRunID = ""
+		if c.Request.Options.ReportFailEmail == "" {
+			c.Request.Options.ReportFailEmail = c.Request.Options.ReportEmail
+		}
+
+		sched, errs := checkSchedule(c.Cron, c.Request)
+		if len(errs) > 0 {
+			log.WithField("errors", errs).Info("Rejecting invalid schedule")
+			response.Status = false
+			response.Msg = "Invalid schedule"
+			response.Errors = errs
+			break
+		}
+		if c.Action == "create" {
+			response.ID, err = scheduleStore.Create(user, c.Cron, sched, c.Request)
+			check.Panic(err, log, "Failed to create schedule")
+			response.Msg = "Created schedule " + response.ID
+		} else {
+			err = scheduleStore.Update(c.ID, user, admin, c.Cron, sched, c.Request)
+			check.Panic(err, log, "Failed to update schedule")
+			response.ID = c.ID
+			response.Msg = "Updated schedule " + c.ID
+		}
+	case "delete":
+		err = scheduleStore.Delete(c.ID, user, admin)
+		check.Panic(err, log, "Failed to delete schedule")
+		response.Msg = "Deleted schedule " + c.ID
+	case "list":
+		response.Schedules = scheduleStore.List()
+		response.Msg = fmt.Sprintf("%d schedules", len(response.Schedules))
+	default:
+		log.Panic("Unknown schedule action")
+	}
+
+	log.WithField("response", response).Info("Sending response")
+	err = server.SendResponse(w, r, response)
+	check.Panic(err, log, "Failed to send the response")
+}
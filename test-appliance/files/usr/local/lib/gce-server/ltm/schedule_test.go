@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"thunk.org/gce-server/util/parser"
+	"thunk.org/gce-server/util/server"
+)
+
+func TestCheckSchedule(t *testing.T) {
+	c := server.TaskRequest{
+		CmdLine: parser.EncodeCmd("ltm -g quick --commit dev"),
+		Options: &server.UserOptions{CommitID: "dev", GitRepo: "https://example.com/linux.git"},
+	}
+	if _, errs := checkSchedule("0 2 * * *", c); len(errs) != 0 {
+		t.Errorf("get errors %q for a valid schedule", errs)
+	}
+
+	c.Options = &server.UserOptions{BranchName: "dev", GsKernel: "gs://bucket/user-20260101000000-onerun.bzImage"}
+	expected := []string{
+		`cron expression "0 2 * *" must have 5 fields`,
+		"--watch cannot be scheduled, a git watcher tests new commits already",
+		"a kernel uploaded for a single run cannot be scheduled, use a kernel in GS or --commit",
+	}
+	if _, errs := checkSchedule("0 2 * *", c); !reflect.DeepEqual(errs, expected) {
+		t.Errorf("get errors %q, want %q", errs, expected)
+	}
+
+	c.Options = &server.UserOptions{}
+	if _, errs := checkSchedule("0 0 30 2 *", c); len(errs) != 1 {
+		t.Errorf("get errors %q for a cron expression that never matches", errs)
+	}
+}
+
+func TestScheduleStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedules.json")
+	store, err := NewScheduleStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := server.TaskRequest{
+		CmdLine: parser.EncodeCmd("ltm -g auto"),
+		Options: &server.UserOptions{GsKernel: "gs://bucket/bzImage"},
+	}
+	sched, errs := checkSchedule("@daily", c)
+	if len(errs) != 0 {
+		t.Fatalf("get errors %q for a valid schedule", errs)
+	}
+	id, err := store.Create("alice", "@daily", sched, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(id, scheduleIDPrefix) {
+		t.Errorf("get schedule ID %s, which may collide with a testID", id)
+	}
+	if err := store.Delete(id, "bob", false); err == nil {
+		t.Errorf("expected error when deleting the schedule of another user")
+	}
+
+	store, err = NewScheduleStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infoList := store.List()
+	if len(infoList) != 1 || infoList[0].ID != id || infoList[0].Command != "ltm -g auto" || infoList[0].NextRun == "" {
+		t.Fatalf("get schedules %+v after reloading", infoList)
+	}
+
+	if err := store.Delete(id, "bob", true); err != nil {
+		t.Error(err)
+	}
+	if len(store.List()) != 0 {
+		t.Errorf("schedule %s not deleted", id)
+	}
+}
+
+func TestScheduleUpdate(t *testing.T) {
+	store, err := NewScheduleStore(filepath.Join(t.TempDir(), "schedules.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := server.TaskRequest{
+		CmdLine: parser.EncodeCmd("ltm -g auto"),
+		Options: &server.UserOptions{GsKernel: "gs://bucket/bzImage"},
+		User:    "alice",
+	}
+	sched, errs := checkSchedule("@daily", c)
+	if len(errs) != 0 {
+		t.Fatalf("get errors %q for a valid schedule", errs)
+	}
+	id, err := store.Create("alice", "@daily", sched, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.CmdLine = parser.EncodeCmd("ltm -g quick")
+	c.User = "bob"
+	if err := store.Update(id, "bob", false, "@daily", sched, c); err == nil {
+		t.Errorf("expected error when updating the schedule of another user")
+	}
+	if err := store.Update(id, "bob", true, "@daily", sched, c); err != nil {
+		t.Fatal(err)
+	}
+	s := store.schedules[id]
+	if s.User != "bob" || s.Request.User != "bob" || s.Info().Command != "ltm -g quick" {
+		t.Errorf("get schedule of %s with request of %s for %q after an admin update",
+			s.User, s.Request.User, s.Info().Command)
+	}
+}
+
+func TestCheckCreator(t *testing.T) {
+	roles := func(user string) (server.Role, bool) {
+		role, ok := map[string]server.Role{
+			"alice": server.SubmitterRole,
+			"bob":   server.ViewerRole,
+		}[user]
+		return role, ok
+	}
+	tests := []struct {
+		user string
+		ok   bool
+	}{
+		{"alice", true},
+		{"bob", false},
+		{"carol", false},
+	}
+	for _, test := range tests {
+		if err := checkCreator(test.user, roles); (err == nil) != test.ok {
+			t.Errorf("checkCreator(%s) = %v", test.user, err)
+		}
+	}
+}
+
+func TestTestActive(t *testing.T) {
+	builds := func() ([]string, error) {
+		return []string{"20260101000000-b"}, nil
+	}
+	failed := func() ([]string, error) {
+		return nil, errors.New("failed to query KCS")
+	}
+	tests := []struct {
+		testID string
+		builds func() ([]string, error)
+		active bool
+		err    bool
+	}{
+		{"20260101000000", builds, true, false},
+		{"2026010100000", builds, false, false},
+		{"20260102000000", builds, false, false},
+		{"20260101000000", failed, false, true},
+	}
+	for _, test := range tests {
+		active, err := testActive(test.testID, test.builds)
+		if active != test.active || (err != nil) != test.err {
+			t.Errorf("testActive(%s) = %v, %v", test.testID, active, err)
+		}
+	}
+}
@@ -21,6 +21,7 @@ import (
 
 	"thunk.org/gce-server/util/check"
 	"thunk.org/gce-server/util/gcp"
+	"thunk.org/gce-server/util/parser"
 	"thunk.org/gce-server/util/server"
 
 	"github.com/sirupsen/logrus"
@@ -28,12 +29,16 @@ import (
 )
 
 // ShardWorker manages a single test VM.
+// lock protects the status fields, which are read by Info and changed by
+// cancel while the shard runs.
 type ShardWorker struct {
 	sharder   *ShardScheduler
 	shardID   string
 	name      string
 	zone      string
 	config    string
+	tests     []string
+	slice     string
 	args      []string
 	vmTimeout bool
 
@@ -44,6 +49,8 @@ type ShardWorker struct {
 	vmTerminated   bool
 	vmTermTime     time.Time
 	vmTermInterval time.Duration
+	cancelledBy    string
+	lock           sync.Mutex
 
 	log                *logrus.Entry
 	logPath            string
@@ -65,14 +72,16 @@ const (
 )
 
 // NewShardWorker constructs a new shard, requested by the sharder
-func NewShardWorker(sharder *ShardScheduler, shardID string, config string, zone string) *ShardWorker {
+func NewShardWorker(sharder *ShardScheduler, shardID string, slice testSlice, zone string) *ShardWorker {
 	logPath := sharder.logDir + shardID
 	shard := ShardWorker{
 		sharder:   sharder,
 		shardID:   shardID,
 		name:      fmt.Sprintf("xfstests-ltm-%s-%s", sharder.testID, shardID),
 		zone:      zone,
-		config:    config,
+		config:    slice.config,
+		tests:     slice.tests,
+		slice:     slice.label,
 		args:      []string{},
 		vmTimeout: false,
 
@@ -92,27 +101,26 @@ func NewShardWorker(sharder *ShardScheduler, shardID string, config string, zone
 
 	shard.log.Info("Initializing test shard")
 
-	shard.args = []string{
-		"gce-xfstests",
-		"--instance-name", shard.name,
-		"--gce-zone", shard.zone,
-		"--gs-bucket", sharder.gsBucket,
-		"--kernel", sharder.gsKernel,
-		"--bucket-subdir", sharder.bucketSubdir,
-		"--no-email",
-		"-c", config,
+	perShard := []parser.Arg{
+		{Name: "--instance-name", Value: shard.name},
+		{Name: "--gce-zone", Value: shard.zone},
+		{Name: "--gs-bucket", Value: sharder.gsBucket},
+		{Name: "--kernel", Value: sharder.gsKernel},
+		{Name: "--bucket-subdir", Value: sharder.bucketSubdir},
+		{Name: "--no-email"},
+		{Name: "-c", Value: slice.config},
 	}
 
 	if sharder.arch != "" {
-		shard.args = append(shard.args, "--arch", sharder.arch)
+		perShard = append(perShard, parser.Arg{Name: "--arch", Value: sharder.arch})
 	}
 
 	if sharder.kernelArch != "" {
-		shard.args = append(shard.args, "--kernel-arch", sharder.kernelArch)
+		perShard = append(perShard, parser.Arg{Name: "--kernel-arch", Value: sharder.kernelArch})
 	}
 
-	if !check.ContainsStr(sharder.validArgs, "--image-project") && len(sharder.imgProjID) > 0 {
-		shard.args = append(shard.args, "--image-project", sharder.imgProjID)
+	if !sharder.request.Has("--image-project") && len(sharder.imgProjID) > 0 {
+		perShard = append(perShard, parser.Arg{Name: "--image-project", Value: sharder.imgProjID})
 	}
 
 	// outside of ltm -> default is vms timeout
@@ -120,12 +128,16 @@ func NewShardWorker(sharder *ShardScheduler, shardID string, config string, zone
 	//               reboot and test skip if a test is crashed or stuck)
 	// users can override default ltm no timeout by passing --vm-timeout flag
 	// below sets no-vm-timeout by default if we do not explictly set anything
-	if !check.ContainsStr(sharder.validArgs, "--vm-timeout") &&
-			!check.ContainsStr(sharder.validArgs, "--no-vm-timeout"){
-		shard.args = append(shard.args, "--no-vm-timeout")
+	if !sharder.request.Has("--vm-timeout") &&
+			!sharder.request.Has("--no-vm-timeout"){
+		perShard = append(perShard, parser.Arg{Name: "--no-vm-timeout"})
 	}
 
-	shard.args = append(shard.args, sharder.validArgs...)
+	request := sharder.request
+	if len(shard.tests) > 0 {
+		request = request.WithTests(shard.tests)
+	}
+	shard.args = append([]string{"gce-xfstests"}, request.ShardArgs(perShard...)...)
 
 	return &shard
 }
@@ -136,7 +148,16 @@ func (shard *ShardWorker) Run(wg *sync.WaitGroup) {
 	defer shard.exit()
 
 	shard.log.WithField("shardInfo", shard.Info()).Debug("Starting shard")
-	shard.vmStatus = "launching"
+	shard.lock.Lock()
+	cancelled := shard.cancelledBy != ""
+	if !cancelled {
+		shard.vmStatus = "launching"
+	}
+	shard.lock.Unlock()
+	if cancelled {
+		shard.log.Info("Shard cancelled before launch")
+		return
+	}
 
 	file, err := os.Create(shard.cmdLogPath)
 	check.Panic(err, shard.log, "Failed to create file")
@@ -145,17 +166,50 @@ func (shard *ShardWorker) Run(wg *sync.WaitGroup) {
 	shard.log.WithField("cmd", cmd.String()).Info("Launching test VM")
 	err = check.LimitedRun(cmd, check.RootDir, check.EmptyEnv, file, file)
 	file.Close()
+	// GCE counts the resources of the VM once it is created
+	ledger.release(shard.name)
 
 	if err != nil {
 		shard.log.WithError(err).WithField("cmd", cmd.String()).Error("Failed to start test VM")
-		shard.vmStatus = "failed to launch"
+		shard.setStatus("failed to launch")
 	} else {
+		if shard.cancelled() != "" {
+			// cancelled while the VM was being created
+			shard.deleteVM()
+		}
 		shard.monitor()
-		shard.finish()
+		if user := shard.cancelled(); user == "" {
+			shard.finish()
+		} else {
+			shard.setStatus("cancelled by " + user)
+		}
 	}
 	shard.log.Info("Existing shard process")
 }
 
+// cancel stops the shard on behalf of user. A launched test VM is deleted,
+// and a shard waiting for launch never launches its VM.
+func (shard *ShardWorker) cancel(user string) {
+	shard.log.WithField("user", user).Info("Cancelling shard")
+	shard.lock.Lock()
+	launched := shard.vmStatus != "waiting for launch"
+	shard.cancelledBy = user
+	shard.testResult = server.Error
+	shard.vmStatus = "cancelled by " + user
+	shard.lock.Unlock()
+	if launched {
+		shard.deleteVM()
+	}
+}
+
+// deleteVM deletes the test VM if it exists.
+func (shard *ShardWorker) deleteVM() {
+	err := shard.sharder.gce.DeleteInstance(shard.sharder.projID, shard.zone, shard.name)
+	if err != nil && !gcp.NotFound(err) {
+		check.NoError(err, shard.log, "Failed to delete VM")
+	}
+}
+
 /*
 monitor blocks until the test VM finishes or timeout.
 
@@ -171,7 +225,7 @@ func (shard *ShardWorker) monitor() {
 	ticker := time.NewTicker(monitorInterval)
 	defer ticker.Stop()
 	monitorStart := time.Now()
-	shard.vmtestStart = monitorStart
+	shard.setStart(monitorStart)
 
 	for range ticker.C {
 		log := shard.log.WithField("time", time.Since(monitorStart).Round(time.Second))
@@ -180,13 +234,13 @@ func (shard *ShardWorker) monitor() {
 		if err != nil {
 			if gcp.NotFound(err) {
 				if shard.vmtestStart == monitorStart {
-					shard.vmStatus = "failed to launch"
+					shard.setStatus("failed to launch")
 					log.Error("Test VM failed to launch")
 				} else {
 					log.Info("Test VM no longer exists")
 				}
 			} else {
-				shard.vmStatus = "unexpected error"
+				shard.setStatus("unexpected error")
 				log.WithError(err).Panic("Failed to get shard instance info")
 			}
 			return
@@ -198,7 +252,7 @@ func (shard *ShardWorker) monitor() {
 
 		if instanceInfo.Status == "TERMINATED" {
 			if !shard.vmTerminated {
-				shard.vmStatus = "terminated"
+				shard.setStatus("terminated")
 				shard.vmTerminated = true
 				shard.vmTermTime = time.Now()
 				shard.vmTermInterval = restartIntervalMin
@@ -233,21 +287,21 @@ func (shard *ShardWorker) monitor() {
 
 		for _, metaData := range instanceInfo.Metadata.Items {
 			if metaData.Key == "status" {
-				if *metaData.Value != shard.vmStatus {
-					shard.vmStatus = *metaData.Value
-					shard.vmtestStart = time.Now()
+				if *metaData.Value != shard.status() {
+					shard.setStatus(*metaData.Value)
+					shard.setStart(time.Now())
 					shard.vmReset = false
 					break
 				}
 			}
 		}
-		if shard.vmStatus == "launching" {
+		if shard.status() == "launching" {
 			if time.Since(monitorStart) > noStatusTimeout {
 				if !shard.sharder.keepDeadVM {
 					shard.shutdownOnTimeout(instanceInfo.Metadata)
 				}
-				shard.vmStatus = "timeout without launching tests"
-				shard.testResult = server.Error
+				shard.setStatus("timeout without launching tests")
+				shard.setResult(server.Error)
 
 				log.Errorf("Tests might fail to start, cannot find test status for %s", noStatusTimeout.Round(time.Second))
 				return
@@ -265,21 +319,21 @@ func (shard *ShardWorker) monitor() {
 		// Selftests may limit monitorTimeout to shorter than noStatusTimeout
 		//    so skip check if we are still launching
 		if time.Since(shard.vmtestStart) > shard.sharder.monitorTimeout &&
-			!shard.vmReset && shard.vmStatus != "launching" {
+			!shard.vmReset && shard.status() != "launching" {
 			log.Debug("Resetting VM")
 			err := shard.sharder.gce.ResetVM(shard.sharder.projID, shard.zone, shard.name)
 			if err != nil {
 				log.Errorf("Failed to reset %s", shard.name)
-				shard.vmStatus = "failed to reset after timeout"
-				shard.testResult = server.Error
+				shard.setStatus("failed to reset after timeout")
+				shard.setResult(server.Error)
 				return
 			}
 			shard.vmReset = true
-			shard.vmtestStart = time.Now()
+			shard.setStart(time.Now())
 		}
 
 		log.WithFields(logrus.Fields{
-			"status": shard.vmStatus,
+			"status": shard.status(),
 			"start":  shard.vmtestStart.Format(time.Stamp),
 		}).Debug("Keep waiting")
 	}
@@ -358,12 +412,12 @@ func (shard *ShardWorker) finish() {
 
 	url := shard.getResults()
 	if url == "" {
-		if shard.testResult == server.DefaultResult {
-			if shard.vmStatus == "launching" {
-				shard.testResult = server.Error
-				shard.vmStatus = "finished without launching tests"
+		if shard.result() == server.DefaultResult {
+			if shard.status() == "launching" {
+				shard.setResult(server.Error)
+				shard.setStatus("finished without launching tests")
 			} else {
-				shard.testResult = server.Crash
+				shard.setResult(server.Crash)
 			}
 		}
 		shard.log.Error("Failed to find result file")
@@ -398,7 +452,7 @@ func (shard *ShardWorker) finish() {
 	prefix = fmt.Sprintf("%s/summary.%s", shard.sharder.bucketSubdir, shard.resultsName)
 	_, err = shard.sharder.gce.DeleteFiles(prefix)
 	check.NoError(err, shard.log, "Failed to delete file")
-	shard.vmStatus = "finished"
+	shard.setStatus("finished")
 }
 
 // getResults fetches the test result files.
@@ -435,9 +489,12 @@ func (shard *ShardWorker) getResults() string {
 
 // Info returns structured shard information.
 func (shard *ShardWorker) Info() server.ShardInfo {
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
 	return server.ShardInfo{
 		ID:     shard.shardID,
 		Config: shard.config,
+		Slice:  shard.slice,
 		Zone:   shard.zone,
 		Status: shard.vmStatus,
 		Time:   time.Since(shard.vmtestStart).Round(time.Second).String(),
@@ -447,6 +504,7 @@ func (shard *ShardWorker) Info() server.ShardInfo {
 
 // exit handles panic from shard run.
 func (shard *ShardWorker) exit() {
+	ledger.release(shard.name)
 	if r := recover(); r != nil {
 		shard.log.Error("Shard exits with error, get stack trace")
 		shard.log.Error(string(debug.Stack()))
@@ -455,8 +513,48 @@ func (shard *ShardWorker) exit() {
 		} else {
 			shard.log.Warn("Serial port output is not found")
 		}
-		if shard.testResult == server.DefaultResult {
-			shard.testResult = server.Error
+		if shard.result() == server.DefaultResult {
+			shard.setResult(server.Error)
 		}
 	}
 }
+
+// cancelled returns the user who cancelled the shard, or an empty string.
+func (shard *ShardWorker) cancelled() string {
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	return shard.cancelledBy
+}
+
+// status returns the status of the test VM.
+func (shard *ShardWorker) status() string {
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	return shard.vmStatus
+}
+
+func (shard *ShardWorker) setStatus(status string) {
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	shard.vmStatus = status
+}
+
+// setStart records when the test VM got its current status.
+func (shard *ShardWorker) setStart(start time.Time) {
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	shard.vmtestStart = start
+}
+
+// result returns the test result of the shard.
+func (shard *ShardWorker) result() server.ResultType {
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	return shard.testResult
+}
+
+func (shard *ShardWorker) setResult(result server.ResultType) {
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	shard.testResult = result
+}
@@ -2,8 +2,9 @@
 ShardScheduler arranges the tests and runs them in multiple shardWorkers.
 
 The sharder parses the command line arguments sent by user, parse it into
-machine understandable xfstests configs. Then it queries for GCE quotas and
-spawns a suitable number of shards to run the tests. The sharder waits until
+machine understandable xfstests configs. The sharder waits in a queue until
+there is GCE quota for its shards (see queue.go), and then spawns a suitable
+number of shards to run the tests. The sharder waits until
 all shards finish, fetch the result files and aggregate them. An email is sent
 to the user if necessary.
 
@@ -14,6 +15,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -47,6 +49,7 @@ type ShardScheduler struct {
 	projID    string
 	imgProjID string
 	origCmd   string
+	user      string
 
 	zone               string
 	region             string
@@ -60,13 +63,24 @@ type ShardScheduler struct {
 	reportFailReceiver string
 	junitReceiver      string
 	maxShards          int
+	regionShard        bool
 	keepDeadVM         bool
 	monitorTimeout     time.Duration
+	splitTests         int
+	splitResults       string
 
+	priority    server.Priority
+	queued      time.Time
+	admitted    chan bool
 	reportKCS   bool
+	series      string
+	siblings    siblingRun
+	variant     string
 	testRequest server.TaskRequest
+	testPlan    json.RawMessage
 	testResult  server.ResultType
 	failed      bool
+	cancelledBy string
 
 	log     *logrus.Entry
 	logDir  string
@@ -74,8 +88,11 @@ type ShardScheduler struct {
 	aggDir  string
 	aggFile string
 
-	validArgs []string
+	request   *parser.Request
 	configs   []string
+	layout    []testSlice
+	testLists map[string][]string
+	testTimes map[string]map[string]float64
 	gce       *gcp.Service
 	shards    []*ShardWorker
 }
@@ -87,6 +104,7 @@ var (
 )
 
 // NewShardScheduler constructs a new sharder from a test request.
+// The sharder is registered for status queries when it is run.
 // All dir strings have a trailing / for consistency purpose,
 // except for bucketSubdir.
 func NewShardScheduler(c server.TaskRequest, testID string) *ShardScheduler {
@@ -119,12 +137,13 @@ func NewShardScheduler(c server.TaskRequest, testID string) *ShardScheduler {
 
 	bucketSubdir, _ := gcp.GceConfig.Get("BUCKET_SUBDIR")
 
-	log.Info("Initiating test sharder")
+	log.WithField("user", c.User).Info("Initiating test sharder")
 	sharder := ShardScheduler{
 		testID:    testID,
 		projID:    projID,
 		imgProjID: imgProjID,
 		origCmd:   origCmd,
+		user:      c.User,
 
 		zone:               zone,
 		region:             region,
@@ -137,12 +156,16 @@ func NewShardScheduler(c server.TaskRequest, testID string) *ShardScheduler {
 		reportReceiver:     c.Options.ReportEmail,
 		reportFailReceiver: c.Options.ReportFailEmail,
 		junitReceiver:      c.Options.JunitEmail,
-		maxShards:      0,
-		keepDeadVM:     false,
-		monitorTimeout: defaultMonitorTimeout,
+		maxShards:          0,
+		keepDeadVM:         false,
+		monitorTimeout:     defaultMonitorTimeout,
+		splitTests:         c.Options.SplitTests,
+		splitResults:       c.Options.SplitResults,
 
+		priority:    sharderPriority(c),
 		reportKCS:   false,
 		testRequest: c,
+		testPlan:    c.Plan,
 		testResult:  server.DefaultResult,
 		failed:      false,
 
@@ -175,82 +198,90 @@ func NewShardScheduler(c server.TaskRequest, testID string) *ShardScheduler {
 		}
 	}
 
-	sharder.validArgs, sharder.configs, err = getConfigs(sharder.origCmd)
+	sharder.request, sharder.configs, err = getConfigs(sharder.origCmd)
 	check.Panic(err, log, "Failed to parse config from origCmd")
 
 	sharder.getKernelInfo()
 
+	sharder.siblings, sharder.variant = findSiblingRun(testID)
+	sharder.siblingLayout()
+
 	sharder.gce, err = gcp.NewService(sharder.gsBucket)
 	check.Panic(err, log, "Failed to connect to GCE service")
 
-	regionShard := !c.Options.NoRegionShard
+	if sharder.splitTests > 1 && sharder.layout == nil {
+		sharder.loadTestLists()
+	}
+
+	sharder.regionShard = !c.Options.NoRegionShard
 	// This is a hack because RegionSharding doesn't know how to
 	// exclude zones that don't have arm64 machine types.  More
 	// generally, if the user has specified a specific machtype,
 	// region sharding doesn't handle that case as well either.
 	if c.Options.Arch == "arm64" {
-		regionShard = false
-	}
-	if regionShard {
-		sharder.initRegionSharding()
-	} else {
-		sharder.initLocalSharding()
+		sharder.regionShard = false
 	}
 
 	if c.ExtraOptions != nil && c.ExtraOptions.Requester == server.KCSBisectStep {
 		sharder.reportKCS = true
 	}
-
-	sharderLock.Lock()
-	sharderMap[testID] = &sharder
-	sharderLock.Unlock()
+	if c.ExtraOptions != nil {
+		sharder.series = c.ExtraOptions.Series
+	}
 
 	return &sharder
 }
 
-// initLocalSharding creates shards in the same zone the VM runs in.
-// The sharder queries for available quotas in the current zone and
-// spawns new shards accordingly.
-func (sharder *ShardScheduler) initLocalSharding() {
-	log := sharder.log.WithField("region", sharder.region)
-	log.Info("Initilizing local sharding")
-	allShards := []*ShardWorker{}
-	quota, err := sharder.gce.GetRegionQuota(sharder.projID, sharder.region)
-	check.Panic(err, log, "Failed to get quota")
+// quotaZones returns a zone for each shard that fits in the available
+// GCE quota, depending on the sharding strategy. It returns an empty slice
+// if the project is out of quota. Quotas are queried through the cache, so
+// that the sharders planned in one pass share a query.
+func (sharder *ShardScheduler) quotaZones(cache *quotaCache) ([]string, error) {
+	if sharder.regionShard {
+		return sharder.regionZones(cache)
+	}
+	return sharder.localZones(cache)
+}
 
-	if quota == nil {
-		log.Panic("GCE region is out of quota")
+// localZones places all shards in the same zone the VM runs in.
+// The sharder queries for available quotas in the current region.
+func (sharder *ShardScheduler) localZones(cache *quotaCache) ([]string, error) {
+	log := sharder.log.WithField("region", sharder.region)
+	log.Info("Checking quota for local sharding")
+	quota, err := cache.regionQuota(sharder.gce, sharder.projID, sharder.region)
+	if err != nil {
+		return nil, err
 	}
 	numShards, err := quota.GetMaxShard()
-	check.Panic(err, log, "Failed to get max shard")
+	if err != nil {
+		return nil, err
+	}
 
 	if sharder.maxShards > 0 {
 		numShards = mymath.MaxInt(numShards, sharder.maxShards)
 	}
-	configs := splitConfigs(numShards, sharder.configs)
-
-	for i, config := range configs {
-		shardID := string(rune(i)/26+'a') + string(rune(i)%26+'a')
-		shard := NewShardWorker(sharder, shardID, config, sharder.zone)
-		allShards = append(allShards, shard)
+	zones := []string{}
+	for i := 0; i < numShards; i++ {
+		zones = append(zones, sharder.zone)
 	}
-
-	sharder.shards = allShards
+	return zones, nil
 }
 
-// initRegionSharding creates shards among all zones with available quotas.
+// regionZones spreads shards among all zones with available quotas.
 // It first query all zones on the same continent as the project, and queries
 // other zones if the quota is not enough to assign each config to a separate VM.
-func (sharder *ShardScheduler) initRegionSharding() {
+func (sharder *ShardScheduler) regionZones(cache *quotaCache) ([]string, error) {
 	continent := strings.Split(sharder.region, "-")[0]
 	log := sharder.log.WithField("continent", continent)
-	log.Info("Initilizing region sharding")
+	log.Info("Checking quota for region sharding")
 
-	allShards := []*ShardWorker{}
-	quotas, err := sharder.gce.GetAllRegionsQuota(sharder.projID)
-	check.Panic(err, log, "Failed to get quota")
+	quotas, err := cache.allQuotas(sharder.gce, sharder.projID)
+	if err != nil {
+		return nil, err
+	}
 
-	var usedZones, avoidZones []string
+	usedZones := []string{}
+	var avoidZones []string
 	content, err := os.ReadFile("/usr/local/lib/zone-avoid-list")
 	if err == nil {
 		avoidZones = strings.Split(string(content), "\n")
@@ -260,7 +291,9 @@ func (sharder *ShardScheduler) initRegionSharding() {
 		if !slices.Contains(avoidZones, quota.Zone) &&
 			strings.HasPrefix(quota.Zone, continent) {
 			maxShard, err := quota.GetMaxShard()
-			check.Panic(err, log, "Failed to get max shard")
+			if err != nil {
+				return nil, err
+			}
 
 			for i := 0; i < maxShard; i++ {
 				usedZones = append(usedZones, quota.Zone)
@@ -275,7 +308,9 @@ func (sharder *ShardScheduler) initRegionSharding() {
 		for _, quota := range quotas {
 			if !strings.HasPrefix(quota.Zone, continent) {
 				maxShard, err := quota.GetMaxShard()
-				check.Panic(err, log, "Failed to get max shard")
+				if err != nil {
+					return nil, err
+				}
 
 				for i := 0; i < maxShard; i++ {
 					usedZones = append(usedZones, quota.Zone)
@@ -286,18 +321,80 @@ func (sharder *ShardScheduler) initRegionSharding() {
 			}
 		}
 	}
-	if len(usedZones) == 0 {
-		log.WithField("projID", sharder.projID).Panic("GCE project is out of quota")
+	return usedZones, nil
+}
+
+// idealShards returns the number of shards to run every config in a
+// separate shard, or every slice of tests with --split-tests, or the
+// number of shards in a fixed layout.
+func (sharder *ShardScheduler) idealShards() int {
+	if sharder.layout != nil {
+		return len(sharder.layout)
+	}
+	if sharder.testLists != nil {
+		ideal := 0
+		for _, config := range sharder.configs {
+			ideal += mymath.MaxInt(1, mymath.MinInt(sharder.splitTests, len(sharder.testLists[config])))
+		}
+		return mymath.MaxInt(1, ideal)
 	}
-	configs := splitConfigs(len(usedZones), sharder.configs)
+	return mymath.MaxInt(1, len(sharder.configs))
+}
 
-	for i, config := range configs {
+// register adds the sharder to the running sharders for status queries.
+func (sharder *ShardScheduler) register() {
+	sharderLock.Lock()
+	defer sharderLock.Unlock()
+	sharderMap[sharder.testID] = sharder
+}
+
+// planShards creates the shards and spreads them among zones.
+func (sharder *ShardScheduler) planShards(zones []string) []*ShardWorker {
+	allShards := []*ShardWorker{}
+	testSlices := sharder.shardSlices(len(zones))
+
+	for i, slice := range testSlices {
 		shardID := string(rune(i)/26+'a') + string(rune(i)%26+'a')
-		shard := NewShardWorker(sharder, shardID, config, usedZones[i])
+		shard := NewShardWorker(sharder, shardID, slice, zones[i%len(zones)])
 		allShards = append(allShards, shard)
 	}
+	return allShards
+}
+
+/*
+initShards creates the shards of the sharder. The quota of each shard is
+reserved in the ledger until its VM is created.
+
+The queue scheduler initializes one sharder at a time, so the first sibling
+of a sibling run records its layout before the next sibling is planned, and
+the other siblings use that layout.
+*/
+func (sharder *ShardScheduler) initShards(zones []string, resources gcp.Resources) {
+	sharder.siblingLayout()
+	ownLayout := sharder.layout == nil
+	allShards := sharder.planShards(zones)
+	for _, shard := range allShards {
+		ledger.reserve(shard.name, shard.zone, resources)
+	}
 
+	sharderLock.Lock()
 	sharder.shards = allShards
+	sharderLock.Unlock()
+
+	if sharder.siblings != nil && ownLayout {
+		layout := []testSlice{}
+		for _, shard := range sharder.shards {
+			layout = append(layout, testSlice{shard.config, shard.tests, shard.slice})
+		}
+		sharder.siblings.SetLayout(layout)
+	}
+}
+
+// releaseShards releases the quota reserved for shards that never run.
+func (sharder *ShardScheduler) releaseShards() {
+	for _, shard := range sharder.shards {
+		ledger.release(shard.name)
+	}
 }
 
 // Get information about the kernel so that each gce-xfstests invocation
@@ -328,12 +425,16 @@ func (sharder *ShardScheduler) getKernelInfo() {
 	}
 }
 
-// getConfigs calls a parser to extract the valid args and configs from
-// the raw cmdline.
-func getConfigs(origCmd string) ([]string, []string, error) {
-	validArgs, configs, err := parser.Cmd(origCmd)
+// getConfigs calls a parser to parse the raw cmdline into a request and
+// extract its configs.
+func getConfigs(origCmd string) (*parser.Request, []string, error) {
+	req, err := parser.Parse(origCmd)
 	if err != nil {
-		return []string{}, []string{}, nil
+		return nil, []string{}, err
+	}
+	configs, err := req.Configs()
+	if err != nil {
+		return nil, []string{}, err
 	}
 	configStrings := []string{}
 	for fs := range configs {
@@ -341,7 +442,20 @@ func getConfigs(origCmd string) ([]string, []string, error) {
 			configStrings = append(configStrings, fs+"/"+cfg)
 		}
 	}
-	return validArgs, configStrings, nil
+	return req, configStrings, nil
+}
+
+// siblingLayout adopts the shard layout of the sibling that started first,
+// so that all the sharders of an A/B or kernel matrix run use the same shards.
+func (sharder *ShardScheduler) siblingLayout() {
+	if sharder.siblings != nil && sharder.layout == nil {
+		sharder.layout = sharder.siblings.Layout()
+	}
+}
+
+// shardConfigs returns the configs for each shard.
+func (sharder *ShardScheduler) shardConfigs(numShards int) []string {
+	return splitConfigs(numShards, sharder.configs)
 }
 
 // splitConfigs distribute configs among shards in a round-robin way.
@@ -363,7 +477,8 @@ func splitConfigs(numShards int, configs []string) []string {
 	return configConcat
 }
 
-// Run starts all the shards in a separate go routine.
+// Run waits in the queue until the sharder is admitted, and starts all
+// the shards in a separate go routine.
 func (sharder *ShardScheduler) Run() {
 	sharder.log.Debug("Starting sharder")
 	var wg sync.WaitGroup
@@ -379,13 +494,19 @@ func (sharder *ShardScheduler) Run() {
 
 	defer sharder.sendWatcherResult()
 
-	for _, shard := range sharder.shards {
-		wg.Add(1)
-		go shard.Run(&wg)
+	if sharder.siblings != nil {
+		defer sharder.siblings.Finish(sharder.variant, sharder)
+	}
+
+	if sharder.admit() {
+		for _, shard := range sharder.shards {
+			wg.Add(1)
+			go shard.Run(&wg)
+		}
+		wg.Wait()
+		sharder.log.Debug("All shards finished")
 	}
-	wg.Wait()
 
-	sharder.log.Debug("All shards finished")
 	sharder.finish()
 }
 
@@ -393,10 +514,13 @@ func (sharder *ShardScheduler) Run() {
 func (sharder *ShardScheduler) Info() server.SharderInfo {
 	info := server.SharderInfo{
 		ID:            sharder.testID,
+		User:          sharder.user,
 		Command:       sharder.origCmd,
 		KernelVersion: sharder.kernelVersion,
 		KernelArch:    sharder.kernelArch,
 		NumShards:     len(sharder.shards),
+		Priority:      sharder.priority.String(),
+		QueuePosition: sharder.QueuePosition(),
 		Result:        sharder.testResult.String(),
 	}
 
@@ -413,11 +537,14 @@ func (sharder *ShardScheduler) finish() {
 	sharder.log.Debug("Finishing sharder")
 
 	sharder.aggResults()
+	sharder.mergeSlices()
 	sharder.createInfo()
+	sharder.savePlan()
 	sharder.createRunStats()
 	sharder.genResultsSummary()
+	sharder.addSeriesInfo()
 
-	if !sharder.reportKCS {
+	if !sharder.reportKCS && sharder.siblings == nil {
 		sharder.emailReport()
 	}
 
@@ -466,6 +593,9 @@ func (sharder *ShardScheduler) aggResults() {
 	}
 	if !hasResults {
 		sharder.log.Error("No shard created any results or serial dumps before exiting")
+		if user := sharder.cancelled(); user != "" {
+			sharder.log.Panic("Test run cancelled by " + user + " before any results were available")
+		}
 		sharder.log.Panic("No results available for any of the shards")
 	}
 
@@ -504,11 +634,18 @@ func (sharder *ShardScheduler) concatResults(filename string) {
 	fmt.Fprintf(file, "LTM aggregate file for %s\n", filename)
 	fmt.Fprintf(file, "Test run ID %s\n", sharder.testID)
 	fmt.Fprintf(file, "Aggregate results from %d shards\n", len(sharder.shards))
+	if user := sharder.cancelled(); user != "" {
+		fmt.Fprintf(file, "Cancelled by %s\n", user)
+	}
 
 	for _, shard := range sharder.shards {
 		shardLog := log.WithField("shardID", shard.shardID)
 		fmt.Fprintf(file, "\n============SHARD %s============\n", shard.shardID)
-		fmt.Fprintf(file, "============CONFIG: %s\n\n", shard.config)
+		fmt.Fprintf(file, "============CONFIG: %s\n", shard.config)
+		if shard.slice != "" {
+			fmt.Fprintf(file, "============TESTS: %s\n", shard.slice)
+		}
+		fmt.Fprint(file, "\n")
 		shardFile := fmt.Sprintf("%s%s/%s", sharder.aggDir, shard.shardID, filename)
 		if check.FileExists(shardFile) {
 			sourceFile, err := os.Open(shardFile)
@@ -544,13 +681,22 @@ func (sharder *ShardScheduler) createInfo() {
 
 	fmt.Fprintf(file, "LTM test run ID %s\n", sharder.testID)
 	fmt.Fprintf(file, "Original command: %s\n", sharder.origCmd)
+	if len(sharder.testPlan) > 0 {
+		fmt.Fprint(file, "Test plan: test-plan.json\n")
+	}
 	fmt.Fprintf(file, "Aggregate results from %d shards\n", len(sharder.shards))
+	if sharder.series != "" {
+		fmt.Fprintf(file, "Patch series:\n%s\n", sharder.series)
+	}
 	fmt.Fprint(file, "SHARD INFO:\n\n")
 
 	for _, shard := range sharder.shards {
 		fmt.Fprintf(file, "SHARD %s\n", shard.shardID)
 		fmt.Fprintf(file, "instance name: %s\n", shard.name)
 		fmt.Fprintf(file, "split config: %s\n", shard.config)
+		if shard.slice != "" {
+			fmt.Fprintf(file, "test slice: %s, %d tests\n", shard.slice, len(shard.tests))
+		}
 		fmt.Fprintf(file, "gce command executed: %v\n\n", shard.args)
 	}
 
@@ -588,7 +734,6 @@ func (sharder *ShardScheduler) genResultsSummary() {
 	sharder.log.Info("Creating LTM test result summary")
 	cmd := exec.Command(genResultsSummaryPath, sharder.aggDir, "--output_file", sharder.aggDir+"report", "--merge_file", sharder.aggDir+"results.xml", "--check_failure")
 
-
 	cmdLog := sharder.log.WithField("cmd", cmd.String())
 	w := cmdLog.Writer()
 	defer w.Close()
@@ -597,7 +742,7 @@ func (sharder *ShardScheduler) genResultsSummary() {
 		sharder.failed = true
 	}
 
-	_, err = os.Stat(sharder.aggDir+"report.failed")
+	_, err = os.Stat(sharder.aggDir + "report.failed")
 	if err == nil || !errors.Is(err, os.ErrNotExist) {
 		sharder.failed = true
 	}
@@ -605,7 +750,7 @@ func (sharder *ShardScheduler) genResultsSummary() {
 	var testFailure, testError, reportInfo bool
 
 	for _, shard := range sharder.shards {
-		switch shard.testResult {
+		switch shard.result() {
 		case server.DefaultResult:
 			// do nothing, won't fallthrough like in C
 		case server.Error:
@@ -630,13 +775,15 @@ func (sharder *ShardScheduler) genResultsSummary() {
 		}
 	}
 
+	result := server.Pass
 	if testFailure {
-		sharder.testResult = server.Fail
+		result = server.Fail
 	} else if testError {
-		sharder.testResult = server.Error
-	} else {
-		sharder.testResult = server.Pass
+		result = server.Error
 	}
+	sharderLock.Lock()
+	sharder.testResult = result
+	sharderLock.Unlock()
 
 	if reportInfo {
 		file, err := os.OpenFile(sharder.aggDir+"report", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
@@ -649,6 +796,23 @@ func (sharder *ShardScheduler) genResultsSummary() {
 	}
 }
 
+// addSeriesInfo puts the tested patch series at the top of the report,
+// so that per-series results can be told apart.
+func (sharder *ShardScheduler) addSeriesInfo() {
+	if sharder.series == "" {
+		return
+	}
+	sharder.log.Info("Adding patch series info to report")
+
+	b, err := ioutil.ReadFile(sharder.aggDir + "report")
+	if !check.NoError(err, sharder.log, "Failed to read the report file") {
+		return
+	}
+	content := fmt.Sprintf("============PATCH SERIES============\n%s\n\n%s", sharder.series, b)
+	err = ioutil.WriteFile(sharder.aggDir+"report", []byte(content), 0644)
+	check.NoError(err, sharder.log, "Failed to write the report file")
+}
+
 // emailReport sends the email.
 func (sharder *ShardScheduler) emailReport() {
 	if sharder.reportReceiver == "" && sharder.reportFailReceiver == "" {
@@ -710,29 +874,16 @@ func (sharder *ShardScheduler) sendWatcherResult() {
 // packResults packs the aggregared files after copying the sharder's log file into it.
 func (sharder *ShardScheduler) packResults() {
 	sharder.log.Info("Packing aggregated files")
-	sharder.log.Info("Copying sharder log file")
-
-	logging.Sync(sharder.log)
-	aggLogFile := sharder.aggDir + "ltm_logs/run.log"
-	err := check.CopyFile(aggLogFile, sharder.logFile)
+	err := sharder.tarResults()
 	if err != nil {
-		check.Panic(err, sharder.log, "Failed to copy sharder log file")
-	}
-
-	cmd := exec.Command("tar", "-cf", sharder.aggFile+".tar", "-C", sharder.aggDir, ".")
-	cmdLog := sharder.log.WithField("cmd", cmd.Args)
-	w1 := cmdLog.Writer()
-	defer w1.Close()
-	err = check.Run(cmd, check.RootDir, check.EmptyEnv, w1, w1)
-	if !check.NoError(err, cmdLog, "Failed to create tarball") {
 		return
 	}
 
-	cmd = exec.Command("xz", "-6ef", sharder.aggFile+".tar")
-	cmdLog = sharder.log.WithField("cmd", cmd.Args)
-	w2 := cmdLog.Writer()
-	defer w2.Close()
-	err = check.Run(cmd, check.RootDir, check.EmptyEnv, w2, w2)
+	cmd := exec.Command("xz", "-6ef", sharder.aggFile+".tar")
+	cmdLog := sharder.log.WithField("cmd", cmd.Args)
+	w := cmdLog.Writer()
+	defer w.Close()
+	err = check.Run(cmd, check.RootDir, check.EmptyEnv, w, w)
 	if !check.NoError(err, cmdLog, "Failed to create xz compressed tarball") {
 		return
 	}
@@ -747,6 +898,12 @@ func (sharder *ShardScheduler) packResults() {
 	err = sharder.gce.UploadFile(sharder.aggDir+"results.xml", gsPath)
 	check.Panic(err, sharder.log, "Failed to upload junit file")
 
+	if len(sharder.testPlan) > 0 {
+		gsPath = fmt.Sprintf("%s/plan.%s-%s.json", sharder.bucketSubdir, server.LTMUserName, sharder.testID)
+		err = sharder.gce.UploadFile(sharder.aggDir+"test-plan.json", gsPath)
+		check.NoError(err, sharder.log, "Failed to upload test plan")
+	}
+
 	os.Remove(sharder.aggFile + ".tar.xz")
 
 	if _, err := gcp.GceConfig.Get("GCE_UPLOAD_SUMMARY"); err == nil {
@@ -756,7 +913,31 @@ func (sharder *ShardScheduler) packResults() {
 	}
 }
 
+// tarResults copies the sharder's log file into the ltm_logs directory and
+// packs the aggregated files into a tarball. Secrets are redacted from the
+// log when it is written, see logging.Redact().
+func (sharder *ShardScheduler) tarResults() error {
+	sharder.log.Info("Copying sharder log file")
+
+	logging.Sync(sharder.log)
+	aggLogFile := sharder.aggDir + "ltm_logs/run.log"
+	err := check.CopyFile(aggLogFile, sharder.logFile)
+	if !check.NoError(err, sharder.log, "Failed to copy sharder log file") {
+		return err
+	}
+
+	cmd := exec.Command("tar", "-cf", sharder.aggFile+".tar", "-C", sharder.aggDir, ".")
+	cmdLog := sharder.log.WithField("cmd", cmd.Args)
+	w := cmdLog.Writer()
+	defer w.Close()
+	err = check.Run(cmd, check.RootDir, check.EmptyEnv, w, w)
+	check.NoError(err, cmdLog, "Failed to create tarball")
+	return err
+}
+
 // clean removes local result and log files.
+// Kernels uploaded for a single run are deleted, while kernels built by KCS
+// are kept in its kernel cache and garbage collected there.
 func (sharder *ShardScheduler) clean() {
 	sharder.log.Info("Cleaning up sharder resources")
 
@@ -767,6 +948,7 @@ func (sharder *ShardScheduler) clean() {
 	sharderLock.Lock()
 	delete(sharderMap, sharder.testID)
 	sharderLock.Unlock()
+	notifyQueue()
 
 	sharder.log.Info("Remove local aggregate results")
 	os.RemoveAll(sharder.aggDir)
@@ -774,6 +956,60 @@ func (sharder *ShardScheduler) clean() {
 	logging.CloseLog(sharder.log)
 }
 
+// Cancel stops all shards of the sharder on behalf of user. Results that
+// are already available are still aggregated and reported.
+func (sharder *ShardScheduler) Cancel(user string) {
+	sharder.log.WithField("user", user).Info("Cancelling test run")
+	sharderLock.Lock()
+	sharder.cancelledBy = user
+	shards := sharder.shards
+	sharderLock.Unlock()
+	for _, shard := range shards {
+		shard.cancel(user)
+	}
+}
+
+// cancelled returns the user who cancelled the test run, or an empty string.
+func (sharder *ShardScheduler) cancelled() string {
+	sharderLock.Lock()
+	defer sharderLock.Unlock()
+	return sharder.cancelledBy
+}
+
+// CancelSharder cancels the running sharder with the testID in the request,
+// or all the running sharders of the A/B or kernel matrix run with that ID.
+// Only admins can cancel test runs submitted by other users.
+// It panics if no matching sharder is found.
+func CancelSharder(c server.TaskRequest, admin bool) {
+	sharderLock.Lock()
+	defer sharderLock.Unlock()
+	sharders := cancelTargets(c.Options.Cancel)
+	if len(sharders) == 0 {
+		panic("No running test with ID " + c.Options.Cancel)
+	}
+	for _, sharder := range sharders {
+		if sharder.user != c.User && !admin {
+			panic("Only admins can cancel tests submitted by other users")
+		}
+	}
+	for _, sharder := range sharders {
+		go sharder.Cancel(c.User)
+	}
+}
+
+// cancelTargets returns the running sharders to cancel for testID: the
+// sharder with that ID, or the siblings of the A/B or kernel matrix run
+// with that ID. The caller must hold sharderLock.
+func cancelTargets(testID string) []*ShardScheduler {
+	sharders := []*ShardScheduler{}
+	for id, sharder := range sharderMap {
+		if id == testID || (sharder.siblings != nil && id == testID+"-"+sharder.variant) {
+			sharders = append(sharders, sharder)
+		}
+	}
+	return sharders
+}
+
 // SharderStatus returns the info for running sharders.
 func SharderStatus() []server.SharderInfo {
 	sharderLock.Lock()
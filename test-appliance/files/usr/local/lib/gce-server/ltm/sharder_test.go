@@ -0,0 +1,244 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"thunk.org/gce-server/util/gcp"
+	"thunk.org/gce-server/util/logging"
+	"thunk.org/gce-server/util/parser"
+	"thunk.org/gce-server/util/server"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestTarResultsRedactsSecrets(t *testing.T) {
+	dir := t.TempDir()
+	aggDir := dir + "/results/"
+	err := os.MkdirAll(aggDir+"ltm_logs", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFile := dir + "/run.log"
+	t.Cleanup(logging.ResetRedact)
+	logging.AddSecret("hunter1")
+
+	sharder := &ShardScheduler{
+		log:     logging.InitLogger(logFile),
+		logFile: logFile,
+		aggDir:  aggDir,
+		aggFile: dir + "/results",
+	}
+	c := server.TaskRequest{
+		CmdLine: "ltm -c ext4/4k generic/001",
+		Options: &server.UserOptions{CommitID: "v6.1"},
+	}
+	sharder.log.WithFields(logrus.Fields{
+		"options":  c.Options,
+		"password": "hunter2",
+	}).Info("Received test request with hunter1")
+	w := sharder.log.WithField("cmd", "gce-xfstests").Writer()
+	fmt.Fprintln(w, "GCE_LTM_PWD=hunter3")
+	w.Close()
+
+	err = sharder.tarResults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logging.CloseLog(sharder.log)
+
+	file, err := os.Open(sharder.aggFile + ".tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader := tar.NewReader(file)
+	found := false
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(header.Name, "./ltm_logs/") {
+			continue
+		}
+		found = true
+		buf, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, secret := range []string{"hunter1", "hunter2", "hunter3"} {
+			if strings.Contains(string(buf), secret) {
+				t.Errorf("secret %s found in %s:\n%s", secret, header.Name, buf)
+			}
+		}
+		if header.Name == "./ltm_logs/run.log" && !strings.Contains(string(buf), "v6.1") {
+			t.Errorf("test request not logged in %s:\n%s", header.Name, buf)
+		}
+	}
+	if !found {
+		t.Error("ltm_logs not found in tarball")
+	}
+}
+
+// newTestSharder returns a sharder that can plan shards of configs without
+// GCE or config files.
+func newTestSharder(t *testing.T, testID string, configs []string) *ShardScheduler {
+	t.Helper()
+	req, err := parser.Parse("ltm -c " + strings.Join(configs, ",") + " generic/001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharder := &ShardScheduler{
+		testID:  testID,
+		request: req,
+		configs: configs,
+		log:     logrus.NewEntry(logrus.New()),
+		logDir:  t.TempDir() + "/",
+	}
+	t.Cleanup(func() {
+		for _, shard := range sharder.shards {
+			ledger.release(shard.name)
+		}
+	})
+	return sharder
+}
+
+func TestSiblingLayout(t *testing.T) {
+	configs := []string{"ext4/4k", "ext4/1k", "xfs/4k"}
+	for _, test := range []struct {
+		siblings siblingRun
+		variants []string
+	}{
+		{&ABRun{&siblingBase{}}, []string{baseVariant, patchVariant}},
+		{&MatrixRun{siblingBase: &siblingBase{}}, []string{"k1", "k2", "k3"}},
+	} {
+		sharders := []*ShardScheduler{}
+		for _, variant := range test.variants {
+			sharder := newTestSharder(t, "siblings-"+variant, configs)
+			sharder.siblings, sharder.variant = test.siblings, variant
+			sharders = append(sharders, sharder)
+		}
+
+		first := sharders[0]
+		first.initShards([]string{"us-central1-a", "us-central1-a"}, gcp.Resources{})
+		if len(first.shards) != 2 || test.siblings.Layout() == nil {
+			t.Fatalf("get %d shards and layout %v for the first sibling", len(first.shards), test.siblings.Layout())
+		}
+
+		for _, sharder := range sharders[1:] {
+			sharder.initShards([]string{"us-central1-a", "us-central1-b", "us-central1-c"}, gcp.Resources{})
+			if len(sharder.shards) != len(first.shards) {
+				t.Fatalf("get %d shards for sibling %s, want %d", len(sharder.shards), sharder.variant, len(first.shards))
+			}
+			for i, shard := range sharder.shards {
+				if shard.config != first.shards[i].config {
+					t.Errorf("shard %d of sibling %s runs %s, want %s", i, sharder.variant, shard.config, first.shards[i].config)
+				}
+			}
+		}
+	}
+}
+
+func TestCancelTargets(t *testing.T) {
+	matrix := &MatrixRun{}
+	sharders := []*ShardScheduler{
+		newTestSharder(t, "matrix-k1", nil),
+		newTestSharder(t, "matrix-k2", nil),
+		newTestSharder(t, "matrix", nil),
+		newTestSharder(t, "matrix-other", nil),
+	}
+	sharders[0].siblings, sharders[0].variant = matrix, "k1"
+	sharders[1].siblings, sharders[1].variant = matrix, "k2"
+	for _, sharder := range sharders {
+		sharder.register()
+	}
+	defer func() {
+		sharderLock.Lock()
+		defer sharderLock.Unlock()
+		for _, sharder := range sharders {
+			delete(sharderMap, sharder.testID)
+		}
+	}()
+
+	for _, test := range []struct {
+		testID  string
+		targets []string
+	}{
+		{"matrix", []string{"matrix", "matrix-k1", "matrix-k2"}},
+		{"matrix-k1", []string{"matrix-k1"}},
+		{"matrix-other", []string{"matrix-other"}},
+		{"other", []string{}},
+	} {
+		sharderLock.Lock()
+		targets := []string{}
+		for _, sharder := range cancelTargets(test.testID) {
+			targets = append(targets, sharder.testID)
+		}
+		sharderLock.Unlock()
+		slices.Sort(targets)
+		if !slices.Equal(targets, test.targets) {
+			t.Errorf("get targets %v to cancel %s, want %v", targets, test.testID, test.targets)
+		}
+	}
+}
+
+func TestCancelRunningSharder(t *testing.T) {
+	sharder := newTestSharder(t, "cancel", []string{"ext4/4k", "xfs/4k"})
+	done := make(chan bool)
+	var wg sync.WaitGroup
+
+	// poll the status like the /status endpoint
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				sharderLock.Lock()
+				sharder.Info()
+				sharderLock.Unlock()
+			}
+		}
+	}()
+
+	sharder.initShards([]string{"us-central1-a", "us-central1-a"}, gcp.Resources{})
+	// update the shards like their monitors while waiting for launch
+	for _, shard := range sharder.shards {
+		wg.Add(1)
+		go func(shard *ShardWorker) {
+			defer wg.Done()
+			for shard.cancelled() == "" {
+				shard.setStart(time.Now())
+				shard.status()
+			}
+		}(shard)
+	}
+	sharder.Cancel("admin")
+	close(done)
+	wg.Wait()
+
+	if sharder.cancelled() != "admin" {
+		t.Errorf("test run cancelled by %q, want admin", sharder.cancelled())
+	}
+	var shardWG sync.WaitGroup
+	for _, shard := range sharder.shards {
+		shardWG.Add(1)
+		shard.Run(&shardWG)
+		if info := shard.Info(); info.Status != "cancelled by admin" || info.Result != server.Error.String() {
+			t.Errorf("shard %s has status %q and result %s after cancel", shard.shardID, info.Status, info.Result)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"thunk.org/gce-server/util/check"
+	"thunk.org/gce-server/util/email"
+	"thunk.org/gce-server/util/gcp"
+	"thunk.org/gce-server/util/junit"
+	"thunk.org/gce-server/util/logging"
+	"thunk.org/gce-server/util/parser"
+	"thunk.org/gce-server/util/server"
+
+	"github.com/sirupsen/logrus"
+)
+
+// siblingRunTimeout defines the max time to wait for all siblings to finish.
+const siblingRunTimeout = 24 * time.Hour
+
+// siblingRun is a test run made of several sharders with identical configs
+// and shard layouts, such as an A/B run or a kernel matrix run. The sharders
+// of a sibling run do not send their own email reports.
+type siblingRun interface {
+	// Layout returns the shard layout of the sibling that started first.
+	Layout() []testSlice
+	// SetLayout records the shard layout for the other siblings. It is
+	// only called by the sibling that started first.
+	SetLayout(layout []testSlice)
+	// Finish records the results of a sibling.
+	Finish(variant string, sharder *ShardScheduler)
+	// Fail records a sibling whose kernel KCS failed to build.
+	Fail(variant string)
+	// Variants returns the variants of the siblings.
+	Variants() []string
+}
+
+// siblingBase holds the state shared by A/B and kernel matrix runs: the
+// test request, the shard layout of the first sibling, the results of the
+// siblings and the log of the run. The sibling with variant v runs with
+// testID <testID>-<v>.
+type siblingBase struct {
+	kind    string
+	testID  string
+	origCmd string
+
+	gsBucket           string
+	bucketSubdir       string
+	reportReceiver     string
+	reportFailReceiver string
+	testRequest        server.TaskRequest
+
+	layout   []testSlice
+	results  map[string]*siblingResult
+	lock     sync.Mutex
+	finished chan string
+
+	logDir  string
+	logFile string
+	log     *logrus.Entry
+}
+
+// siblingResult holds the outcome of one sibling of a sibling run.
+type siblingResult struct {
+	TestID        string `json:"test_id"`
+	KernelVersion string `json:"kernel_version"`
+	Result        string `json:"test_result"`
+	resultsFile   string
+}
+
+// siblingRunMap indexes A/B and kernel matrix runs by testID.
+var (
+	siblingRunMap  = make(map[string]siblingRun)
+	siblingRunLock sync.Mutex
+)
+
+// newSiblingBase constructs the shared state of a sibling run of the given
+// kind with the given number of siblings.
+func newSiblingBase(c server.TaskRequest, testID string, kind string, siblings int) *siblingBase {
+	logDir := logging.LTMLogDir + testID + "/"
+	err := check.CreateDir(logDir)
+	if err != nil {
+		panic(err)
+	}
+
+	logFile := logDir + "run.log"
+	log := logging.InitLogger(logFile)
+	log.Info("Initiating " + kind)
+
+	bucketSubdir, _ := gcp.GceConfig.Get("BUCKET_SUBDIR")
+	if c.Options.BucketSubdir != "" {
+		bucketSubdir = c.Options.BucketSubdir
+	}
+	if bucketSubdir == "" {
+		bucketSubdir = "results"
+	}
+
+	gsBucket, err := gcp.GceConfig.Get("GS_BUCKET")
+	check.Panic(err, log, "Failed to get gs bucket config")
+
+	origCmd, err := parser.DecodeCmd(c.CmdLine)
+	check.Panic(err, log, "Failed to decode cmdline")
+
+	return &siblingBase{
+		kind:    kind,
+		testID:  testID,
+		origCmd: origCmd,
+
+		gsBucket:           gsBucket,
+		bucketSubdir:       bucketSubdir,
+		reportReceiver:     c.Options.ReportEmail,
+		reportFailReceiver: c.Options.ReportFailEmail,
+		testRequest:        c,
+
+		results:  make(map[string]*siblingResult),
+		finished: make(chan string, siblings),
+
+		logDir:  logDir,
+		logFile: logFile,
+		log:     log,
+	}
+}
+
+// register adds the sibling run to siblingRunMap, so that its sharders
+// find it by testID.
+func (s *siblingBase) register(run siblingRun) {
+	siblingRunLock.Lock()
+	defer siblingRunLock.Unlock()
+	siblingRunMap[s.testID] = run
+}
+
+// Layout returns the shard layout of the sibling that started first,
+// or nil if no sibling has been sharded yet.
+func (s *siblingBase) Layout() []testSlice {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.layout
+}
+
+// SetLayout records the shard layout so that the other siblings reuse it.
+func (s *siblingBase) SetLayout(layout []testSlice) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.layout = layout
+}
+
+// Finish records the results of a sibling. The results file is copied
+// since the sharder removes its local files when it exits.
+func (s *siblingBase) Finish(variant string, sharder *ShardScheduler) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	log := s.log.WithField("variant", variant)
+
+	r := &siblingResult{
+		TestID:        sharder.testID,
+		KernelVersion: sharder.kernelVersion,
+		Result:        sharder.testResult.String(),
+	}
+	resultsFile := s.logDir + variant + ".xml"
+	err := check.CopyFile(resultsFile, sharder.aggDir+"results.xml")
+	if check.NoError(err, log, "Failed to copy results file") {
+		r.resultsFile = resultsFile
+	}
+	s.results[variant] = r
+	s.finished <- variant
+}
+
+// Fail records a sibling whose kernel KCS failed to build, so that the
+// sibling run reports without waiting for it.
+func (s *siblingBase) Fail(variant string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.results[variant]; ok {
+		return
+	}
+	s.log.WithField("variant", variant).Warn("Sibling kernel failed to build")
+	s.results[variant] = &siblingResult{
+		TestID: s.testID + "-" + variant,
+		Result: server.Error.String(),
+	}
+	s.finished <- variant
+}
+
+// wait blocks until the given number of siblings finish or
+// siblingRunTimeout expires.
+func (s *siblingBase) wait(pending int) {
+	timer := time.NewTimer(siblingRunTimeout)
+	defer timer.Stop()
+	for ; pending > 0; pending-- {
+		select {
+		case variant := <-s.finished:
+			s.log.WithField("variant", variant).Info("Sibling finished")
+		case <-timer.C:
+			s.log.Warn("Sibling run timeout, reporting available results")
+			return
+		}
+	}
+}
+
+// outcomes returns the test outcomes of a sibling, and whether its results
+// are available. The caller must hold the lock.
+func (s *siblingBase) outcomes(variant string) (map[string]junit.Outcome, bool) {
+	r, ok := s.results[variant]
+	if !ok || r.resultsFile == "" {
+		return nil, false
+	}
+	suites, err := junit.Parse(r.resultsFile)
+	if !check.NoError(err, s.log, "Failed to parse results file") {
+		return nil, false
+	}
+	return suites.Outcomes(), true
+}
+
+// uploadReport writes the json report of the sibling run and uploads it
+// next to the test results as results.<ltm>-<testID>-<name>.json. It returns
+// the GS path of the report.
+func (s *siblingBase) uploadReport(r interface{}, name string) string {
+	js, err := json.MarshalIndent(r, "", "\t")
+	check.Panic(err, s.log, "Failed to encode json report")
+	jsonFile := s.logDir + name + "-report.json"
+	err = ioutil.WriteFile(jsonFile, js, 0644)
+	check.Panic(err, s.log, "Failed to write json report")
+
+	gsPath := fmt.Sprintf("%s/results.%s-%s-%s.json", s.bucketSubdir, server.LTMUserName, s.testID, name)
+	gce, err := gcp.NewService(s.gsBucket)
+	if check.NoError(err, s.log, "Failed to connect to GCE service") {
+		err = gce.UploadFile(jsonFile, gsPath)
+		check.NoError(err, s.log, "Failed to upload json report")
+		gce.Close()
+	}
+	return fmt.Sprintf("gs://%s/%s", s.gsBucket, gsPath)
+}
+
+// sendReport emails the combined report, to the failure receiver if the
+// run failed or its results are incomplete.
+func (s *siblingBase) sendReport(subject string, content string, failed bool) {
+	receiver := s.reportReceiver
+	if failed {
+		receiver = s.reportFailReceiver
+	}
+	if receiver == "" {
+		s.log.Info("Skipping e-mail report")
+		return
+	}
+	err := email.Send(subject, content, receiver)
+	check.NoError(err, s.log, "Failed to send the email")
+}
+
+// clean removes the sibling run from siblingRunMap and closes the log.
+func (s *siblingBase) clean() {
+	siblingRunLock.Lock()
+	defer siblingRunLock.Unlock()
+	s.log.Info("Cleaning up " + s.kind + " resources")
+	delete(siblingRunMap, s.testID)
+	logging.CloseLog(s.log)
+}
+
+// findSiblingRun returns the A/B or kernel matrix run and variant a sharder
+// testID belongs to. It returns a nil interface for a standalone sharder.
+// The testID of the sibling run may contain "-" itself, e.g. with --testrunid.
+func findSiblingRun(testID string) (siblingRun, string) {
+	siblingRunLock.Lock()
+	defer siblingRunLock.Unlock()
+
+	i := strings.LastIndex(testID, "-")
+	if i < 0 {
+		return nil, ""
+	}
+	run, ok := siblingRunMap[testID[:i]]
+	variant := testID[i+1:]
+	if !ok || !slices.Contains(run.Variants(), variant) {
+		return nil, ""
+	}
+	return run, variant
+}
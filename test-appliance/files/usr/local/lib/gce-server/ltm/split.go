@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"thunk.org/gce-server/util/check"
+	"thunk.org/gce-server/util/junit"
+	"thunk.org/gce-server/util/server"
+)
+
+// testSlice is the work of a shard: a config, or a part of the tests of a
+// config when the tests are split with --split-tests. label is empty for a
+// whole config, and looks like "2/3" for a slice.
+type testSlice struct {
+	config string
+	tests  []string
+	label  string
+}
+
+/*
+loadTestLists finds the tests each config runs, so that they can be split
+among shards.
+
+The tests are expanded from the group files of the test appliance. With
+--split-results, the run times of the tests in a prior LTM run are used
+to balance the slices, and the tests of the prior run are used for a config
+whose tests cannot be expanded. A config without a test list is not split.
+*/
+func (sharder *ShardScheduler) loadTestLists() {
+	sharder.testLists = make(map[string][]string)
+	sharder.testTimes = make(map[string]map[string]float64)
+	priorLists := make(map[string][]string)
+	if sharder.splitResults != "" {
+		priorLists = sharder.loadPriorResults()
+	}
+
+	for _, config := range sharder.configs {
+		tests, err := sharder.request.ExpandTests(config)
+		if !check.NoError(err, sharder.log, "Failed to expand tests") || len(tests) == 0 {
+			tests = priorLists[config]
+		}
+		if len(tests) > 0 {
+			sharder.testLists[config] = tests
+		}
+	}
+	sharder.log.WithField("numConfigs", len(sharder.testLists)).Info("Loaded test lists")
+}
+
+// loadPriorResults reads the results.xml of a prior LTM run from GS, and
+// keeps the run time of each test. It returns the tests of each config.
+func (sharder *ShardScheduler) loadPriorResults() map[string][]string {
+	lists := make(map[string][]string)
+	log := sharder.log.WithField("splitResults", sharder.splitResults)
+
+	prefix := fmt.Sprintf("%s/results.%s-%s.", sharder.bucketSubdir, server.LTMUserName, sharder.splitResults)
+	names, err := sharder.gce.GetFileNames(prefix)
+	if !check.NoError(err, log, "Failed to find prior results") {
+		return lists
+	}
+	name := ""
+	for _, n := range names {
+		if strings.HasSuffix(n, ".xml") {
+			name = n
+		}
+	}
+	if name == "" {
+		log.WithField("prefix", prefix).Warn("No prior results found")
+		return lists
+	}
+
+	content, err := sharder.gce.ReadFile(name)
+	if !check.NoError(err, log, "Failed to read prior results") {
+		return lists
+	}
+	suites, err := junit.ParseBytes(content)
+	if !check.NoError(err, log, "Failed to parse prior results") {
+		return lists
+	}
+	for _, suite := range suites.Testsuites {
+		config := suite.Config()
+		if sharder.testTimes[config] == nil {
+			sharder.testTimes[config] = make(map[string]float64)
+		}
+		for _, test := range suite.Testcases {
+			// skip the markers added by LTM
+			if !strings.Contains(test.Name, "/") {
+				continue
+			}
+			if _, ok := sharder.testTimes[config][test.Name]; !ok {
+				lists[config] = append(lists[config], test.Name)
+			}
+			sharder.testTimes[config][test.Name] += test.Time
+		}
+	}
+	for config := range lists {
+		sort.Strings(lists[config])
+	}
+	log.WithField("file", name).Info("Loaded prior results")
+	return lists
+}
+
+/*
+shardSlices returns the work of each shard.
+
+The fixed layout of a sibling run is used as is, even if it has more shards
+than numShards. Without --split-tests, each shard runs one or more configs
+as returned by shardConfigs. Otherwise, if there are more shards than
+configs, the tests of each config are split among up to --split-tests
+shards, as far as the shards go around.
+*/
+func (sharder *ShardScheduler) shardSlices(numShards int) []testSlice {
+	if sharder.layout != nil {
+		return sharder.layout
+	}
+	result := []testSlice{}
+	if sharder.testLists == nil || len(sharder.configs) == 0 ||
+		numShards <= len(sharder.configs) {
+		for _, config := range sharder.shardConfigs(numShards) {
+			result = append(result, testSlice{config: config})
+		}
+		return result
+	}
+
+	perConfig := numShards / len(sharder.configs)
+	if perConfig > sharder.splitTests {
+		perConfig = sharder.splitTests
+	}
+	for _, config := range sharder.configs {
+		parts := splitTests(sharder.testLists[config], sharder.testTimes[config], perConfig)
+		if len(parts) <= 1 {
+			result = append(result, testSlice{config: config})
+			continue
+		}
+		for i, tests := range parts {
+			result = append(result, testSlice{
+				config: config,
+				tests:  tests,
+				label:  fmt.Sprintf("%d/%d", i+1, len(parts)),
+			})
+		}
+	}
+	return result
+}
+
+/*
+splitTests splits tests into up to n slices of about the same run time.
+
+It places the longest tests first, each in the slice with the least run
+time so far. A test without a known run time counts as the average of the
+known ones, or as 1 if none is known. Each slice is sorted by test name.
+*/
+func splitTests(tests []string, times map[string]float64, n int) [][]string {
+	if n > len(tests) {
+		n = len(tests)
+	}
+	if n <= 1 {
+		return [][]string{tests}
+	}
+
+	average := 1.0
+	if len(times) > 0 {
+		total := 0.0
+		for _, t := range times {
+			total += t
+		}
+		average = math.Max(total/float64(len(times)), 1)
+	}
+	runtime := func(test string) float64 {
+		if t, ok := times[test]; ok {
+			return t
+		}
+		return average
+	}
+
+	sorted := append([]string{}, tests...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ti, tj := runtime(sorted[i]), runtime(sorted[j])
+		if ti != tj {
+			return ti > tj
+		}
+		return sorted[i] < sorted[j]
+	})
+
+	parts := make([][]string, n)
+	loads := make([]float64, n)
+	for _, test := range sorted {
+		least := 0
+		for i := range loads {
+			if loads[i] < loads[least] {
+				least = i
+			}
+		}
+		parts[least] = append(parts[least], test)
+		loads[least] += runtime(test)
+	}
+	for _, part := range parts {
+		sort.Strings(part)
+	}
+	return parts
+}
+
+/*
+mergeSlices merges the results of the shards that ran slices of the tests
+of a config, so that the report shows a single test suite for the config.
+
+The merged results.xml is written in the first shard of the config, and
+the results.xml files of the other shards are renamed to results.xml.slice,
+so that gen_results_summary only picks up the merged one.
+*/
+func (sharder *ShardScheduler) mergeSlices() {
+	configs := []string{}
+	files := make(map[string][]string)
+	for _, shard := range sharder.shards {
+		if shard.slice == "" {
+			continue
+		}
+		if _, ok := files[shard.config]; !ok {
+			configs = append(configs, shard.config)
+		}
+		files[shard.config] = append(files[shard.config], findResults(sharder.aggDir+shard.shardID)...)
+	}
+
+	for _, config := range configs {
+		log := sharder.log.WithField("config", config)
+		if len(files[config]) < 2 {
+			continue
+		}
+		log.WithField("numFiles", len(files[config])).Info("Merging results of test slices")
+
+		contents := [][]byte{}
+		for _, file := range files[config] {
+			content, err := os.ReadFile(file)
+			if check.NoError(err, log, "Failed to read results file") {
+				contents = append(contents, content)
+			}
+		}
+		if len(contents) < len(files[config]) {
+			continue
+		}
+		merged, err := junit.Merge(contents...)
+		if !check.NoError(err, log, "Failed to merge results") {
+			continue
+		}
+		err = os.WriteFile(files[config][0], merged, 0644)
+		if !check.NoError(err, log, "Failed to write merged results") {
+			continue
+		}
+		for _, file := range files[config][1:] {
+			err = os.Rename(file, file+".slice")
+			check.NoError(err, log, "Failed to rename results file")
+		}
+	}
+}
+
+// findResults returns the results.xml files in the results dir of a shard.
+func findResults(dir string) []string {
+	files := []string{}
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && d.Name() == "results.xml" {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitTests(t *testing.T) {
+	tests := []string{"generic/001", "generic/002", "generic/003", "generic/004", "generic/005"}
+	times := map[string]float64{
+		"generic/001": 100,
+		"generic/002": 10,
+		"generic/003": 60,
+		"generic/004": 50,
+	}
+
+	// generic/005 counts as the average run time of 55
+	expected := [][]string{
+		{"generic/001", "generic/004"},
+		{"generic/002", "generic/003", "generic/005"},
+	}
+	if parts := splitTests(tests, times, 2); !reflect.DeepEqual(parts, expected) {
+		t.Errorf("get slices %v, want %v", parts, expected)
+	}
+
+	// without run times, tests are dealt out evenly
+	expected = [][]string{
+		{"generic/001", "generic/004"},
+		{"generic/002", "generic/005"},
+		{"generic/003"},
+	}
+	if parts := splitTests(tests, nil, 3); !reflect.DeepEqual(parts, expected) {
+		t.Errorf("get slices %v, want %v", parts, expected)
+	}
+
+	if parts := splitTests(tests[:2], nil, 4); len(parts) != 2 {
+		t.Errorf("get %d slices for 2 tests, want 2", len(parts))
+	}
+	if parts := splitTests(tests, nil, 1); !reflect.DeepEqual(parts, [][]string{tests}) {
+		t.Errorf("get slices %v, want a single slice", parts)
+	}
+}
+
+func TestShardSlices(t *testing.T) {
+	sharder := &ShardScheduler{
+		configs:    []string{"ext4/4k", "ext4/1k"},
+		splitTests: 2,
+		testLists: map[string][]string{
+			"ext4/4k": {"generic/001", "generic/002", "generic/003"},
+		},
+	}
+
+	labels := func(slices []testSlice) []string {
+		result := []string{}
+		for _, s := range slices {
+			result = append(result, s.config+" "+s.label)
+		}
+		return result
+	}
+
+	// ext4/1k has no test list, so it is not split
+	expected := []string{"ext4/4k 1/2", "ext4/4k 2/2", "ext4/1k "}
+	if got := labels(sharder.shardSlices(5)); !reflect.DeepEqual(got, expected) {
+		t.Errorf("get slices %q, want %q", got, expected)
+	}
+
+	// not enough shards to split
+	expected = []string{"ext4/4k ", "ext4/1k "}
+	if got := labels(sharder.shardSlices(3)); !reflect.DeepEqual(got, expected) {
+		t.Errorf("get slices %q, want %q", got, expected)
+	}
+	expected = []string{"ext4/4k,ext4/1k "}
+	if got := labels(sharder.shardSlices(1)); !reflect.DeepEqual(got, expected) {
+		t.Errorf("get slices %q, want %q", got, expected)
+	}
+}
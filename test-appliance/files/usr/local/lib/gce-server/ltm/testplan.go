@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+
+	"thunk.org/gce-server/util/check"
+	"thunk.org/gce-server/util/parser"
+	"thunk.org/gce-server/util/server"
+	"thunk.org/gce-server/util/testplan"
+)
+
+// planCmdOptions are the options allowed on the command line of a request
+// with a test plan. The other options must be given in the plan.
+var planCmdOptions = []string{
+	"--plan", "--dry-run", "--testrunid", "--bucket-subdir",
+	"--email", "--fail-email", "--junit-email", "--no-junit-email",
+}
+
+/*
+applyTestPlan converts the test plan of a request into its command line
+and options, so that the request runs like one sent with a command line.
+It returns an error message for each problem of the plan, and leaves the
+request unchanged if there is any.
+*/
+func applyTestPlan(c *server.TaskRequest) []string {
+	plan, err := testplan.Parse(c.Plan)
+	if err != nil {
+		return []string{"invalid test plan: " + err.Error()}
+	}
+	errs := plan.Validate()
+
+	origCmd, err := parser.DecodeCmd(c.CmdLine)
+	if err != nil {
+		return append(errs, "failed to decode the command line: "+err.Error())
+	}
+	req, err := parser.Parse(origCmd)
+	if err != nil {
+		return append(errs, err.Error())
+	}
+	for _, arg := range req.Options {
+		if !slices.Contains(planCmdOptions, arg.Name) {
+			errs = append(errs, fmt.Sprintf("option %s must be given in the test plan", arg.Name))
+		}
+	}
+	if len(req.Tests) > 0 {
+		errs = append(errs, "tests must be given in the test plan")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	options := server.UserOptions{}
+	if c.Options != nil {
+		options = *c.Options
+	}
+	plan.Apply(&options)
+	if options.CommitID != "" && options.GitRepo == "" {
+		return []string{"the kernel commit needs a repo, in the test plan or GIT_REPO of the configuration"}
+	}
+	c.Options = &options
+	c.CmdLine = parser.EncodeCmd(plan.CmdLine())
+	return []string{}
+}
+
+// savePlan stores the test plan of a request with the results, so that
+// the test run can be repeated.
+func (sharder *ShardScheduler) savePlan() {
+	if len(sharder.testPlan) == 0 {
+		return
+	}
+	sharder.log.Info("Saving test plan")
+
+	var b bytes.Buffer
+	err := json.Indent(&b, sharder.testPlan, "", "  ")
+	if !check.NoError(err, sharder.log, "Failed to format test plan") {
+		return
+	}
+	b.WriteString("\n")
+	err = os.WriteFile(sharder.aggDir+"test-plan.json", b.Bytes(), 0644)
+	check.NoError(err, sharder.log, "Failed to write test plan")
+}
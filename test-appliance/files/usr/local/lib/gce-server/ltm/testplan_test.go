@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"thunk.org/gce-server/util/parser"
+	"thunk.org/gce-server/util/server"
+)
+
+func TestApplyTestPlan(t *testing.T) {
+	plan := `{
+		"version": 1,
+		"configs": ["ext4/4k"],
+		"groups": ["quick"],
+		"kernels": [{"commit": "v6.10"}]
+	}`
+
+	c := server.TaskRequest{
+		CmdLine: parser.EncodeCmd("ltm --plan plan.yaml -c ext4/1k generic/001"),
+		Plan:    []byte(plan),
+		Options: &server.UserOptions{GitRepo: "https://example.com/linux.git"},
+	}
+	expected := []string{
+		"option -c must be given in the test plan",
+		"tests must be given in the test plan",
+	}
+	if errs := applyTestPlan(&c); !reflect.DeepEqual(errs, expected) {
+		t.Errorf("get errors %q, want %q", errs, expected)
+	}
+
+	c.CmdLine = parser.EncodeCmd("ltm --plan plan.yaml --dry-run")
+	if errs := applyTestPlan(&c); len(errs) != 0 {
+		t.Fatalf("get errors %q for a valid plan", errs)
+	}
+	cmdLine, _ := parser.DecodeCmd(c.CmdLine)
+	if cmdLine != "-c ext4/4k -g quick" || c.Options.CommitID != "v6.10" {
+		t.Errorf("get command line %q and commit %q from the plan", cmdLine, c.Options.CommitID)
+	}
+
+	cmdLine = parser.EncodeCmd("ltm --plan plan.yaml")
+	c = server.TaskRequest{
+		CmdLine: cmdLine,
+		Plan:    []byte(plan),
+		Options: &server.UserOptions{},
+	}
+	if errs := applyTestPlan(&c); len(errs) != 1 {
+		t.Errorf("get errors %q for a commit without a repo", errs)
+	}
+	if c.CmdLine != cmdLine || c.Options.CommitID != "" {
+		t.Errorf("request changed to %q with commit %q by an invalid plan", c.CmdLine, c.Options.CommitID)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"thunk.org/gce-server/util/gcp"
+	"thunk.org/gce-server/util/parser"
+	"thunk.org/gce-server/util/server"
+)
+
+/*
+validateRequest checks a test request from user before anything is
+launched, and returns an error message for each problem found.
+
+It checks the command line against the gce-xfstests option table, that
+the configs exist, and that the option values parse. The kernel is checked
+separately by validateKernel, since it may not be built yet.
+*/
+func validateRequest(c server.TaskRequest) []string {
+	origCmd, err := parser.DecodeCmd(c.CmdLine)
+	if err != nil {
+		return []string{"failed to decode the command line: " + err.Error()}
+	}
+	req, err := parser.Parse(origCmd)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	return append(append(req.Validate(), req.CheckConfigs()...), validateOptions(c.Options, req)...)
+}
+
+/*
+validateOptions checks the option values of a test request, with the
+validation of the matching command line options.
+
+The options sent by the client repeat the values of the command line, so an
+option given on the command line of req is only checked by req.Validate.
+*/
+func validateOptions(o *server.UserOptions, req *parser.Request) []string {
+	errs := []string{}
+	for _, arg := range []parser.Arg{
+		{Name: "--monitor-timeout", Value: o.MonitorTimeout},
+		{Name: "--arch", Value: o.Arch},
+		{Name: "--watch-commits", Value: o.WatchCommits},
+	} {
+		if arg.Value == "" || req.Has(arg.Name) {
+			continue
+		}
+		if err := parser.CheckValue(arg.Name, arg.Value); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if o.WatchMaxCommits < 0 && !req.Has("--watch-max-commits") {
+		errs = append(errs, fmt.Sprintf("invalid --watch-max-commits %d: must not be negative", o.WatchMaxCommits))
+	}
+	if o.SplitTests < 0 && !req.Has("--split-tests") {
+		errs = append(errs, fmt.Sprintf("invalid --split-tests %d: must not be negative", o.SplitTests))
+	}
+	if o.SplitResults != "" && o.SplitTests == 0 {
+		errs = append(errs, "--split-results requires --split-tests")
+	}
+	if (o.BadCommit == "") != (o.GoodCommit == "") {
+		errs = append(errs, "--bisect-bad and --bisect-good must be given together")
+	}
+	if o.CommitID == "" {
+		if o.BuildOnly {
+			errs = append(errs, "--build-only requires --commit")
+		}
+		if o.BackportCommits != "" {
+			errs = append(errs, "--backport requires a base stable branch or commit in --commit")
+		}
+		if o.PatchMbox != "" || o.MessageID != "" {
+			errs = append(errs, "patch series test requires a base commit in --commit")
+		}
+	}
+	if len(o.KernelMatrix) > 0 {
+		errs = append(errs, validateKernelMatrix(o)...)
+	}
+	return errs
+}
+
+// validateKernelMatrix checks the kernels of a kernel matrix run. Each of
+// them is either a kernel in GS or a commit, and is tested like a single
+// --kernel or --commit.
+func validateKernelMatrix(o *server.UserOptions) []string {
+	errs := []string{}
+	if len(o.KernelMatrix) < 2 {
+		errs = append(errs, "--kernel-matrix requires at least two kernels")
+	}
+	if o.GsKernel != "" || o.CommitID != "" {
+		errs = append(errs, "--kernel-matrix conflicts with --kernel and --commit")
+	}
+	if o.BranchName != "" || o.BadCommit != "" || o.GoodCommit != "" || o.BuildOnly {
+		errs = append(errs, "--kernel-matrix conflicts with --watch, --bisect-bad, --bisect-good and --build-only")
+	}
+	if o.BackportCommits != "" || o.PatchMbox != "" || o.MessageID != "" {
+		errs = append(errs, "--kernel-matrix conflicts with backport and patch series tests")
+	}
+
+	seen := make(map[server.MatrixKernel]bool)
+	for i, k := range o.KernelMatrix {
+		switch {
+		case k.GsKernel == "" && k.CommitID == "":
+			errs = append(errs, fmt.Sprintf("kernel %d of --kernel-matrix has no gs:// path or commit", i+1))
+		case k.GsKernel != "" && k.CommitID != "":
+			errs = append(errs, fmt.Sprintf("kernel %d of --kernel-matrix has both a gs:// path and a commit", i+1))
+		case k.GsKernel != "" && !strings.HasPrefix(k.GsKernel, "gs://"):
+			errs = append(errs, fmt.Sprintf("kernel %s of --kernel-matrix is not a gs:// path", k.GsKernel))
+		case k.CommitID != "" && k.GitRepo == "" && o.GitRepo == "":
+			errs = append(errs, fmt.Sprintf("commit %s of --kernel-matrix requires --repo", k.CommitID))
+		}
+		if seen[k] {
+			errs = append(errs, fmt.Sprintf("kernel %s appears twice in --kernel-matrix", k))
+		}
+		seen[k] = true
+	}
+	return errs
+}
+
+/*
+validateKernel checks that the kernel of a sharder exists in GS, and that
+its architecture from get-kernel-info matches the requested architecture.
+*/
+func (sharder *ShardScheduler) validateKernel() []string {
+	if sharder.gsKernel == "" {
+		return []string{"no kernel to test, use --kernel or --commit"}
+	}
+	exists, err := sharder.kernelExists()
+	if err != nil {
+		return []string{fmt.Sprintf("failed to look up kernel %s: %v", sharder.gsKernel, err)}
+	}
+	if !exists {
+		return []string{fmt.Sprintf("kernel %s does not exist", sharder.gsKernel)}
+	}
+	if sharder.kernelArch == "" {
+		return []string{fmt.Sprintf("failed to get the architecture of kernel %s", sharder.gsKernel)}
+	}
+	if !archMatches(sharder.arch, sharder.kernelArch) {
+		return []string{fmt.Sprintf("kernel %s is built for %s, not %s",
+			sharder.gsKernel, sharder.kernelArch, sharder.arch)}
+	}
+	return []string{}
+}
+
+// kernelExists returns whether the kernel of a sharder exists in GS. The
+// kernel may be in another bucket than the results.
+func (sharder *ShardScheduler) kernelExists() (bool, error) {
+	path := strings.TrimPrefix(sharder.gsKernel, "gs://")
+	if path == sharder.gsKernel {
+		return false, fmt.Errorf("not a gs:// path")
+	}
+	bucket, name, found := strings.Cut(path, "/")
+	if !found || name == "" {
+		return false, fmt.Errorf("no object name in path")
+	}
+	if bucket == sharder.gsBucket {
+		return sharder.gce.FileExists(name)
+	}
+	gce, err := gcp.NewService(bucket)
+	if err != nil {
+		return false, err
+	}
+	defer gce.Close()
+	return gce.FileExists(name)
+}
+
+// archMatches returns whether a kernel built for kernelArch runs on arch.
+// An x86 kernel runs on both i386 and amd64, and any kernel matches if no
+// arch is requested.
+func archMatches(arch string, kernelArch string) bool {
+	if arch == "" || arch == kernelArch {
+		return true
+	}
+	return kernelArch == "x86" && (arch == "i386" || arch == "amd64")
+}
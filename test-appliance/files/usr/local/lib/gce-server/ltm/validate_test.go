@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"thunk.org/gce-server/util/parser"
+	"thunk.org/gce-server/util/server"
+)
+
+func TestValidateOptions(t *testing.T) {
+	tests := []struct {
+		options server.UserOptions
+		errs    []string
+	}{
+		{server.UserOptions{MonitorTimeout: "2h", Arch: "arm64"}, []string{}},
+		{server.UserOptions{MonitorTimeout: "2 hours"}, []string{
+			`invalid --monitor-timeout 2 hours: time: unknown unit " hours" in duration "2 hours"`,
+		}},
+		{server.UserOptions{MonitorTimeout: "-1h", Arch: "x86"}, []string{
+			"invalid --monitor-timeout -1h: must be positive",
+			"invalid --arch x86: must be one of amd64, arm64, i386",
+		}},
+		{server.UserOptions{WatchCommits: "last", BadCommit: "v6.1"}, []string{
+			"invalid --watch-commits last: must be first-parent or all",
+			"--bisect-bad and --bisect-good must be given together",
+		}},
+		{server.UserOptions{BuildOnly: true}, []string{"--build-only requires --commit"}},
+		{server.UserOptions{SplitTests: 4, SplitResults: "20260101000000"}, []string{}},
+		{server.UserOptions{SplitResults: "20260101000000"}, []string{"--split-results requires --split-tests"}},
+		{server.UserOptions{GitRepo: "https://example.com/linux.git", KernelMatrix: []server.MatrixKernel{
+			{GsKernel: "gs://bucket/bzImage-6.1"},
+			{CommitID: "v6.6"},
+			{GitRepo: "https://example.com/stable.git", CommitID: "v6.6"},
+		}}, []string{}},
+		{server.UserOptions{CommitID: "v6.6", GitRepo: "https://example.com/linux.git", KernelMatrix: []server.MatrixKernel{
+			{GsKernel: "gs://bucket/bzImage-6.1", CommitID: "v6.1"},
+			{CommitID: "v6.6"},
+			{CommitID: "v6.6"},
+		}}, []string{
+			"--kernel-matrix conflicts with --kernel and --commit",
+			"kernel 1 of --kernel-matrix has both a gs:// path and a commit",
+			"kernel v6.6 appears twice in --kernel-matrix",
+		}},
+		{server.UserOptions{KernelMatrix: []server.MatrixKernel{{GsKernel: "bzImage"}, {CommitID: "v6.6"}}}, []string{
+			"kernel bzImage of --kernel-matrix is not a gs:// path",
+			"commit v6.6 of --kernel-matrix requires --repo",
+		}},
+		{server.UserOptions{KernelMatrix: []server.MatrixKernel{{GsKernel: "gs://bucket/bzImage"}}}, []string{
+			"--kernel-matrix requires at least two kernels",
+		}},
+	}
+
+	for _, e := range tests {
+		if errs := validateOptions(&e.options, &parser.Request{}); !reflect.DeepEqual(errs, e.errs) {
+			t.Errorf("get errors %q for %+v, want %q", errs, e.options, e.errs)
+		}
+	}
+}
+
+func TestValidateRequestOnce(t *testing.T) {
+	c := server.TaskRequest{
+		CmdLine: parser.EncodeCmd("ltm -c ext4/4k --monitor-timeout 2hours --split-tests -1 generic/001"),
+		Options: &server.UserOptions{MonitorTimeout: "2hours", SplitTests: -1},
+	}
+	errs := validateRequest(c)
+	for _, name := range []string{"--monitor-timeout", "--split-tests"} {
+		n := 0
+		for _, err := range errs {
+			if strings.Contains(err, name) {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Errorf("get %d errors about %s in %q, want 1", n, name, errs)
+		}
+	}
+}
+
+func TestArchMatches(t *testing.T) {
+	tests := []struct {
+		arch, kernelArch string
+		match            bool
+	}{
+		{"", "arm64", true},
+		{"amd64", "x86", true},
+		{"i386", "x86", true},
+		{"arm64", "arm64", true},
+		{"arm64", "x86", false},
+		{"amd64", "arm64", false},
+	}
+
+	for _, e := range tests {
+		if match := archMatches(e.arch, e.kernelArch); match != e.match {
+			t.Errorf("archMatches(%s, %s) = %v, want %v", e.arch, e.kernelArch, match, e.match)
+		}
+	}
+}
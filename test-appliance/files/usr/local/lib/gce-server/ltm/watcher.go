@@ -28,12 +28,22 @@ const (
 	aggMinCount = 10
 	// historyLength sets the length of testHistory return by ltm-info.
 	historyLength = 10
+	// defaultMaxCommits caps the commits tested per push in per-commit mode.
+	defaultMaxCommits = 10
+
+	// watchFirstParent tests each commit on the first-parent chain of a push.
+	watchFirstParent = "first-parent"
+	// watchAll tests each commit in a push, including those merged in.
+	watchAll = "all"
 )
 
-// GitWatcher watches a branch of a remote repo and detects new commits
+// GitWatcher watches a branch of a remote repo and detects new commits.
+// By default only the new HEAD is tested. In per-commit mode, each commit
+// of a push is tested, up to maxCommits of the newest ones.
 type GitWatcher struct {
 	testID  string
 	origCmd string
+	user    string
 
 	gsBucket           string
 	bucketSubdir       string
@@ -44,9 +54,12 @@ type GitWatcher struct {
 	packHistory        []string
 	historyLock        sync.Mutex
 	buildID            int
+	commitMode         string
+	maxCommits         int
 
-	repo *git.RemoteRepository
-	done chan bool
+	repo    *git.RemoteRepository
+	repoDir string
+	done    chan bool
 
 	logDir     string
 	resultsDir string
@@ -78,7 +91,7 @@ func NewGitWatcher(c server.TaskRequest, testID string) *GitWatcher {
 
 	logFile := logDir + "run.log"
 	log := logging.InitLogger(logFile)
-	log.Info("Initiating git watcher")
+	log.WithField("user", c.User).Info("Initiating git watcher")
 
 	resultsDir := logDir + "results/"
 	err = check.CreateDir(resultsDir)
@@ -98,6 +111,15 @@ func NewGitWatcher(c server.TaskRequest, testID string) *GitWatcher {
 	origCmd, err := parser.DecodeCmd(c.CmdLine)
 	check.Panic(err, log, "Failed to decode cmdline")
 
+	commitMode := c.Options.WatchCommits
+	if commitMode != "" && commitMode != watchFirstParent && commitMode != watchAll {
+		log.WithField("watchCommits", commitMode).Panic("Unknown per-commit watch mode")
+	}
+	maxCommits := c.Options.WatchMaxCommits
+	if maxCommits <= 0 {
+		maxCommits = defaultMaxCommits
+	}
+
 	done := make(chan bool)
 	repo, err := git.NewRemoteRepository(c.Options.GitRepo, c.Options.BranchName)
 	check.Panic(err, log, "failed to initiate remote repo")
@@ -105,11 +127,13 @@ func NewGitWatcher(c server.TaskRequest, testID string) *GitWatcher {
 	c.ExtraOptions = &server.InternalOptions{
 		TestID:    testID,
 		Requester: server.LTMBuild,
+		Priority:  server.WatcherPriority,
 	}
 
 	watcher := &GitWatcher{
 		testID:  testID,
 		origCmd: origCmd,
+		user:    c.User,
 
 		gsBucket:           gsBucket,
 		bucketSubdir:       bucketSubdir,
@@ -119,8 +143,11 @@ func NewGitWatcher(c server.TaskRequest, testID string) *GitWatcher {
 		testHistory:        []server.TestInfo{},
 		packHistory:        []string{},
 		buildID:            0,
+		commitMode:         commitMode,
+		maxCommits:         maxCommits,
 
 		repo:       repo,
+		repoDir:    logDir + "repo.git/",
 		done:       done,
 		logDir:     logDir,
 		resultsDir: resultsDir,
@@ -149,7 +176,7 @@ func (watcher *GitWatcher) watch() {
 	var runonce bool
 	var skip, skipAmount int
 
-	subject := fmt.Sprintf("xfstests LTM watcher failure " + watcher.testID)
+	subject := "xfstests LTM watcher failure " + watcher.testID
 	defer email.ReportFailure(watcher.log, watcher.logFile, watcher.reportFailReceiver, subject)
 
 	checkTicker := time.NewTicker(checkInterval)
@@ -159,7 +186,7 @@ func (watcher *GitWatcher) watch() {
 
 	start := time.Now()
 	if !watcher.testRequest.Options.WatchSkipInitial {
-		watcher.InitTest()
+		watcher.InitTest(watcher.repo.Head())
 	} else {
 		watcher.log.Info("Skipping initial test run as requested")
 	}
@@ -176,6 +203,7 @@ func (watcher *GitWatcher) watch() {
 				continue
 			}
 			watcher.log.WithField("time", time.Since(start).Round(time.Second)).Debug("Checking for new commits")
+			oldHead := watcher.repo.Head()
 			updated, err := watcher.repo.Update()
 			if err != nil {
 				if !runonce {
@@ -195,7 +223,7 @@ func (watcher *GitWatcher) watch() {
 			runonce = true
 			skipAmount = 0
 			if updated {
-				watcher.InitTest()
+				watcher.InitTests(oldHead)
 			}
 
 		case <-aggTicker.C:
@@ -205,29 +233,80 @@ func (watcher *GitWatcher) watch() {
 	}
 }
 
-// InitTest initiates a kernel building and testing using the current repo head.
-func (watcher *GitWatcher) InitTest() {
+// InitTests initiates tests for a push that moved the branch from oldHead
+// to the current repo head.
+func (watcher *GitWatcher) InitTests(oldHead string) {
+	for _, commit := range watcher.pushedCommits(oldHead) {
+		watcher.InitTest(commit)
+	}
+}
+
+/*
+pushedCommits returns the commits to test for a push from oldHead to the
+current repo head.
+
+By default only the new head is tested. In per-commit mode, the commits in
+oldHead..head are tested one by one, oldest first. If there are more than
+maxCommits of them, only the newest ones are tested.
+*/
+func (watcher *GitWatcher) pushedCommits(oldHead string) []string {
+	head := watcher.repo.Head()
+	if watcher.commitMode == "" {
+		return []string{head}
+	}
+
+	log := watcher.log.WithFields(logrus.Fields{
+		"oldHead": oldHead,
+		"newHead": head,
+		"mode":    watcher.commitMode,
+	})
+	w := log.WithField("cmd", "revList").Writer()
+	defer w.Close()
+	commits, err := watcher.repo.RevList(watcher.repoDir, oldHead, head, watcher.commitMode == watchFirstParent, w)
+	if !check.NoError(err, log, "Failed to list pushed commits, testing new head only") || len(commits) == 0 {
+		commits = []string{head}
+	}
+
+	if len(commits) > watcher.maxCommits {
+		log.WithFields(logrus.Fields{
+			"commits":    len(commits),
+			"maxCommits": watcher.maxCommits,
+		}).Warn("Too many commits pushed, skipping the oldest ones")
+		commits = commits[len(commits)-watcher.maxCommits:]
+	}
+	log.WithField("commits", len(commits)).Info("Testing pushed commits")
+	return commits
+}
+
+// InitTest initiates a kernel building and testing on a commit.
+func (watcher *GitWatcher) InitTest(commit string) {
 	watcher.historyLock.Lock()
 	watcher.buildID++
 	log := watcher.log.WithFields(logrus.Fields{
 		"buildID": watcher.buildID,
-		"commit":  watcher.repo.Head(),
+		"commit":  commit,
 	})
 	log.Info("initiating new build and test task")
 	testID := fmt.Sprintf("%s-%04d", watcher.testID, watcher.buildID)
 
 	watcher.testHistory = append(watcher.testHistory, server.TestInfo{
 		TestID:     testID,
-		Commit:     watcher.repo.Head()[:12],
+		Commit:     commit[:12],
 		UpdateTime: time.Now().Format(time.Stamp),
 		Status:     "running",
 	})
 	watcher.historyLock.Unlock()
 
-	watcher.testRequest.Options.CommitID = watcher.repo.Head()
-	watcher.testRequest.ExtraOptions.TestID = testID
+	// copy the options since several tests can be forwarded at once
+	c := watcher.testRequest
+	options := *c.Options
+	options.CommitID = commit
+	c.Options = &options
+	extraOptions := *c.ExtraOptions
+	extraOptions.TestID = testID
+	c.ExtraOptions = &extraOptions
 
-	go ForwardKCS(watcher.testRequest, watcher.testID)
+	go ForwardKCS(c, watcher.testID)
 }
 
 // tidyUp used to clean up the GCS bucket by fetching and aggregating
@@ -252,6 +331,7 @@ func (watcher *GitWatcher) Clean() {
 	delete(watcherMap, watcher.testID)
 	close(watcher.done)
 	os.RemoveAll(watcher.resultsDir)
+	os.RemoveAll(watcher.repoDir)
 	logging.CloseLog(watcher.log)
 }
 
@@ -265,6 +345,7 @@ func (watcher *GitWatcher) Info() server.WatcherInfo {
 	}
 	return server.WatcherInfo{
 		ID:      watcher.testID,
+		User:    watcher.user,
 		Command: watcher.origCmd,
 		Repo:    watcher.testRequest.Options.GitRepo,
 		Branch:  watcher.testRequest.Options.BranchName,
@@ -291,9 +372,13 @@ func (watcher *GitWatcher) UpdateTest(testID string, testResult server.ResultTyp
 }
 
 // StopWatcher finds the running watcher on a given branch and terminate it.
+// Only admins can stop watchers started by other users.
 // It panics if no matching watcher is found.
-func StopWatcher(c server.TaskRequest) {
+func StopWatcher(c server.TaskRequest, admin bool) {
 	if watcher, ok := watcherMap[c.Options.UnWatch]; ok {
+		if watcher.user != c.User && !admin {
+			panic("Only admins can stop watchers started by other users")
+		}
 		watcher.done <- true
 		return
 	}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"thunk.org/gce-server/util/check"
+	"thunk.org/gce-server/util/git"
+
+	"github.com/sirupsen/logrus"
+)
+
+// gitIn runs a git command in dir and returns its trimmed output.
+func gitIn(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	output, err := check.CombinedOutput(exec.Command("git", args...), dir, check.EmptyEnv)
+	if err != nil {
+		t.Fatalf("git %s failed: %v\n%s", strings.Join(args, " "), err, output)
+	}
+	return strings.TrimSpace(output)
+}
+
+// gitCommit creates an empty commit in dir and returns its hash.
+func gitCommit(t *testing.T, dir string, msg string) string {
+	t.Helper()
+	gitIn(t, dir, "commit", "-q", "--allow-empty", "-m", msg)
+	return gitIn(t, dir, "rev-parse", "HEAD")
+}
+
+func TestPushedCommits(t *testing.T) {
+	for _, env := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(env, "test")
+	}
+	for _, env := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(env, "test@localhost")
+	}
+	dir := t.TempDir()
+	gitIn(t, dir, "init", "-q", "-b", "master")
+	oldHead := gitCommit(t, dir, "initial commit")
+	gitIn(t, dir, "checkout", "-q", "-b", "side")
+	side := gitCommit(t, dir, "side commit")
+	gitIn(t, dir, "checkout", "-q", "master")
+	first := gitCommit(t, dir, "first commit")
+	second := gitCommit(t, dir, "second commit")
+	gitIn(t, dir, "merge", "-q", "--no-ff", "-m", "merge side", "side")
+	head := gitIn(t, dir, "rev-parse", "HEAD")
+
+	repo, err := git.NewRemoteRepository(dir, "master")
+	if err != nil {
+		t.Fatalf("failed to watch local repo: %v", err)
+	}
+	tests := []struct {
+		mode       string
+		maxCommits int
+		oldHead    string
+		commits    []string
+	}{
+		{"", 10, oldHead, []string{head}},
+		{watchFirstParent, 10, oldHead, []string{first, second, head}},
+		{watchFirstParent, 2, oldHead, []string{second, head}},
+		{watchAll, 1, oldHead, []string{head}},
+		{watchFirstParent, 10, head, []string{head}},
+		{watchFirstParent, 10, "0123456789abcdef0123456789abcdef01234567", []string{head}},
+	}
+	for i, test := range tests {
+		watcher := &GitWatcher{
+			commitMode: test.mode,
+			maxCommits: test.maxCommits,
+			repo:       repo,
+			repoDir:    filepath.Join(t.TempDir(), "repo.git"),
+			log:        logrus.NewEntry(logrus.New()),
+		}
+		if commits := watcher.pushedCommits(test.oldHead); !reflect.DeepEqual(commits, test.commits) {
+			t.Errorf("case %d: get commits %v, want %v", i, commits, test.commits)
+		}
+	}
+
+	watcher := &GitWatcher{
+		commitMode: watchAll,
+		maxCommits: 10,
+		repo:       repo,
+		repoDir:    filepath.Join(t.TempDir(), "repo.git"),
+		log:        logrus.NewEntry(logrus.New()),
+	}
+	commits := watcher.pushedCommits(oldHead)
+	if len(commits) != 4 || commits[3] != head || !slices.Contains(commits, side) ||
+		slices.Index(commits, first) > slices.Index(commits, second) {
+		t.Errorf("get commits %v, want %s, %s and %s before %s", commits, side, first, second, head)
+	}
+}
@@ -0,0 +1,186 @@
+// Package cron parses the cron expressions of scheduled LTM test runs.
+//
+// An expression has five fields: minute, hour, day of month, month and day of
+// week. A field is "*", a number, a range "a-b", or a list of them separated
+// by commas. "*" and ranges may have a step, e.g. "*/15" or "1-5/2", and "a/n"
+// is short for "a-max/n". Days of week are 0-7, where both 0 and 7 are
+// Sunday. Names of months and days are not supported.
+//
+// As in crontab, if both the day of month and the day of week are restricted,
+// a day matching either of them matches. The macros @yearly, @monthly,
+// @weekly, @daily (or @midnight) and @hourly are accepted too.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// searchYears bounds the search for the next run of a schedule, so that
+// expressions that never match, e.g. "0 0 30 2 *", do not loop forever.
+const searchYears = 5
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+type field struct {
+	name string
+	min  int
+	max  int
+}
+
+var fields = []field{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// Schedule is a parsed cron expression. Each field is a bitset of the
+// values it matches.
+type Schedule struct {
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	// anyDay is set if the day of month or the day of week is "*", so
+	// that a day must match both of them.
+	anyDay bool
+}
+
+// Parse parses a cron expression.
+func Parse(expr string) (*Schedule, error) {
+	if m, ok := macros[expr]; ok {
+		expr = m
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("cron expression %q must have %d fields", expr, len(fields))
+	}
+
+	sets := make([]uint64, len(fields))
+	for i, f := range fields {
+		set, err := f.parse(parts[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", f.name, parts[i], err)
+		}
+		sets[i] = set
+	}
+
+	s := &Schedule{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		anyDay: strings.HasPrefix(parts[2], "*") || strings.HasPrefix(parts[4], "*"),
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+// parse returns the bitset of the values matched by a field.
+func (f field) parse(expr string) (uint64, error) {
+	var set uint64
+	for _, item := range strings.Split(expr, ",") {
+		valueRange, stepValue, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepValue)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepValue)
+			}
+			step = n
+		}
+
+		low, high := f.min, f.max
+		if valueRange != "*" {
+			first, last, isRange := strings.Cut(valueRange, "-")
+			var err error
+			low, err = f.value(first)
+			if err != nil {
+				return 0, err
+			}
+			switch {
+			case isRange:
+				high, err = f.value(last)
+				if err != nil {
+					return 0, err
+				}
+				if high < low {
+					return 0, fmt.Errorf("invalid range %q", valueRange)
+				}
+			case !hasStep:
+				high = low
+			}
+		}
+
+		for v := low; v <= high; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func (f field) value(s string) (int, error) {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("value %d out of range %d-%d", v, f.min, f.max)
+	}
+	return v, nil
+}
+
+/*
+Next returns the first minute after t that matches the schedule, in the
+location of t. It returns the zero time if the schedule does not match
+within the next five years.
+*/
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(searchYears, 0, 0)
+
+	for t.Before(end) {
+		switch {
+		case !has(s.month, int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !has(s.hour, t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !has(s.minute, t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) matchDay(t time.Time) bool {
+	dom := has(s.dom, t.Day())
+	dow := has(s.dow, int(t.Weekday()))
+	if s.anyDay {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func has(set uint64, v int) bool {
+	return set&(1<<uint(v)) != 0
+}
@@ -0,0 +1,62 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	// a Monday
+	from := time.Date(2026, 3, 2, 10, 30, 15, 0, time.UTC)
+
+	for _, test := range []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2026, 3, 2, 10, 31, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2026, 3, 3, 10, 30, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2026, 3, 3, 2, 0, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2026, 3, 2, 10, 40, 0, 0, time.UTC)},
+		{"45 9-17/4 * * *", time.Date(2026, 3, 2, 13, 45, 0, 0, time.UTC)},
+		{"0 0 * * 6,7", time.Date(2026, 3, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2026, 3, 8, 0, 0, 0, 0, time.UTC)},
+		{"0 0 15 * 5", time.Date(2026, 3, 6, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1 1/6 *", time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2026, 3, 8, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, 3, 2, 11, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		s, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("failed to parse %q: %v", test.expr, err)
+			continue
+		}
+		if next := s.Next(from); !next.Equal(test.expected) {
+			t.Errorf("get next run %v for %q, want %v", next, test.expr, test.expected)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"0 2 * *",
+		"0 2 * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1,,2 * * * *",
+		"@often",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("expected error for %q", expr)
+		}
+	}
+}
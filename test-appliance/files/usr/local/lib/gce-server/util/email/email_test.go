@@ -1,4 +1,4 @@
-package email
+package email_test
 
 import (
 	"thunk.org/gce-server/util/email"
@@ -34,12 +34,30 @@ type Service struct {
 	bucket  *storage.BucketHandle
 }
 
-// Quota holds the quota limits for a zone.
+// Resources counts the GCE resources that limit the number of test VMs.
+// SSD is in GB.
+type Resources struct {
+	CPUs int
+	IPs  int
+	SSD  int
+}
+
+// Add returns the sum of two resources.
+func (r Resources) Add(other Resources) Resources {
+	return Resources{r.CPUs + other.CPUs, r.IPs + other.IPs, r.SSD + other.SSD}
+}
+
+// Sub returns the resources left after other is taken from r.
+func (r Resources) Sub(other Resources) Resources {
+	return Resources{r.CPUs - other.CPUs, r.IPs - other.IPs, r.SSD - other.SSD}
+}
+
+// Quota holds the quota limits for a zone. Available is what is left of
+// the quota of its region, and Shard is what every test VM needs.
 type Quota struct {
-	Zone     string
-	cpuLimit int
-	ipLimit  int
-	ssdLimit int
+	Zone      string
+	Available Resources
+	Shard     Resources
 }
 
 // NewService launches a new GCP service client.
@@ -122,8 +140,7 @@ func (gce *Service) getZoneInfo(projID string, zone string) (*compute.Zone, erro
 
 // GetRegionQuota picks the first available zone in a region and returns the
 // quota limits on it.
-// Every shard needs 2 vCPUs and SSD space of GCE_MIN_SCR_SIZE.
-// SSD space is no less than 50 GB.
+// The resources every shard needs are given by ShardResources.
 func (gce *Service) GetRegionQuota(projID string, region string) (*Quota, error) {
 	regionInfo, err := gce.getRegionInfo(projID, region)
 	if err != nil {
@@ -145,34 +162,43 @@ func (gce *Service) GetRegionQuota(projID string, region string) (*Quota, error)
 	if pickedZone == "" {
 		return nil, fmt.Errorf("GCE region %s has no available zones", region)
 	}
-	var cpuNum, ipNum, ssdNum int
+	var available Resources
 
 	for _, quota := range regionInfo.Quotas {
 		switch quota.Metric {
 		case "CPUS":
-			cpuNum = int(quota.Limit - quota.Usage)
+			available.CPUs = int(quota.Limit - quota.Usage)
 		case "IN_USE_ADDRESSES":
-			ipNum = int(quota.Limit - quota.Usage)
+			available.IPs = int(quota.Limit - quota.Usage)
 		case "SSD_TOTAL_GB":
-			ssdNum = int(quota.Limit - quota.Usage)
+			available.SSD = int(quota.Limit - quota.Usage)
 		}
 	}
-	size, err := GceConfig.Get("GCE_MIN_SCR_SIZE")
+	shard, err := ShardResources()
 	if err != nil {
 		return nil, err
 	}
+
+	return &Quota{
+		Zone:      pickedZone,
+		Available: available,
+		Shard:     shard,
+	}, nil
+}
+
+// ShardResources returns the resources of a test VM.
+// Every shard needs 2 vCPUs, an IP address, and SSD space of
+// GCE_MIN_SCR_SIZE, which is no less than 50 GB.
+func ShardResources() (Resources, error) {
+	size, err := GceConfig.Get("GCE_MIN_SCR_SIZE")
+	if err != nil {
+		return Resources{}, err
+	}
 	ssdMin, err := strconv.Atoi(size)
 	if err != nil {
 		ssdMin = 0
 	}
-	ssdLimit := ssdNum / mymath.MaxInt(50, ssdMin)
-
-	return &Quota{
-		Zone:     pickedZone,
-		cpuLimit: cpuNum / 2,
-		ipLimit:  ipNum,
-		ssdLimit: ssdLimit,
-	}, nil
+	return Resources{CPUs: 2, IPs: 1, SSD: mymath.MaxInt(50, ssdMin)}, nil
 }
 
 // GetAllRegionsQuota returns quota limits for every available region.
@@ -195,7 +221,15 @@ func (gce *Service) GetAllRegionsQuota(projID string) ([]*Quota, error) {
 
 // GetMaxShard return the max possible number of shards according to the quota limits
 func (quota *Quota) GetMaxShard() (int, error) {
-	return mymath.MinIntSlice([]int{quota.cpuLimit, quota.ipLimit, quota.ssdLimit})
+	if quota.Shard.CPUs <= 0 || quota.Shard.IPs <= 0 || quota.Shard.SSD <= 0 {
+		return 0, fmt.Errorf("invalid shard resources %+v", quota.Shard)
+	}
+	maxShard, err := mymath.MinIntSlice([]int{
+		quota.Available.CPUs / quota.Shard.CPUs,
+		quota.Available.IPs / quota.Shard.IPs,
+		quota.Available.SSD / quota.Shard.SSD,
+	})
+	return mymath.MaxInt(0, maxShard), err
 }
 
 // getFiles returns an iterator for all files with a matching path prefix on GS.
@@ -256,6 +290,70 @@ func (gce *Service) GetFileNames(prefix string) ([]string, error) {
 	return names, nil
 }
 
+// GetFileSize returns the size of a file on GS.
+func (gce *Service) GetFileSize(name string) (int64, error) {
+	if gce.bucket == nil {
+		return 0, fmt.Errorf("GS client is not initialized")
+	}
+	attrs, err := gce.bucket.Object(name).Attrs(gce.ctx)
+	if err != nil {
+		return 0, err
+	}
+	return attrs.Size, nil
+}
+
+// GetFileGeneration returns the generation of a file on GS, which changes
+// each time the file is replaced.
+func (gce *Service) GetFileGeneration(name string) (int64, error) {
+	if gce.bucket == nil {
+		return 0, fmt.Errorf("GS client is not initialized")
+	}
+	attrs, err := gce.bucket.Object(name).Attrs(gce.ctx)
+	if err != nil {
+		return 0, err
+	}
+	return attrs.Generation, nil
+}
+
+// FileExists returns whether a file exists on GS.
+func (gce *Service) FileExists(name string) (bool, error) {
+	_, err := gce.GetFileSize(name)
+	if NotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReadFile returns the content of a file on GS.
+func (gce *Service) ReadFile(name string) ([]byte, error) {
+	if gce.bucket == nil {
+		return nil, fmt.Errorf("GS client is not initialized")
+	}
+	r, err := gce.bucket.Object(name).NewReader(gce.ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// DeleteFile removes a single file on GS.
+func (gce *Service) DeleteFile(name string) error {
+	if gce.bucket == nil {
+		return fmt.Errorf("GS client is not initialized")
+	}
+	return gce.bucket.Object(name).Delete(gce.ctx)
+}
+
+// CopyFile copies a file on GS to dst in the same bucket.
+func (gce *Service) CopyFile(src string, dst string) error {
+	if gce.bucket == nil {
+		return fmt.Errorf("GS client is not initialized")
+	}
+	_, err := gce.bucket.Object(dst).CopierFrom(gce.bucket.Object(src)).Run(gce.ctx)
+	return err
+}
+
 // UploadFile uploads a local file or directory to GS.
 func (gce *Service) UploadFile(localPath string, gsPath string) error {
 	if gce.bucket == nil {
@@ -281,6 +379,9 @@ func (gce *Service) UploadFile(localPath string, gsPath string) error {
 // NotFound returns true if err is 404 not found.
 func NotFound(err error) bool {
 	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return true
+		}
 		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
 			return true
 		}
@@ -31,14 +31,24 @@ const (
 	watchInterval     = 10
 )
 
+// committerEnv sets the identity used for commits created on KCS, since the
+// cached repositories have no user configured.
+var committerEnv = map[string]string{
+	"GIT_COMMITTER_NAME":  "gce-xfstests",
+	"GIT_COMMITTER_EMAIL": "gce-xfstests@localhost",
+}
+
 // Repository represents a local copy of git repo with a lock to
 // avoid concurrent access.
+// Worktrees of a repository share its fetch lock, since they also share
+// the refs updated by git fetch.
 type Repository struct {
-	id   string
-	url  string
-	base string
-	dir  string
-	lock sync.Mutex
+	id        string
+	url       string
+	base      string
+	dir       string
+	lock      sync.Mutex
+	fetchLock *sync.Mutex
 }
 
 // RemoteRepository represents a remote repo for queries.
@@ -90,10 +100,11 @@ func NewRepository(id string, repoURL string, writer io.Writer) (*Repository, er
 	}
 
 	repo := Repository{
-		id:   id,
-		url:  repoURL,
-		base: base,
-		dir:  RepoRootDir + id + "/",
+		id:        id,
+		url:       repoURL,
+		base:      base,
+		dir:       RepoRootDir + id + "/",
+		fetchLock: &sync.Mutex{},
 	}
 
 	if check.DirExists(repo.dir) {
@@ -154,8 +165,10 @@ func (repo *Repository) Checkout(commit string, writer io.Writer) error {
 			return nil
 		}
 	}
+	repo.fetchLock.Lock()
 	cmd := exec.Command("git", "fetch", "-qpf", "--all")
 	err := check.Run(cmd, repo.dir, check.EmptyEnv, writer, writer)
+	repo.fetchLock.Unlock()
 	if err != nil {
 		return err
 	}
@@ -189,44 +202,103 @@ func (repo *Repository) Valid(revision string, writer io.Writer) (bool, error) {
 	return true, nil
 }
 
+// BisectTerms names the two states of a git bisect and maps test results
+// to them.
+type BisectTerms struct {
+	Old string
+	New string
+	// Reverse is set when passing tests mark the new state, i.e. when
+	// bisecting for the commit that fixed a failure.
+	Reverse bool
+}
+
+var (
+	// RegressionTerms finds the first commit that fails.
+	RegressionTerms = BisectTerms{Old: "good", New: "bad"}
+	// FixTerms finds the first commit that passes again.
+	FixTerms = BisectTerms{Old: "broken", New: "fixed", Reverse: true}
+)
+
+// Step returns the bisect term for a test result.
+func (terms BisectTerms) Step(testResult server.ResultType) (string, error) {
+	switch testResult {
+	case server.Pass:
+		if terms.Reverse {
+			return terms.New, nil
+		}
+		return terms.Old, nil
+	case server.Fail:
+		fallthrough
+	case server.Hang:
+		fallthrough
+	case server.Crash:
+		if terms.Reverse {
+			return terms.Old, nil
+		}
+		return terms.New, nil
+	case server.Error:
+		return "skip", nil
+	}
+	return "", fmt.Errorf("unexpect test result value")
+}
+
+// FirstCommit returns the result line of a finished bisect from the bisect
+// log, in the form "[<hash>] <subject>". It is empty if bisect has not ended.
+func (terms BisectTerms) FirstCommit(bisectLog string) string {
+	prefix := "# first " + terms.New + " commit: "
+	for _, line := range strings.Split(bisectLog, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimPrefix(line, prefix)
+		}
+	}
+	return ""
+}
+
+// finished returns true if git bisect output shows the bisect has ended.
+func (terms BisectTerms) finished(output string) bool {
+	return strings.Contains(output, "is the first "+terms.New+" commit")
+}
+
 /*
 BisectStart starts a git bisect on a repository.
 
-It uses badCommit and goodCommits to narrow down the search path.
-Current head is used if badCommit is empty, and throws error if
-goodCommits is empty. It returns true if git bisect has ended.
+It uses newCommit and oldCommits to narrow down the search path, where the
+commits are in the new and old state named by terms (the bad and good
+commits for RegressionTerms). Current head is used if newCommit is empty,
+and throws error if oldCommits is empty. It returns true if git bisect has
+ended.
 
 `git bisect start <bad> <good> [<good-2>...]` command fails silently
 if <bad> is a branch, so we expand it explicitly.
 */
-func (repo *Repository) BisectStart(badCommit string, goodCommits []string, writer io.Writer) (bool, error) {
+func (repo *Repository) BisectStart(newCommit string, oldCommits []string, terms BisectTerms, writer io.Writer) (bool, error) {
 	repo.lock.Lock()
 	defer repo.lock.Unlock()
-	if len(goodCommits) == 0 {
-		return false, fmt.Errorf("No good commits provided")
+	if len(oldCommits) == 0 {
+		return false, fmt.Errorf("No %s commits provided", terms.Old)
 	}
 	if !check.DirExists(repo.dir) {
 		return false, fmt.Errorf("directory %s does not exist", repo.dir)
 	}
 
-	if badCommit == "" {
-		badCommit = "HEAD"
+	if newCommit == "" {
+		newCommit = "HEAD"
 	}
 
-	cmd := exec.Command("git", "bisect", "start")
+	cmd := exec.Command("git", "bisect", "start", "--term-old", terms.Old, "--term-new", terms.New)
 	err := check.Run(cmd, repo.dir, check.EmptyEnv, writer, writer)
 	if err != nil {
 		return false, err
 	}
 
-	cmd = exec.Command("git", "bisect", "bad", badCommit)
+	cmd = exec.Command("git", "bisect", terms.New, newCommit)
 	err = check.Run(cmd, repo.dir, check.EmptyEnv, writer, writer)
 	if err != nil {
 		return false, err
 	}
 
-	args := []string{"bisect", "good"}
-	args = append(args, goodCommits...)
+	args := []string{"bisect", terms.Old}
+	args = append(args, oldCommits...)
 
 	cmd = exec.Command("git", args...)
 	output, err := check.Output(cmd, repo.dir, check.EmptyEnv, writer)
@@ -235,36 +307,21 @@ func (repo *Repository) BisectStart(badCommit string, goodCommits []string, writ
 		return false, err
 	}
 
-	if strings.Contains(output, "is the first bad commit") {
-		return true, nil
-	}
-
-	return false, nil
+	return terms.finished(output), nil
 }
 
-// BisectStep tells git bisect whether the current version is good or not
-// and proceeds to the next step.
+// BisectStep tells git bisect the state of the current version using the
+// same terms as BisectStart, and proceeds to the next step.
 // It returns true if git bisect has ended.
-func (repo *Repository) BisectStep(testResult server.ResultType, writer io.Writer) (bool, error) {
+func (repo *Repository) BisectStep(testResult server.ResultType, terms BisectTerms, writer io.Writer) (bool, error) {
 	repo.lock.Lock()
 	defer repo.lock.Unlock()
 	if !check.DirExists(repo.dir) {
 		return false, fmt.Errorf("directory %s does not exist", repo.dir)
 	}
-	var step string
-	switch testResult {
-	case server.Pass:
-		step = "good"
-	case server.Fail:
-		fallthrough
-	case server.Hang:
-		fallthrough
-	case server.Crash:
-		step = "bad"
-	case server.Error:
-		step = "skip"
-	default:
-		return false, fmt.Errorf("unexpect test result value")
+	step, err := terms.Step(testResult)
+	if err != nil {
+		return false, err
 	}
 
 	cmd := exec.Command("git", "bisect", step)
@@ -273,11 +330,8 @@ func (repo *Repository) BisectStep(testResult server.ResultType, writer io.Write
 		writer.Write([]byte(output))
 		return false, err
 	}
-	if strings.Contains(output, "is the first bad commit") {
-		return true, nil
-	}
 
-	return false, nil
+	return terms.finished(output), nil
 }
 
 // BisectLog returns bisect log output.
@@ -308,6 +362,103 @@ func (repo *Repository) BisectReset(writer io.Writer) error {
 	return check.Run(cmd, repo.dir, check.EmptyEnv, writer, writer)
 }
 
+/*
+ApplyMbox applies a patch series in mbox format on top of the current HEAD.
+
+It returns the output of git am so that callers can report why a series
+does not apply. On failure the am session is aborted, leaving HEAD at the
+original commit.
+*/
+func (repo *Repository) ApplyMbox(mboxPath string, writer io.Writer) (string, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	if !check.DirExists(repo.dir) {
+		return "", fmt.Errorf("directory %s does not exist", repo.dir)
+	}
+
+	cmd := exec.Command("git", "am", "--3way", mboxPath)
+	output, err := check.CombinedOutput(cmd, repo.dir, committerEnv)
+	writer.Write([]byte(output))
+	if err != nil {
+		cmd = exec.Command("git", "am", "--abort")
+		check.Run(cmd, repo.dir, check.EmptyEnv, writer, writer)
+		return output, err
+	}
+
+	return output, nil
+}
+
+// Revert creates a commit on top of the current HEAD that reverts commit.
+// If the revert does not apply cleanly it is aborted and HEAD is unchanged.
+func (repo *Repository) Revert(commit string, writer io.Writer) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	if !check.DirExists(repo.dir) {
+		return fmt.Errorf("directory %s does not exist", repo.dir)
+	}
+
+	env := map[string]string{
+		"GIT_AUTHOR_NAME":  committerEnv["GIT_COMMITTER_NAME"],
+		"GIT_AUTHOR_EMAIL": committerEnv["GIT_COMMITTER_EMAIL"],
+	}
+	for k, v := range committerEnv {
+		env[k] = v
+	}
+	cmd := exec.Command("git", "revert", "--no-edit", commit)
+	err := check.Run(cmd, repo.dir, env, writer, writer)
+	if err != nil {
+		cmd = exec.Command("git", "revert", "--abort")
+		check.Run(cmd, repo.dir, check.EmptyEnv, writer, writer)
+		return err
+	}
+
+	return nil
+}
+
+/*
+CherryPick applies commit on top of the current HEAD, recording the
+original commit id in the commit message.
+
+It returns the output of git cherry-pick so that callers can report why a
+commit does not apply. On failure the cherry-pick is aborted and HEAD is
+unchanged.
+*/
+func (repo *Repository) CherryPick(commit string, writer io.Writer) (string, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	if !check.DirExists(repo.dir) {
+		return "", fmt.Errorf("directory %s does not exist", repo.dir)
+	}
+
+	cmd := exec.Command("git", "cherry-pick", "-x", commit)
+	output, err := check.CombinedOutput(cmd, repo.dir, committerEnv)
+	writer.Write([]byte(output))
+	if err != nil {
+		cmd = exec.Command("git", "cherry-pick", "--abort")
+		check.Run(cmd, repo.dir, check.EmptyEnv, writer, writer)
+		return output, err
+	}
+
+	return output, nil
+}
+
+// Log returns the one line summaries of the commits in revRange,
+// oldest first.
+func (repo *Repository) Log(revRange string, writer io.Writer) (string, error) {
+	if !check.DirExists(repo.dir) {
+		return "", fmt.Errorf("directory %s does not exist", repo.dir)
+	}
+
+	cmd := exec.Command("git", "log", "--oneline", "--no-decorate", "--reverse", revRange)
+	output, err := check.Output(cmd, repo.dir, check.EmptyEnv, writer)
+	if err != nil {
+		writer.Write([]byte(output))
+		return "", err
+	}
+
+	return output, nil
+}
+
 // BuildUpload builds the current kernel code and uploads image to GS.
 // Script output is written into a given writer.
 func (repo *Repository) BuildUpload(gsBucket string, gsPath string, gsConfig string, arch string, kConfigOpts string, kbuildOpts string, writer io.Writer) error {
@@ -333,6 +484,77 @@ func (repo *Repository) BuildUpload(gsBucket string, gsPath string, gsConfig str
 	return err
 }
 
+/*
+AddWorktree returns an additional working tree of the repository.
+
+The worktree shares objects and refs with the repository, so that different
+commits can be checked out and built at the same time without another clone.
+The worktree directory is named after the repo id and name. If it already
+exists and is still a registered worktree of the repository it is reused,
+otherwise it is left over from a failed attempt and is created again.
+*/
+func (repo *Repository) AddWorktree(name string, writer io.Writer) (*Repository, error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+	if !check.DirExists(repo.dir) {
+		return nil, fmt.Errorf("directory %s does not exist", repo.dir)
+	}
+
+	tree := Repository{
+		id:        repo.id + "-" + name,
+		url:       repo.url,
+		base:      repo.base,
+		dir:       RepoRootDir + repo.id + "-" + name + "/",
+		fetchLock: repo.fetchLock,
+	}
+	if check.DirExists(tree.dir) {
+		if repo.hasWorktree(tree.dir, writer) {
+			return &tree, nil
+		}
+		err := os.RemoveAll(tree.dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cmd := exec.Command("git", "worktree", "prune")
+	err := check.Run(cmd, repo.dir, check.EmptyEnv, writer, writer)
+	if err != nil {
+		return nil, err
+	}
+	cmd = exec.Command("git", "worktree", "add", "--detach", tree.dir)
+	err = check.Run(cmd, repo.dir, check.EmptyEnv, writer, writer)
+	if err != nil {
+		os.RemoveAll(tree.dir)
+		return nil, err
+	}
+
+	return &tree, nil
+}
+
+// hasWorktree returns true if dir is a working worktree of the repository.
+// The caller must hold the repo lock.
+func (repo *Repository) hasWorktree(dir string, writer io.Writer) bool {
+	cmd := exec.Command("git", "worktree", "list", "--porcelain")
+	output, err := check.Output(cmd, repo.dir, check.EmptyEnv, writer)
+	if err != nil {
+		return false
+	}
+	registered := false
+	for _, line := range strings.Split(output, "\n") {
+		if line == "worktree "+strings.TrimSuffix(dir, "/") {
+			registered = true
+			break
+		}
+	}
+	if !registered {
+		return false
+	}
+	cmd = exec.Command("git", "rev-parse", "--verify", "-q", "HEAD")
+	_, err = check.Output(cmd, dir, check.EmptyEnv, writer)
+	return err == nil
+}
+
 // Delete removes repo from local storage.
 func (repo *Repository) Delete() error {
 	repo.lock.Lock()
@@ -341,11 +563,50 @@ func (repo *Repository) Delete() error {
 	return err
 }
 
+// ID returns the repo id.
+func (repo *Repository) ID() string {
+	return repo.id
+}
+
 // Dir returns the repo directory.
 func (repo *Repository) Dir() string {
 	return repo.dir
 }
 
+/*
+FetchLoreMbox retrieves the patch series for a message-id from a lore mirror.
+
+It calls b4 with its midmask pointed at the mirror, so that only the patches
+of the series (with trailers collected from replies) end up in the mbox.
+Returns the path to the generated mbox file in outDir.
+*/
+func FetchLoreMbox(messageID string, mirror string, outDir string, writer io.Writer) (string, error) {
+	if messageID == "" {
+		return "", fmt.Errorf("message-id not specified")
+	}
+	if mirror == "" {
+		return "", fmt.Errorf("lore mirror not configured")
+	}
+
+	env := map[string]string{
+		"GIT_CONFIG_COUNT":   "1",
+		"GIT_CONFIG_KEY_0":   "b4.midmask",
+		"GIT_CONFIG_VALUE_0": strings.TrimSuffix(mirror, "/") + "/%s",
+	}
+	cmd := exec.Command("b4", "am", "--no-cover",
+		"--outdir", outDir, "--mbox-name", "series", messageID)
+	err := check.Run(cmd, outDir, env, writer, writer)
+	if err != nil {
+		return "", err
+	}
+
+	mboxPath := outDir + "series.mbx"
+	if !check.FileExists(mboxPath) {
+		return "", fmt.Errorf("b4 did not produce an mbox for %s", messageID)
+	}
+	return mboxPath, nil
+}
+
 // NewRemoteRepository initiates a remote repo and get HEAD on given branch.
 func NewRemoteRepository(repoURL string, branch string) (*RemoteRepository, error) {
 	repo := RemoteRepository{
@@ -381,6 +642,46 @@ func (repo *RemoteRepository) Head() string {
 	return repo.head
 }
 
+/*
+RevList returns the commits in oldHead..newHead on the branch, oldest first.
+
+The commits are listed from a treeless bare clone of the branch kept in dir,
+so that only commit objects are downloaded. If firstParent is true, only the
+commits on the first-parent chain are returned, i.e. merges are not expanded.
+*/
+func (repo *RemoteRepository) RevList(dir string, oldHead string, newHead string, firstParent bool, writer io.Writer) ([]string, error) {
+	if !check.DirExists(dir) {
+		cmd := exec.Command("git", "clone", "-q", "--bare", "--filter=tree:0",
+			"--single-branch", "--branch", repo.branch, repo.url, dir)
+		err := check.Run(cmd, check.RootDir, check.EmptyEnv, writer, writer)
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	} else {
+		refspec := fmt.Sprintf("+refs/heads/%s:refs/heads/%s", repo.branch, repo.branch)
+		cmd := exec.Command("git", "fetch", "-q", "origin", refspec)
+		err := check.Run(cmd, dir, check.EmptyEnv, writer, writer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	args := []string{"rev-list", "--reverse"}
+	if firstParent {
+		args = append(args, "--first-parent")
+	}
+	args = append(args, oldHead+".."+newHead)
+	cmd := exec.Command("git", args...)
+	output, err := check.Output(cmd, dir, check.EmptyEnv, writer)
+	if err != nil {
+		writer.Write([]byte(output))
+		return nil, err
+	}
+
+	return strings.Fields(output), nil
+}
+
 // getHead retrives the commit hash of the HEAD on a branch.
 func getHead(repoURL string, branch string) (string, error) {
 	cmd := exec.Command("git", "ls-remote", "--heads", "--quiet", "--exit-code", repoURL, branch)
@@ -2,8 +2,16 @@ package git
 
 import (
 	"thunk.org/gce-server/util/check"
+	"thunk.org/gce-server/util/server"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -102,3 +110,244 @@ func TestParseURL(t *testing.T) {
 		}
 	}
 }
+
+func TestBisectTerms(t *testing.T) {
+	tests := []struct {
+		terms  BisectTerms
+		result server.ResultType
+		step   string
+	}{
+		{RegressionTerms, server.Pass, "good"},
+		{RegressionTerms, server.Fail, "bad"},
+		{RegressionTerms, server.Crash, "bad"},
+		{RegressionTerms, server.Error, "skip"},
+		{FixTerms, server.Pass, "fixed"},
+		{FixTerms, server.Fail, "broken"},
+		{FixTerms, server.Hang, "broken"},
+		{FixTerms, server.Error, "skip"},
+	}
+	for _, e := range tests {
+		step, err := e.terms.Step(e.result)
+		if err != nil {
+			t.Error(err)
+		}
+		if step != e.step {
+			t.Errorf("get wrong bisect step %s instead of %s", step, e.step)
+		}
+	}
+	if _, err := FixTerms.Step(server.DefaultResult); err == nil {
+		t.Error("expected error for default result")
+	}
+}
+
+func TestBisectFirstCommit(t *testing.T) {
+	log := `git bisect start '--term-old' 'broken' '--term-new' 'fixed'
+# fixed: [7111951b8d4973bda27ff663f2cf18b663d15b48] Linux 5.6
+git bisect fixed 7111951b8d4973bda27ff663f2cf18b663d15b48
+# first fixed commit: [c870e04e71136d57817526add31b6abe2b451c63] ext4: fix race
+`
+	expected := "[c870e04e71136d57817526add31b6abe2b451c63] ext4: fix race"
+	if commit := FixTerms.FirstCommit(log); commit != expected {
+		t.Errorf("get wrong first commit %s instead of %s", commit, expected)
+	}
+	if commit := RegressionTerms.FirstCommit(log); commit != "" {
+		t.Errorf("get unexpected first bad commit %s", commit)
+	}
+}
+
+// newLocalRepo creates a repository in a temporary directory with a single
+// commit of file, so that tests do not need the network or a KCS server.
+func newLocalRepo(t *testing.T) *Repository {
+	t.Helper()
+	for k, v := range committerEnv {
+		t.Setenv(k, v)
+	}
+	t.Setenv("GIT_AUTHOR_NAME", committerEnv["GIT_COMMITTER_NAME"])
+	t.Setenv("GIT_AUTHOR_EMAIL", committerEnv["GIT_COMMITTER_EMAIL"])
+
+	repo := &Repository{
+		id:        "test",
+		dir:       t.TempDir() + "/",
+		fetchLock: &sync.Mutex{},
+	}
+	runGit(t, repo, "init", "-q", "-b", "master")
+	commitFile(t, repo, "file", "line 1\n", "initial commit")
+	return repo
+}
+
+// runGit runs a git command in repo and returns its output.
+func runGit(t *testing.T, repo *Repository, args ...string) string {
+	t.Helper()
+	output, err := check.CombinedOutput(exec.Command("git", args...), repo.dir, check.EmptyEnv)
+	if err != nil {
+		t.Fatalf("git %s failed: %v\n%s", strings.Join(args, " "), err, output)
+	}
+	return output
+}
+
+// commitFile writes content into name and commits it.
+func commitFile(t *testing.T, repo *Repository, name string, content string, msg string) {
+	t.Helper()
+	err := os.WriteFile(filepath.Join(repo.dir, name), []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, repo, "add", name)
+	runGit(t, repo, "commit", "-q", "-m", msg)
+}
+
+func TestApplyMbox(t *testing.T) {
+	repo := newLocalRepo(t)
+	base := strings.TrimSpace(runGit(t, repo, "rev-parse", "HEAD"))
+	commitFile(t, repo, "file", "line 1\nline 2\n", "file: add line 2")
+	mbox := filepath.Join(t.TempDir(), "series.mbx")
+	patch := runGit(t, repo, "format-patch", "-1", "--stdout", "HEAD")
+	if err := os.WriteFile(mbox, []byte(patch), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, repo, "reset", "-q", "--hard", base)
+
+	if _, err := repo.ApplyMbox(mbox, ioutil.Discard); err != nil {
+		t.Fatalf("failed to apply series: %v", err)
+	}
+	if subject := runGit(t, repo, "log", "-1", "--format=%s"); subject != "file: add line 2\n" {
+		t.Errorf("get HEAD %q after applying series", subject)
+	}
+
+	// the series no longer applies on top of itself
+	runGit(t, repo, "reset", "-q", "--hard", base)
+	commitFile(t, repo, "file", "line 1\nconflict\n", "file: conflict")
+	head := runGit(t, repo, "rev-parse", "HEAD")
+	if _, err := repo.ApplyMbox(mbox, ioutil.Discard); err == nil {
+		t.Fatal("expected error for a series that does not apply")
+	}
+	if h := runGit(t, repo, "rev-parse", "HEAD"); h != head {
+		t.Errorf("HEAD moved from %s to %s after a failed git am", head, h)
+	}
+	if check.DirExists(repo.dir + ".git/rebase-apply") {
+		t.Error("git am not aborted")
+	}
+}
+
+func TestFetchLoreMbox(t *testing.T) {
+	dir := t.TempDir() + "/"
+	if _, err := FetchLoreMbox("", "https://lore.kernel.org/all", dir, ioutil.Discard); err == nil {
+		t.Error("expected error without message-id")
+	}
+	if _, err := FetchLoreMbox("msg@example.com", "", dir, ioutil.Discard); err == nil {
+		t.Error("expected error without lore mirror")
+	}
+
+	// a fake b4 that records the midmask and writes the mbox
+	binDir := t.TempDir()
+	script := "#!/bin/sh\n" +
+		"echo \"$GIT_CONFIG_VALUE_0 $*\" > args\n" +
+		"[ \"$7\" = missing@example.com ] || echo mbox > series.mbx\n"
+	if err := os.WriteFile(filepath.Join(binDir, "b4"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	mboxPath, err := FetchLoreMbox("msg@example.com", "https://lore.kernel.org/all/", dir, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mboxPath != dir+"series.mbx" {
+		t.Errorf("get mbox path %s", mboxPath)
+	}
+	args, _ := os.ReadFile(dir + "args")
+	expected := "https://lore.kernel.org/all/%s am --no-cover --outdir " + dir + " --mbox-name series msg@example.com\n"
+	if string(args) != expected {
+		t.Errorf("get b4 args %q, want %q", args, expected)
+	}
+
+	if _, err := FetchLoreMbox("missing@example.com", "https://lore.kernel.org/all", t.TempDir()+"/", ioutil.Discard); err == nil {
+		t.Error("expected error when b4 writes no mbox")
+	}
+}
+
+func TestAddWorktree(t *testing.T) {
+	repo := newLocalRepo(t)
+	repo.id = fmt.Sprintf("test%d", os.Getpid())
+	dir := RepoRootDir + repo.id + "-worktree1/"
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	w := ioutil.Discard
+
+	tree, err := repo.AddWorktree("worktree1", w)
+	if err != nil {
+		t.Fatalf("failed to add worktree: %v", err)
+	}
+	if tree.dir != dir || !repo.hasWorktree(dir, w) {
+		t.Fatalf("worktree %s is not registered", tree.dir)
+	}
+	if _, err := repo.AddWorktree("worktree1", w); err != nil {
+		t.Errorf("failed to reuse worktree: %v", err)
+	}
+
+	// a half created worktree is not registered and gets created again
+	err = os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.hasWorktree(dir, w) {
+		t.Fatal("empty directory is taken as a worktree")
+	}
+	tree, err = repo.AddWorktree("worktree1", w)
+	if err != nil {
+		t.Fatalf("failed to recreate worktree: %v", err)
+	}
+	if !repo.hasWorktree(tree.dir, w) {
+		t.Error("recreated worktree is not registered")
+	}
+}
+
+func TestRevList(t *testing.T) {
+	repo := newLocalRepo(t)
+	oldHead := strings.TrimSpace(runGit(t, repo, "rev-parse", "HEAD"))
+	runGit(t, repo, "checkout", "-q", "-b", "side")
+	commitFile(t, repo, "side", "side\n", "side: add file")
+	side := strings.TrimSpace(runGit(t, repo, "rev-parse", "HEAD"))
+	runGit(t, repo, "checkout", "-q", "master")
+	commitFile(t, repo, "file", "line 1\nline 2\n", "file: add line 2")
+	main := strings.TrimSpace(runGit(t, repo, "rev-parse", "HEAD"))
+	runGit(t, repo, "merge", "-q", "--no-ff", "-m", "merge side", "side")
+	merge := strings.TrimSpace(runGit(t, repo, "rev-parse", "HEAD"))
+
+	remote := &RemoteRepository{url: repo.dir, branch: "master"}
+	dir := filepath.Join(t.TempDir(), "repo.git")
+	w := ioutil.Discard
+
+	commits, err := remote.RevList(dir, oldHead, merge, true, w)
+	if err != nil {
+		t.Fatalf("failed to list commits: %v", err)
+	}
+	if expected := []string{main, merge}; !reflect.DeepEqual(commits, expected) {
+		t.Errorf("get first-parent commits %v, want %v", commits, expected)
+	}
+	commits, err = remote.RevList(dir, oldHead, merge, false, w)
+	if err != nil {
+		t.Fatalf("failed to list commits: %v", err)
+	}
+	if len(commits) != 3 || commits[2] != merge || !slices.Contains(commits, side) {
+		t.Errorf("get commits %v, want %s and %s before %s", commits, side, main, merge)
+	}
+
+	// a later push is fetched into the existing clone
+	commitFile(t, repo, "file", "line 1\nline 2\nline 3\n", "file: add line 3")
+	newHead := strings.TrimSpace(runGit(t, repo, "rev-parse", "HEAD"))
+	commits, err = remote.RevList(dir, merge, newHead, true, w)
+	if err != nil {
+		t.Fatalf("failed to list commits after fetch: %v", err)
+	}
+	if expected := []string{newHead}; !reflect.DeepEqual(commits, expected) {
+		t.Errorf("get commits %v after fetch, want %v", commits, expected)
+	}
+
+	if _, err := remote.RevList(dir, "0123456789abcdef0123456789abcdef01234567", newHead, true, w); err == nil {
+		t.Error("RevList accepts an unknown commit")
+	}
+}
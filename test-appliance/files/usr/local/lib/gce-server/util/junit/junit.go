@@ -0,0 +1,330 @@
+/*
+Package junit parses the xunit results.xml files generated by the test
+appliance, compares test outcomes between runs and merges the results of
+shards that split the tests of a config.
+*/
+package junit
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+)
+
+// Outcome defines the result of a single test case.
+type Outcome int
+
+const (
+	// Pass indicates the test passed.
+	Pass Outcome = iota
+	// Skip indicates the test was not run.
+	Skip
+	// Fail indicates the test failed.
+	Fail
+	// Error indicates the test could not complete.
+	Error
+)
+
+func (o Outcome) String() string {
+	return [...]string{
+		"pass",
+		"skip",
+		"fail",
+		"error",
+	}[o]
+}
+
+// Failed returns true if the outcome counts as a test failure.
+func (o Outcome) Failed() bool {
+	return o == Fail || o == Error
+}
+
+// Property is a name value pair attached to a test suite.
+type Property struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+// Result holds the failure, error or skipped element of a test case.
+type Result struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+}
+
+// Testcase is a single test in a test suite.
+type Testcase struct {
+	Name      string  `xml:"name,attr"`
+	Classname string  `xml:"classname,attr"`
+	Time      float64 `xml:"time,attr"`
+	Failure   *Result `xml:"failure"`
+	Error     *Result `xml:"error"`
+	Skipped   *Result `xml:"skipped"`
+}
+
+// Testsuite is the result of running tests with one config.
+type Testsuite struct {
+	Name       string     `xml:"name,attr"`
+	Properties []Property `xml:"properties>property"`
+	Testcases  []Testcase `xml:"testcase"`
+}
+
+// Testsuites is the root of a results.xml file.
+type Testsuites struct {
+	Testsuites []Testsuite `xml:"testsuite"`
+}
+
+// Comparison lists the tests that changed between two runs.
+type Comparison struct {
+	New       []string `json:"new"`
+	Fixed     []string `json:"fixed"`
+	Unchanged []string `json:"unchanged"`
+}
+
+// these test cases are markers added by LTM rather than real tests.
+var markers = []string{"preempted", "timeout"}
+
+// Parse reads a results.xml file. The root element can either be
+// a testsuites or a single testsuite.
+func Parse(filename string) (*Testsuites, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseBytes(content)
+}
+
+// ParseBytes parses the content of a results.xml file.
+func ParseBytes(content []byte) (*Testsuites, error) {
+	var root struct {
+		XMLName xml.Name
+		Testsuites
+		Testsuite
+	}
+	err := xml.Unmarshal(content, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	switch root.XMLName.Local {
+	case "testsuites":
+		return &root.Testsuites, nil
+	case "testsuite":
+		return &Testsuites{Testsuites: []Testsuite{root.Testsuite}}, nil
+	}
+	return nil, fmt.Errorf("unexpected root element %s", root.XMLName.Local)
+}
+
+// Property returns the value of the first property with the given name.
+func (s *Testsuite) Property(name string) string {
+	for _, p := range s.Properties {
+		if p.Name == name {
+			return p.Value
+		}
+	}
+	return ""
+}
+
+// Config returns the file system config the test suite ran with.
+func (s *Testsuite) Config() string {
+	if cfg := s.Property("TESTCFG"); cfg != "" {
+		return cfg
+	}
+	if cfg := s.Property("FSTESTCFG"); cfg != "" {
+		return cfg
+	}
+	return s.Name
+}
+
+// Outcome returns the outcome of a test case.
+func (c *Testcase) Outcome() Outcome {
+	switch {
+	case c.Error != nil:
+		return Error
+	case c.Failure != nil:
+		return Fail
+	case c.Skipped != nil:
+		return Skip
+	}
+	return Pass
+}
+
+// Outcomes returns the outcome of every test indexed by "<config>:<test>".
+// If a test ran more than once in a config, a failure takes precedence.
+func (s *Testsuites) Outcomes() map[string]Outcome {
+	outcomes := make(map[string]Outcome)
+	for i := range s.Testsuites {
+		suite := &s.Testsuites[i]
+		cfg := suite.Config()
+		for j := range suite.Testcases {
+			test := &suite.Testcases[j]
+			if isMarker(test.Name) {
+				continue
+			}
+			key := cfg + ":" + test.Name
+			outcome := test.Outcome()
+			if prev, ok := outcomes[key]; !ok || outcome > prev {
+				outcomes[key] = outcome
+			}
+		}
+	}
+	return outcomes
+}
+
+// Compare classifies failures between a before and an after run.
+// A test that is only present in one of the runs counts as passed in
+// the other one.
+func Compare(before map[string]Outcome, after map[string]Outcome) Comparison {
+	c := Comparison{
+		New:       []string{},
+		Fixed:     []string{},
+		Unchanged: []string{},
+	}
+	for key, outcome := range after {
+		if !outcome.Failed() {
+			continue
+		}
+		if before[key].Failed() {
+			c.Unchanged = append(c.Unchanged, key)
+		} else {
+			c.New = append(c.New, key)
+		}
+	}
+	for key, outcome := range before {
+		if outcome.Failed() && !after[key].Failed() {
+			c.Fixed = append(c.Fixed, key)
+		}
+	}
+	sort.Strings(c.New)
+	sort.Strings(c.Fixed)
+	sort.Strings(c.Unchanged)
+	return c
+}
+
+// rawElement keeps an XML element as it is.
+type rawElement struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	InnerXML string     `xml:",innerxml"`
+}
+
+// rawSuite keeps a test suite with its attributes and children as they are.
+type rawSuite struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr   `xml:",any,attr"`
+	Children []rawElement `xml:",any"`
+}
+
+/*
+Merge combines the results.xml files of shards that ran parts of the tests
+of one config into a single test suite.
+
+The first suite keeps its properties and other elements, and the test
+cases of the other suites are appended to it. The tests, failures, errors
+and skipped counts are recomputed from the test cases, and the times of
+the suites are added up. Each file must hold a single test suite.
+*/
+func Merge(contents ...[]byte) ([]byte, error) {
+	var merged *rawSuite
+	var tests, failures, errors, skipped int
+	var runtime float64
+
+	for _, content := range contents {
+		suite, err := parseRawSuite(content)
+		if err != nil {
+			return nil, err
+		}
+		typed, err := ParseBytes(content)
+		if err != nil {
+			return nil, err
+		}
+		for _, test := range typed.Testsuites[0].Testcases {
+			tests++
+			switch test.Outcome() {
+			case Error:
+				errors++
+			case Fail:
+				failures++
+			case Skip:
+				skipped++
+			}
+		}
+		for _, attr := range suite.Attrs {
+			if attr.Name.Local == "time" {
+				t, err := strconv.ParseFloat(attr.Value, 64)
+				if err == nil {
+					runtime += t
+				}
+			}
+		}
+
+		if merged == nil {
+			merged = suite
+			continue
+		}
+		for _, child := range suite.Children {
+			if child.XMLName.Local == "testcase" {
+				merged.Children = append(merged.Children, child)
+			}
+		}
+	}
+	if merged == nil {
+		return nil, fmt.Errorf("no test suite to merge")
+	}
+
+	setAttr(merged, "tests", strconv.Itoa(tests))
+	setAttr(merged, "failures", strconv.Itoa(failures))
+	setAttr(merged, "errors", strconv.Itoa(errors))
+	setAttr(merged, "skipped", strconv.Itoa(skipped))
+	setAttr(merged, "time", strconv.FormatFloat(runtime, 'f', -1, 64))
+
+	b, err := xml.MarshalIndent(merged, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(b, '\n')...), nil
+}
+
+// parseRawSuite parses a results.xml file with a single test suite, which
+// may be wrapped in a testsuites element.
+func parseRawSuite(content []byte) (*rawSuite, error) {
+	var suite rawSuite
+	if err := xml.Unmarshal(content, &suite); err != nil {
+		return nil, err
+	}
+	if suite.XMLName.Local == "testsuites" {
+		if len(suite.Children) != 1 || suite.Children[0].XMLName.Local != "testsuite" {
+			return nil, fmt.Errorf("expected a single testsuite in testsuites")
+		}
+		b, err := xml.Marshal(suite.Children[0])
+		if err != nil {
+			return nil, err
+		}
+		return parseRawSuite(b)
+	}
+	if suite.XMLName.Local != "testsuite" {
+		return nil, fmt.Errorf("unexpected root element %s", suite.XMLName.Local)
+	}
+	return &suite, nil
+}
+
+// setAttr sets an attribute of a suite, adding it if it is missing.
+func setAttr(suite *rawSuite, name string, value string) {
+	for i := range suite.Attrs {
+		if suite.Attrs[i].Name.Local == name {
+			suite.Attrs[i].Value = value
+			return
+		}
+	}
+	suite.Attrs = append(suite.Attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+}
+
+func isMarker(name string) bool {
+	for _, m := range markers {
+		if name == m {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package junit
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var before = `<?xml version="1.0" encoding="utf-8"?>
+<testsuites>
+<testsuite name="xfstests" failures="2" tests="4">
+  <properties>
+    <property name="TESTCFG" value="ext4/4k"/>
+  </properties>
+  <testcase classname="xfstests.global" name="generic/001" time="3"/>
+  <testcase classname="xfstests.global" name="generic/002" time="1">
+    <failure message="output mismatch" type="TestFail"/>
+  </testcase>
+  <testcase classname="xfstests.global" name="generic/003" time="1">
+    <failure message="output mismatch" type="TestFail"/>
+  </testcase>
+  <testcase classname="xfstests.global" name="generic/004" time="0">
+    <skipped message="not supported"/>
+  </testcase>
+</testsuite>
+<testsuite name="xfstests" failures="0" tests="1">
+  <properties>
+    <property name="FSTESTCFG" value="ext4/1k"/>
+  </properties>
+  <testcase classname="xfstests.global" name="generic/001" time="3"/>
+  <testcase classname="xfstests.global" name="timeout" time="0">
+    <error message="timeout"/>
+  </testcase>
+</testsuite>
+</testsuites>`
+
+var after = `<?xml version="1.0" encoding="utf-8"?>
+<testsuite name="xfstests" failures="2" tests="3">
+  <properties>
+    <property name="TESTCFG" value="ext4/4k"/>
+  </properties>
+  <testcase classname="xfstests.global" name="generic/001" time="3">
+    <error message="crashed"/>
+  </testcase>
+  <testcase classname="xfstests.global" name="generic/002" time="1"/>
+  <testcase classname="xfstests.global" name="generic/003" time="1">
+    <failure message="output mismatch" type="TestFail"/>
+  </testcase>
+</testsuite>`
+
+func TestOutcomes(t *testing.T) {
+	suites, err := ParseBytes([]byte(before))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]Outcome{
+		"ext4/4k:generic/001": Pass,
+		"ext4/4k:generic/002": Fail,
+		"ext4/4k:generic/003": Fail,
+		"ext4/4k:generic/004": Skip,
+		"ext4/1k:generic/001": Pass,
+	}
+	if outcomes := suites.Outcomes(); !reflect.DeepEqual(outcomes, expected) {
+		t.Errorf("get wrong outcomes %v", outcomes)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	b, err := ParseBytes([]byte(before))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := ParseBytes([]byte(after))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Comparison{
+		New:       []string{"ext4/4k:generic/001"},
+		Fixed:     []string{"ext4/4k:generic/002"},
+		Unchanged: []string{"ext4/4k:generic/003"},
+	}
+	if c := Compare(b.Outcomes(), a.Outcomes()); !reflect.DeepEqual(c, expected) {
+		t.Errorf("get wrong comparison %+v", c)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	if _, err := ParseBytes([]byte("<results/>")); err == nil {
+		t.Error("expected error for unknown root element")
+	}
+}
+
+var slice = `<?xml version="1.0" encoding="utf-8"?>
+<testsuite name="xfstests" failures="1" skipped="1" errors="0" tests="2" time="12">
+  <properties>
+    <property name="TESTCFG" value="ext4/4k"/>
+  </properties>
+  <testcase classname="xfstests.global" name="generic/005" time="8">
+    <failure message="output mismatch" type="TestFail"/>
+    <system-out>diff output</system-out>
+  </testcase>
+  <testcase classname="xfstests.global" name="generic/006" time="0">
+    <skipped message="not supported"/>
+  </testcase>
+</testsuite>`
+
+func TestMerge(t *testing.T) {
+	merged, err := Merge([]byte(after), []byte(slice))
+	if err != nil {
+		t.Fatal(err)
+	}
+	suites, err := ParseBytes(merged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suites.Testsuites) != 1 {
+		t.Fatalf("get %d test suites, want 1", len(suites.Testsuites))
+	}
+	suite := suites.Testsuites[0]
+	if cfg := suite.Config(); cfg != "ext4/4k" {
+		t.Errorf("get config %s, want ext4/4k", cfg)
+	}
+	expected := map[string]Outcome{
+		"ext4/4k:generic/001": Error,
+		"ext4/4k:generic/002": Pass,
+		"ext4/4k:generic/003": Fail,
+		"ext4/4k:generic/005": Fail,
+		"ext4/4k:generic/006": Skip,
+	}
+	if outcomes := suites.Outcomes(); !reflect.DeepEqual(outcomes, expected) {
+		t.Errorf("get wrong outcomes %v", outcomes)
+	}
+
+	var attrs struct {
+		Tests    int     `xml:"tests,attr"`
+		Failures int     `xml:"failures,attr"`
+		Errors   int     `xml:"errors,attr"`
+		Skipped  int     `xml:"skipped,attr"`
+		Time     float64 `xml:"time,attr"`
+	}
+	if err := xml.Unmarshal(merged, &attrs); err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Tests != 5 || attrs.Failures != 2 || attrs.Errors != 1 || attrs.Skipped != 1 || attrs.Time != 12 {
+		t.Errorf("get wrong counts %+v", attrs)
+	}
+	if !strings.Contains(string(merged), "<system-out>diff output</system-out>") {
+		t.Errorf("merged results lost the test output:\n%s", merged)
+	}
+}
+
+func TestMergeInvalid(t *testing.T) {
+	if _, err := Merge([]byte(before)); err == nil {
+		t.Error("expected error for more than one test suite")
+	}
+	if _, err := Merge(); err == nil {
+		t.Error("expected error for no results")
+	}
+}
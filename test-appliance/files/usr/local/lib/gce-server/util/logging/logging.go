@@ -28,7 +28,8 @@ const (
 )
 
 // InitLogger initializes a logrus logger and writes to logfile.
-// It writes to stdout if cannot open logfile.
+// It writes to stdout if cannot open logfile. Secrets are redacted from
+// the log, see redact.go.
 func InitLogger(logfile string) *logrus.Entry {
 	log := logrus.New()
 	file, err := os.OpenFile(logfile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
@@ -41,6 +42,7 @@ func InitLogger(logfile string) *logrus.Entry {
 	log.SetLevel(logrus.DebugLevel)
 	log.SetFormatter(&logrus.TextFormatter{})
 	log.SetReportCaller(true)
+	log.AddHook(redactHook{})
 
 	if DEBUG {
 		log.Out = os.Stdout
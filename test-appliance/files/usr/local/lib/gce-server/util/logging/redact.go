@@ -0,0 +1,113 @@
+package logging
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Redacted replaces secrets in log entries.
+const Redacted = "<redacted>"
+
+// secretKeyRegex matches field and option names whose values are secrets.
+var secretKeyRegex = regexp.MustCompile(`(?i)password|passwd|pwd|secret|token`)
+
+// secret values and patterns redacted from every log entry.
+// A pattern with a capture group keeps the first group, e.g. the name
+// of the secret, and redacts the rest of the match.
+var (
+	redactLock      sync.RWMutex
+	secrets         []string
+	defaultPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)((?:password|passwd|pwd|secret|token)\w*["']?\s*[:=]\s*["']?)[^\s"',}&\]]+`),
+		regexp.MustCompile(`(Bearer\s+)\S+`),
+	}
+	patterns = defaultPatterns
+)
+
+// AddSecret redacts all occurrences of a secret value, e.g. the server
+// password, from the logs.
+func AddSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	redactLock.Lock()
+	defer redactLock.Unlock()
+	secrets = append(secrets, secret)
+}
+
+// AddPattern redacts all matches of a regular expression from the logs.
+func AddPattern(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	redactLock.Lock()
+	defer redactLock.Unlock()
+	patterns = append(patterns, re)
+	return nil
+}
+
+// ResetRedact removes the secrets and patterns added by AddSecret and
+// AddPattern, so that tests do not leak them into each other.
+func ResetRedact() {
+	redactLock.Lock()
+	defer redactLock.Unlock()
+	secrets = nil
+	patterns = defaultPatterns
+}
+
+// Redact returns s with the known secrets and patterns redacted.
+func Redact(s string) string {
+	redactLock.RLock()
+	defer redactLock.RUnlock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, Redacted)
+	}
+	for _, re := range patterns {
+		if re.NumSubexp() > 0 {
+			s = re.ReplaceAllString(s, "${1}"+Redacted)
+		} else {
+			s = re.ReplaceAllString(s, Redacted)
+		}
+	}
+	return s
+}
+
+// IsSecretKey returns whether a field or option name holds a secret.
+func IsSecretKey(key string) bool {
+	return secretKeyRegex.MatchString(key)
+}
+
+// redactHook redacts secrets from the message and fields of log entries
+// before they are written. Output of commands written to log.Writer() is
+// logged as entries too, so it goes through the hook.
+type redactHook struct{}
+
+func (hook redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire redacts an entry. Fields which contain secrets when printed with
+// field names are replaced by their redacted string form.
+func (hook redactHook) Fire(entry *logrus.Entry) error {
+	entry.Message = Redact(entry.Message)
+	for key, value := range entry.Data {
+		if IsSecretKey(key) {
+			entry.Data[key] = Redacted
+			continue
+		}
+		if s, ok := value.(string); ok {
+			entry.Data[key] = Redact(s)
+			continue
+		}
+		s := fmt.Sprintf("%+v", value)
+		if redacted := Redact(s); redacted != s {
+			entry.Data[key] = redacted
+		}
+	}
+	return nil
+}
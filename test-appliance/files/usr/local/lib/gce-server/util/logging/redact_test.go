@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+type testOptions struct {
+	CommitID string
+	Password string
+}
+
+func TestRedact(t *testing.T) {
+	t.Cleanup(ResetRedact)
+	AddSecret("s3cr3t-pwd")
+	err := AddPattern(`(ACCESS_KEY=)[A-Za-z0-9]+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if AddPattern("(") == nil {
+		t.Error("invalid pattern accepted")
+	}
+
+	logFile := t.TempDir() + "/run.log"
+	log := InitLogger(logFile)
+	log.WithField("password", "hunter1").Info("Received login request")
+	log.WithField("options", &testOptions{"v6.1", "hunter2"}).Info("Received test request")
+	log.WithField("cmd", "login").Info("Logging in with s3cr3t-pwd")
+	log.Errorf("Failed to send request with Bearer %s", "0123abcd")
+	w := log.WithField("cmd", "gce-xfstests").Writer()
+	fmt.Fprintln(w, "GCE_LTM_PWD=hunter3 ACCESS_KEY=hunter4")
+	fmt.Fprintln(w, `{"smtp_password": "hunter5"}`)
+	w.Close()
+	CloseLog(log)
+
+	buf, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := string(buf)
+	for _, secret := range []string{"hunter1", "hunter2", "hunter3", "hunter4", "hunter5", "s3cr3t-pwd", "0123abcd"} {
+		if strings.Contains(content, secret) {
+			t.Errorf("secret %s found in log:\n%s", secret, content)
+		}
+	}
+	for _, keep := range []string{"v6.1", "Received test request", "GCE_LTM_PWD=" + Redacted, "ACCESS_KEY=" + Redacted} {
+		if !strings.Contains(content, keep) {
+			t.Errorf("%s not found in log:\n%s", keep, content)
+		}
+	}
+
+	ResetRedact()
+	if s := Redact("s3cr3t-pwd ACCESS_KEY=abc pwd=abc"); s != "s3cr3t-pwd ACCESS_KEY=abc pwd="+Redacted {
+		t.Errorf("get %q after reset", s)
+	}
+}
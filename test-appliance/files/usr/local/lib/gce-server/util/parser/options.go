@@ -0,0 +1,248 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Handling describes what LTM does with an option of a test request.
+type Handling int
+
+const (
+	// Shard options are passed on to the gce-xfstests command of each shard.
+	Shard Handling = iota
+	// Consumed options are handled by the client, LTM or KCS, and are not
+	// passed on to the shards.
+	Consumed
+	// PerShard options are set by LTM for each shard, so the user value is
+	// not passed on.
+	PerShard
+	// Ignored options have no effect with LTM, and are dropped.
+	Ignored
+	// Unsupported options are rejected in LTM test requests.
+	Unsupported
+)
+
+// Option describes a gce-xfstests command line option. HasArg tells
+// whether the option takes an argument, and Validate checks its value.
+type Option struct {
+	Name     string
+	HasArg   bool
+	Handling Handling
+	Validate func(string) error
+}
+
+// Arch names accepted by --arch.
+var Archs = []string{"amd64", "arm64", "i386"}
+
+/*
+options lists every option of gce-xfstests, as parsed by run-fstests/util/parse_cli.
+A new option must be added here, or LTM rejects the command lines using it.
+
+"ltm" is the gce-xfstests command that sends a request to LTM, and "smoke"
+is an alias of "-c 4k -g quick", so both are handled by Parse.
+*/
+var options = []*Option{
+	{"-a", false, Shard, nil},
+	{"-c", true, PerShard, validateNonEmpty},
+	{"-C", true, Shard, validateCount},
+	{"-g", true, Shard, nil},
+	{"-h", false, Unsupported, nil},
+	{"-I", true, Shard, nil},
+	{"-m", true, Shard, nil},
+	{"-n", true, Ignored, nil},
+	{"-N", false, Unsupported, nil},
+	{"-o", true, Shard, nil},
+	{"-O", true, Shard, nil},
+	{"-r", true, Ignored, nil},
+	{"-v", false, Shard, nil},
+	{"-x", true, Shard, nil},
+	{"-X", true, Shard, nil},
+
+	{"--aio", true, Unsupported, nil},
+	{"--arch", true, PerShard, validateArch},
+	{"--arm64", false, PerShard, nil},
+	{"--archive", false, Unsupported, nil},
+	{"--backport", true, Consumed, nil},
+	{"--backport-compare", false, Consumed, nil},
+	{"--bisect-bad", true, Consumed, nil},
+	{"--bisect-build", false, Consumed, nil},
+	{"--bisect-fix", false, Consumed, nil},
+	{"--bisect-good", true, Consumed, nil},
+	{"--bisect-verify", false, Consumed, nil},
+	{"--blktests", false, Shard, nil},
+	{"--bucket-subdir", true, PerShard, nil},
+	{"--build-only", false, Consumed, nil},
+	{"--cache", true, Unsupported, nil},
+	{"--cancel", true, Consumed, nil},
+	{"--commit", true, Consumed, nil},
+	{"--config", true, Consumed, nil},
+	{"--cpu-type", true, Unsupported, nil},
+	{"--disable-serial", false, Shard, nil},
+	{"--dry-run", false, Consumed, nil},
+	{"--email", true, Consumed, nil},
+	{"--enable-serial", false, Shard, nil},
+	{"--fail-email", true, Consumed, nil},
+	{"--fail-loop-count", true, Shard, validateCount},
+	{"--gce-disk-spec", true, Shard, nil},
+	{"--gce-network", true, Shard, nil},
+	{"--gce-zone", true, PerShard, nil},
+	{"--gs-bucket", true, PerShard, nil},
+	{"--help", false, Unsupported, nil},
+	{"--hooks", true, Ignored, nil},
+	{"--i386", false, PerShard, nil},
+	{"--image-family", true, Shard, nil},
+	{"--image-project", true, Shard, nil},
+	{"--initrd", true, Unsupported, nil},
+	{"--install-kconfig", false, Shard, nil},
+	{"--install-kconfig-opts", true, Shard, nil},
+	{"--instance-name", true, PerShard, nil},
+	{"--junit-email", true, Consumed, nil},
+	{"--kernel", true, PerShard, nil},
+	{"--kernel-arch", true, PerShard, nil},
+	{"--kernel-matrix", true, Consumed, nil},
+	{"--kbuild", false, Shard, nil},
+	{"--kbuild-opts", true, Consumed, nil},
+	{"--kconfig-opts", true, Consumed, nil},
+	{"--kernel-build", false, Unsupported, nil},
+	{"--local-ssd", false, Shard, nil},
+	{"--local-ssd-nvme", false, Shard, nil},
+	{"--log", false, Unsupported, nil},
+	{"--machtype", true, Ignored, nil},
+	{"--mkfs-config", true, Shard, nil},
+	{"--modules", true, Shard, nil},
+	{"--monitor-timeout", true, Consumed, validateTimeout},
+	{"--new-count", false, Shard, nil},
+	{"--nfssrv", true, Shard, nil},
+	{"--note", true, Shard, nil},
+	{"--oslogin", false, Shard, nil},
+	{"--no-oslogin", false, Shard, nil},
+	{"--oslogin-2fa", false, Shard, nil},
+	{"--no-oslogin-2fa", false, Shard, nil},
+	{"--no-action", false, Unsupported, nil},
+	{"--no-archive", false, Unsupported, nil},
+	{"--no-collapse", false, Shard, nil},
+	{"--no-email", false, PerShard, nil},
+	{"--no-insert", false, Shard, nil},
+	{"--no-junit-email", false, Consumed, nil},
+	{"--no-log", false, Unsupported, nil},
+	{"--no-preemptible", false, Shard, nil},
+	{"--no-spot-fallback", false, Shard, nil},
+	{"--no-spot", false, Shard, nil},
+	{"--no-punch", false, Shard, nil},
+	{"--no-region-shard", false, Consumed, nil},
+	{"--no-virtio-rng", false, Unsupported, nil},
+	{"--no-vm-timeout", false, Shard, nil},
+	{"--no-zero", false, Shard, nil},
+	{"--numa", true, Unsupported, nil},
+	{"--plan", true, Consumed, nil},
+	{"--pmem-device", false, Shard, nil},
+	{"--pts-size", true, Shard, nil},
+	{"--preemptible", false, Shard, nil},
+	{"--spot", false, Shard, nil},
+	{"--spot-fallback", false, Shard, nil},
+	{"--primary_fstype", true, Shard, nil},
+	{"--repo", true, Consumed, nil},
+	{"--schedule", true, Consumed, nil},
+	{"--schedule-id", true, Consumed, nil},
+	{"--skip-kernel-arch-probe", false, Shard, nil},
+	{"--soak-duration", true, Shard, nil},
+	{"--split-results", true, Consumed, nil},
+	{"--split-tests", true, Consumed, validateCount},
+	{"--stress-mem", true, Shard, nil},
+	{"--stress-opts", true, Shard, nil},
+	{"--testrunid", true, Consumed, nil},
+	{"--unschedule", true, Consumed, nil},
+	{"--unwatch", true, Consumed, nil},
+	{"--update-files", false, Ignored, nil},
+	{"--update-xfstests", false, Ignored, nil},
+	{"--update-xfstests-tar", false, Ignored, nil},
+	{"--virtfs-model", true, Unsupported, nil},
+	{"--virtfs-scratch", true, Unsupported, nil},
+	{"--virtfs-test", true, Unsupported, nil},
+	{"--virtfs-type", true, Unsupported, nil},
+	{"--virtfs", true, Unsupported, nil},
+	{"--virtiofsd", true, Unsupported, nil},
+	{"--vm-timeout", false, Shard, nil},
+	{"--watch", true, Consumed, nil},
+	{"--watch-commits", true, Consumed, validateWatchCommits},
+	{"--watch-max-commits", true, Consumed, validateCount},
+	{"--watch-skip-initial", false, Consumed, nil},
+}
+
+// optionMap indexes options by name.
+var optionMap = make(map[string]*Option)
+
+func init() {
+	for _, opt := range options {
+		optionMap[opt.Name] = opt
+	}
+}
+
+// Lookup returns the option with a name, e.g. "-c" or "--kernel".
+func Lookup(name string) (*Option, bool) {
+	opt, ok := optionMap[name]
+	return opt, ok
+}
+
+// CheckValue validates the value of an option.
+func CheckValue(name string, value string) error {
+	opt, ok := Lookup(name)
+	if !ok {
+		return fmt.Errorf("unknown option %s", name)
+	}
+	if opt.Validate == nil {
+		return nil
+	}
+	if err := opt.Validate(value); err != nil {
+		return fmt.Errorf("invalid %s %s: %v", name, value, err)
+	}
+	return nil
+}
+
+func validateNonEmpty(value string) error {
+	if value == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	return nil
+}
+
+func validateCount(value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("must be a number")
+	}
+	if n < 0 {
+		return fmt.Errorf("must not be negative")
+	}
+	return nil
+}
+
+func validateTimeout(value string) error {
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if timeout <= 0 {
+		return fmt.Errorf("must be positive")
+	}
+	return nil
+}
+
+func validateArch(value string) error {
+	for _, arch := range Archs {
+		if value == arch {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of %s", strings.Join(Archs, ", "))
+}
+
+func validateWatchCommits(value string) error {
+	if value != "first-parent" && value != "all" {
+		return fmt.Errorf("must be first-parent or all")
+	}
+	return nil
+}
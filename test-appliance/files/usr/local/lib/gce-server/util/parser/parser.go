@@ -16,40 +16,6 @@ const (
 	xfsPath   = "/root"
 )
 
-var invalidBools = []string{
-	"ltm",
-	"--no-region-shard",
-	"--no-email",
-	"--no-junit-email",
-}
-var invalidOpts = []string{
-	"--instance-name",
-	"--bucket-subdir",
-	"--gs-bucket",
-	"--email",
-	"--fail-email",
-	"--junit-email",
-	"--gce-zone",
-	"--testrunid",
-	"--hooks",
-	"--update-xfstests-tar",
-	"--update-xfstests",
-	"--update-files",
-	"-n",
-	"-r",
-	"--machtype",
-	"--kernel",
-	"--arch",
-	"--commit",
-	"--config",
-	"--kconfig-opts",
-	"--repo",
-	"--watch",
-	"--bisect-good",
-	"--bisect-bad",
-	"--monitor-timeout",
-}
-
 /*
 Cmd parses a cmdline into validArgs and configs.
 
@@ -57,97 +23,40 @@ Returns:
 
 	validArgs - a slice of cmd args not related to test configurations.
 	Parser removes arguments from the original cmd that don't make sense
-	for LTM (e.g. ltm, --instance-name).
+	for LTM (e.g. ltm, --instance-name), see options.go.
 
 	configs - a map from filesystem names to a slice of corresponding
 	configurations.  Duplicates are removed from the original cmd configs.
 */
 func Cmd(cmdLine string) ([]string, map[string][]string, error) {
-	args := strings.Fields(cmdLine)
-	validArgs, _ := sanitizeCmd(args)
-	validArgs = expandAliases(validArgs)
-	return processConfigs(validArgs)
-}
-
-// sanitizeCmd removes invalid args from input cmdline.
-func sanitizeCmd(args []string) ([]string, []string) {
-	boolDict := NewSet(invalidBools)
-	optDict := NewSet(invalidOpts)
-	validArgs := []string{}
-	invalidArgs := []string{}
-	skipIndex := false
-
-	for _, arg := range args {
-		if skipIndex {
-			invalidArgs = append(invalidArgs, arg)
-			skipIndex = false
-		} else {
-			if boolDict.Contain(arg) {
-				invalidArgs = append(invalidArgs, arg)
-			} else if optDict.Contain(arg) {
-				invalidArgs = append(invalidArgs, arg)
-				skipIndex = true
-			} else {
-				validArgs = append(validArgs, arg)
-			}
-		}
-	}
-	return validArgs, invalidArgs
-}
-
-// expandAliases expands some explicit aliases of test options.
-// It only converts "smoke" to "-c 4k -g quick", since other aliases
-// ("full", "quick") have no effects on -c configs.
-func expandAliases(args []string) []string {
-	prefixArgs := []string{}
-	expandedArgs := []string{}
-
-	for _, arg := range args {
-		if arg == "smoke" {
-			if len(prefixArgs) == 0 {
-				prefixArgs = append(prefixArgs, "-c", "4k", "-g", "quick")
-			}
-		} else {
-			expandedArgs = append(expandedArgs, arg)
-		}
+	req, err := Parse(cmdLine)
+	if err != nil {
+		return []string{}, make(map[string][]string), err
 	}
-
-	expandedArgs = append(prefixArgs, expandedArgs...)
-	return expandedArgs
+	configs, err := req.Configs()
+	return req.ShardArgs(), configs, err
 }
 
-// processConfigs finds the configuration args following "-c" and parses
-// them. If no "-c" option is specified (or aliases like "smoke"), it uses
-// primaryFS as the filesystem and "all" as the config.
-func processConfigs(args []string) ([]string, map[string][]string, error) {
-	newArgs := make([]string, len(args))
-	copy(newArgs, args)
-	configArg := ""
+// processConfigs parses the configuration argument of "-c". If no config
+// is specified, it uses primaryFS as the filesystem and "all" as the config.
+func processConfigs(configArg string) (map[string][]string, error) {
 	configs := make(map[string][]string)
 
-	for i, arg := range args {
-		if arg == "-c" {
-			configArg = args[i+1]
-			newArgs = append(args[:i], args[i+2:]...)
-			break
-		}
-	}
-
 	if configArg == "" {
 		err := defaultConfigs(configs)
 		if err != nil {
-			return newArgs, configs, err
+			return configs, err
 		}
 	} else {
 		for _, c := range strings.Split(configArg, ",") {
 			err := singleConfig(configs, c)
 			if err != nil {
-				return newArgs, configs, err
+				return configs, err
 			}
 		}
 	}
 
-	return newArgs, configs, nil
+	return configs, nil
 }
 
 func defaultConfigs(configs map[string][]string) error {
@@ -241,3 +150,8 @@ func DecodeCmd(cmdLine string) (string, error) {
 	}
 	return strings.TrimSpace(string(data)), nil
 }
+
+// EncodeCmd encodes a command line in base64, as sent in user requests.
+func EncodeCmd(cmdLine string) string {
+	return base64.StdEncoding.EncodeToString([]byte(cmdLine))
+}
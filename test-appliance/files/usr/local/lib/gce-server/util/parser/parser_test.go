@@ -102,6 +102,20 @@ var tests = []struct {
 	},
 }
 
+var configTests = []struct {
+	cmdline string
+	errs    []string
+}{
+	{"ltm smoke", []string{}},
+	{"ltm -c ext4/4k,xfs/all -g auto", []string{}},
+	{"ltm -c ext4", []string{}},
+	{"ltm -c ext4/invalid_cfg,invalid_fs", []string{
+		"unknown config ext4/invalid_cfg",
+		"unknown config invalid_fs",
+	}},
+	{"ltm -c ext4/4k,4k/invalid_cfg", []string{"unknown config 4k/invalid_cfg"}},
+}
+
 func TestParse(t *testing.T) {
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -126,3 +140,26 @@ func TestParse(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckConfigs(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Error(err)
+	}
+	if hostname != "xfstests-ltm" && hostname != "xfstests-kcs" {
+		t.Skip("test only runs on LTM or KCS server")
+	}
+
+	for _, e := range configTests {
+		req, err := Parse(e.cmdline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		errs := req.CheckConfigs()
+		if !reflect.DeepEqual(e.errs, errs) {
+			t.Errorf("Unmatched errors for cmdline %s. Should get %s but get %s instead.",
+				e.cmdline, e.errs, errs,
+			)
+		}
+	}
+}
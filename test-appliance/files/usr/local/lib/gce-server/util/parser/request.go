@@ -0,0 +1,221 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Arg is an option given on a command line. Value is empty if the option
+// takes no argument.
+type Arg struct {
+	Name  string
+	Value string
+}
+
+// Request is a gce-xfstests command line parsed with the option table.
+// Options are kept in command line order, and Tests holds the arguments
+// which are not options, e.g. test names and the aliases "quick" and "full".
+type Request struct {
+	Options []Arg
+	Tests   []string
+}
+
+/*
+Parse parses a gce-xfstests command line into a request.
+
+Options follow getopt conventions: "--name value" or "--name=value" for
+long options, "-g value" or "-gvalue" for short options, grouped short
+flags like "-av", and "--" ends the options. The "ltm" command is dropped,
+and the "smoke" alias is expanded to "-c 4k -g quick". Returns an error for
+unknown options and missing arguments.
+*/
+func Parse(cmdLine string) (*Request, error) {
+	req := &Request{Options: []Arg{}, Tests: []string{}}
+	args := strings.Fields(cmdLine)
+	smoke := false
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			req.Tests = append(req.Tests, args[i+1:]...)
+			i = len(args)
+
+		case strings.HasPrefix(arg, "--"):
+			name, value, hasValue := strings.Cut(arg, "=")
+			opt, ok := Lookup(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown option %s", name)
+			}
+			if !opt.HasArg {
+				if hasValue {
+					return nil, fmt.Errorf("option %s takes no argument", name)
+				}
+				req.Options = append(req.Options, Arg{Name: name})
+				continue
+			}
+			if !hasValue {
+				if i+1 >= len(args) {
+					return nil, fmt.Errorf("option %s requires an argument", name)
+				}
+				i++
+				value = args[i]
+			}
+			req.Options = append(req.Options, Arg{name, value})
+
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			for j := 1; j < len(arg); j++ {
+				name := "-" + arg[j:j+1]
+				opt, ok := Lookup(name)
+				if !ok {
+					return nil, fmt.Errorf("unknown option %s", name)
+				}
+				if !opt.HasArg {
+					req.Options = append(req.Options, Arg{Name: name})
+					continue
+				}
+				value := arg[j+1:]
+				if value == "" {
+					if i+1 >= len(args) {
+						return nil, fmt.Errorf("option %s requires an argument", name)
+					}
+					i++
+					value = args[i]
+				}
+				req.Options = append(req.Options, Arg{name, value})
+				break
+			}
+
+		case arg == "ltm":
+
+		case arg == "smoke":
+			smoke = true
+
+		default:
+			req.Tests = append(req.Tests, arg)
+		}
+	}
+
+	if smoke {
+		req.Options = append([]Arg{{"-c", "4k"}, {"-g", "quick"}}, req.Options...)
+	}
+	return req, nil
+}
+
+// Has returns whether an option is given.
+func (req *Request) Has(name string) bool {
+	_, ok := req.Get(name)
+	return ok
+}
+
+// Get returns the value of the last occurrence of an option.
+func (req *Request) Get(name string) (string, bool) {
+	value, found := "", false
+	for _, arg := range req.Options {
+		if arg.Name == name {
+			value, found = arg.Value, true
+		}
+	}
+	return value, found
+}
+
+// Validate checks the options of a request, and returns an error message
+// for each invalid value, each option LTM does not support, and repeated
+// configs.
+func (req *Request) Validate() []string {
+	errs := []string{}
+	configs := 0
+	for _, arg := range req.Options {
+		opt, _ := Lookup(arg.Name)
+		if opt.Handling == Unsupported {
+			errs = append(errs, fmt.Sprintf("option %s is not supported by LTM", arg.Name))
+			continue
+		}
+		if arg.Name == "-c" {
+			configs++
+			if configs == 2 {
+				errs = append(errs, "option -c (or smoke) can only be given once")
+			}
+		}
+		if err := CheckValue(arg.Name, arg.Value); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	return errs
+}
+
+// Configs parses the configs given with "-c" (or "smoke") into a map from
+// filesystem names to configurations.
+func (req *Request) Configs() (map[string][]string, error) {
+	configArg, _ := req.Get("-c")
+	return processConfigs(configArg)
+}
+
+// CheckConfigs returns an error message for each config of the request
+// that does not exist or cannot be read. Configs skips unknown configs, so
+// a request should be checked before it is run.
+func (req *Request) CheckConfigs() []string {
+	errs := []string{}
+	configArg, ok := req.Get("-c")
+	if !ok {
+		return errs
+	}
+	for _, c := range strings.Split(configArg, ",") {
+		configs := make(map[string][]string)
+		err := singleConfig(configs, c)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to read config %s: %v", c, err))
+		} else if len(configs) == 0 {
+			errs = append(errs, fmt.Sprintf("unknown config %s", c))
+		}
+	}
+	return errs
+}
+
+// Render returns the command line arguments of a request. Parsing the
+// rendered arguments gives back the same request.
+func (req *Request) Render() []string {
+	args := renderArgs([]string{}, req.Options, nil)
+	return req.renderTests(args)
+}
+
+/*
+ShardArgs returns the gce-xfstests arguments of a shard. The options set by
+LTM for the shard come first, followed by the shard options and the tests
+of the request. The other options of the request are dropped.
+*/
+func (req *Request) ShardArgs(perShard ...Arg) []string {
+	args := renderArgs([]string{}, perShard, nil)
+	args = renderArgs(args, req.Options, func(opt *Option) bool {
+		return opt.Handling == Shard
+	})
+	return req.renderTests(args)
+}
+
+// renderTests appends the tests to args, after "--" if a test looks like
+// an option.
+func (req *Request) renderTests(args []string) []string {
+	for _, test := range req.Tests {
+		if strings.HasPrefix(test, "-") {
+			args = append(args, "--")
+			break
+		}
+	}
+	return append(args, req.Tests...)
+}
+
+// renderArgs appends the options accepted by filter to args. A nil filter
+// accepts all options.
+func renderArgs(args []string, options []Arg, filter func(*Option) bool) []string {
+	for _, arg := range options {
+		opt, ok := Lookup(arg.Name)
+		if !ok || (filter != nil && !filter(opt)) {
+			continue
+		}
+		args = append(args, arg.Name)
+		if opt.HasArg {
+			args = append(args, arg.Value)
+		}
+	}
+	return args
+}
@@ -0,0 +1,163 @@
+package parser
+
+import (
+	"bufio"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// parseCLI is the gce-xfstests option parser in the source tree.
+const parseCLI = "../../../../../../../../run-fstests/util/parse_cli"
+
+var requestTests = []struct {
+	cmdline   string
+	render    string
+	shardArgs string
+}{
+	{
+		"ltm smoke",
+		"-c 4k -g quick",
+		"-g quick",
+	},
+	{
+		"ltm -c ext4/4k -g auto -X generic/475 --no-region-shard",
+		"-c ext4/4k -g auto -X generic/475 --no-region-shard",
+		"-g auto -X generic/475",
+	},
+	{
+		"ltm --kernel=gs://bucket/bzImage --arm64 -c4k -av generic/001 generic/002",
+		"--kernel gs://bucket/bzImage --arm64 -c 4k -a -v generic/001 generic/002",
+		"-a -v generic/001 generic/002",
+	},
+	{
+		"ltm --repo stable.git --commit v6.1 --backport abc --backport-compare --watch-skip-initial -g quick",
+		"--repo stable.git --commit v6.1 --backport abc --backport-compare --watch-skip-initial -g quick",
+		"-g quick",
+	},
+	{
+		"ltm -c 4k --hooks hooks.tar.gz -n 4 --machtype e2-standard-4 --image-project proj -- -g",
+		"-c 4k --hooks hooks.tar.gz -n 4 --machtype e2-standard-4 --image-project proj -- -g",
+		"--image-project proj -- -g",
+	},
+}
+
+func TestRequestRoundTrip(t *testing.T) {
+	for _, e := range requestTests {
+		req, err := Parse(e.cmdline)
+		if err != nil {
+			t.Errorf("failed to parse %s: %v", e.cmdline, err)
+			continue
+		}
+		render := strings.Join(req.Render(), " ")
+		if render != e.render {
+			t.Errorf("cmdline %s renders as %s, want %s", e.cmdline, render, e.render)
+		}
+		again, err := Parse(render)
+		if err != nil || !reflect.DeepEqual(req, again) {
+			t.Errorf("rendered cmdline %s parses as %+v, want %+v (%v)", render, again, req, err)
+		}
+		shardArgs := strings.Join(req.ShardArgs(), " ")
+		if shardArgs != e.shardArgs {
+			t.Errorf("cmdline %s gives shard args %s, want %s", e.cmdline, shardArgs, e.shardArgs)
+		}
+	}
+}
+
+func TestShardArgs(t *testing.T) {
+	req, err := Parse("ltm -c ext4/all -g auto --instance-name mine --no-vm-timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := req.ShardArgs(Arg{"--instance-name", "xfstests-ltm-aa"}, Arg{"--no-email", ""}, Arg{"-c", "ext4/4k"})
+	want := []string{"--instance-name", "xfstests-ltm-aa", "--no-email", "-c", "ext4/4k", "-g", "auto", "--no-vm-timeout"}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("get shard args %q, want %q", args, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for cmdline, want := range map[string]string{
+		"ltm --no-such-option":  "unknown option --no-such-option",
+		"ltm -g auto -c":        "option -c requires an argument",
+		"ltm --dry-run=yes":     "option --dry-run takes no argument",
+		"ltm -aZ":               "unknown option -Z",
+		"ltm --monitor-timeout": "option --monitor-timeout requires an argument",
+	} {
+		if _, err := Parse(cmdline); err == nil || err.Error() != want {
+			t.Errorf("parsing %s returns error %v, want %s", cmdline, err, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	req, err := Parse("ltm smoke -c 4k --aio native -C x --monitor-timeout 0s --arch x86 --watch-commits all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"option -c (or smoke) can only be given once",
+		"option --aio is not supported by LTM",
+		"invalid -C x: must be a number",
+		"invalid --monitor-timeout 0s: must be positive",
+		"invalid --arch x86: must be one of amd64, arm64, i386",
+	}
+	if errs := req.Validate(); !reflect.DeepEqual(errs, want) {
+		t.Errorf("get errors %q, want %q", errs, want)
+	}
+}
+
+// TestOptionTable checks that the option table matches the options parsed
+// by gce-xfstests, so new options are not silently mishandled.
+func TestOptionTable(t *testing.T) {
+	file, err := os.Open(parseCLI)
+	if err != nil {
+		t.Skip("parse_cli is not in the source tree")
+	}
+	defer file.Close()
+
+	cliOptions := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	inLongopts := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "shortopts="):
+			short := strings.Trim(strings.TrimPrefix(line, "shortopts="), `"`)
+			for i := 0; i < len(short); i++ {
+				hasArg := i+1 < len(short) && short[i+1] == ':'
+				cliOptions["-"+short[i:i+1]] = hasArg
+				if hasArg {
+					i++
+				}
+			}
+		case line == "longopts=(":
+			inLongopts = true
+		case inLongopts && line == ")":
+			inLongopts = false
+		case inLongopts:
+			cliOptions["--"+strings.TrimSuffix(line, ":")] = strings.HasSuffix(line, ":")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cliOptions) == 0 {
+		t.Fatal("no options found in parse_cli")
+	}
+
+	for name, hasArg := range cliOptions {
+		opt, ok := Lookup(name)
+		if !ok {
+			t.Errorf("option %s of parse_cli is missing in the option table", name)
+		} else if opt.HasArg != hasArg {
+			t.Errorf("option %s takes an argument in parse_cli: %v, in the option table: %v", name, hasArg, opt.HasArg)
+		}
+	}
+	for _, opt := range options {
+		if _, ok := cliOptions[opt.Name]; !ok {
+			t.Errorf("option %s of the option table is not in parse_cli", opt.Name)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"thunk.org/gce-server/util/check"
+)
+
+// testsPath is the xfstests tests directory in the test appliance.
+const testsPath = xfsPath + "/xfstests/tests"
+
+// aliases of test groups given as tests.
+var groupAliases = map[string]string{
+	"quick": "quick",
+	"full":  "auto",
+}
+
+/*
+ExpandTests returns the tests that the request runs with a config, in
+sorted order.
+
+The tests of the groups given with "-g" (or the aliases "quick" and "full")
+are read from the xfstests group files of the generic tests and the tests
+of the filesystem of the config, leaving out the groups given with "-x".
+Tests named on the command line are added as they are. Excluded tests of
+the config are left to the test appliance.
+*/
+func (req *Request) ExpandTests(config string) ([]string, error) {
+	return req.expandTests(testsPath, config)
+}
+
+func (req *Request) expandTests(testsDir string, config string) ([]string, error) {
+	groups := make(map[string]bool)
+	excludes := make(map[string]bool)
+	tests := make(map[string]bool)
+
+	for _, arg := range req.Options {
+		switch arg.Name {
+		case "-g":
+			for _, g := range strings.Split(arg.Value, ",") {
+				groups[g] = true
+			}
+		case "-x":
+			for _, g := range strings.Split(arg.Value, ",") {
+				excludes[g] = true
+			}
+		}
+	}
+	for _, test := range req.Tests {
+		if group, ok := groupAliases[test]; ok {
+			groups[group] = true
+		} else {
+			tests[test] = true
+		}
+	}
+
+	if len(groups) > 0 {
+		for _, dir := range []string{"generic", "shared", configFS(config)} {
+			groupFile := fmt.Sprintf("%s/%s/group.list", testsDir, dir)
+			if !check.FileExists(groupFile) {
+				continue
+			}
+			lines, err := check.ReadLines(groupFile)
+			if err != nil {
+				return []string{}, err
+			}
+			for _, line := range lines {
+				fields := strings.Fields(line)
+				if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+					continue
+				}
+				if inGroups(fields[1:], groups) && !inGroups(fields[1:], excludes) {
+					tests[dir+"/"+fields[0]] = true
+				}
+			}
+		}
+	}
+
+	result := []string{}
+	for test := range tests {
+		result = append(result, test)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// WithTests returns a copy of the request that runs the given tests
+// instead of its groups and tests.
+func (req *Request) WithTests(tests []string) *Request {
+	sliced := &Request{Options: []Arg{}, Tests: tests}
+	for _, arg := range req.Options {
+		if arg.Name != "-g" && arg.Name != "-x" {
+			sliced.Options = append(sliced.Options, arg)
+		}
+	}
+	return sliced
+}
+
+// configFS returns the filesystem a config tests, e.g. "ext4" for
+// "ext4/4k" and "overlay" for "ext4:overlay/small".
+func configFS(config string) string {
+	fs, _, found := strings.Cut(config, "/")
+	if !found {
+		return primaryFS
+	}
+	if _, overlay, ok := strings.Cut(fs, ":"); ok {
+		return overlay
+	}
+	return fs
+}
+
+func inGroups(testGroups []string, groups map[string]bool) bool {
+	for _, g := range testGroups {
+		if groups[g] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeGroups(t *testing.T, dir string, fs string, content string) {
+	if err := os.MkdirAll(filepath.Join(dir, fs), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, fs, "group.list"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpandTests(t *testing.T) {
+	dir := t.TempDir()
+	writeGroups(t, dir, "generic", "# comment\n001 auto quick rw\n002 auto punch\n003 dangerous\n")
+	writeGroups(t, dir, "ext4", "001 auto quick\n002 auto\n")
+	writeGroups(t, dir, "xfs", "001 auto quick\n")
+
+	tests := []struct {
+		cmdline string
+		config  string
+		tests   []string
+	}{
+		{"ltm -c ext4/4k -g auto", "ext4/4k", []string{"ext4/001", "ext4/002", "generic/001", "generic/002"}},
+		{"ltm -c ext4/4k -g auto -x punch", "ext4/4k", []string{"ext4/001", "ext4/002", "generic/001"}},
+		{"ltm -c xfs/4k quick generic/003", "xfs/4k", []string{"generic/001", "generic/003", "xfs/001"}},
+		{"ltm -c ext4:overlay/small -g quick", "ext4:overlay/small", []string{"generic/001"}},
+		{"ltm -c 4k generic/002", "ext4/4k", []string{"generic/002"}},
+	}
+	for _, e := range tests {
+		req, err := Parse(e.cmdline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := req.expandTests(dir, e.config)
+		if err != nil {
+			t.Errorf("failed to expand tests of %s: %v", e.cmdline, err)
+		} else if !reflect.DeepEqual(got, e.tests) {
+			t.Errorf("cmdline %s expands to %s with config %s, want %s", e.cmdline, got, e.config, e.tests)
+		}
+	}
+}
+
+func TestWithTests(t *testing.T) {
+	req, err := Parse("ltm -c ext4/4k -g auto -x punch -X generic/475 quick")
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := req.WithTests([]string{"generic/001", "ext4/002"}).ShardArgs()
+	want := []string{"-X", "generic/475", "generic/001", "ext4/002"}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("get shard args %q, want %q", args, want)
+	}
+}
@@ -0,0 +1,352 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"thunk.org/gce-server/util/check"
+	"thunk.org/gce-server/util/logging"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// auditPath is the append-only audit log of the server.
+	auditPath = logging.LogDir + "audit.jsonl"
+	// maxAuditBody limits the size of the request options and response
+	// bodies kept in the audit log. Requests are passed on in full.
+	maxAuditBody = 1 << 20
+	// defaultAuditLimit is the number of entries returned by a query
+	// without a limit.
+	defaultAuditLimit = 100
+	// maxAuditSize is the size at which the audit log is rotated. Only one
+	// rotated log is kept, so the audit log takes at most twice this size.
+	maxAuditSize = 64 << 20
+)
+
+// bulkyOptions are request options that can be megabytes long. Only their
+// size is kept in the audit log.
+var bulkyOptions = []string{"patch_mbox", "plan", "series"}
+
+// AuditEntry records a single API request and its outcome.
+// User is the authenticated identity, or the peer server for internal
+// requests. Submitter is the user a request was made on behalf of.
+type AuditEntry struct {
+	Time      time.Time              `json:"time"`
+	User      string                 `json:"user"`
+	Submitter string                 `json:"submitter,omitempty"`
+	Endpoint  string                 `json:"endpoint"`
+	CmdLine   string                 `json:"cmdline,omitempty"`
+	Options   map[string]interface{} `json:"options,omitempty"`
+	TestID    string                 `json:"test_id,omitempty"`
+	Code      int                    `json:"code"`
+	Outcome   string                 `json:"outcome"`
+	Msg       string                 `json:"msg,omitempty"`
+}
+
+// AuditQuery selects audit entries. Since and Until are RFC3339 time
+// stamps; empty fields match all entries. The latest Limit entries are
+// returned.
+type AuditQuery struct {
+	Since  string `json:"since"`
+	Until  string `json:"until"`
+	User   string `json:"user"`
+	TestID string `json:"test_id"`
+	Limit  int    `json:"limit"`
+}
+
+// AuditResponse returns the audit entries matching a query.
+type AuditResponse struct {
+	Status  bool         `json:"status"`
+	Msg     string       `json:"msg"`
+	Entries []AuditEntry `json:"entries"`
+}
+
+// AuditLog is an append-only log of API requests in JSON lines.
+// When the log grows over maxSize, it is moved to path.1, replacing the
+// previous rotated log.
+type AuditLog struct {
+	path    string
+	maxSize int64
+	lock    sync.Mutex
+}
+
+// NewAuditLog returns an audit log that appends to path.
+func NewAuditLog(path string) *AuditLog {
+	return &AuditLog{path: path, maxSize: maxAuditSize}
+}
+
+// Record appends an entry to the audit log.
+func (audit *AuditLog) Record(entry AuditEntry) error {
+	js, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	audit.lock.Lock()
+	defer audit.lock.Unlock()
+	if info, err := os.Stat(audit.path); err == nil && info.Size() >= audit.maxSize {
+		err = os.Rename(audit.path, audit.path+".1")
+		if err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(audit.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(js, '\n'))
+	return err
+}
+
+// Query returns the latest entries matching the query, oldest first.
+func (audit *AuditLog) Query(q AuditQuery) ([]AuditEntry, error) {
+	var since, until time.Time
+	var err error
+	if q.Since != "" {
+		since, err = time.Parse(time.RFC3339, q.Since)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if q.Until != "" {
+		until, err = time.Parse(time.RFC3339, q.Until)
+		if err != nil {
+			return nil, err
+		}
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultAuditLimit
+	}
+
+	audit.lock.Lock()
+	defer audit.lock.Unlock()
+	entries := []AuditEntry{}
+	for _, path := range []string{audit.path + ".1", audit.path} {
+		entries, err = queryFile(path, entries, func(entry AuditEntry) bool {
+			if !since.IsZero() && entry.Time.Before(since) {
+				return false
+			}
+			if !until.IsZero() && entry.Time.After(until) {
+				return false
+			}
+			if q.User != "" && entry.User != q.User && entry.Submitter != q.User {
+				return false
+			}
+			return q.TestID == "" || entry.TestID == q.TestID
+		}, limit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// queryFile appends the entries of an audit log file that match to
+// entries, and keeps the latest limit entries.
+func queryFile(path string, entries []AuditEntry, match func(AuditEntry) bool, limit int) ([]AuditEntry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 2*maxAuditBody)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil || !match(entry) {
+			continue
+		}
+		entries = append(entries, entry)
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// auditWriter keeps the status code and the beginning of a response.
+type auditWriter struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (w *auditWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	if room := maxAuditBody - w.body.Len(); room > 0 {
+		if len(b) < room {
+			room = len(b)
+		}
+		w.body.Write(b[:room])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+/*
+AuditHandler records the request and its outcome in the audit log, and
+passes over to the next handler.
+
+It must wrap LoginHandler or InternalHandler, so that requests rejected
+by them are audited too. They fill in the identity of the requester with
+setAuditUser(). The command line is decoded and secrets in the options
+are redacted before the request is logged.
+*/
+func (server *Instance) AuditHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log := server.log.WithField("endpoint", "AuditHandler")
+
+		entry := &AuditEntry{
+			Time:     time.Now(),
+			Endpoint: r.URL.Path,
+		}
+		if r.Body != nil {
+			body, err := ioutil.ReadAll(r.Body)
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			if check.NoError(err, log, "Failed to read request body") {
+				parseAuditRequest(body, entry)
+			}
+		}
+
+		aw := &auditWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), auditKey, entry)))
+		parseAuditResponse(aw, entry)
+
+		err := server.audit.Record(*entry)
+		check.NoError(err, log.WithField("entry", entry), "Failed to write audit log")
+	})
+}
+
+// setAuditUser records the authenticated user or peer server of a request
+// in its audit entry, if the request goes through AuditHandler.
+func setAuditUser(r *http.Request, user string) {
+	if entry, ok := r.Context().Value(auditKey).(*AuditEntry); ok {
+		entry.User = user
+	}
+}
+
+// parseAuditRequest fills in the command line and redacted options of a
+// json request. Bulky options are replaced with their size, and options
+// longer than maxAuditBody altogether are replaced with their total size.
+func parseAuditRequest(body []byte, entry *AuditEntry) {
+	var options map[string]interface{}
+	if json.Unmarshal(body, &options) != nil {
+		return
+	}
+	if cmdLine, ok := options["orig_cmdline"].(string); ok {
+		decoded, err := base64.StdEncoding.DecodeString(cmdLine)
+		if err == nil {
+			entry.CmdLine = string(decoded)
+		} else {
+			entry.CmdLine = cmdLine
+		}
+		entry.CmdLine = logging.Redact(entry.CmdLine)
+		delete(options, "orig_cmdline")
+	}
+	if user, ok := options["user"].(string); ok && user != "" {
+		entry.Submitter = user
+	}
+	if extra, ok := options["extra_options"].(map[string]interface{}); ok {
+		if testID, ok := extra["test_id"].(string); ok {
+			entry.TestID = testID
+		}
+	}
+	redact(options)
+	summarize(options)
+	if encoded, _ := json.Marshal(options); len(encoded) > maxAuditBody {
+		options = map[string]interface{}{"options": byteSize(len(encoded))}
+	}
+	entry.Options = options
+}
+
+// parseAuditResponse fills in the outcome and testID of a response.
+func parseAuditResponse(w *auditWriter, entry *AuditEntry) {
+	entry.Code = w.code
+	entry.Outcome = "success"
+	var response SimpleResponse
+	if json.Unmarshal(w.body.Bytes(), &response) == nil {
+		if !response.Status {
+			entry.Outcome = "failure"
+		}
+		entry.Msg = response.Msg
+		if response.TestID != "" {
+			entry.TestID = response.TestID
+		}
+	}
+	if w.code != http.StatusOK {
+		entry.Outcome = "failure"
+		entry.Msg = string(bytes.TrimSpace(w.body.Bytes()))
+	}
+}
+
+// redact replaces the values of secret options, recursively.
+func redact(options map[string]interface{}) {
+	for key, value := range options {
+		if logging.IsSecretKey(key) {
+			options[key] = logging.Redacted
+		} else if nested, ok := value.(map[string]interface{}); ok {
+			redact(nested)
+		}
+	}
+}
+
+// summarize replaces the values of bulky options with their size,
+// recursively.
+func summarize(options map[string]interface{}) {
+	for key, value := range options {
+		if slices.Contains(bulkyOptions, key) {
+			encoded, _ := json.Marshal(value)
+			options[key] = byteSize(len(encoded))
+		} else if nested, ok := value.(map[string]interface{}); ok {
+			summarize(nested)
+		}
+	}
+}
+
+// byteSize describes a value of size bytes left out of the audit log.
+func byteSize(size int) string {
+	return fmt.Sprintf("<%d bytes>", size)
+}
+
+// Audit handles the admin endpoint that queries the audit log.
+func (server *Instance) Audit(w http.ResponseWriter, r *http.Request) {
+	log := server.log.WithFields(logrus.Fields{
+		"endpoint": "/audit",
+		"user":     User(r),
+	})
+
+	var c AuditQuery
+	err := json.NewDecoder(r.Body).Decode(&c)
+	check.Panic(err, log, "Failed to parse json request")
+	log.WithField("query", c).Info("Querying audit log")
+
+	entries, err := server.audit.Query(c)
+	check.Panic(err, log, "Failed to query audit log")
+
+	response := AuditResponse{
+		Status:  true,
+		Msg:     fmt.Sprintf("%d entries", len(entries)),
+		Entries: entries,
+	}
+	err = SendResponse(w, r, response)
+	check.Panic(err, log, "Failed to send the response")
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"thunk.org/gce-server/util/logging"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestAuditLog(t *testing.T) {
+	audit := NewAuditLog(t.TempDir() + "/audit.jsonl")
+	start := time.Now()
+	for i, user := range []string{"alice", "bob", "alice"} {
+		err := audit.Record(AuditEntry{
+			Time:     start.Add(time.Duration(i) * time.Hour),
+			User:     user,
+			Endpoint: "/gce-xfstests",
+			TestID:   []string{"1", "2", "3"}[i],
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(q AuditQuery, want ...string) {
+		t.Helper()
+		entries, err := audit.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, entry := range entries {
+			got = append(got, entry.TestID)
+		}
+		if len(got) != len(want) {
+			t.Errorf("query %+v get %v, want %v", q, got, want)
+			return
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("query %+v get %v, want %v", q, got, want)
+				return
+			}
+		}
+	}
+	check(AuditQuery{}, "1", "2", "3")
+	check(AuditQuery{User: "alice"}, "1", "3")
+	check(AuditQuery{TestID: "2"}, "2")
+	check(AuditQuery{Since: start.Add(30 * time.Minute).Format(time.RFC3339)}, "2", "3")
+	check(AuditQuery{Until: start.Add(90 * time.Minute).Format(time.RFC3339)}, "1", "2")
+	check(AuditQuery{Limit: 1}, "3")
+	if _, err := audit.Query(AuditQuery{Since: "yesterday"}); err == nil {
+		t.Error("invalid time accepted")
+	}
+}
+
+func TestAuditRequest(t *testing.T) {
+	cmdLine := base64.StdEncoding.EncodeToString([]byte("ltm -c ext4/4k generic/001"))
+	body := `{"orig_cmdline": "` + cmdLine + `", "user": "alice", "password": "hunter2",
+		"options": {"commit_id": "v6.1", "smtp_password": "hunter2"}}`
+
+	var entry AuditEntry
+	parseAuditRequest([]byte(body), &entry)
+	if entry.CmdLine != "ltm -c ext4/4k generic/001" {
+		t.Errorf("get cmdline %q", entry.CmdLine)
+	}
+	if entry.Submitter != "alice" {
+		t.Errorf("get submitter %q", entry.Submitter)
+	}
+	options := entry.Options["options"].(map[string]interface{})
+	if entry.Options["password"] != logging.Redacted || options["smtp_password"] != logging.Redacted {
+		t.Errorf("secrets not redacted: %v", entry.Options)
+	}
+	if options["commit_id"] != "v6.1" {
+		t.Errorf("get options %v", options)
+	}
+
+	w := &auditWriter{ResponseWriter: httptest.NewRecorder(), code: http.StatusOK}
+	w.Write([]byte(`{"status": false, "testID": "20230101", "msg": "no such commit"}`))
+	parseAuditResponse(w, &entry)
+	if entry.Outcome != "failure" || entry.TestID != "20230101" || entry.Msg != "no such commit" {
+		t.Errorf("get outcome %+v", entry)
+	}
+
+	w = &auditWriter{ResponseWriter: httptest.NewRecorder(), code: http.StatusOK}
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte("Permission denied\n"))
+	parseAuditResponse(w, &entry)
+	if entry.Outcome != "failure" || entry.Code != http.StatusForbidden || entry.Msg != "Permission denied" {
+		t.Errorf("get outcome %+v", entry)
+	}
+}
+
+func TestAuditRotation(t *testing.T) {
+	path := t.TempDir() + "/audit.jsonl"
+	audit := NewAuditLog(path)
+	audit.maxSize = 1
+	for _, testID := range []string{"1", "2", "3"} {
+		if err := audit.Record(AuditEntry{TestID: testID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path + ".2"); !os.IsNotExist(err) {
+		t.Error("more than one rotated audit log kept")
+	}
+	entries, err := audit.Query(AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].TestID != "2" || entries[1].TestID != "3" {
+		t.Errorf("get entries %+v after rotation, want 2 and 3", entries)
+	}
+}
+
+func TestAuditRejectedLogin(t *testing.T) {
+	tokens, err := NewTokenStore(t.TempDir() + "/tokens.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := tokens.Create("alice", ViewerRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Instance{
+		tokens: tokens,
+		audit:  NewAuditLog(t.TempDir() + "/audit.jsonl"),
+		log:    logrus.NewEntry(logrus.New()),
+	}
+	handler := server.AuditHandler(server.LoginHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {})))
+
+	for _, token := range []string{"wrong", secret} {
+		r := httptest.NewRequest("POST", "/status", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	entries, err := server.audit.Query(AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("get %d audit entries, want 2", len(entries))
+	}
+	if entries[0].User != "" || entries[0].Code != http.StatusForbidden || entries[0].Outcome != "failure" {
+		t.Errorf("get entry %+v for a rejected login", entries[0])
+	}
+	if entries[1].User != "alice" || entries[1].Outcome != "success" {
+		t.Errorf("get entry %+v for a valid token", entries[1])
+	}
+}
+
+func TestAuditLargeRequest(t *testing.T) {
+	server := &Instance{
+		audit: NewAuditLog(t.TempDir() + "/audit.jsonl"),
+		log:   logrus.NewEntry(logrus.New()),
+	}
+	var received int
+	handler := server.AuditHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			received = len(body)
+		}))
+
+	mbox := strings.Repeat("x", 2*maxAuditBody)
+	body := `{"user": "alice", "options": {"commit_id": "v6.1", "patch_mbox": "` + mbox + `"},
+		"extra_options": {"series": ["` + mbox + `"]}, "plan": {"shards": []}}`
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/gce-xfstests", strings.NewReader(body)))
+	if received != len(body) {
+		t.Errorf("next handler reads %d bytes of a %d byte request", received, len(body))
+	}
+
+	entries, err := server.audit.Query(AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("get %d audit entries, want 1", len(entries))
+	}
+	options := entries[0].Options["options"].(map[string]interface{})
+	extra := entries[0].Options["extra_options"].(map[string]interface{})
+	if entries[0].Submitter != "alice" || options["commit_id"] != "v6.1" ||
+		options["patch_mbox"] != byteSize(len(mbox)+2) || extra["series"] != byteSize(len(mbox)+4) ||
+		entries[0].Options["plan"] != byteSize(len(`{"shards":[]}`)) {
+		t.Errorf("get options %v for a large request", entries[0].Options)
+	}
+
+	var entry AuditEntry
+	many := `{"a": "` + strings.Repeat("x", maxAuditBody) + `"}`
+	parseAuditRequest([]byte(many), &entry)
+	if len(entry.Options) != 1 || entry.Options["options"] != byteSize(len(many)-1) {
+		t.Errorf("get options %.100v over the audit limit", entry.Options)
+	}
+}
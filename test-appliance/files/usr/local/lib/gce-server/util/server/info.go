@@ -16,34 +16,74 @@ import (
 // SharderInfo exports sharder info.
 type SharderInfo struct {
 	ID            string      `json:"id"`
+	User          string      `json:"user"`
 	Command       string      `json:"command"`
 	KernelVersion string      `json:"kernel_version"`
 	KernelArch    string      `json:"kernel_arch"`
 	NumShards     int         `json:"num_shards"`
+	Priority      string      `json:"priority"`
+	QueuePosition int         `json:"queue_position"`
 	Result        string      `json:"test_result"`
 	ShardInfo     []ShardInfo `json:"shards"`
 }
 
 func (s SharderInfo) String() string {
 	info := fmt.Sprintf(
-		"============SHARDER INFO %s============\nCMDLINE:\t%s\nKERNEL VERSION:\t%s\nKERNEL ARCH:\t%s\nSHARD NUM:\t%d\nTEST RESULT:\t%s\n",
+		"============SHARDER INFO %s============\nUSER:\t%s\nCMDLINE:\t%s\nKERNEL VERSION:\t%s\nKERNEL ARCH:\t%s\nSHARD NUM:\t%d\nTEST RESULT:\t%s\n",
 		s.ID,
+		s.User,
 		s.Command,
 		s.KernelVersion,
 		s.KernelArch,
 		s.NumShards,
 		s.Result,
 	)
+	if s.QueuePosition > 0 {
+		info += fmt.Sprintf("QUEUE POSITION:\t%d (%s priority, waiting for GCE quota)\n", s.QueuePosition, s.Priority)
+	}
 	for _, shard := range s.ShardInfo {
 		info += shard.String()
 	}
 	return info
 }
 
+// ShardPlan is the result of a dry run of a test request. It shows the
+// shards LTM would launch with the current quota. The run time and the cost
+// are only estimated if the run times of the tests are known.
+type ShardPlan struct {
+	Status        bool           `json:"status"`
+	Msg           string         `json:"msg"`
+	Command       string         `json:"command"`
+	KernelVersion string         `json:"kernel_version"`
+	KernelArch    string         `json:"kernel_arch"`
+	RegionShard   bool           `json:"region_shard"`
+	Configs       []string       `json:"configs"`
+	Available     int            `json:"available_shards"`
+	Ideal         int            `json:"ideal_shards"`
+	Shards        []PlannedShard `json:"shards"`
+	MachineType   string         `json:"machine_type,omitempty"`
+	EstimatedTime string         `json:"estimated_time,omitempty"`
+	EstimatedCost string         `json:"estimated_cost,omitempty"`
+	Errors        []string       `json:"errors,omitempty"`
+}
+
+// PlannedShard is a shard in a ShardPlan, with the gce-xfstests command
+// that would launch its test VM. Slice is set if the shard runs a part of
+// the tests of its config, e.g. "2/3".
+type PlannedShard struct {
+	ID            string   `json:"id"`
+	Config        string   `json:"cfg"`
+	Slice         string   `json:"slice,omitempty"`
+	Zone          string   `json:"zone"`
+	Args          []string `json:"args"`
+	EstimatedTime string   `json:"estimated_time,omitempty"`
+}
+
 // ShardInfo exports shard info.
 type ShardInfo struct {
 	ID     string `json:"id"`
 	Config string `json:"cfg"`
+	Slice  string `json:"slice,omitempty"`
 	Zone   string `json:"zone"`
 	Status string `json:"vm_status"`
 	Time   string `json:"since_update"`
@@ -51,10 +91,14 @@ type ShardInfo struct {
 }
 
 func (s ShardInfo) String() string {
+	config := s.Config
+	if s.Slice != "" {
+		config += " (tests " + s.Slice + ")"
+	}
 	return fmt.Sprintf(
 		"------------SHARD INFO %s------------\n\tCONFIG:\t%s\n\tZONE:\t%s\n\tVM STATUS:\t%s\n\tSINCE LAST UPDATE:\t%s\n\tTEST STATUS:\t%s\n",
 		s.ID,
-		s.Config,
+		config,
 		s.Zone,
 		s.Status,
 		s.Time,
@@ -83,6 +127,7 @@ func (t TestInfo) String() string {
 // WatcherInfo exports watcher info.
 type WatcherInfo struct {
 	ID      string     `json:"id"`
+	User    string     `json:"user"`
 	Command string     `json:"command"`
 	Repo    string     `json:"repo"`
 	Branch  string     `json:"branch"`
@@ -93,8 +138,9 @@ type WatcherInfo struct {
 
 func (w WatcherInfo) String() string {
 	info := fmt.Sprintf(
-		"============WATCHER INFO %s============\nCMDLINE:\t%s\nREPO:\t%s\nBRANCH:\t%s\nHEAD:\t%s\nPACKED TESTS:\n\t%s\nRECENT TESTS:\n",
+		"============WATCHER INFO %s============\nUSER:\t%s\nCMDLINE:\t%s\nREPO:\t%s\nBRANCH:\t%s\nHEAD:\t%s\nPACKED TESTS:\n\t%s\nRECENT TESTS:\n",
 		w.ID,
+		w.User,
 		w.Command,
 		w.Repo,
 		w.Branch,
@@ -108,34 +154,115 @@ func (w WatcherInfo) String() string {
 }
 
 // BisectorInfo exports bisector info.
+// Target is "fix" when the bisector looks for the commit that fixed a
+// failure, in which case BadCommit still fails and GoodCommits pass.
 type BisectorInfo struct {
-	ID          string   `json:"id"`
-	Command     string   `json:"command"`
-	Repo        string   `json:"repo"`
-	BadCommit   string   `json:"bad_commit"`
-	GoodCommits []string `json:"good_commits"`
-	LastActive  string   `json:"last_active"`
-	Log         []string `json:"log"`
+	ID           string   `json:"id"`
+	User         string   `json:"user"`
+	Command      string   `json:"command"`
+	Mode         string   `json:"mode"`
+	Target       string   `json:"target"`
+	Repo         string   `json:"repo"`
+	BadCommit    string   `json:"bad_commit"`
+	GoodCommits  []string `json:"good_commits"`
+	LastActive   string   `json:"last_active"`
+	Result       string   `json:"result"`
+	Verification string   `json:"verification"`
+	Log          []string `json:"log"`
 }
 
 func (b BisectorInfo) String() string {
+	bad, good, first := "BAD COMMIT", "GOOD COMMITS", "FIRST BAD COMMIT"
+	if b.Target == "fix" {
+		bad, good, first = "BROKEN COMMIT", "FIXED COMMITS", "FIRST FIXED COMMIT"
+	}
+	result := b.Result
+	if result == "" {
+		result = "not found yet"
+	}
+	verification := b.Verification
+	if verification == "" {
+		verification = "not requested"
+	}
 	return fmt.Sprintf(
-		"============BISECTOR INFO %s============\nCMDLINE:\t%s\nREPO:\t%s\nBAD COMMIT:\t%s\nGOOD COMMITS:\t%s\nSINCE LAST UPDATE:\t%s\nBISECT LOG:\n%s\n",
+		"============BISECTOR INFO %s============\nUSER:\t%s\nCMDLINE:\t%s\nMODE:\t%s\nTARGET:\t%s\nREPO:\t%s\n%s:\t%s\n%s:\t%s\nSINCE LAST UPDATE:\t%s\n%s:\t%s\nVERIFICATION:\t%s\nBISECT LOG:\n%s\n",
 		b.ID,
+		b.User,
 		b.Command,
+		b.Mode,
+		b.Target,
 		b.Repo,
+		bad,
 		b.BadCommit,
+		good,
 		strings.Join(b.GoodCommits, ", "),
 		b.LastActive,
+		first,
+		result,
+		verification,
 		strings.Join(b.Log, "\n"),
 	)
 }
 
+// ScheduleInfo exports the info of a schedule of recurring test runs.
+// NextRun is empty if the cron expression never matches.
+type ScheduleInfo struct {
+	ID         string `json:"id"`
+	User       string `json:"user"`
+	Cron       string `json:"cron"`
+	Command    string `json:"command"`
+	NextRun    string `json:"next_run"`
+	LastRun    string `json:"last_run"`
+	LastTestID string `json:"last_test_id"`
+	LastStatus string `json:"last_status"`
+}
+
+func (s ScheduleInfo) String() string {
+	return fmt.Sprintf(
+		"============SCHEDULE INFO %s============\nUSER:\t%s\nCRON:\t%s\nCMDLINE:\t%s\nNEXT RUN:\t%s\nLAST RUN:\t%s\nLAST TEST:\t%s\nLAST STATUS:\t%s\n",
+		s.ID,
+		s.User,
+		s.Cron,
+		s.Command,
+		s.NextRun,
+		s.LastRun,
+		s.LastTestID,
+		s.LastStatus,
+	)
+}
+
+// BuildInfo exports the state of a kernel build in the KCS build queue.
+// Position is 0 for a running build and the place in queue otherwise.
+type BuildInfo struct {
+	ID       string `json:"id"`
+	Repo     string `json:"repo"`
+	Commit   string `json:"commit"`
+	Priority string `json:"priority"`
+	Status   string `json:"status"`
+	Position int    `json:"queue_position"`
+	Time     string `json:"since_update"`
+}
+
+func (b BuildInfo) String() string {
+	return fmt.Sprintf(
+		"[BUILD INFO %s]\tREPO:\t%s\tCOMMIT:\t%s\tPRIORITY:\t%s\tSTATUS:\t%s\tQUEUE POSITION:\t%d\tSINCE LAST UPDATE:\t%s\n",
+		b.ID,
+		b.Repo,
+		b.Commit,
+		b.Priority,
+		b.Status,
+		b.Position,
+		b.Time,
+	)
+}
+
 // StatusResponse returns the running status to user.
 type StatusResponse struct {
 	Sharders  []SharderInfo  `json:"sharders"`
 	Watchers  []WatcherInfo  `json:"watchers"`
 	Bisectors []BisectorInfo `json:"bisectors"`
+	Builds    []BuildInfo    `json:"builds"`
+	Schedules []ScheduleInfo `json:"schedules"`
 }
 
 // InternalQuery sends a query request from LTM to KCS.
@@ -163,7 +290,6 @@ func InternalQuery(log *logrus.Entry) StatusResponse {
 	c := TaskRequest{
 		ExtraOptions: &InternalOptions{
 			Requester: Query,
-			Password:  password,
 		},
 	}
 
@@ -172,7 +298,7 @@ func InternalQuery(log *logrus.Entry) StatusResponse {
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(js))
 	check.Panic(err, log.WithField("js", js), "Failed to format request")
 
-	resp, err := sendRequest(req, kcsTimeout)
+	resp, err := sendRequest(req, kcsTimeout, KCSServer)
 	check.Panic(err, log, "Failed to send request")
 
 	defer resp.Body.Close()
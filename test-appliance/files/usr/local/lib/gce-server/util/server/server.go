@@ -5,13 +5,15 @@ Files included in this package:
 
 	server.go: 	Web servers interface and handlers, and functions to send requests.
 	info.go: 	Construct human-friendly status info for multiple modules.
+	token.go: 	Named API tokens for per-user authentication.
+	tls.go: 	Mutual TLS between LTM and KCS with an internal CA.
+	audit.go: 	Append-only audit log of API requests.
 */
 package server
 
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -39,6 +41,8 @@ const (
 	LTMServer = "xfstests-ltm"
 	// KCSServer defines the instance name for KCS server
 	KCSServer = "xfstests-kcs"
+	// PasswordUser is the identity of sessions logged in with the server password.
+	PasswordUser = "admin"
 	// file paths for certificates and keys
 	secretPath      = "/etc/lighttpd/server.pem"
 	sessionsKeyPath = "/usr/local/lib/gce-server/.sessions_secret_key"
@@ -66,6 +70,15 @@ const (
 	KCSBisectStep
 	// Query indicates a running status query request.
 	Query
+	// LTMPatchTest indicates a patch series test request from LTM to KCS.
+	LTMPatchTest
+	// LTMBuildOnly indicates a build request from LTM to KCS without tests.
+	LTMBuildOnly
+	// LTMBackportTest indicates a stable backport test request from LTM to KCS.
+	LTMBackportTest
+	// KCSBuildFailure indicates that KCS failed to build the kernel of a
+	// request from LTM.
+	KCSBuildFailure
 )
 
 func (r RequestType) String() string {
@@ -76,6 +89,11 @@ func (r RequestType) String() string {
 		"LTM-bisectStep",
 		"KCS-test",
 		"KCS-bisectStep",
+		"query",
+		"LTM-patchTest",
+		"LTM-buildOnly",
+		"LTM-backportTest",
+		"KCS-buildFailure",
 	}[r]
 }
 
@@ -108,6 +126,63 @@ func (r ResultType) String() string {
 	}[r]
 }
 
+// Priority defines the scheduling priority of a task.
+// Tasks with a higher priority get served first.
+type Priority int
+
+const (
+	// AdHocPriority is the default priority for user requests.
+	AdHocPriority Priority = iota
+	// WatcherPriority is used for tasks started by a git watcher.
+	WatcherPriority
+	// BisectPriority is used for bisect steps, which block the next step.
+	BisectPriority
+)
+
+func (p Priority) String() string {
+	return [...]string{
+		"ad-hoc",
+		"watcher",
+		"bisect",
+	}[p]
+}
+
+// Role defines what an authenticated user is allowed to do.
+// Each role includes the permissions of the roles before it.
+type Role int
+
+const (
+	// ViewerRole can query running status and results.
+	ViewerRole Role = iota
+	// SubmitterRole can also submit tests and manage their own tasks.
+	SubmitterRole
+	// AdminRole can also manage other users' tasks, tokens and configs.
+	AdminRole
+)
+
+func (r Role) String() string {
+	return [...]string{
+		"viewer",
+		"submitter",
+		"admin",
+	}[r]
+}
+
+// Allows returns whether role r has the permissions of role min.
+func (r Role) Allows(min Role) bool {
+	return r >= min
+}
+
+// ParseRole returns the role with a given name.
+func ParseRole(name string) (Role, error) {
+	for _, role := range []Role{ViewerRole, SubmitterRole, AdminRole} {
+		if role.String() == name {
+			return role, nil
+		}
+	}
+	return ViewerRole, fmt.Errorf("unknown role %q", name)
+}
+
 const (
 	kcsTimeout     = 5 * time.Minute
 	ltmTimeout     = 5 * time.Minute
@@ -118,25 +193,57 @@ const (
 
 // UserOptions contains configs user sends to LTM or KCS.
 type UserOptions struct {
-	NoRegionShard   bool   `json:"no_region_shard"`
-	BucketSubdir    string `json:"bucket_subdir"`
-	GsKernel        string `json:"gs_kernel"`
-	ReportEmail     string `json:"report_email"`
-	ReportFailEmail string `json:"report_fail_email"`
-	JunitEmail      string `json:"junit_email"`
-	CommitID        string `json:"commit_id"`
-	GitRepo         string `json:"git_repo"`
-	BranchName      string `json:"branch_name"`
+	NoRegionShard    bool   `json:"no_region_shard"`
+	BucketSubdir     string `json:"bucket_subdir"`
+	GsKernel         string `json:"gs_kernel"`
+	ReportEmail      string `json:"report_email"`
+	ReportFailEmail  string `json:"report_fail_email"`
+	JunitEmail       string `json:"junit_email"`
+	CommitID         string `json:"commit_id"`
+	GitRepo          string `json:"git_repo"`
+	BranchName       string `json:"branch_name"`
 	WatchSkipInitial bool   `json:"watch_skip_initial"`
-	UnWatch         string `json:"unwatch"`
-	BadCommit       string `json:"bad_commit"`
-	GoodCommit      string `json:"good_commit"`
-	KConfig         string `json:"kconfig"`
-	KConfigOpts     string `json:"kconfig_opts"`
-	KbuildOpts      string `json:"kbuild_opts"`
-	Arch            string `json:"arch"`
-	MonitorTimeout  string `json:"monitor_timeout"`
-	TestRunID       string `json:"test_run_id"`
+	WatchCommits     string `json:"watch_commits"`
+	WatchMaxCommits  int    `json:"watch_max_commits"`
+	UnWatch          string `json:"unwatch"`
+	Cancel           string `json:"cancel"`
+	BadCommit        string `json:"bad_commit"`
+	GoodCommit       string `json:"good_commit"`
+	KConfig          string `json:"kconfig"`
+	KConfigOpts      string `json:"kconfig_opts"`
+	KbuildOpts       string `json:"kbuild_opts"`
+	Arch             string `json:"arch"`
+	MonitorTimeout   string `json:"monitor_timeout"`
+	TestRunID        string `json:"test_run_id"`
+	PatchMbox        string `json:"patch_mbox"`
+	MessageID        string `json:"message_id"`
+	ABCompare        bool   `json:"ab_compare"`
+	BackportCommits  string `json:"backport_commits"`
+	BuildOnly        bool   `json:"build_only"`
+	BisectBuild      bool   `json:"bisect_build"`
+	BisectFix        bool   `json:"bisect_fix"`
+	BisectVerify     bool   `json:"bisect_verify"`
+	SplitTests       int    `json:"split_tests"`
+	SplitResults     string `json:"split_results"`
+	// KernelMatrix lists the kernels of a kernel matrix run, which tests
+	// each of them with the same command line.
+	KernelMatrix []MatrixKernel `json:"kernel_matrix,omitempty"`
+}
+
+// MatrixKernel is a kernel of a kernel matrix run, either a kernel image in
+// GS, or a commit built by KCS. GitRepo defaults to the repo of the request.
+type MatrixKernel struct {
+	GsKernel string `json:"gs_kernel,omitempty"`
+	GitRepo  string `json:"git_repo,omitempty"`
+	CommitID string `json:"commit_id,omitempty"`
+}
+
+// String returns the GS path or the commit of a kernel.
+func (k MatrixKernel) String() string {
+	if k.GsKernel != "" {
+		return k.GsKernel
+	}
+	return k.CommitID
 }
 
 // InternalOptions contains configs used by LTM and KCS internally.
@@ -144,7 +251,8 @@ type InternalOptions struct {
 	TestID     string      `json:"test_id"`
 	Requester  RequestType `json:"requester"`
 	TestResult ResultType  `json:"test_result"`
-	Password   string      `json:"password"`
+	Series     string      `json:"series"`
+	Priority   Priority    `json:"priority"`
 }
 
 // LoginRequest contains a password for user authentication.
@@ -152,19 +260,65 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
+// TokenRequest creates, revokes or lists named API tokens.
+// Action is one of "create", "revoke" or "list". Role is the role of a new
+// token, and defaults to submitter.
+type TokenRequest struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+}
+
+// TokenResponse returns the secret of a newly created token, which is
+// not stored on the server, or the list of existing tokens.
+type TokenResponse struct {
+	Status bool        `json:"status"`
+	Msg    string      `json:"msg"`
+	Token  string      `json:"token,omitempty"`
+	Tokens []TokenInfo `json:"tokens,omitempty"`
+}
+
+// ScheduleRequest creates, updates, deletes or lists the schedules of
+// recurring test runs on LTM. Action is one of "create", "update", "delete"
+// or "list". Request is the test request submitted by the schedule, in the
+// form sent to /gce-xfstests.
+type ScheduleRequest struct {
+	Action  string      `json:"action"`
+	ID      string      `json:"id"`
+	Cron    string      `json:"cron"`
+	Request TaskRequest `json:"request"`
+}
+
+// ScheduleResponse returns the ID of a created schedule, or the list of
+// existing schedules.
+type ScheduleResponse struct {
+	Status    bool           `json:"status"`
+	Msg       string         `json:"msg"`
+	ID        string         `json:"id,omitempty"`
+	Schedules []ScheduleInfo `json:"schedules,omitempty"`
+	Errors    []string       `json:"errors,omitempty"`
+}
+
 // TaskRequest contains the full cmd from user in base 64 and some configs.
 // LTM and KCS could add an additional field ExtraOptions when talks.
+// User is the authenticated submitter, and is overwritten by the server
+// for requests from users. Plan is a declarative test plan that replaces
+// the command line, see package testplan.
 type TaskRequest struct {
 	CmdLine      string           `json:"orig_cmdline"`
+	User         string           `json:"user"`
+	Plan         json.RawMessage  `json:"plan,omitempty"`
 	Options      *UserOptions     `json:"options"`
 	ExtraOptions *InternalOptions `json:"extra_options"`
 }
 
-// SimpleResponse returns whether a web request succeeds along with a message.
+// SimpleResponse returns whether a web request succeeds along with a message,
+// and the errors of a rejected request.
 type SimpleResponse struct {
-	Status bool   `json:"status"`
-	TestID string `json:"testID"`
-	Msg    string `json:"msg"`
+	Status bool     `json:"status"`
+	TestID string   `json:"testID"`
+	Msg    string   `json:"msg"`
+	Errors []string `json:"errors,omitempty"`
 }
 
 // Instance implements an https server with encrypted sessions and log.
@@ -174,10 +328,25 @@ type Instance struct {
 	name       string
 	router     *mux.Router
 
-	store *sessions.CookieStore
-	log   *logrus.Entry
+	store  *sessions.CookieStore
+	tokens *TokenStore
+	audit  *AuditLog
+	log    *logrus.Entry
 }
 
+// contextKey is the type for values stored in a request context.
+type contextKey string
+
+// userKey and roleKey store the authenticated user and its role in a
+// request context. internalKey stores the peer server of internal requests.
+// auditKey stores the audit entry of a request.
+const (
+	userKey     contextKey = "user"
+	roleKey     contextKey = "role"
+	internalKey contextKey = "internal"
+	auditKey    contextKey = "audit"
+)
+
 // server maintained secrets and mutex to avoid race conditions.
 // also, path to cert file, path must be genereated at runtime
 var (
@@ -215,6 +384,18 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+	logging.AddSecret(password)
+	for _, name := range []string{"SMTP_PASSWORD", "SENDGRID_API_KEY"} {
+		if secret, err := gcp.GceConfig.Get(name); err == nil {
+			logging.AddSecret(secret)
+		}
+	}
+
+	if pattern, err := gcp.GceConfig.Get("GCE_LOG_REDACT"); err == nil && pattern != "" {
+		if logging.AddPattern(pattern) != nil {
+			panic("Failed to parse GCE_LOG_REDACT")
+		}
+	}
 
 	projID, err := gcp.GceConfig.Get("GCE_PROJECT")
 	if err != nil || projID == "" {
@@ -229,16 +410,30 @@ func New(addr string, name string) (*Instance, error) {
 	log := logging.InitLogger(logging.ServerLogPath)
 	log.Info("Initiating server")
 
+	tokens, err := NewTokenStore(tokensPath)
+	if err != nil {
+		return nil, err
+	}
+
 	server := &Instance{
 		name:   name,
 		addr:   addr,
 		router: mux.NewRouter(),
 		store:  sessions.NewCookieStore(key),
+		tokens: tokens,
+		audit:  NewAuditLog(auditPath),
 		log:    log,
 	}
 
 	server.router.HandleFunc("/", server.Index).Methods("GET")
-	server.router.HandleFunc("/login", server.Login).Methods("POST")
+	server.router.Handle("/login", server.AuditHandler(
+		http.HandlerFunc(server.Login))).Methods("POST")
+	server.router.Handle("/tokens", server.AuditHandler(server.LoginHandler(server.RoleHandler(AdminRole,
+		server.FailureHandler(http.HandlerFunc(server.Tokens)))))).Methods("POST")
+	server.router.Handle("/reload", server.AuditHandler(server.LoginHandler(server.RoleHandler(AdminRole,
+		server.FailureHandler(http.HandlerFunc(server.Reload)))))).Methods("POST")
+	server.router.Handle("/audit", server.AuditHandler(server.LoginHandler(server.RoleHandler(AdminRole,
+		server.FailureHandler(http.HandlerFunc(server.Audit)))))).Methods("POST")
 
 	return server, nil
 }
@@ -264,11 +459,20 @@ func (server *Instance) Start() {
 		server.log.WithError(err).Error("Failed log startup message")
 	}
 
+	tlsConfig, err := serverTLSConfig()
+	if tlsConfig == nil {
+		server.log.WithError(err).Panic("Failed to load the public certificate, cannot serve https")
+	}
+	if err != nil {
+		server.log.WithError(err).Error("Failed to load internal certificates, " +
+			"rejecting requests between LTM and KCS until gce-xfstests setup is run and the server is relaunched")
+	}
 	server.httpServer = &http.Server{
-		Addr:    server.addr,
-		Handler: server.router,
+		Addr:      server.addr,
+		Handler:   server.router,
+		TLSConfig: tlsConfig,
 	}
-	err = server.httpServer.ListenAndServeTLS(certPath, secretPath)
+	err = server.httpServer.ListenAndServeTLS("", "")
 
 	if err != http.ErrServerClosed {
 		server.log.WithError(err).Error("Server stopped unexpectedly")
@@ -337,11 +541,38 @@ func (server *Instance) Login(w http.ResponseWriter, r *http.Request) {
 	w.Write(js)
 }
 
-// LoginHandler validates the user session and passes over to the next handler.
+/*
+LoginHandler validates the user and passes over to the next handler.
+
+A request is authenticated either by a named API token in a bearer
+authorization header, or by a session logged in with the server password.
+The user name and role are stored in the request context, see User() and
+UserRole(). Sessions logged in with the server password are admins.
+*/
 func (server *Instance) LoginHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log := server.log.WithField("endpoint", "UserLoginHandler")
 
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			secret := strings.TrimPrefix(auth, "Bearer ")
+			user, role, ok := server.tokens.Lookup(secret)
+			if secret == auth || !ok {
+				log.Error("token validation failed")
+				http.Error(w, "Login failed", http.StatusForbidden)
+				return
+			}
+
+			log.WithFields(logrus.Fields{
+				"user": user,
+				"role": role,
+			}).Info("token validation succeeded")
+			setAuditUser(r, user)
+			ctx := context.WithValue(r.Context(), userKey, user)
+			ctx = context.WithValue(ctx, roleKey, role)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
 		session, err := server.store.Get(r, "single-session")
 		if !check.NoError(err, log, "Failed to retrieve user session") {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -355,10 +586,141 @@ func (server *Instance) LoginHandler(next http.Handler) http.Handler {
 		}
 
 		log.Info("password validation succeeded")
+		setAuditUser(r, PasswordUser)
+		ctx := context.WithValue(r.Context(), userKey, PasswordUser)
+		ctx = context.WithValue(ctx, roleKey, AdminRole)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RoleHandler rejects users without the permissions of role min, and passes
+// over to the next handler. It must be wrapped by LoginHandler.
+func (server *Instance) RoleHandler(min Role, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log := server.log.WithFields(logrus.Fields{
+			"endpoint": "RoleHandler",
+			"user":     User(r),
+			"role":     UserRole(r),
+		})
+
+		if !UserRole(r).Allows(min) {
+			log.WithField("required", min).Error("permission denied")
+			http.Error(w, "Permission denied", http.StatusForbidden)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
 
+// User returns the user authenticated by LoginHandler, or an empty string
+// for requests that did not go through it.
+func User(r *http.Request) string {
+	user, _ := r.Context().Value(userKey).(string)
+	return user
+}
+
+// Internal returns whether a request comes from the peer server and was
+// verified by InternalHandler.
+func Internal(r *http.Request) bool {
+	return Peer(r) != ""
+}
+
+// Peer returns the peer server verified by InternalHandler, or an empty
+// string for requests from users.
+func Peer(r *http.Request) string {
+	peer, _ := r.Context().Value(internalKey).(string)
+	return peer
+}
+
+func withPeer(r *http.Request, peer string) context.Context {
+	return context.WithValue(r.Context(), internalKey, peer)
+}
+
+// UserRole returns the role of the user authenticated by LoginHandler.
+// Requests that did not go through it are viewers.
+func UserRole(r *http.Request) Role {
+	role, ok := r.Context().Value(roleKey).(Role)
+	if !ok {
+		return ViewerRole
+	}
+	return role
+}
+
+// LookupRole returns the current role of a user authenticated by
+// LoginHandler, or false if the token of the user was revoked. Requests
+// made later on behalf of a user, e.g. scheduled test runs, check it again.
+func (server *Instance) LookupRole(user string) (Role, bool) {
+	if user == PasswordUser {
+		return AdminRole, true
+	}
+	return server.tokens.Role(user)
+}
+
+// Reload handles the admin endpoint that rereads the config files,
+// so that config changes take effect without restarting the server.
+func (server *Instance) Reload(w http.ResponseWriter, r *http.Request) {
+	log := server.log.WithFields(logrus.Fields{
+		"endpoint": "/reload",
+		"user":     User(r),
+	})
+	log.Info("Reloading config files")
+
+	err := gcp.Update()
+	check.Panic(err, log, "Failed to reload config files")
+
+	response := SimpleResponse{
+		Status: true,
+		Msg:    "Config files reloaded",
+	}
+	err = SendResponse(w, r, response)
+	check.Panic(err, log, "Failed to send the response")
+}
+
+/*
+Tokens handles the admin endpoint for named API tokens.
+
+Only admins can manage tokens. The secret of a new token is returned once;
+the server only keeps its hash.
+*/
+func (server *Instance) Tokens(w http.ResponseWriter, r *http.Request) {
+	log := server.log.WithField("endpoint", "/tokens")
+
+	var c TokenRequest
+	err := json.NewDecoder(r.Body).Decode(&c)
+	check.Panic(err, log, "Failed to parse json request")
+	log = log.WithFields(logrus.Fields{
+		"action": c.Action,
+		"name":   c.Name,
+	})
+	log.Info("Received token request")
+
+	response := TokenResponse{Status: true}
+	switch c.Action {
+	case "create":
+		role := SubmitterRole
+		if c.Role != "" {
+			role, err = ParseRole(c.Role)
+			check.Panic(err, log, "Failed to parse token role")
+		}
+		response.Token, err = server.tokens.Create(c.Name, role)
+		check.Panic(err, log, "Failed to create token")
+		response.Msg = fmt.Sprintf("Created %s token %s", role, c.Name)
+	case "revoke":
+		err = server.tokens.Revoke(c.Name)
+		check.Panic(err, log, "Failed to revoke token")
+		response.Msg = "Revoked token " + c.Name
+	case "list":
+		response.Tokens = server.tokens.List()
+		response.Msg = fmt.Sprintf("%d tokens", len(response.Tokens))
+	default:
+		log.Panic("Unknown token action")
+	}
+
+	err = SendResponse(w, r, response)
+	check.Panic(err, log, "Failed to send the response")
+}
+
 // FailureHandler handles panic and send error back to client
 func (server *Instance) FailureHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -394,7 +756,8 @@ func (server *Instance) FailureHandler(next http.Handler) http.Handler {
 }
 
 // ParseTaskRequest parses the request into a TaskRequest struct
-// Validates the password if the request is internal
+// Rejects internal options unless the request is from the peer server
+// Records the authenticated user if the request is from a user
 func ParseTaskRequest(w http.ResponseWriter, r *http.Request) (TaskRequest, error) {
 	var c TaskRequest
 	err := json.NewDecoder(r.Body).Decode(&c)
@@ -403,9 +766,13 @@ func ParseTaskRequest(w http.ResponseWriter, r *http.Request) (TaskRequest, erro
 		return c, err
 	}
 
-	if c.ExtraOptions != nil && c.ExtraOptions.Password != password {
+	if c.ExtraOptions != nil && !Internal(r) {
 		http.Error(w, "Login failed", http.StatusForbidden)
-		return c, fmt.Errorf("Failed to validate password")
+		return c, fmt.Errorf("Internal options are only accepted from the peer server")
+	}
+
+	if user := User(r); user != "" {
+		c.User = user
 	}
 
 	return c, nil
@@ -428,11 +795,11 @@ func SendResponse(w http.ResponseWriter, r *http.Request, resp interface{}) erro
 
 // SendInternalRequest sends a task request between LTM and KCS.
 // The request is from LTM to KCS if toKCS is true.
-// Append a password field for internal request validation.
+// The peer server verifies the internal certificate of the sender.
 func SendInternalRequest(c TaskRequest, log *logrus.Entry, toKCS bool) {
-	receiver := "KCS"
+	receiver, peer := "KCS", KCSServer
 	if !toKCS {
-		receiver = "LTM"
+		receiver, peer = "LTM", LTMServer
 	}
 	log.Info("Sending request to " + receiver)
 
@@ -460,7 +827,6 @@ func SendInternalRequest(c TaskRequest, log *logrus.Entry, toKCS bool) {
 	if c.ExtraOptions == nil {
 		log.Panic("No internal option fields set in the request")
 	}
-	c.ExtraOptions.Password = password
 
 	log.WithFields(logrus.Fields{
 		"cmdLine":      c.CmdLine,
@@ -478,7 +844,7 @@ func SendInternalRequest(c TaskRequest, log *logrus.Entry, toKCS bool) {
 		timeout = kcsTimeout
 	}
 
-	resp, err := sendRequest(req, timeout)
+	resp, err := sendRequest(req, timeout, peer)
 	check.Panic(err, log, "Failed to send request")
 
 	defer resp.Body.Close()
@@ -501,19 +867,14 @@ func SendInternalRequest(c TaskRequest, log *logrus.Entry, toKCS bool) {
 	}
 }
 
-func sendRequest(req *http.Request, timeout time.Duration) (*http.Response, error) {
+// sendRequest sends a request to the peer server instance over mutual TLS.
+func sendRequest(req *http.Request, timeout time.Duration, peer string) (*http.Response, error) {
 	req.Header.Set("Content-Type", "application/json")
 
-	cert, err := tls.LoadX509KeyPair(certPath, secretPath)
+	tlsConfig, err := clientTLSConfig(peer)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to load key pair")
-	}
-
-	tlsConfig := &tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		InsecureSkipVerify: true,
+		return nil, err
 	}
-	tlsConfig.BuildNameToCertificate()
 	transport := &http.Transport{TLSClientConfig: tlsConfig}
 	client := &http.Client{
 		Transport: transport,
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	// caCertPath is the certificate of the project's internal CA, which
+	// issues the certificates LTM and KCS use to authenticate each other.
+	caCertPath = "/etc/lighttpd/ca-cert.pem"
+	// internalCertPath holds the key and internal certificate of this server.
+	internalCertPath = "/etc/lighttpd/internal.pem"
+	// internalDomain is appended to the instance name in internal certificates.
+	internalDomain = ".internal.gce-xfstests"
+)
+
+// InternalName returns the DNS name in the internal certificate of a server
+// instance, e.g. xfstests-kcs.internal.gce-xfstests.
+func InternalName(instance string) string {
+	return instance + internalDomain
+}
+
+// loadCAPool returns a cert pool with the internal CA certificate.
+func loadCAPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no CA certificate found in %s", path)
+	}
+	return pool, nil
+}
+
+/*
+serverTLSConfig returns the TLS config for the https server.
+
+The server presents the shared public certificate to users, and its internal
+certificate to peers that ask for its internal name with SNI. Client
+certificates are optional, since users authenticate with a password or
+token, but if one is given it must be issued by the internal CA.
+
+If the internal certificates cannot be loaded, e.g. on a server set up before
+they were introduced, the config with only the public certificate is returned
+along with the error. Users are still served then, while internal requests
+are rejected since no client certificate can be verified.
+*/
+func serverTLSConfig() (*tls.Config, error) {
+	return loadServerTLSConfig(certPath, secretPath, internalCertPath, caCertPath)
+}
+
+func loadServerTLSConfig(publicCert string, publicKey string, internalCert string, caCert string) (*tls.Config, error) {
+	public, err := tls.LoadX509KeyPair(publicCert, publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load public key pair: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{public},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	internal, err := tls.LoadX509KeyPair(internalCert, internalCert)
+	if err != nil {
+		return config, fmt.Errorf("failed to load internal key pair: %w", err)
+	}
+	pool, err := loadCAPool(caCert)
+	if err != nil {
+		return config, err
+	}
+	config.Certificates = append(config.Certificates, internal)
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return config, nil
+}
+
+// clientTLSConfig returns the TLS config for requests to a peer server.
+// The peer must present an internal certificate for its instance name.
+func clientTLSConfig(peer string) (*tls.Config, error) {
+	internal, err := tls.LoadX509KeyPair(internalCertPath, internalCertPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load internal key pair: %w", err)
+	}
+	pool, err := loadCAPool(caCertPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{internal},
+		RootCAs:      pool,
+		ServerName:   InternalName(peer),
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// verifyPeer checks that a request comes with a client certificate issued
+// by the internal CA for the peer instance.
+func verifyPeer(r *http.Request, peer string) error {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return fmt.Errorf("no verified client certificate")
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	return leaf.VerifyHostname(InternalName(peer))
+}
+
+// InternalHandler only passes requests from the peer server instance over
+// to the next handler, and marks them as internal, see Internal() and Peer().
+func (server *Instance) InternalHandler(peer string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log := server.log.WithField("endpoint", "InternalHandler")
+
+		err := verifyPeer(r, peer)
+		if err != nil {
+			log.WithError(err).WithField("peer", peer).Error("peer validation failed")
+			http.Error(w, "Login failed", http.StatusForbidden)
+			return
+		}
+
+		setAuditUser(r, peer)
+		next.ServeHTTP(w, r.WithContext(withPeer(r, peer)))
+	})
+}
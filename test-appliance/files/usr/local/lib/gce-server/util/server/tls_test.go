@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	} else {
+		template.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestVerifyPeer(t *testing.T) {
+	ca, caKey := newTestCert(t, "gce-xfstests internal CA", nil, nil)
+	ltm, _ := newTestCert(t, InternalName(LTMServer), ca, caKey)
+
+	r := httptest.NewRequest("POST", "/internal", nil)
+	if err := verifyPeer(r, LTMServer); err == nil {
+		t.Error("request without TLS accepted")
+	}
+
+	r.TLS = &tls.ConnectionState{}
+	if err := verifyPeer(r, LTMServer); err == nil {
+		t.Error("request without client certificate accepted")
+	}
+
+	r.TLS.VerifiedChains = [][]*x509.Certificate{{ltm, ca}}
+	if err := verifyPeer(r, LTMServer); err != nil {
+		t.Errorf("LTM certificate rejected: %v", err)
+	}
+	if err := verifyPeer(r, KCSServer); err == nil {
+		t.Error("LTM certificate accepted as KCS")
+	}
+}
+
+// writeKeyPair writes a certificate and its key into one pem file.
+func writeKeyPair(t *testing.T, path string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	content = append(content, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})...)
+	err = os.WriteFile(path, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newTestCert(t, "gce-xfstests internal CA", nil, nil)
+	public, publicKey := newTestCert(t, "xfstests-ltm", ca, caKey)
+	internal, internalKey := newTestCert(t, InternalName(LTMServer), ca, caKey)
+	publicPath := filepath.Join(dir, "public.pem")
+	internalPath := filepath.Join(dir, "internal.pem")
+	caPath := filepath.Join(dir, "ca-cert.pem")
+	writeKeyPair(t, publicPath, public, publicKey)
+
+	config, err := loadServerTLSConfig(filepath.Join(dir, "missing.pem"), publicPath, internalPath, caPath)
+	if config != nil || err == nil {
+		t.Error("get a TLS config without the public certificate")
+	}
+
+	// a server set up before the internal certificates still serves users
+	config, err = loadServerTLSConfig(publicPath, publicPath, internalPath, caPath)
+	if config == nil || err == nil {
+		t.Fatalf("get config %v and error %v without internal certificates", config, err)
+	}
+	if len(config.Certificates) != 1 || config.ClientCAs != nil || config.ClientAuth != tls.NoClientCert {
+		t.Error("fallback config accepts client certificates")
+	}
+
+	writeKeyPair(t, internalPath, internal, internalKey)
+	err = os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = loadServerTLSConfig(publicPath, publicPath, internalPath, caPath)
+	if err != nil {
+		t.Fatalf("failed to load certificates: %v", err)
+	}
+	if len(config.Certificates) != 2 || config.ClientCAs == nil || config.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Error("config does not verify internal client certificates")
+	}
+}
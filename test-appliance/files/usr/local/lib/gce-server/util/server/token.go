@@ -0,0 +1,197 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"thunk.org/gce-server/util/check"
+)
+
+const (
+	// tokensPath stores the hashed API tokens next to the session key.
+	tokensPath = "/usr/local/lib/gce-server/.api_tokens.json"
+	// tokenBytes is the amount of randomness in a token.
+	tokenBytes = 32
+)
+
+var tokenNameRegex = regexp.MustCompile(`^[A-Za-z0-9._@-]+$`)
+
+// apiToken is a named API token. Only the sha256 hash of the token is
+// kept, so that a leaked token file cannot be used to authenticate.
+// Tokens created before roles existed have no role and act as submitters.
+type apiToken struct {
+	Hash    string    `json:"hash"`
+	Role    string    `json:"role"`
+	Created time.Time `json:"created"`
+}
+
+// TokenStore keeps the named API tokens on disk.
+type TokenStore struct {
+	path   string
+	tokens map[string]*apiToken
+	lock   sync.Mutex
+}
+
+// TokenInfo describes a named API token without the secret.
+type TokenInfo struct {
+	Name    string `json:"name"`
+	Role    string `json:"role"`
+	Created string `json:"created"`
+}
+
+// NewTokenStore loads the tokens saved in path, if any.
+func NewTokenStore(path string) (*TokenStore, error) {
+	store := &TokenStore{
+		path:   path,
+		tokens: make(map[string]*apiToken),
+	}
+	if !check.FileExists(path) {
+		return store, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(content, &store.tokens)
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range store.tokens {
+		if token.Role == "" {
+			token.Role = SubmitterRole.String()
+		}
+	}
+	return store, nil
+}
+
+// Create generates a new token for name with a role and returns the secret,
+// which cannot be retrieved again.
+func (store *TokenStore) Create(name string, role Role) (string, error) {
+	if !tokenNameRegex.MatchString(name) {
+		return "", fmt.Errorf("invalid token name %q", name)
+	}
+	if name == PasswordUser {
+		return "", fmt.Errorf("token name %s is reserved", name)
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if _, ok := store.tokens[name]; ok {
+		return "", fmt.Errorf("token %s already exists", name)
+	}
+
+	buf := make([]byte, tokenBytes)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(buf)
+	store.tokens[name] = &apiToken{
+		Hash:    hashToken(secret),
+		Role:    role.String(),
+		Created: time.Now(),
+	}
+	err = store.save()
+	if err != nil {
+		delete(store.tokens, name)
+		return "", err
+	}
+	return secret, nil
+}
+
+// Revoke removes the token for name.
+func (store *TokenStore) Revoke(name string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	token, ok := store.tokens[name]
+	if !ok {
+		return fmt.Errorf("no token named %s", name)
+	}
+	delete(store.tokens, name)
+	err := store.save()
+	if err != nil {
+		store.tokens[name] = token
+		return err
+	}
+	return nil
+}
+
+// Lookup returns the name and role of the token matching secret.
+func (store *TokenStore) Lookup(secret string) (string, Role, bool) {
+	hash := hashToken(secret)
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for name, token := range store.tokens {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(token.Hash)) == 1 {
+			role, err := ParseRole(token.Role)
+			if err != nil {
+				return "", ViewerRole, false
+			}
+			return name, role, true
+		}
+	}
+	return "", ViewerRole, false
+}
+
+// Role returns the role of the token named name, or false if there is no
+// such token, e.g. because it was revoked.
+func (store *TokenStore) Role(name string) (Role, bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	token, ok := store.tokens[name]
+	if !ok {
+		return ViewerRole, false
+	}
+	role, err := ParseRole(token.Role)
+	if err != nil {
+		return ViewerRole, false
+	}
+	return role, true
+}
+
+// List returns the tokens sorted by name.
+func (store *TokenStore) List() []TokenInfo {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	infoList := []TokenInfo{}
+	for name, token := range store.tokens {
+		infoList = append(infoList, TokenInfo{
+			Name:    name,
+			Role:    token.Role,
+			Created: token.Created.Format(time.RFC3339),
+		})
+	}
+	sort.Slice(infoList, func(i, j int) bool {
+		return infoList[i].Name < infoList[j].Name
+	})
+	return infoList
+}
+
+// save writes the tokens to disk. The caller must hold the store lock.
+func (store *TokenStore) save() error {
+	js, err := json.MarshalIndent(store.tokens, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmpFile := store.path + ".tmp"
+	err = ioutil.WriteFile(tmpFile, js, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, store.path)
+}
+
+func hashToken(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
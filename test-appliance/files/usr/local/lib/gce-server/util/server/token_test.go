@@ -0,0 +1,74 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestTokenStore(t *testing.T) {
+	path := t.TempDir() + "/tokens.json"
+	store, err := NewTokenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := store.Create("alice", SubmitterRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Create("alice", AdminRole); err == nil {
+		t.Error("duplicate token name accepted")
+	}
+	if _, err := store.Create(PasswordUser, AdminRole); err == nil {
+		t.Error("reserved token name accepted")
+	}
+	if _, err := store.Create("bad name", ViewerRole); err == nil {
+		t.Error("invalid token name accepted")
+	}
+
+	// reload from disk to check that tokens persist
+	store, err = NewTokenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, role, ok := store.Lookup(secret); !ok || name != "alice" || role != SubmitterRole {
+		t.Errorf("failed to look up token, get %s %s", name, role)
+	}
+	if _, _, ok := store.Lookup("wrong"); ok {
+		t.Error("wrong token accepted")
+	}
+	if infoList := store.List(); len(infoList) != 1 || infoList[0].Name != "alice" || infoList[0].Role != "submitter" {
+		t.Errorf("get wrong token list %v", infoList)
+	}
+	if role, ok := store.Role("alice"); !ok || role != SubmitterRole {
+		t.Errorf("get role %s for alice", role)
+	}
+
+	err = store.Revoke("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := store.Lookup(secret); ok {
+		t.Error("revoked token accepted")
+	}
+	if _, ok := store.Role("alice"); ok {
+		t.Error("revoked token has a role")
+	}
+	if err := store.Revoke("alice"); err == nil {
+		t.Error("revoked a missing token")
+	}
+}
+
+func TestParseRole(t *testing.T) {
+	for _, role := range []Role{ViewerRole, SubmitterRole, AdminRole} {
+		parsed, err := ParseRole(role.String())
+		if err != nil || parsed != role {
+			t.Errorf("failed to parse role %s, get %s", role, parsed)
+		}
+	}
+	if _, err := ParseRole("root"); err == nil {
+		t.Error("unknown role accepted")
+	}
+	if !AdminRole.Allows(SubmitterRole) || ViewerRole.Allows(SubmitterRole) {
+		t.Error("wrong role order")
+	}
+}
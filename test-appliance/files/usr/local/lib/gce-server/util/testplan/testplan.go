@@ -0,0 +1,266 @@
+/*
+Package testplan parses the declarative test plans accepted by LTM.
+
+A test plan describes a test run with named fields instead of a gce-xfstests
+command line. LTM converts a plan into the command line and options of a
+test request, so that it runs like any other request. Plans are sent in
+json; gce-xfstests converts yaml plan files before sending them. A plan with
+several kernels is a kernel matrix run, which runs the same tests on each
+kernel and reports the outcome of each test per kernel.
+
+An example plan in yaml:
+
+	version: 1
+	name: ext4-nightly
+	configs: [ext4/4k, ext4/1k]
+	groups: [auto]
+	exclude_tests: [generic/475]
+	kernels:
+	  - repo: https://git.kernel.org/pub/scm/linux/kernel/git/tytso/ext4.git
+	    commit: dev
+	kconfig_opts: [--kasan]
+	notify:
+	  email: ext4-results@example.com
+	retry:
+	  fail_loop_count: 2
+	sharding:
+	  split_tests: 4
+*/
+package testplan
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"thunk.org/gce-server/util/parser"
+	"thunk.org/gce-server/util/server"
+)
+
+// Version is the version of the test plan schema.
+const Version = 1
+
+// Plan is a declarative test plan. Unknown fields are rejected.
+type Plan struct {
+	Version        int      `json:"version"`
+	Name           string   `json:"name,omitempty"`
+	Configs        []string `json:"configs"`
+	Groups         []string `json:"groups,omitempty"`
+	Tests          []string `json:"tests,omitempty"`
+	ExcludeGroups  []string `json:"exclude_groups,omitempty"`
+	ExcludeTests   []string `json:"exclude_tests,omitempty"`
+	Kernels        []Kernel `json:"kernels"`
+	KConfig        string   `json:"kconfig,omitempty"`
+	KConfigOpts    []string `json:"kconfig_opts,omitempty"`
+	Arch           string   `json:"arch,omitempty"`
+	MonitorTimeout string   `json:"monitor_timeout,omitempty"`
+	Notify         Notify   `json:"notify"`
+	Retry          Retry    `json:"retry"`
+	Sharding       Sharding `json:"sharding"`
+}
+
+// Kernel is a kernel to test, either a kernel image in GS, or a commit
+// built by KCS.
+type Kernel struct {
+	GsKernel string `json:"gs_kernel,omitempty"`
+	Repo     string `json:"repo,omitempty"`
+	Commit   string `json:"commit,omitempty"`
+}
+
+// Notify lists the receivers of the reports. FailEmail defaults to Email.
+type Notify struct {
+	Email      string `json:"email,omitempty"`
+	FailEmail  string `json:"fail_email,omitempty"`
+	JunitEmail string `json:"junit_email,omitempty"`
+}
+
+// Retry is the retry policy of failed tests.
+type Retry struct {
+	FailLoopCount int `json:"fail_loop_count,omitempty"`
+}
+
+// Sharding holds hints on how to split the tests among test VMs.
+type Sharding struct {
+	SplitTests    int    `json:"split_tests,omitempty"`
+	SplitResults  string `json:"split_results,omitempty"`
+	NoRegionShard bool   `json:"no_region_shard,omitempty"`
+}
+
+// Parse decodes a json test plan, and rejects unknown fields.
+func Parse(content []byte) (*Plan, error) {
+	var plan Plan
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&plan); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after the test plan")
+	}
+	return &plan, nil
+}
+
+// Validate checks a plan against the schema, and returns an error
+// message for each problem found.
+func (plan *Plan) Validate() []string {
+	errs := []string{}
+	addErr := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, a...))
+	}
+
+	if plan.Version != Version {
+		addErr("unsupported test plan version %d, expected %d", plan.Version, Version)
+	}
+	if len(plan.Configs) == 0 {
+		addErr("configs must not be empty")
+	}
+	if len(plan.Groups) == 0 && len(plan.Tests) == 0 {
+		addErr("groups or tests must be given")
+	}
+	for _, field := range []struct {
+		name   string
+		values []string
+	}{
+		{"configs", plan.Configs},
+		{"groups", plan.Groups},
+		{"tests", plan.Tests},
+		{"exclude_groups", plan.ExcludeGroups},
+		{"exclude_tests", plan.ExcludeTests},
+		{"kconfig_opts", plan.KConfigOpts},
+	} {
+		for _, value := range field.values {
+			if value == "" || strings.ContainsAny(value, ", \t\n") {
+				addErr("invalid %s entry %q", field.name, value)
+			}
+		}
+	}
+
+	if len(plan.Kernels) == 0 {
+		addErr("kernels must not be empty")
+	}
+	commit := false
+	for i, kernel := range plan.Kernels {
+		switch {
+		case kernel.GsKernel != "" && kernel.Commit != "":
+			addErr("kernel %d has both gs_kernel and commit", i+1)
+		case kernel.GsKernel != "":
+			if !strings.HasPrefix(kernel.GsKernel, "gs://") {
+				addErr("gs_kernel of kernel %d must be a gs:// path", i+1)
+			}
+			if kernel.Repo != "" {
+				addErr("repo of kernel %d requires a commit", i+1)
+			}
+		case kernel.Commit != "":
+			commit = true
+		default:
+			addErr("kernel %d needs a gs_kernel or a commit", i+1)
+		}
+	}
+	if !commit && (plan.KConfig != "" || len(plan.KConfigOpts) > 0) {
+		addErr("kconfig and kconfig_opts require a kernel built from a commit")
+	}
+	if plan.KConfig != "" && !strings.HasPrefix(plan.KConfig, "gs://") {
+		addErr("kconfig must be a gs:// path")
+	}
+
+	for _, arg := range []parser.Arg{
+		{Name: "--arch", Value: plan.Arch},
+		{Name: "--monitor-timeout", Value: plan.MonitorTimeout},
+		{Name: "--fail-loop-count", Value: strconv.Itoa(plan.Retry.FailLoopCount)},
+		{Name: "--split-tests", Value: strconv.Itoa(plan.Sharding.SplitTests)},
+	} {
+		if arg.Value == "" {
+			continue
+		}
+		if err := parser.CheckValue(arg.Name, arg.Value); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if plan.Sharding.SplitResults != "" && plan.Sharding.SplitTests == 0 {
+		addErr("sharding split_results requires split_tests")
+	}
+	return errs
+}
+
+// Request returns the gce-xfstests command line of a plan, parsed.
+func (plan *Plan) Request() *parser.Request {
+	req := &parser.Request{
+		Options: []parser.Arg{{Name: "-c", Value: strings.Join(plan.Configs, ",")}},
+		Tests:   append([]string{}, plan.Tests...),
+	}
+	if len(plan.Groups) > 0 {
+		req.Options = append(req.Options, parser.Arg{Name: "-g", Value: strings.Join(plan.Groups, ",")})
+	}
+	if len(plan.ExcludeGroups) > 0 {
+		req.Options = append(req.Options, parser.Arg{Name: "-x", Value: strings.Join(plan.ExcludeGroups, ",")})
+	}
+	if len(plan.ExcludeTests) > 0 {
+		req.Options = append(req.Options, parser.Arg{Name: "-X", Value: strings.Join(plan.ExcludeTests, ",")})
+	}
+	if plan.Retry.FailLoopCount > 0 {
+		req.Options = append(req.Options, parser.Arg{Name: "--fail-loop-count", Value: strconv.Itoa(plan.Retry.FailLoopCount)})
+	}
+	return req
+}
+
+// CmdLine returns the gce-xfstests command line of a plan.
+func (plan *Plan) CmdLine() string {
+	return strings.Join(plan.Request().Render(), " ")
+}
+
+/*
+Apply sets the options of a test request from a validated plan. Fields that
+are not set in the plan leave the options as they are, e.g. the report
+receivers and the git repo from the configuration of the client. A plan
+with several kernels becomes a kernel matrix run.
+*/
+func (plan *Plan) Apply(o *server.UserOptions) {
+	if len(plan.Kernels) == 1 {
+		k := plan.Kernels[0]
+		o.GsKernel = k.GsKernel
+		o.CommitID = k.Commit
+		if k.Repo != "" {
+			o.GitRepo = k.Repo
+		}
+	} else {
+		o.GsKernel = ""
+		o.CommitID = ""
+		o.KernelMatrix = []server.MatrixKernel{}
+		for _, k := range plan.Kernels {
+			o.KernelMatrix = append(o.KernelMatrix, server.MatrixKernel{
+				GsKernel: k.GsKernel,
+				GitRepo:  k.Repo,
+				CommitID: k.Commit,
+			})
+		}
+	}
+	if plan.KConfig != "" {
+		o.KConfig = plan.KConfig
+	}
+	if len(plan.KConfigOpts) > 0 {
+		o.KConfigOpts = strings.Join(plan.KConfigOpts, " ")
+	}
+	if plan.Arch != "" {
+		o.Arch = plan.Arch
+	}
+	if plan.MonitorTimeout != "" {
+		o.MonitorTimeout = plan.MonitorTimeout
+	}
+	if plan.Notify.Email != "" {
+		o.ReportEmail = plan.Notify.Email
+		o.ReportFailEmail = plan.Notify.Email
+	}
+	if plan.Notify.FailEmail != "" {
+		o.ReportFailEmail = plan.Notify.FailEmail
+	}
+	if plan.Notify.JunitEmail != "" {
+		o.JunitEmail = plan.Notify.JunitEmail
+	}
+	o.SplitTests = plan.Sharding.SplitTests
+	o.SplitResults = plan.Sharding.SplitResults
+	if plan.Sharding.NoRegionShard {
+		o.NoRegionShard = true
+	}
+}
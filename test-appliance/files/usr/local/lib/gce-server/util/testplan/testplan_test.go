@@ -0,0 +1,126 @@
+package testplan
+
+import (
+	"reflect"
+	"testing"
+
+	"thunk.org/gce-server/util/parser"
+	"thunk.org/gce-server/util/server"
+)
+
+var example = `{
+	"version": 1,
+	"name": "ext4-nightly",
+	"configs": ["ext4/4k", "ext4/1k"],
+	"groups": ["auto"],
+	"tests": ["generic/001"],
+	"exclude_groups": ["dangerous"],
+	"exclude_tests": ["generic/475", "generic/476"],
+	"kernels": [{"repo": "https://example.com/linux.git", "commit": "v6.10"}],
+	"kconfig_opts": ["--kasan", "--lockdep"],
+	"notify": {"email": "results@example.com"},
+	"retry": {"fail_loop_count": 2},
+	"sharding": {"split_tests": 4, "no_region_shard": true}
+}`
+
+func TestParse(t *testing.T) {
+	plan, err := Parse([]byte(example))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := plan.Validate(); len(errs) != 0 {
+		t.Errorf("get errors %q for a valid plan", errs)
+	}
+
+	for _, content := range []string{
+		`{"version": 1, "config": ["ext4/4k"]}`,
+		`{"version": 1} {"version": 1}`,
+		`{"version": "1"}`,
+	} {
+		if _, err := Parse([]byte(content)); err == nil {
+			t.Errorf("expected error for plan %s", content)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	plan := Plan{
+		Version:     2,
+		Configs:     []string{"ext4/4k,ext4/1k"},
+		Kernels:     []Kernel{{GsKernel: "bzImage", Repo: "https://example.com/linux.git"}, {}},
+		KConfigOpts: []string{"--kasan"},
+		Arch:        "x86",
+		Retry:       Retry{FailLoopCount: -1},
+		Sharding:    Sharding{SplitResults: "20260101000000"},
+	}
+	expected := []string{
+		"unsupported test plan version 2, expected 1",
+		"groups or tests must be given",
+		`invalid configs entry "ext4/4k,ext4/1k"`,
+		"gs_kernel of kernel 1 must be a gs:// path",
+		"repo of kernel 1 requires a commit",
+		"kernel 2 needs a gs_kernel or a commit",
+		"kconfig and kconfig_opts require a kernel built from a commit",
+		"invalid --arch x86: must be one of amd64, arm64, i386",
+		"invalid --fail-loop-count -1: must not be negative",
+		"sharding split_results requires split_tests",
+	}
+	if errs := plan.Validate(); !reflect.DeepEqual(errs, expected) {
+		t.Errorf("get errors %q, want %q", errs, expected)
+	}
+}
+
+func TestCmdLine(t *testing.T) {
+	plan, err := Parse([]byte(example))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmdLine := plan.CmdLine()
+	expected := "-c ext4/4k,ext4/1k -g auto -x dangerous -X generic/475,generic/476 --fail-loop-count 2 generic/001"
+	if cmdLine != expected {
+		t.Errorf("get command line %q, want %q", cmdLine, expected)
+	}
+
+	req, err := parser.Parse(cmdLine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := req.Validate(); len(errs) != 0 {
+		t.Errorf("get errors %q for the command line of a plan", errs)
+	}
+}
+
+func TestApply(t *testing.T) {
+	plan, err := Parse([]byte(example))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := server.UserOptions{
+		GsKernel:   "gs://bucket/bzImage",
+		JunitEmail: "junit@example.com",
+	}
+	plan.Apply(&o)
+	expected := server.UserOptions{
+		NoRegionShard:   true,
+		ReportEmail:     "results@example.com",
+		ReportFailEmail: "results@example.com",
+		JunitEmail:      "junit@example.com",
+		CommitID:        "v6.10",
+		GitRepo:         "https://example.com/linux.git",
+		KConfigOpts:     "--kasan --lockdep",
+		SplitTests:      4,
+	}
+	if !reflect.DeepEqual(o, expected) {
+		t.Errorf("get options %+v, want %+v", o, expected)
+	}
+
+	plan.Kernels = append(plan.Kernels, Kernel{GsKernel: "gs://bucket/bzImage-6.6"})
+	plan.Apply(&o)
+	matrix := []server.MatrixKernel{
+		{GitRepo: "https://example.com/linux.git", CommitID: "v6.10"},
+		{GsKernel: "gs://bucket/bzImage-6.6"},
+	}
+	if o.GsKernel != "" || o.CommitID != "" || !reflect.DeepEqual(o.KernelMatrix, matrix) {
+		t.Errorf("get kernel %q, commit %q and kernel matrix %+v, want matrix %+v", o.GsKernel, o.CommitID, o.KernelMatrix, matrix)
+	}
+}